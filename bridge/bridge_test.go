@@ -1,27 +1,50 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 // 创建测试用的FileFlowBridge实例
 func createTestBridge() *FileFlowBridge {
 	return &FileFlowBridge{
-		HTTPPort:      8000,
-		TCPPort:       8888,
-		MaxFileSize:   100,
-		TokenLength:   8,
-		ShutdownEvent: make(chan struct{}),
-		fileRegistry:  make(map[string]*FileMetadata),
-		activeStreams: make(map[string]interface{}),
+		HTTPPort:          8000,
+		TCPPort:           8888,
+		MaxFileSize:       100,
+		TokenLength:       8,
+		ShutdownEvent:     make(chan struct{}),
+		fileRegistry:      make(map[string]*FileMetadata),
+		activeStreams:     make(map[string]Stream),
+		streamThroughput:  make(map[string]float64),
+		streamReady:       make(map[string]chan struct{}),
+		transferDone:      make(map[string]chan struct{}),
+		cacheEntries:      make(map[string]*cacheEntry),
+		cacheByHash:       make(map[string]*cacheEntry),
+		idempotencyKeys:   make(map[string]idempotencyEntry),
+		bandwidthByIP:     make(map[string]*ipBandwidth),
+		finishedTransfers: make(map[string]*finishedTransfer),
 	}
 }
 
@@ -74,7 +97,7 @@ func TestStatusCheck(t *testing.T) {
 	ffb := createTestBridge()
 
 	// 手动创建一个测试条目，而不是通过模拟HTTP请求
-	testToken := ffb.createNewID()
+	testToken := ffb.createNewID(0)
 	now := time.Now()
 	ffb.fileRegistry[testToken] = &FileMetadata{
 		Filename:         "test.txt",
@@ -128,7 +151,7 @@ func TestTokenGeneration(t *testing.T) {
 	// 生成多个令牌测试唯一性
 	tokens := make(map[string]bool)
 	for i := 0; i < 1000; i++ {
-		token := ffb.createNewID()
+		token := ffb.createNewID(0)
 		if tokens[token] {
 			t.Errorf("生成的令牌重复: %s", token)
 		}
@@ -178,9 +201,49 @@ func TestFileExpirationCleanup(t *testing.T) {
 		t.Error("有效文件被错误清理")
 	}
 
+	if ffb.serverStats.FilesExpiredTotal != 1 {
+		t.Errorf("期望 files_expired_total 为 1, 得到 %d", ffb.serverStats.FilesExpiredTotal)
+	}
+
 	t.Log("文件过期清理测试通过")
 }
 
+// 测试空闲注册清理：只清理从未建立流的注册，不影响正在传输或等待中的条目
+func TestIdleRegistrationCleanup(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.IdleRegistrationTimeout = 10 * time.Minute
+
+	registeredAt := time.Now().Add(-time.Hour)
+	expiresAt := time.Now().Add(time.Hour)
+	ffb.fileRegistry["idle"] = &FileMetadata{Status: "registered", RegisteredAt: registeredAt, ExpiresAt: expiresAt}
+	ffb.fileRegistry["fresh"] = &FileMetadata{Status: "registered", RegisteredAt: time.Now(), ExpiresAt: expiresAt}
+	ffb.fileRegistry["streaming"] = &FileMetadata{Status: STATUS_READY, RegisteredAt: registeredAt, ExpiresAt: expiresAt, StreamStarted: time.Now()}
+	ffb.fileRegistry["waiting"] = &FileMetadata{Status: "registered", RegisteredAt: registeredAt, ExpiresAt: expiresAt}
+	ffb.streamReady["waiting"] = make(chan struct{})
+
+	ffb.cleanupResources()
+
+	if _, exists := ffb.fileRegistry["idle"]; exists {
+		t.Error("空闲注册未被清理")
+	}
+	for _, token := range []string{"fresh", "streaming", "waiting"} {
+		if _, exists := ffb.fileRegistry[token]; !exists {
+			t.Errorf("注册 %s 被错误清理", token)
+		}
+	}
+	if ffb.serverStats.FilesExpiredTotal != 0 {
+		t.Errorf("空闲清理不应计入 files_expired_total, 得到 %d", ffb.serverStats.FilesExpiredTotal)
+	}
+
+	// 未配置空闲时限时只按过期时间清理
+	ffb.IdleRegistrationTimeout = 0
+	ffb.fileRegistry["idle"] = &FileMetadata{Status: "registered", RegisteredAt: registeredAt, ExpiresAt: expiresAt}
+	ffb.cleanupResources()
+	if _, exists := ffb.fileRegistry["idle"]; !exists {
+		t.Error("未配置空闲时限时不应清理未过期的注册")
+	}
+}
+
 // 测试并发注册处理
 func TestConcurrentRegistration(t *testing.T) {
 	ffb := createTestBridge()
@@ -255,3 +318,1500 @@ func TestCompleteFileFlow(t *testing.T) {
 	// 由于需要启动完整的服务器，暂时跳过实际的网络测试
 	t.Log("集成测试准备完成（需要启动完整服务器进行网络测试）")
 }
+
+// 测试注册响应中的多种下载地址
+func TestRegistrationURLVariants(t *testing.T) {
+	ffb := createTestBridge()
+
+	requestBody, _ := json.Marshal(map[string]interface{}{
+		"filename": "report final.pdf",
+		"size":     10,
+	})
+	req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+	req.Host = "files.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	// 模拟同机部署的反向代理转发的请求
+	req.RemoteAddr = "127.0.0.1:40000"
+	w := httptest.NewRecorder()
+
+	ffb.handleFileRegistration(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("期望状态码 %d, 得到 %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		AuthToken   string `json:"auth_token"`
+		DownloadURL string `json:"download_url"`
+		URLs        struct {
+			Download       string `json:"download"`
+			DirectDownload string `json:"direct_download"`
+			Status         string `json:"status"`
+		} `json:"urls"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+
+	token := response.AuthToken
+	if want := "https://files.example.com/download/" + token + "/report%20final.pdf"; response.URLs.Download != want {
+		t.Errorf("代理下载地址期望 %s, 得到 %s", want, response.URLs.Download)
+	}
+	if want := "http://files.example.com:8000/download/" + token + "/report%20final.pdf"; response.URLs.DirectDownload != want {
+		t.Errorf("直连下载地址期望 %s, 得到 %s", want, response.URLs.DirectDownload)
+	}
+	if want := "https://files.example.com/status/" + token; response.URLs.Status != want {
+		t.Errorf("状态地址期望 %s, 得到 %s", want, response.URLs.Status)
+	}
+	if response.DownloadURL != response.URLs.Download {
+		t.Errorf("download_url 应与代理下载地址一致, 得到 %s", response.DownloadURL)
+	}
+}
+
+// 测试只有来自可信代理的请求才采用 X-Forwarded-* 头
+func TestTrustedProxies(t *testing.T) {
+	ffb := createTestBridge()
+
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		return req
+	}
+
+	// 默认只信任本机回环地址，直连客户端伪造的代理头被忽略
+	if scheme := ffb.getScheme(newRequest("127.0.0.1:40000")); scheme != "https" {
+		t.Errorf("本机代理转发的请求应采用 X-Forwarded-Proto, 得到 %s", scheme)
+	}
+	spoofed := newRequest("198.51.100.9:40000")
+	if scheme := ffb.getScheme(spoofed); scheme != "http" {
+		t.Errorf("不可信来源伪造的 X-Forwarded-Proto 应被忽略, 得到 %s", scheme)
+	}
+	if ip := ffb.downloaderIP(spoofed); ip != "198.51.100.9" {
+		t.Errorf("不可信来源伪造的 X-Forwarded-For 应被忽略, 得到 %s", ip)
+	}
+
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 198.51.100.9")
+	if err != nil {
+		t.Fatalf("解析可信代理失败: %v", err)
+	}
+	ffb.TrustedProxies = proxies
+	for _, remoteAddr := range []string{"10.1.2.3:40000", "198.51.100.9:40000"} {
+		req := newRequest(remoteAddr)
+		if scheme := ffb.getScheme(req); scheme != "https" {
+			t.Errorf("来自可信代理 %s 的请求应采用 X-Forwarded-Proto, 得到 %s", remoteAddr, scheme)
+		}
+		if ip := ffb.downloaderIP(req); ip != "203.0.113.7" {
+			t.Errorf("来自可信代理 %s 的请求应采用 X-Forwarded-For, 得到 %s", remoteAddr, ip)
+		}
+	}
+	if scheme := ffb.getScheme(newRequest("127.0.0.1:40000")); scheme != "http" {
+		t.Errorf("配置可信代理后回环地址不再默认可信, 得到 %s", scheme)
+	}
+
+	none, err := parseTrustedProxies(TRUSTED_PROXIES_NONE)
+	if err != nil || none == nil || len(none) != 0 {
+		t.Fatalf("none 应解析为空列表, 得到 %v, %v", none, err)
+	}
+	ffb.TrustedProxies = none
+	if scheme := ffb.getScheme(newRequest("127.0.0.1:40000")); scheme != "http" {
+		t.Errorf("不信任任何代理时应忽略 X-Forwarded-Proto, 得到 %s", scheme)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.0/8,example.com"} {
+		if _, err := parseTrustedProxies(invalid); err == nil {
+			t.Errorf("无效的可信代理 %q 应返回错误", invalid)
+		}
+	}
+}
+
+// 测试注册时拒绝非法文件名
+func TestRegistrationRejectsIllegalFilename(t *testing.T) {
+	ffb := createTestBridge()
+
+	for _, name := range []string{"../etc/passwd", `a\b.txt`, `say"hi".txt`, "line\nbreak.txt", ".."} {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"filename": name,
+			"size":     10,
+		})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+		w := httptest.NewRecorder()
+
+		ffb.handleFileRegistration(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("文件名 %q 期望状态码 %d, 得到 %d", name, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	if len(ffb.fileRegistry) != 0 {
+		t.Errorf("非法文件名不应被注册, 注册表中有 %d 项", len(ffb.fileRegistry))
+	}
+}
+
+// 测试注册时单独指定令牌长度：范围内生效，超出范围时使用默认长度并附带警告
+func TestRegistrationTokenLength(t *testing.T) {
+	ffb := createTestBridge()
+
+	register := func(tokenLength int) map[string]interface{} {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"filename":     "share.txt",
+			"size":         10,
+			"token_length": tokenLength,
+		})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+		w := httptest.NewRecorder()
+		ffb.handleFileRegistration(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("token_length %d 期望注册成功, 得到 %d", tokenLength, w.Code)
+		}
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response
+	}
+
+	tests := []struct {
+		tokenLength int
+		expectedLen int
+		warning     bool
+	}{
+		{0, ffb.TokenLength, false},
+		{24, 24, false},
+		{DEFAULT_MAX_TOKEN_LENGTH, DEFAULT_MAX_TOKEN_LENGTH, false},
+		{MIN_TOKEN_LENGTH - 1, ffb.TokenLength, true},
+		{DEFAULT_MAX_TOKEN_LENGTH + 1, ffb.TokenLength, true},
+	}
+	for _, tt := range tests {
+		response := register(tt.tokenLength)
+		token, _ := response["auth_token"].(string)
+		if len(token) != tt.expectedLen {
+			t.Errorf("token_length %d 期望令牌长度 %d, 得到 %q", tt.tokenLength, tt.expectedLen, token)
+		}
+		if _, hasWarning := response["warning"]; hasWarning != tt.warning {
+			t.Errorf("token_length %d 的警告字段期望 %v, 得到 %v", tt.tokenLength, tt.warning, response["warning"])
+		}
+	}
+
+	ffb.MaxTokenLength = 64
+	if token, _ := register(64)["auth_token"].(string); len(token) != 64 {
+		t.Errorf("调高上限后期望令牌长度 64, 得到 %q", token)
+	}
+}
+
+// 测试文件名规范化：去除双向控制符与零宽字符、转换为NFC，并限制长度
+func TestRegistrationNormalizesFilename(t *testing.T) {
+	ffb := createTestBridge()
+
+	register := func(name string) (int, map[string]interface{}) {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"filename": name,
+			"size":     10,
+		})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+		w := httptest.NewRecorder()
+		ffb.handleFileRegistration(w, req)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"invoice\u202egpj.exe", "invoicegpj.exe"}, // RLO 会让文件名显示为 invoiceexe.jpg
+		{"re\u200bport.pdf", "report.pdf"},         // 零宽空格
+		{"cafe\u0301.txt", "caf\u00e9.txt"},        // 组合字符转换为预组字符
+		{"\ufeff\u2066名单\u2069.txt", "名单.txt"},     // BOM 与隔离符
+	}
+	for _, tt := range tests {
+		code, response := register(tt.input)
+		if code != http.StatusOK {
+			t.Errorf("文件名 %q 期望注册成功, 得到 %d", tt.input, code)
+			continue
+		}
+		if response["original_filename"] != tt.expected {
+			t.Errorf("文件名 %q 期望规范化为 %q, 得到 %q", tt.input, tt.expected, response["original_filename"])
+		}
+	}
+
+	if code, _ := register("\u202e\u200b"); code != http.StatusBadRequest {
+		t.Errorf("只包含不可见字符的文件名期望 %d, 得到 %d", http.StatusBadRequest, code)
+	}
+
+	ffb.MaxFilenameLength = 12
+	if code, _ := register("报告2024.pdf"); code != http.StatusBadRequest {
+		t.Errorf("超过长度上限 (按UTF-8字节计) 期望 %d, 得到 %d", http.StatusBadRequest, code)
+	}
+	if code, _ := register("report12.pdf"); code != http.StatusOK {
+		t.Errorf("恰好达到长度上限期望注册成功, 得到 %d", code)
+	}
+}
+
+// 测试注册请求体上限：超出上限返回413，不会读入整个请求体
+func TestRegistrationBodyLimit(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.MaxRegisterBody = 1024
+
+	post := func(body []byte) int {
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		ffb.handleFileRegistration(w, req)
+		return w.Code
+	}
+
+	oversized, _ := json.Marshal(map[string]interface{}{
+		"filename": "big.txt",
+		"size":     10,
+		"metadata": map[string]string{"padding": strings.Repeat("x", 4096)},
+	})
+	if code := post(oversized); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("超出上限的请求体期望 %d, 得到 %d", http.StatusRequestEntityTooLarge, code)
+	}
+	if len(ffb.fileRegistry) != 0 {
+		t.Errorf("被拒绝的请求不应创建注册, 注册表中有 %d 项", len(ffb.fileRegistry))
+	}
+
+	normal, _ := json.Marshal(map[string]interface{}{"filename": "small.txt", "size": 10})
+	if code := post(normal); code != http.StatusOK {
+		t.Errorf("正常大小的请求体期望注册成功, 得到 %d", code)
+	}
+}
+
+// 测试注册幂等键：相同键的重试返回原注册，不同内容复用键返回409
+func TestRegistrationIdempotencyKey(t *testing.T) {
+	ffb := createTestBridge()
+
+	register := func(key, filename string) *httptest.ResponseRecorder {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"filename": filename,
+			"size":     10,
+		})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		ffb.handleFileRegistration(w, req)
+		return w
+	}
+	token := func(w *httptest.ResponseRecorder) string {
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp["auth_token"].(string) + "/" + resp["provider_token"].(string)
+	}
+
+	first := token(register("retry-1", "a.txt"))
+	if again := token(register("retry-1", "a.txt")); again != first {
+		t.Errorf("相同幂等键应返回原注册, 得到 %s 与 %s", first, again)
+	}
+	if len(ffb.fileRegistry) != 1 {
+		t.Fatalf("重试不应创建新注册, 注册表中有 %d 项", len(ffb.fileRegistry))
+	}
+
+	if w := register("retry-1", "b.txt"); w.Code != http.StatusConflict {
+		t.Errorf("幂等键用于不同文件期望 %d, 得到 %d", http.StatusConflict, w.Code)
+	}
+
+	if other := token(register("", "a.txt")); other == first {
+		t.Error("未携带幂等键时应创建新注册")
+	}
+
+	// 过期的幂等键在清理时移除，之后相同键会创建新注册
+	entry := ffb.idempotencyKeys["retry-1"]
+	entry.expiresAt = time.Now().Add(-time.Second)
+	ffb.idempotencyKeys["retry-1"] = entry
+	ffb.cleanupResources()
+	if _, exists := ffb.idempotencyKeys["retry-1"]; exists {
+		t.Error("过期的幂等键应被清理")
+	}
+	if renewed := token(register("retry-1", "a.txt")); renewed == first {
+		t.Error("幂等键过期后应创建新注册")
+	}
+}
+
+// 测试吞吐量采样与峰值记录
+func TestThroughputSampling(t *testing.T) {
+	ffb := createTestBridge()
+
+	ffb.recordThroughput("a", 1000)
+	ffb.recordThroughput("b", 3000)
+	ffb.recordThroughput("a", 500)
+
+	if peak := ffb.serverStats.PeakBytesPerSec; peak != 4000 {
+		t.Errorf("期望峰值吞吐量 4000, 得到 %v", peak)
+	}
+	if current := ffb.currentThroughputLocked(); current != 3500 {
+		t.Errorf("期望当前吞吐量 3500, 得到 %v", current)
+	}
+
+	ffb.clearThroughput("a")
+	ffb.clearThroughput("b")
+
+	if current := ffb.currentThroughputLocked(); current != 0 {
+		t.Errorf("下载结束后当前吞吐量应为 0, 得到 %v", current)
+	}
+	if peak := ffb.serverStats.PeakBytesPerSec; peak != 4000 {
+		t.Errorf("峰值吞吐量不应随下载结束而下降, 得到 %v", peak)
+	}
+}
+
+// 测试下载方在流连接建立时被立即唤醒
+func TestWaitForStreamNotification(t *testing.T) {
+	ffb := createTestBridge()
+	token := "wait_token"
+	ffb.fileRegistry[token] = &FileMetadata{AuthToken: token, Status: "registered"}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ffb.mu.Lock()
+		ffb.setActiveStreamLocked(token, &StreamConnection{})
+		ffb.mu.Unlock()
+	}()
+
+	start := time.Now()
+	stream, ok := ffb.waitForStream(context.Background(), token, 5*time.Second)
+	if !ok || stream == nil {
+		t.Fatal("期望等待到流连接")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("流就绪后应立即唤醒, 实际等待 %v", elapsed)
+	}
+
+	// 未建立流连接时应在超时后返回
+	ffb.fileRegistry["idle_token"] = &FileMetadata{AuthToken: "idle_token", Status: "registered"}
+	start = time.Now()
+	if _, ok := ffb.waitForStream(context.Background(), "idle_token", 200*time.Millisecond); ok {
+		t.Error("没有流连接时不应返回成功")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("应等待满超时时间, 实际等待 %v", elapsed)
+	}
+}
+
+// 测试TCP流与HTTP上传共用的 Stream 实现：读取上传内容、写回控制消息、关闭连接
+func TestStreamConnectionInterface(t *testing.T) {
+	providerConn, bridgeConn := net.Pipe()
+	defer providerConn.Close()
+	pr, pw := io.Pipe()
+	var stream Stream = &StreamConnection{Reader: pr, Writer: bridgeConn, Conn: bridgeConn, Pipe: pr}
+
+	go pw.Write([]byte("data"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("读取上传内容失败: %q (%v)", buf, err)
+	}
+
+	go stream.Write([]byte("TRANSFER_COMPLETE\n"))
+	line, _ := bufio.NewReader(providerConn).ReadString('\n')
+	if line != "TRANSFER_COMPLETE\n" {
+		t.Errorf("上传端应收到控制消息, 得到 %q", line)
+	}
+	if stream.RemoteAddr() == "" {
+		t.Error("TCP流应有上传端地址")
+	}
+
+	stream.Close()
+	if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("关闭后管道写入端应返回 io.ErrClosedPipe, 得到 %v", err)
+	}
+
+	// HTTP上传没有控制通道
+	upload := &StreamConnection{Reader: strings.NewReader("")}
+	if _, err := upload.Write([]byte("x")); err != errNoControlChannel {
+		t.Errorf("期望 errNoControlChannel, 得到 %v", err)
+	}
+	if upload.RemoteAddr() != "" || upload.Close() != nil {
+		t.Error("没有底层连接时 RemoteAddr 应为空, Close 应成功")
+	}
+}
+
+// 测试WebSocket上传源的读取期限：期限到达返回超时错误，清除期限后仍可继续读取
+func TestWebSocketSourceReadDeadline(t *testing.T) {
+	var source StreamSource = &WebSocketStreamConnection{DataChan: make(chan []byte, 1), CloseChan: make(chan struct{})}
+	buf := make([]byte, 8)
+
+	source.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := source.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("期望 os.ErrDeadlineExceeded, 得到 %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("应在期限到达时返回, 实际等待 %v", elapsed)
+	}
+
+	source.SetReadDeadline(time.Time{})
+	source.(*WebSocketStreamConnection).DataChan <- []byte("frame")
+	n, err := source.Read(buf)
+	if err != nil || string(buf[:n]) != "frame" {
+		t.Errorf("清除期限后应读到数据帧, 得到 %q (%v)", buf[:n], err)
+	}
+	if source.RemoteAddr() != "" {
+		t.Errorf("没有底层连接时 RemoteAddr 应为空, 得到 %q", source.RemoteAddr())
+	}
+}
+
+// 测试向WebSocket上传端请求数据失败：摘下失效的流，多次下载的分享恢复为等待上传端，而不是停留在下载中
+func TestWebSocketSendChunkFailure(t *testing.T) {
+	ffb := createTestBridge()
+	token := "wsbroken"
+	ffb.fileRegistry[token] = &FileMetadata{
+		Filename: "ws.txt", OriginalFilename: "ws.txt", Size: 10, AuthToken: token,
+		Status: STATUS_READY, MaxDownloads: 2, ExpiresAt: time.Now().Add(time.Hour),
+	}
+	// 没有底层连接的WebSocket流，发送控制命令必然失败
+	ffb.activeStreams[token] = &WebSocketStreamConnection{DataChan: make(chan []byte), CloseChan: make(chan struct{})}
+
+	w := httptest.NewRecorder()
+	ffb.handleDownloadRequest(w, httptest.NewRequest("GET", "/download/"+token, nil), token)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("期望 %d, 得到 %d", http.StatusBadGateway, w.Code)
+	}
+
+	metadata, exists := ffb.fileRegistry[token]
+	if !exists {
+		t.Fatal("注册不应被释放")
+	}
+	if metadata.Status != STATUS_REGISTERED {
+		t.Errorf("状态应恢复为 %s, 得到 %s", STATUS_REGISTERED, metadata.Status)
+	}
+	if _, ok := ffb.activeStreams[token]; ok {
+		t.Error("失效的WebSocket流应被摘下")
+	}
+}
+
+// 测试清理间隔的随机抖动范围
+func TestCleanupDelayJitter(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.CleanupInterval = 10 * time.Second
+
+	for i := 0; i < 100; i++ {
+		delay := ffb.nextCleanupDelay()
+		if delay < 9*time.Second || delay > 11*time.Second {
+			t.Fatalf("清理间隔应在 ±10%% 范围内, 得到 %v", delay)
+		}
+	}
+}
+
+// 测试缓存总容量不足时淘汰最早的已完成缓存，正在写入或下载中的缓存不被淘汰
+func TestCacheBudgetEvictsOldest(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.CacheDir = t.TempDir()
+	ffb.CacheMaxSize = 100
+
+	for _, token := range []string{"old", "new", "newest"} {
+		ffb.fileRegistry[token] = &FileMetadata{Filename: token, Size: 40, ExpiresAt: time.Now().Add(time.Hour)}
+		cache, err := ffb.createCacheEntryLocked(token, 40)
+		if err != nil {
+			t.Fatalf("创建缓存失败: %v", err)
+		}
+		cache.file.Close()
+		cache.finish(nil)
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, exists := ffb.cacheEntries["old"]; exists {
+		t.Error("最早的缓存应被淘汰")
+	}
+	if _, exists := ffb.fileRegistry["old"]; exists {
+		t.Error("被淘汰的缓存对应的注册应被释放")
+	}
+	if len(ffb.cacheEntries) != 2 || ffb.cacheUsageLocked() != 80 {
+		t.Errorf("期望保留 2 个缓存共 80 字节, 得到 %d 个共 %d 字节", len(ffb.cacheEntries), ffb.cacheUsageLocked())
+	}
+
+	if _, err := ffb.createCacheEntryLocked("huge", 101); err == nil {
+		t.Error("超过总容量的文件不应被缓存")
+	}
+
+	// "new" 有下载会话、"newest" 被替换为仍在写入的缓存：都不可淘汰，分配失败，由调用者改用实时转发
+	ffb.fileRegistry["new"].sessions = map[string]*downloadSession{"s": {inflight: 1, lastActive: time.Now()}}
+	ffb.removeFileResourcesLocked("newest")
+	ffb.fileRegistry["filling"] = &FileMetadata{Filename: "filling", Size: 40, ExpiresAt: time.Now().Add(time.Hour)}
+	filling, err := ffb.createCacheEntryLocked("filling", 40)
+	if err != nil {
+		t.Fatalf("创建缓存失败: %v", err)
+	}
+	defer filling.file.Close()
+	if _, err := ffb.createCacheEntryLocked("late", 40); err == nil {
+		t.Error("没有可淘汰的缓存时分配应失败")
+	}
+	for _, token := range []string{"new", "filling"} {
+		if _, exists := ffb.fileRegistry[token]; !exists {
+			t.Errorf("正在下载或写入的注册 %s 不应被淘汰", token)
+		}
+	}
+}
+
+// 测试累计统计持久化：保存后新实例载入并继续累加，/stats 同时给出本次启动与累计的值
+func TestStatsPersistence(t *testing.T) {
+	statsPath := filepath.Join(t.TempDir(), "stats.json")
+
+	first := createTestBridge()
+	first.StatsPath = statsPath
+	if err := first.loadStats(); err != nil {
+		t.Fatalf("统计文件不存在时应从零开始: %v", err)
+	}
+	first.serverStats.StartTime = time.Now().Add(-time.Hour)
+	first.serverStats.FilesTransferred = 3
+	first.serverStats.BytesTransferred = 3000
+	first.serverStats.PeakConnections = 5
+	first.serverStats.ActiveConnections = 2
+	if err := first.saveStats(); err != nil {
+		t.Fatalf("保存统计失败: %v", err)
+	}
+
+	second := createTestBridge()
+	second.StatsPath = statsPath
+	if err := second.loadStats(); err != nil {
+		t.Fatalf("载入统计失败: %v", err)
+	}
+	second.serverStats.FilesTransferred = 1
+	second.serverStats.BytesTransferred = 500
+	second.serverStats.PeakConnections = 2
+
+	w := httptest.NewRecorder()
+	second.handleServerStats(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats["files_transferred"] != float64(1) || stats["bytes_transferred"] != float64(500) {
+		t.Errorf("本次启动的计数不应包含历史值: %v / %v", stats["files_transferred"], stats["bytes_transferred"])
+	}
+	if stats["lifetime_files_transferred"] != float64(4) || stats["lifetime_bytes_transferred"] != float64(3500) {
+		t.Errorf("累计计数应跨重启累加: %v / %v", stats["lifetime_files_transferred"], stats["lifetime_bytes_transferred"])
+	}
+	if stats["lifetime_peak_connections"] != float64(5) {
+		t.Errorf("累计峰值应取较大者, 得到 %v", stats["lifetime_peak_connections"])
+	}
+	if since := first.serverStats.StartTime.Format(time.RFC3339); stats["lifetime_since"] != since {
+		t.Errorf("累计起始时间应为首次启动时间 %s, 得到 %v", since, stats["lifetime_since"])
+	}
+	if _, ok := stats["lifetime_active_connections"]; ok {
+		t.Error("实时值不应持久化")
+	}
+
+	// 未启用持久化时不输出累计字段
+	w = httptest.NewRecorder()
+	createTestBridge().handleServerStats(w, httptest.NewRequest("GET", "/stats", nil))
+	if strings.Contains(w.Body.String(), "lifetime_") {
+		t.Errorf("未启用持久化时不应输出累计字段: %s", w.Body.String())
+	}
+
+	os.WriteFile(statsPath, []byte("{broken"), 0600)
+	if err := second.loadStats(); err == nil {
+		t.Error("统计文件损坏时应返回错误")
+	}
+}
+
+// 测试注册容量预检：超出总量配额或缓存磁盘放不下时返回507，/stats 给出剩余容量
+func TestRegistrationCapacityCheck(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.MaxFileSize = 1 << 62
+	ffb.MaxTotalSize = 100
+
+	register := func(size int64) int {
+		requestBody, _ := json.Marshal(map[string]interface{}{
+			"filename": "capacity.bin",
+			"size":     size,
+		})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(requestBody))
+		w := httptest.NewRecorder()
+		ffb.handleFileRegistration(w, req)
+		return w.Code
+	}
+	remaining := func() interface{} {
+		w := httptest.NewRecorder()
+		ffb.handleServerStats(w, httptest.NewRequest("GET", "/stats", nil))
+		var stats map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		return stats["remaining_capacity_bytes"]
+	}
+
+	if code := register(60); code != http.StatusOK {
+		t.Fatalf("配额内的注册期望 %d, 得到 %d", http.StatusOK, code)
+	}
+	if code := register(50); code != http.StatusInsufficientStorage {
+		t.Errorf("超出配额的注册期望 %d, 得到 %d", http.StatusInsufficientStorage, code)
+	}
+	if got := remaining(); got != float64(40) {
+		t.Errorf("期望剩余容量 40, 得到 %v", got)
+	}
+	if code := register(40); code != http.StatusOK {
+		t.Errorf("恰好用完配额的注册期望 %d, 得到 %d", http.StatusOK, code)
+	}
+
+	// 缓存模式下声明的大小远超磁盘可用空间；超过缓存总容量的文件改用实时转发，不做磁盘检查
+	ffb.MaxTotalSize = 0
+	ffb.CacheDir = t.TempDir()
+	ffb.CacheMaxSize = 1 << 61
+	if code := register(1 << 60); code != http.StatusInsufficientStorage {
+		t.Errorf("缓存磁盘空间不足时期望 %d, 得到 %d", http.StatusInsufficientStorage, code)
+	}
+	if _, ok := remaining().(float64); !ok {
+		t.Error("启用缓存时 /stats 应给出 remaining_capacity_bytes")
+	}
+	ffb.CacheMaxSize = 100
+	if code := register(1 << 60); code != http.StatusOK {
+		t.Errorf("不会进入缓存的文件期望注册成功, 得到 %d", code)
+	}
+}
+
+// 测试纯文本统计：键名与JSON一致、每行 "键 值"，/stats 携带 Accept: text/plain 时输出相同内容
+func TestServerStatsText(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.serverStats.FilesRegisteredTotal = 12
+
+	w := httptest.NewRecorder()
+	ffb.handleServerStats(w, httptest.NewRequest("GET", "/stats", nil))
+	var stats map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("解析JSON统计失败: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	ffb.handleServerStatsText(w, httptest.NewRequest("GET", "/stats.txt", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("期望 text/plain, 得到 %q", ct)
+	}
+	text := w.Body.String()
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) != len(stats) {
+		t.Errorf("纯文本应有 %d 行, 得到 %d 行", len(stats), len(lines))
+	}
+	var keys []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Errorf("每行应为 \"键 值\", 得到 %q", line)
+			continue
+		}
+		if _, ok := stats[fields[0]]; !ok {
+			t.Errorf("键 %q 不在JSON统计中", fields[0])
+		}
+		keys = append(keys, fields[0])
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Error("纯文本统计应按键名排序")
+	}
+	if !strings.Contains(text, "files_registered_total 12\n") || !strings.Contains(text, "status running\n") {
+		t.Errorf("纯文本统计缺少期望的行:\n%s", text)
+	}
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Set("Accept", "text/plain")
+	w = httptest.NewRecorder()
+	ffb.handleServerStats(w, req)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || !strings.Contains(w.Body.String(), "files_registered_total 12\n") {
+		t.Errorf("Accept: text/plain 应返回纯文本统计, 得到 %q", w.Body.String())
+	}
+}
+
+// 测试性能分析路由：独立的 ServeMux 提供 pprof 索引与 goroutine 概要
+func TestPprofHandler(t *testing.T) {
+	handler := pprofHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("pprof 索引期望 200 且列出 goroutine, 得到 %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine 概要期望 200, 得到 %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("性能分析路由不应提供其他接口, 得到 %d", w.Code)
+	}
+}
+
+// 测试传输分布直方图：桶按 le 累计，/metrics 输出Prometheus文本格式
+func TestTransferMetricsHistogram(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.transferSizes = newHistogram(transferSizeBuckets)
+	ffb.transferDurations = newHistogram(transferDurationBuckets)
+	ffb.transferRates = newHistogram(transferThroughputBuckets)
+
+	ffb.recordTransfer(512, 50*time.Millisecond)
+	ffb.recordTransfer(1<<20, 2*time.Second)
+	ffb.recordTransfer(100<<30, 2*time.Hour)
+
+	w := httptest.NewRecorder()
+	ffb.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("期望 text/plain, 得到 %q", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE fileflow_transfer_size_bytes histogram",
+		`fileflow_transfer_size_bytes_bucket{le="1024"} 1`,
+		`fileflow_transfer_size_bytes_bucket{le="1.048576e+06"} 2`,
+		`fileflow_transfer_size_bytes_bucket{le="6.8719476736e+10"} 2`,
+		`fileflow_transfer_size_bytes_bucket{le="+Inf"} 3`,
+		"fileflow_transfer_size_bytes_count 3",
+		`fileflow_transfer_duration_seconds_bucket{le="0.1"} 1`,
+		`fileflow_transfer_duration_seconds_bucket{le="5"} 2`,
+		`fileflow_transfer_duration_seconds_bucket{le="+Inf"} 3`,
+		"fileflow_transfer_duration_seconds_sum 7202.05",
+		"# TYPE fileflow_transfer_throughput_bytes_per_second histogram",
+		"fileflow_transfer_throughput_bytes_per_second_count 3",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics 缺少 %q:\n%s", line, body)
+		}
+	}
+
+	// 未初始化的直方图不记录也不输出
+	empty := createTestBridge()
+	empty.recordTransfer(1, time.Second)
+	w = httptest.NewRecorder()
+	empty.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("未初始化的直方图期望空输出, 得到 %d %q", w.Code, w.Body.String())
+	}
+}
+
+// 测试就绪检查：监听正常时就绪，关闭中或活跃流已满时返回503
+func TestReadyCheck(t *testing.T) {
+	ffb := createTestBridge()
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		ffb.handleReadyCheck(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("TCP监听未建立时期望 %d, 得到 %d", http.StatusServiceUnavailable, code)
+	}
+
+	ffb.tcpListening = true
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("监听正常时期望 %d, 得到 %d", http.StatusOK, code)
+	}
+
+	ffb.MaxActiveStreams = 1
+	ffb.activeStreams["busy"] = &StreamConnection{}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("活跃流已满时期望 %d, 得到 %d", http.StatusServiceUnavailable, code)
+	}
+
+	delete(ffb.activeStreams, "busy")
+	ffb.paused = true
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("暂停期间期望 %d, 得到 %d", http.StatusServiceUnavailable, code)
+	}
+
+	ffb.paused = false
+	ffb.isShuttingDown = true
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("关闭中期望 %d, 得到 %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+// 测试TCP监听意外终止：/health 与 /ready 均报告不可用
+func TestTCPListenerFailure(t *testing.T) {
+	ffb := createTestBridge()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("创建监听失败: %v", err)
+	}
+	ffb.tcpListening = true
+	done := make(chan struct{})
+	go func() {
+		ffb.acceptStreamConnections(listener)
+		close(done)
+	}()
+
+	health := func() int {
+		w := httptest.NewRecorder()
+		ffb.handleHealthCheck(w, httptest.NewRequest("GET", "/health", nil))
+		return w.Code
+	}
+	if code := health(); code != http.StatusOK {
+		t.Fatalf("监听正常时期望 %d, 得到 %d", http.StatusOK, code)
+	}
+
+	listener.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("监听关闭后接受循环未退出")
+	}
+
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Errorf("监听终止后 /health 期望 %d, 得到 %d", http.StatusServiceUnavailable, code)
+	}
+	w := httptest.NewRecorder()
+	ffb.handleReadyCheck(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "tcp_listener_down") {
+		t.Errorf("监听终止后 /ready 期望 %d 与 tcp_listener_down, 得到 %d %s", http.StatusServiceUnavailable, w.Code, w.Body.String())
+	}
+}
+
+// 测试监听地址校验，以及TCP流只监听具体地址时告知提供端该地址
+func TestListenAddress(t *testing.T) {
+	valid := map[string]int{":9000": 9000, "127.0.0.1:8888": 8888, "[::1]:8000": 8000, "localhost:8001": 8001}
+	for addr, want := range valid {
+		if port, err := parseListenAddr(addr); err != nil || port != want {
+			t.Errorf("%q 期望端口 %d, 得到 %d (%v)", addr, want, port, err)
+		}
+	}
+	for _, addr := range []string{"8000", "127.0.0.1", "127.0.0.1:0", "127.0.0.1:70000", "127.0.0.1:http", "no-such-host.invalid:8000"} {
+		if _, err := parseListenAddr(addr); err == nil {
+			t.Errorf("%q 应被拒绝", addr)
+		}
+	}
+
+	if got := listenAddr("", 8000); got != ":8000" {
+		t.Errorf("未设置监听地址时期望 :8000, 得到 %s", got)
+	}
+
+	ffb := createTestBridge()
+	if got := ffb.tcpEndpointHost("files.example.com"); got != "files.example.com" {
+		t.Errorf("未设置TCP监听地址时应沿用请求主机, 得到 %s", got)
+	}
+	ffb.TCPListen = "0.0.0.0:8888"
+	if got := ffb.tcpEndpointHost("files.example.com"); got != "files.example.com" {
+		t.Errorf("监听所有网卡时应沿用请求主机, 得到 %s", got)
+	}
+	ffb.TCPListen = "10.8.0.1:8888"
+	if got := ffb.tcpEndpointHost("files.example.com"); got != "10.8.0.1" {
+		t.Errorf("只监听VPN地址时应告知该地址, 得到 %s", got)
+	}
+}
+
+// 测试带文件名的下载地址：文件名不一致时重定向到规范地址，一致时进入正常下载流程
+func TestDownloadFilenameSlug(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.fileRegistry["slug1234"] = &FileMetadata{
+		AuthToken:        "slug1234",
+		OriginalFilename: "报告 final.pdf",
+		Status:           STATUS_DOWNLOADING,
+	}
+
+	download := func(token, filename, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/download/"+token+"/x"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"auth_token": token, "filename": filename})
+		w := httptest.NewRecorder()
+		ffb.handleFileDownloadWithName(w, req)
+		return w
+	}
+
+	w := download("slug1234", "wrong.pdf", "?lang=zh")
+	if w.Code != http.StatusFound {
+		t.Fatalf("文件名不一致时期望 %d, 得到 %d", http.StatusFound, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "%E6%8A%A5%E5%91%8A%20final.pdf?lang=zh" {
+		t.Errorf("重定向地址不正确: %q", loc)
+	}
+
+	// 文件名一致时交给下载核心逻辑，这里正在被其他下载方读取因此返回409
+	if w := download("slug1234", "报告 final.pdf", ""); w.Code != http.StatusConflict {
+		t.Errorf("文件名一致时期望 %d, 得到 %d", http.StatusConflict, w.Code)
+	}
+
+	if w := download("missing1", "any.pdf", ""); w.Code != http.StatusNotFound {
+		t.Errorf("令牌不存在时期望 %d, 得到 %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// 测试缓存下载会话：会话占用下载次数，闲置超过有效期后释放
+func TestDownloadSessionExpiry(t *testing.T) {
+	ffb := createTestBridge()
+	metadata := &FileMetadata{AuthToken: "sess1234", MaxDownloads: 1}
+
+	first := ffb.acquireDownloadSessionLocked(metadata, "")
+	if first == "" {
+		t.Fatal("应能创建第一个下载会话")
+	}
+	if again := ffb.acquireDownloadSessionLocked(metadata, first); again != first {
+		t.Errorf("携带会话ID应继续使用原会话, 得到 %q", again)
+	}
+	ffb.releaseDownloadSession(metadata, first)
+	ffb.releaseDownloadSession(metadata, first)
+
+	if other := ffb.acquireDownloadSessionLocked(metadata, ""); other != "" {
+		t.Errorf("下载次数已被会话占用, 不应创建新会话, 得到 %q", other)
+	}
+
+	metadata.sessions[first].lastActive = time.Now().Add(-DOWNLOAD_SESSION_TTL - time.Minute)
+	if other := ffb.acquireDownloadSessionLocked(metadata, ""); other == "" || other == first {
+		t.Errorf("过期会话应被释放并创建新会话, 得到 %q", other)
+	}
+}
+
+// 测试在途字节预算：超出上限时只发放剩余额度，用尽后等待归还
+func TestInflightBudget(t *testing.T) {
+	var budget inflightBudget
+	done := make(chan struct{})
+
+	if n := budget.acquire(80, 100, done); n != 80 {
+		t.Fatalf("期望获得 80 字节, 得到 %d", n)
+	}
+	if n := budget.acquire(80, 100, done); n != 20 {
+		t.Fatalf("预算不足时期望获得剩余的 20 字节, 得到 %d", n)
+	}
+
+	granted := make(chan int, 1)
+	go func() { granted <- budget.acquire(50, 100, done) }()
+	select {
+	case n := <-granted:
+		t.Fatalf("预算用尽时应等待, 却获得 %d 字节", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	budget.release(30)
+	if n := <-granted; n != 30 {
+		t.Errorf("归还后期望获得 30 字节, 得到 %d", n)
+	}
+	if used := budget.current(); used != 100 {
+		t.Errorf("期望在途 100 字节, 得到 %d", used)
+	}
+
+	go func() { granted <- budget.acquire(10, 100, done) }()
+	close(done)
+	if n := <-granted; n != 0 {
+		t.Errorf("关闭后期望返回 0, 得到 %d", n)
+	}
+
+	// 不限制时只统计
+	var unlimited inflightBudget
+	if n := unlimited.acquire(1<<20, 0, nil); n != 1<<20 || unlimited.current() != 1<<20 {
+		t.Errorf("不限制时应发放全部请求, 得到 %d (在途 %d)", n, unlimited.current())
+	}
+}
+
+// 测试最大文件大小的单位解析：带单位时按单位换算，未带单位时按数值大小推断并给出警告
+func TestParseMaxFileSize(t *testing.T) {
+	cases := []struct {
+		input   string
+		want    int64
+		warning bool
+	}{
+		{"100GiB", 100 << 30, false},
+		{"5GB", 5e9, false},
+		{"500mb", 500e6, false},
+		{"512MiB", 512 << 20, false},
+		{"1.5 GiB", 3 << 29, false},
+		{"64KiB", 64 << 10, false},
+		{"2TB", 2e12, false},
+		{"4096B", 4096, false},
+		{"100", 100 << 30, true},
+		{"100000000", 100000000, true},
+	}
+	for _, c := range cases {
+		got, warning, err := parseMaxFileSize(c.input)
+		if err != nil {
+			t.Errorf("%q: 意外的错误 %v", c.input, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: 期望 %d 字节, 得到 %d", c.input, c.want, got)
+		}
+		if (warning != "") != c.warning {
+			t.Errorf("%q: 警告不符合预期: %q", c.input, warning)
+		}
+	}
+
+	for _, input := range []string{"", "abc", "-5GB", "10XB", "0", "0MB", "99999999TB"} {
+		if _, _, err := parseMaxFileSize(input); err == nil {
+			t.Errorf("%q: 期望解析失败", input)
+		}
+	}
+}
+
+// 测试布尔环境变量：接受常见写法，无法识别的值使用默认值
+func TestGetEnvBool(t *testing.T) {
+	cases := []struct {
+		value      string
+		defaultVal bool
+		want       bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"true", false, true},
+		{"0", true, false},
+		{"YES", false, true},
+		{" off ", true, false},
+		{"enabled", true, true},
+		{"enabled", false, false},
+	}
+	for _, c := range cases {
+		t.Setenv("FFB_TEST_BOOL", c.value)
+		if got := getEnvBool("FFB_TEST_BOOL", c.defaultVal); got != c.want {
+			t.Errorf("%q (默认 %v): 期望 %v, 得到 %v", c.value, c.defaultVal, c.want, got)
+		}
+	}
+}
+
+// 测试配置接口：返回公开配置，不泄露管理令牌与缓存路径
+func TestConfigEndpoint(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.AdminToken = "admin-secret"
+	ffb.CacheDir = "/var/cache/secret-dir"
+
+	w := httptest.NewRecorder()
+	ffb.handleConfig(w, httptest.NewRequest("GET", "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("期望状态码 %d, 得到 %d", http.StatusOK, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("配置响应不应包含敏感信息: %s", w.Body.String())
+	}
+
+	var config struct {
+		MaxFileSizeBytes int64           `json:"max_file_size_bytes"`
+		FileTTLSeconds   int64           `json:"file_ttl_seconds"`
+		TCPPort          int             `json:"tcp_port"`
+		Features         map[string]bool `json:"features"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("解析配置响应失败: %v", err)
+	}
+	if config.MaxFileSizeBytes != ffb.MaxFileSize {
+		t.Errorf("期望 max_file_size_bytes 为 %d, 得到 %d", ffb.MaxFileSize, config.MaxFileSizeBytes)
+	}
+	if config.FileTTLSeconds != int64(FILE_TTL/time.Second) {
+		t.Errorf("期望 file_ttl_seconds 为 %d, 得到 %d", int64(FILE_TTL/time.Second), config.FileTTLSeconds)
+	}
+	if config.TCPPort != ffb.TCPPort {
+		t.Errorf("期望 tcp_port 为 %d, 得到 %d", ffb.TCPPort, config.TCPPort)
+	}
+	if !config.Features["cache"] || !config.Features["websocket"] || config.Features["tls"] {
+		t.Errorf("功能开关不符合预期: %v", config.Features)
+	}
+	if !config.Features["resume"] || !config.Features["websocket_upload"] || !config.Features["http_upload"] || config.Features["tcp_stream"] {
+		t.Errorf("传输通道开关不符合预期: %v", config.Features)
+	}
+	if !config.Features["compression"] {
+		t.Errorf("默认应允许压缩: %v", config.Features)
+	}
+
+	ffb.DisableCompression = true
+	w = httptest.NewRecorder()
+	ffb.handleConfig(w, httptest.NewRequest("GET", "/config", nil))
+	config.Features = nil
+	json.Unmarshal(w.Body.Bytes(), &config)
+	if config.Features["compression"] {
+		t.Errorf("关闭压缩后 compression 应为 false: %v", config.Features)
+	}
+	if summary := ffb.featureSummary(); !strings.Contains(summary, "compression=关") || !strings.Contains(summary, "cache=开") {
+		t.Errorf("功能开关摘要不符合预期: %s", summary)
+	}
+
+	// tls 反映服务器的配置，而不是本次请求的协议
+	w = httptest.NewRecorder()
+	ffb.handleConfig(w, httptest.NewRequest("GET", "https://bridge.example/config", nil))
+	config.Features = nil
+	json.Unmarshal(w.Body.Bytes(), &config)
+	if config.Features["tls"] {
+		t.Errorf("未配置TLS时经HTTPS请求 tls 也应为 false: %v", config.Features)
+	}
+	ffb.TCPTLSConfig = &tls.Config{}
+	w = httptest.NewRecorder()
+	ffb.handleConfig(w, httptest.NewRequest("GET", "/config", nil))
+	config.Features = nil
+	json.Unmarshal(w.Body.Bytes(), &config)
+	if !config.Features["tls"] || !config.Features["tcp_tls"] {
+		t.Errorf("配置TLS后 tls 与 tcp_tls 应为 true: %v", config.Features)
+	}
+}
+
+// 测试限速：注册限速与全局限速取较小值
+func TestEffectiveRate(t *testing.T) {
+	ffb := createTestBridge()
+
+	cases := []struct {
+		global, share, want int64
+	}{
+		{0, 0, 0},
+		{0, 1000, 1000},
+		{500, 0, 500},
+		{500, 1000, 500},
+		{2000, 1000, 1000},
+	}
+	for _, c := range cases {
+		ffb.MaxRate = c.global
+		if got := ffb.effectiveRate(&FileMetadata{MaxRate: c.share}); got != c.want {
+			t.Errorf("全局 %d, 注册 %d: 期望 %d, 得到 %d", c.global, c.share, c.want, got)
+		}
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Error("限速为0时不应创建限速器")
+	}
+	var unlimited *rateLimiter
+	if got := unlimited.chunk(4096); got != 4096 {
+		t.Errorf("不限速时单次读取应为 4096, 得到 %d", got)
+	}
+	if got := newRateLimiter(100).chunk(4096); got != 100 {
+		t.Errorf("限速 100 字节/秒时单次读取应为 100, 得到 %d", got)
+	}
+}
+
+// 测试配置了允许来源时CORS只回显列表中的来源
+func TestCORSAllowedOrigins(t *testing.T) {
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{"https://app.example.com"})
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://APP.example.com/": "https://APP.example.com/",
+		"https://evil.example.com": "",
+	} {
+		req := httptest.NewRequest("GET", "/stats", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("来源 %s: 期望 Access-Control-Allow-Origin %q, 得到 %q", origin, want, got)
+		}
+	}
+}
+
+// 测试CORS中间件暴露自定义下载响应头
+func TestCORSExposeHeaders(t *testing.T) {
+	handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-FileFlow-Original-Filename", "a.txt")
+	}), nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/download/abc", nil))
+
+	exposed := w.Header().Get("Access-Control-Expose-Headers")
+	for _, name := range []string{"X-FileFlow-FileID", "X-FileFlow-Original-Filename", "Content-Disposition"} {
+		if !strings.Contains(exposed, name) {
+			t.Errorf("Access-Control-Expose-Headers 缺少 %s: %q", name, exposed)
+		}
+	}
+}
+
+// 测试下载字节计数：按粒度批量写入统计，结束时的刷新不会重复计数
+func TestByteCounterFlush(t *testing.T) {
+	ffb := createTestBridge()
+	ffb.StatsFlushBytes = 100
+
+	bc := ffb.newByteCounter("")
+	steps := []struct {
+		add  int64
+		want int64
+	}{
+		{60, 0},
+		{60, 120},
+		{30, 120},
+	}
+	for _, step := range steps {
+		bc.add(step.add)
+		if got := ffb.serverStats.BytesTransferred; got != step.want {
+			t.Fatalf("累加 %d 后期望统计 %d, 得到 %d", step.add, step.want, got)
+		}
+	}
+
+	bc.flush()
+	bc.flush()
+	if got := ffb.serverStats.BytesTransferred; got != 150 {
+		t.Errorf("刷新后期望统计 150, 得到 %d", got)
+	}
+}
+
+// 模糊测试TCP握手元数据解析：任意输入都不应panic，超长行必须被拒绝，元数据之后的数据保持不动
+func FuzzHandshakeMetadata(f *testing.F) {
+	f.Add([]byte(`{"auth_token":"abc","provider_token":"xyz"}` + "\nDATA"))
+	f.Add([]byte(`{"compression":"gzip"}` + "\n"))
+	f.Add([]byte("null\n"))
+	f.Add([]byte("not json\n"))
+	f.Add([]byte(`{"auth_token":1}` + "\n"))
+	f.Add([]byte(`{"auth_token":"abc"`))
+	f.Add(bytes.Repeat([]byte("a"), MAX_HANDSHAKE_METADATA_SIZE+10))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReaderSize(bytes.NewReader(data), MAX_HANDSHAKE_METADATA_SIZE)
+		_, err := readHandshakeMetadata(reader)
+
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 || newline >= MAX_HANDSHAKE_METADATA_SIZE {
+			if err == nil {
+				t.Fatalf("没有换行或超出长度上限的输入应被拒绝: %d 字节", len(data))
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		rest, _ := io.ReadAll(reader)
+		if !bytes.Equal(rest, data[newline+1:]) {
+			t.Fatalf("元数据之后的数据被改动: 期望 %q, 得到 %q", data[newline+1:], rest)
+		}
+	})
+}
+
+// 测试令牌字符均匀分布在字符集内
+func TestRandomTokenDistribution(t *testing.T) {
+	counts := make(map[rune]int)
+	const samples = 2000
+	for i := 0; i < samples; i++ {
+		token := randomToken(31)
+		if len(token) != 31 {
+			t.Fatalf("令牌长度期望 31, 得到 %d", len(token))
+		}
+		for _, c := range token {
+			if !strings.ContainsRune(TOKEN_CHARSET, c) {
+				t.Fatalf("令牌包含字符集以外的字符: %q", c)
+			}
+			counts[c]++
+		}
+	}
+
+	// 62000个字符平均每个字符出现1000次，偏差超过30%说明映射有偏
+	expected := float64(samples*31) / float64(len(TOKEN_CHARSET))
+	for _, c := range TOKEN_CHARSET {
+		if n := float64(counts[c]); n < expected*0.7 || n > expected*1.3 {
+			t.Errorf("字符 %q 出现 %v 次, 期望约 %.0f 次", c, n, expected)
+		}
+	}
+}
+
+// 测试 --token-charset 与 --token-prefix：随机部分只使用所选字符集且分布均匀，前缀不计入长度
+func TestTokenCharsetAndPrefix(t *testing.T) {
+	for name, charset := range tokenCharsets {
+		t.Run(name, func(t *testing.T) {
+			ffb := createTestBridge()
+			ffb.TokenCharset = name
+			ffb.TokenPrefix = "ffb_"
+			counts := make(map[rune]int)
+			const samples = 1000
+			for i := 0; i < samples; i++ {
+				token := ffb.createNewID(0)
+				if !strings.HasPrefix(token, "ffb_") {
+					t.Fatalf("令牌缺少前缀: %q", token)
+				}
+				random := strings.TrimPrefix(token, "ffb_")
+				if len(random) != ffb.TokenLength {
+					t.Fatalf("令牌随机部分长度期望 %d, 得到 %d", ffb.TokenLength, len(random))
+				}
+				for _, c := range random {
+					if !strings.ContainsRune(charset, c) {
+						t.Fatalf("令牌包含字符集以外的字符: %q", c)
+					}
+					counts[c]++
+				}
+			}
+			expected := float64(samples*ffb.TokenLength) / float64(len(charset))
+			for _, c := range charset {
+				if n := float64(counts[c]); n < expected*0.7 || n > expected*1.3 {
+					t.Errorf("字符 %q 出现 %v 次, 期望约 %.0f 次", c, n, expected)
+				}
+			}
+			if token := ffb.createNewID(12); len(token) != len("ffb_")+12 {
+				t.Errorf("注册指定长度时期望随机部分 12 位, 得到 %q", token)
+			}
+		})
+	}
+
+	for _, prefix := range []string{"ffb_", "share-", ""} {
+		if err := validateTokenPrefix(prefix); err != nil {
+			t.Errorf("前缀 %q 应有效: %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"a/b", "ffb.", "前缀", strings.Repeat("x", MAX_TOKEN_PREFIX_LENGTH+1)} {
+		if err := validateTokenPrefix(prefix); err == nil {
+			t.Errorf("前缀 %q 应被拒绝", prefix)
+		}
+	}
+}
+
+// 测试令牌熵按字符集与单词口令计算：默认令牌不触发低熵警告，8位十六进制与单词口令会触发
+func TestTokenEntropyBits(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		charset   string
+		length    int
+		wordCodes bool
+		low       bool
+	}{
+		{"默认字母数字", DEFAULT_TOKEN_CHARSET, 8, false, false},
+		{"base58", "base58", 8, false, false},
+		{"十六进制", "hex", 8, false, true},
+		{"短字母数字", DEFAULT_TOKEN_CHARSET, 6, false, true},
+		{"单词口令", DEFAULT_TOKEN_CHARSET, 8, true, true},
+	} {
+		ffb := createTestBridge()
+		ffb.TokenCharset = tc.charset
+		ffb.TokenLength = tc.length
+		ffb.WordCodes = tc.wordCodes
+		bits := ffb.tokenEntropyBits()
+		if low := bits < MIN_RECOMMENDED_TOKEN_BITS; low != tc.low {
+			t.Errorf("%s: %.1f 位熵, 期望低于建议值 %v", tc.name, bits, tc.low)
+		}
+	}
+
+	ffb := createTestBridge()
+	ffb.TokenCharset = "hex"
+	ffb.TokenLength = 8
+	if bits := ffb.tokenEntropyBits(); bits != 32 {
+		t.Errorf("8位十六进制令牌期望 32 位熵, 得到 %.1f", bits)
+	}
+}
+
+// 总是返回错误的随机源，模拟系统熵源失效
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("熵源不可用")
+}
+
+// 测试随机源失败时令牌仍然有效且不退化为固定字符
+func TestRandomTokenFallback(t *testing.T) {
+	randReader = failingReader{}
+	defer func() { randReader = rand.Reader }()
+
+	// 令牌不能全由同一个字符组成，两次生成也不能相同
+	assertNonDegenerate := func(t *testing.T, a, b string) {
+		t.Helper()
+		if a == b {
+			t.Fatalf("两次生成的令牌相同: %q", a)
+		}
+		if strings.Count(a, a[:1]) == len(a) {
+			t.Fatalf("令牌退化为单一字符: %q", a)
+		}
+	}
+
+	t.Run("UUID", func(t *testing.T) {
+		a, b := randomToken(8), randomToken(8)
+		if _, err := uuid.Parse(a); err != nil {
+			t.Fatalf("随机源失败时应回退为UUID, 得到 %q", a)
+		}
+		assertNonDegenerate(t, a, b)
+	})
+
+	t.Run("UUIDAlsoFails", func(t *testing.T) {
+		uuid.SetRand(failingReader{})
+		defer uuid.SetRand(nil)
+
+		a, b := randomToken(8), randomToken(8)
+		if len(a) != DEFAULT_MAX_TOKEN_LENGTH {
+			t.Fatalf("备用令牌长度期望 %d, 得到 %d", DEFAULT_MAX_TOKEN_LENGTH, len(a))
+		}
+		for _, c := range a {
+			if !strings.ContainsRune(TOKEN_CHARSET, c) {
+				t.Fatalf("备用令牌包含字符集以外的字符: %q", c)
+			}
+		}
+		assertNonDegenerate(t, a, b)
+	})
+
+	t.Run("WordCode", func(t *testing.T) {
+		seen := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			code := wordCode()
+			if parts := strings.Split(code, "-"); len(parts) != 3 {
+				t.Fatalf("口令格式错误: %q", code)
+			}
+			seen[code] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("随机源失败时口令退化为固定值: %v", seen)
+		}
+	})
+}
+
+// 原先逐字符调用 rand.Int 的实现，作为基准对照
+func randomTokenBigInt(length int) string {
+	ret := make([]byte, length)
+	for i := 0; i < length; i++ {
+		num, _ := rand.Int(rand.Reader, big.NewInt(int64(len(TOKEN_CHARSET))))
+		ret[i] = TOKEN_CHARSET[num.Int64()]
+	}
+	return string(ret)
+}
+
+// 基准测试：32位令牌的生成开销
+func BenchmarkRandomToken(b *testing.B) {
+	b.Run("BigInt", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			randomTokenBigInt(32)
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			randomToken(32)
+		}
+	})
+}
+
+// 测试下载不存在的令牌时的自定义响应
+func TestDownloadNotFoundCustomization(t *testing.T) {
+	ffb := createTestBridge()
+
+	download := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/download/missing", nil)
+		req = mux.SetURLVars(req, map[string]string{"auth_token": "missing"})
+		w := httptest.NewRecorder()
+		ffb.handleFileDownload(w, req)
+		return w
+	}
+
+	if w := download(); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "文件不存在") {
+		t.Errorf("默认应返回404, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	ffb.NotFoundPage = []byte("<h1>链接已失效</h1>")
+	w := download()
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>链接已失效</h1>" {
+		t.Errorf("应返回自定义页面, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("自定义页面的 Content-Type 应为HTML, 得到 %q", ct)
+	}
+
+	ffb.NotFoundRedirect = "https://example.com/expired"
+	w = download()
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/expired" {
+		t.Errorf("应重定向到落地页, 得到 %d: %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// 按分块校验格式编码一个数据块
+func encodeFrame(payload []byte, checksum uint32) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], checksum)
+	return append(frame, payload...)
+}
+
+// 测试分块校验：正确的数据完整读出，损坏的块报告其在文件中的偏移
+func TestFramedStreamReader(t *testing.T) {
+	first := bytes.Repeat([]byte("a"), 50)
+	second := bytes.Repeat([]byte("b"), 30)
+
+	var stream bytes.Buffer
+	stream.Write(encodeFrame(first, crc32.ChecksumIEEE(first)))
+	stream.Write(encodeFrame(second, crc32.ChecksumIEEE(second)))
+	stream.Write(encodeFrame(nil, 0))
+	data, err := io.ReadAll(&framedStreamReader{src: &stream, chunkSize: 64})
+	if err != nil || string(data) != string(first)+string(second) {
+		t.Fatalf("读取分块数据失败: %v, 得到 %d 字节", err, len(data))
+	}
+
+	stream.Reset()
+	stream.Write(encodeFrame(first, crc32.ChecksumIEEE(first)))
+	stream.Write(encodeFrame(second, crc32.ChecksumIEEE(second)+1))
+	data, err = io.ReadAll(&framedStreamReader{src: &stream, chunkSize: 64})
+	if err == nil || !strings.Contains(err.Error(), "偏移 50") || len(data) != 50 {
+		t.Errorf("期望在偏移 50 处校验失败且只交付第一块, 得到 %v, %d 字节", err, len(data))
+	}
+
+	stream.Reset()
+	stream.Write(encodeFrame(bytes.Repeat([]byte("c"), 65), 0))
+	if _, err := io.ReadAll(&framedStreamReader{src: &stream, chunkSize: 64}); err == nil {
+		t.Error("超过协商大小的分块应被拒绝")
+	}
+}
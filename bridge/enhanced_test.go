@@ -43,10 +43,19 @@ func createEnhancedTestSuite(t *testing.T) *EnhancedTestSuite {
 		TCPPort:           0, // Use random port
 		MaxFileSize:       100 * 1024 * 1024, // 100MB
 		TokenLength:       8,
+		DownloadWait:      2 * time.Second,
 		ShutdownEvent:     make(chan struct{}),
 		fileRegistry:      make(map[string]*FileMetadata),
-		activeStreams:     make(map[string]interface{}),
+		activeStreams:     make(map[string]Stream),
 		downloadCompleted: make(map[string]bool),
+		streamThroughput:  make(map[string]float64),
+		streamReady:       make(map[string]chan struct{}),
+		transferDone:      make(map[string]chan struct{}),
+		cacheEntries:      make(map[string]*cacheEntry),
+		cacheByHash:       make(map[string]*cacheEntry),
+		idempotencyKeys:   make(map[string]idempotencyEntry),
+		bandwidthByIP:     make(map[string]*ipBandwidth),
+		finishedTransfers: make(map[string]*finishedTransfer),
 		serverStats: ServerStats{
 			StartTime: time.Now(),
 		},
@@ -217,6 +226,7 @@ func TestEnhancedWebSocketFileTransfer(t *testing.T) {
 
 	var registerResp struct {
 		AuthToken        string `json:"auth_token"`
+		ProviderToken    string `json:"provider_token"`
 		DownloadURL      string `json:"download_url"`
 		OriginalFilename string `json:"original_filename"`
 		TcpEndpoint      struct {
@@ -229,7 +239,7 @@ func TestEnhancedWebSocketFileTransfer(t *testing.T) {
 	}
 
 	// Build WebSocket URL correctly
-	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken
+	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken + "?provider_token=" + registerResp.ProviderToken
 
 	// Establish WebSocket connection with proper headers
 	dialer := websocket.DefaultDialer
@@ -555,7 +565,7 @@ func TestEnhancedHealthAndStats(t *testing.T) {
 	}
 
 	// Verify expected fields
-	expectedFields := []string{"status", "uptime", "files_registered", "files_transferred", "active_connections", "registered_files"}
+	expectedFields := []string{"status", "uptime", "files_registered_total", "files_transferred", "active_connections", "registered_files"}
 	for _, field := range expectedFields {
 		if _, ok := stats[field]; !ok {
 			t.Errorf("Stats missing field: %s", field)
@@ -700,6 +710,7 @@ func TestEnhancedConnectionInterruption(t *testing.T) {
 
 	var registerResp struct {
 		AuthToken        string `json:"auth_token"`
+		ProviderToken    string `json:"provider_token"`
 		DownloadURL      string `json:"download_url"`
 		OriginalFilename string `json:"original_filename"`
 	}
@@ -708,7 +719,7 @@ func TestEnhancedConnectionInterruption(t *testing.T) {
 	}
 
 	// Test WebSocket connection interruption
-	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken
+	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken + "?provider_token=" + registerResp.ProviderToken
 
 	dialer := websocket.DefaultDialer
 	headers := http.Header{}
@@ -1,15 +1,35 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -21,14 +41,62 @@ import (
 
 // 集成测试套件
 type IntegrationTestSuite struct {
-	bridge      *FileFlowBridge
-	server      *httptest.Server
-	bridgeURL   string
-	tempDir     string
-	testFiles   []string
-	cleanupOnce sync.Once
+	bridge         *FileFlowBridge
+	server         *httptest.Server
+	streamListener *memoryListener
+	bridgeURL      string
+	tempDir        string
+	testFiles      []string
+	cleanupOnce    sync.Once
 }
 
+// 内存中的流端口监听器：Dial 通过 net.Pipe 建立连接，服务器一侧交给接受循环，测试无需绑定真实端口
+type memoryListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemoryListener() *memoryListener {
+	return &memoryListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+// 模拟提供端连接流端口，返回提供端一侧的连接
+func (l *memoryListener) Dial() (net.Conn, error) {
+	providerConn, bridgeConn := net.Pipe()
+	select {
+	case l.conns <- bridgeConn:
+		return providerConn, nil
+	case <-l.closed:
+		providerConn.Close()
+		bridgeConn.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
+
 // 创建集成测试环境
 func createIntegrationTestSuite(t *testing.T) *IntegrationTestSuite {
 	// 创建临时目录
@@ -43,10 +111,19 @@ func createIntegrationTestSuite(t *testing.T) *IntegrationTestSuite {
 		TCPPort:           0, // 使用随机端口
 		MaxFileSize:       100,
 		TokenLength:       8,
+		DownloadWait:      2 * time.Second,
 		ShutdownEvent:     make(chan struct{}),
 		fileRegistry:      make(map[string]*FileMetadata),
-		activeStreams:     make(map[string]interface{}),
+		activeStreams:     make(map[string]Stream),
 		downloadCompleted: make(map[string]bool),
+		streamThroughput:  make(map[string]float64),
+		streamReady:       make(map[string]chan struct{}),
+		transferDone:      make(map[string]chan struct{}),
+		cacheEntries:      make(map[string]*cacheEntry),
+		cacheByHash:       make(map[string]*cacheEntry),
+		idempotencyKeys:   make(map[string]idempotencyEntry),
+		bandwidthByIP:     make(map[string]*ipBandwidth),
+		finishedTransfers: make(map[string]*finishedTransfer),
 		serverStats: ServerStats{
 			StartTime: time.Now(),
 		},
@@ -59,18 +136,26 @@ func createIntegrationTestSuite(t *testing.T) *IntegrationTestSuite {
 	router.HandleFunc("/stats", ffb.handleServerStats).Methods("GET")
 	router.HandleFunc("/health", ffb.handleHealthCheck).Methods("GET")
 	router.HandleFunc("/download/{auth_token}", ffb.handleFileDownload).Methods("GET")
+	router.HandleFunc("/download-zip", ffb.handleZipDownload).Methods("GET")
 	router.HandleFunc("/upload/{auth_token}", ffb.handleFileUpload).Methods("POST")
 	router.HandleFunc("/ws/{auth_token}", ffb.handleWebSocketConnection).Methods("GET")
 
 	// 创建测试服务器
 	server := httptest.NewServer(router)
 
+	// 流端口使用内存监听器，握手与生产环境一样经过接受循环
+	listener := newMemoryListener()
+	ffb.streamListener = func() (net.Listener, error) { return listener, nil }
+	ffb.tcpListening = true
+	go ffb.acceptStreamConnections(listener)
+
 	return &IntegrationTestSuite{
-		bridge:    ffb,
-		server:    server,
-		bridgeURL: server.URL,
-		tempDir:   tempDir,
-		testFiles: []string{},
+		bridge:         ffb,
+		server:         server,
+		streamListener: listener,
+		bridgeURL:      server.URL,
+		tempDir:        tempDir,
+		testFiles:      []string{},
 	}
 }
 
@@ -80,6 +165,13 @@ func (suite *IntegrationTestSuite) cleanup() {
 		if suite.server != nil {
 			suite.server.Close()
 		}
+		if suite.streamListener != nil {
+			// 先标记关闭，接受循环按正常停止处理而不是视为监听故障
+			suite.bridge.mu.Lock()
+			suite.bridge.isShuttingDown = true
+			suite.bridge.mu.Unlock()
+			suite.streamListener.Close()
+		}
 		// 清理临时文件
 		for _, file := range suite.testFiles {
 			os.Remove(file)
@@ -99,6 +191,93 @@ func (suite *IntegrationTestSuite) createTestFile(name string, content string) s
 	return filePath
 }
 
+// 注册文件并返回认证令牌
+func (suite *IntegrationTestSuite) registerFile(t *testing.T, filename string, size int64) string {
+	t.Helper()
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{
+		"filename": filename,
+		"size":     size,
+	})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("注册失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+	}
+
+	var registerResp struct {
+		AuthToken string `json:"auth_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registerResp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	return registerResp.AuthToken
+}
+
+// 查询注册时发给上传端的凭证
+func (suite *IntegrationTestSuite) providerToken(authToken string) string {
+	suite.bridge.mu.RLock()
+	defer suite.bridge.mu.RUnlock()
+	if metadata, ok := suite.bridge.fileRegistry[authToken]; ok {
+		return metadata.ProviderToken
+	}
+	return ""
+}
+
+// 通过内存监听器模拟提供端发送TCP握手，返回提供端一侧的连接和服务器的应答
+func (suite *IntegrationTestSuite) handshakeStream(t *testing.T, authToken string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	return suite.handshakeStreamWithToken(t, authToken, suite.providerToken(authToken))
+}
+
+// 使用指定的上传端凭证发送TCP握手
+func (suite *IntegrationTestSuite) handshakeStreamWithToken(t *testing.T, authToken, providerToken string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	return suite.handshakeStreamWithMeta(t, map[string]string{"auth_token": authToken, "provider_token": providerToken})
+}
+
+// 发送任意握手元数据
+func (suite *IntegrationTestSuite) handshakeStreamWithMeta(t *testing.T, metadata map[string]string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+
+	providerConn, err := suite.streamListener.Dial()
+	if err != nil {
+		t.Fatalf("连接流端口失败: %v", err)
+	}
+
+	meta, _ := json.Marshal(metadata)
+	providerConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := providerConn.Write(append(meta, '\n')); err != nil {
+		t.Fatalf("发送握手元数据失败: %v", err)
+	}
+
+	reader := bufio.NewReader(providerConn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("读取握手响应失败: %v", err)
+	}
+	providerConn.SetDeadline(time.Time{})
+
+	return providerConn, reader, strings.TrimSpace(line)
+}
+
+// 模拟提供端完成TCP握手，要求服务器应答 STREAM_READY
+func (suite *IntegrationTestSuite) connectStreamProvider(t *testing.T, authToken string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	providerConn, reader, reply := suite.handshakeStream(t, authToken)
+	if reply != "STREAM_READY" {
+		providerConn.Close()
+		t.Fatalf("期望 STREAM_READY, 得到 %q", reply)
+	}
+	return providerConn, reader
+}
+
 // 测试完整的文件注册流程
 func TestCompleteFileRegistration(t *testing.T) {
 	suite := createIntegrationTestSuite(t)
@@ -212,6 +391,7 @@ func TestWebSocketFileTransfer(t *testing.T) {
 
 	var registerResp struct {
 		AuthToken        string `json:"auth_token"`
+		ProviderToken    string `json:"provider_token"`
 		DownloadURL      string `json:"download_url"`
 		OriginalFilename string `json:"original_filename"`
 		TcpEndpoint      struct {
@@ -224,7 +404,7 @@ func TestWebSocketFileTransfer(t *testing.T) {
 	}
 
 	// 建立WebSocket连接
-	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken
+	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + registerResp.AuthToken + "?provider_token=" + registerResp.ProviderToken
 	wsConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
 		t.Fatalf("WebSocket连接失败: %v", err)
@@ -290,6 +470,69 @@ func TestWebSocketFileTransfer(t *testing.T) {
 	t.Log("WebSocket文件传输测试通过")
 }
 
+// 测试WebSocket上传端在下载中止时收到 transfer_aborted，而不是 transfer_complete
+func TestWebSocketTransferAborted(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "aborted.txt", 20)
+	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + authToken + "?provider_token=" + suite.providerToken(authToken)
+	wsConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("WebSocket连接失败: %v", err)
+	}
+	defer wsConn.Close()
+	wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// 读取控制消息直到出现期望的命令之一
+	waitCommand := func(commands ...string) string {
+		t.Helper()
+		for {
+			var msg map[string]interface{}
+			if err := wsConn.ReadJSON(&msg); err != nil {
+				t.Fatalf("读取控制消息失败: %v", err)
+			}
+			for _, command := range commands {
+				if msg["command"] == command {
+					return command
+				}
+			}
+		}
+	}
+	waitCommand("READY")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", suite.bridgeURL+"/download/"+authToken, nil)
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		done <- result{resp, err}
+	}()
+
+	waitCommand("send_chunk")
+	wsConn.WriteMessage(websocket.BinaryMessage, []byte("01234"))
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("下载请求失败: %v", res.err)
+	}
+	io.ReadFull(res.resp.Body, make([]byte, 5))
+
+	// 下载方中途断开后，再到达的数据使中继发现断开并结束
+	cancel()
+	res.resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	wsConn.WriteMessage(websocket.BinaryMessage, []byte("56789"))
+
+	if command := waitCommand("transfer_aborted", "transfer_complete"); command != "transfer_aborted" {
+		t.Errorf("下载中止时期望 transfer_aborted, 得到 %s", command)
+	}
+}
+
 // 测试并发文件传输
 func TestConcurrentFileTransfers(t *testing.T) {
 	suite := createIntegrationTestSuite(t)
@@ -443,7 +686,7 @@ func TestServerStats(t *testing.T) {
 	}
 
 	// 验证统计信息字段
-	expectedFields := []string{"status", "uptime", "files_registered", "files_transferred", "active_connections"}
+	expectedFields := []string{"status", "uptime", "files_registered_total", "files_transferred", "active_connections"}
 	for _, field := range expectedFields {
 		if _, ok := stats[field]; !ok {
 			t.Errorf("统计信息缺少字段: %s", field)
@@ -594,3 +837,3028 @@ func TestStressConcurrentConnections(t *testing.T) {
 
 	t.Logf("压力测试完成，成功处理 %d 个请求", successCount)
 }
+
+// 测试健康检查协程不泄漏：流传输完成或资源被释放后，对应的健康检查协程立即退出，而不是等到下一次检查
+func TestHealthMonitorGoroutinesExit(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	content := "monitor-leak-content"
+	transfer := func(i int) {
+		authToken := suite.registerFile(t, fmt.Sprintf("leak_%d.txt", i), int64(len(content)))
+		providerConn, reader := suite.connectStreamProvider(t, authToken)
+		defer providerConn.Close()
+
+		// 一半完整下载，一半在下载前直接释放资源
+		if i%2 == 1 {
+			suite.bridge.removeFileResources(authToken)
+			return
+		}
+		go providerConn.Write([]byte(content))
+		resp, err := client.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			t.Fatalf("下载失败: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != content {
+			t.Fatalf("下载内容不一致: %q", body)
+		}
+		providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader.ReadString('\n')
+	}
+
+	transfer(0)
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	const transfers = 40
+	for i := 0; i < transfers; i++ {
+		transfer(i)
+	}
+
+	// 默认检查间隔为30秒，协程若依赖定时检查才退出，这里会多出约 transfers 个
+	deadline := time.Now().Add(2 * time.Second)
+	after := runtime.NumGoroutine()
+	for after > before+2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before+2 {
+		t.Errorf("%d 次传输后协程数从 %d 增加到 %d，健康检查协程未退出", transfers, before, after)
+	}
+}
+
+// 压力测试：健康检查高频运行期间，多个真实TCP流并发缓慢传输，数据不应被中断或损坏
+func TestStressTransfersWithHealthMonitoring(t *testing.T) {
+	if testing.Short() {
+		t.Skip("跳过压力测试")
+	}
+
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.MaxFileSize = 1024 * 1024
+	suite.bridge.healthCheckInterval = 5 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("创建TCP监听失败: %v", err)
+	}
+	defer listener.Close()
+	go suite.bridge.acceptStreamConnections(listener)
+
+	const transfers = 8
+	const chunks = 16
+	chunk := bytes.Repeat([]byte("m"), 4096)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, transfers)
+	for i := 0; i < transfers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+
+			authToken := suite.registerFile(t, fmt.Sprintf("monitored_%d.bin", id), int64(len(chunk)*chunks))
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				errs <- fmt.Errorf("连接TCP端口失败 %d: %v", id, err)
+				return
+			}
+			defer conn.Close()
+			meta, _ := json.Marshal(map[string]string{"auth_token": authToken, "provider_token": suite.providerToken(authToken)})
+			conn.Write(append(meta, '\n'))
+			reader := bufio.NewReader(conn)
+			if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != "STREAM_READY" {
+				errs <- fmt.Errorf("握手失败 %d: %q", id, line)
+				return
+			}
+
+			// 缓慢写入，使健康检查在传输过程中反复运行
+			go func() {
+				for c := 0; c < chunks; c++ {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+			if err != nil {
+				errs <- fmt.Errorf("下载失败 %d: %v", id, err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if !bytes.Equal(body, bytes.Repeat(chunk, chunks)) {
+				errs <- fmt.Errorf("下载内容不完整 %d: 得到 %d 字节", id, len(body))
+				return
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+				errs <- fmt.Errorf("期望 TRANSFER_COMPLETE %d, 得到 %q", id, line)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// 测试下载完成后桥接服务器通过TCP控制通道通知提供端
+func TestTCPStreamTransferCompleteNotification(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := "TCP流传输测试内容"
+	authToken := suite.registerFile(t, "tcp_notify.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	go providerConn.Write([]byte(content))
+
+	downloadResp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(downloadResp.Body)
+	downloadResp.Body.Close()
+
+	if string(body) != content {
+		t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("读取传输结果通知失败: %v", err)
+	}
+	if strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+		t.Errorf("期望 TRANSFER_COMPLETE, 得到 %q", line)
+	}
+
+	suite.bridge.mu.RLock()
+	completed := suite.bridge.serverStats.FilesCompletedTotal
+	suite.bridge.mu.RUnlock()
+	if completed != 1 {
+		t.Errorf("期望 files_completed_total 为 1, 得到 %d", completed)
+	}
+}
+
+// 测试活跃流上限：超出上限的握手收到 SERVER_BUSY，对应下载返回503
+func TestMaxActiveStreamsLimit(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	suite.bridge.MaxActiveStreams = 1
+
+	firstToken := suite.registerFile(t, "first.bin", 10)
+	secondToken := suite.registerFile(t, "second.bin", 10)
+
+	firstConn, _ := suite.connectStreamProvider(t, firstToken)
+	defer firstConn.Close()
+
+	secondConn, _, reply := suite.handshakeStream(t, secondToken)
+	defer secondConn.Close()
+	if reply != "SERVER_BUSY" {
+		t.Fatalf("期望 SERVER_BUSY, 得到 %q", reply)
+	}
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + secondToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("期望状态码 %d, 得到 %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	resp, err = http.Get(suite.bridgeURL + "/stats")
+	if err != nil {
+		t.Fatalf("获取统计信息失败: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		ActiveStreams    int `json:"active_streams"`
+		MaxActiveStreams int `json:"max_active_streams"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("解析统计信息失败: %v", err)
+	}
+	if stats.ActiveStreams != 1 || stats.MaxActiveStreams != 1 {
+		t.Errorf("期望 active_streams=1, max_active_streams=1, 得到 %d/%d", stats.ActiveStreams, stats.MaxActiveStreams)
+	}
+}
+
+// 测试管道模式：提供端先到和下载方先到两种顺序都能完整传输
+func TestPipeModeArrivalOrders(t *testing.T) {
+	content := "管道模式传输测试内容"
+
+	download := func(suite *IntegrationTestSuite, authToken string, result chan<- string) {
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			result <- "请求失败: " + err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		result <- string(body)
+	}
+
+	t.Run("提供端先到", func(t *testing.T) {
+		suite := createIntegrationTestSuite(t)
+		defer suite.cleanup()
+
+		authToken := suite.registerFile(t, "provider_first.txt", int64(len(content)))
+		providerConn, _ := suite.connectStreamProvider(t, authToken)
+		defer providerConn.Close()
+		go providerConn.Write([]byte(content))
+
+		result := make(chan string, 1)
+		go download(suite, authToken, result)
+
+		select {
+		case body := <-result:
+			if body != content {
+				t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("下载超时")
+		}
+	})
+
+	t.Run("下载方先到", func(t *testing.T) {
+		suite := createIntegrationTestSuite(t)
+		defer suite.cleanup()
+
+		authToken := suite.registerFile(t, "downloader_first.txt", int64(len(content)))
+
+		result := make(chan string, 1)
+		go download(suite, authToken, result)
+
+		// 等待下载方进入等待状态后再接入提供端
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			suite.bridge.mu.RLock()
+			_, waiting := suite.bridge.streamReady[authToken]
+			suite.bridge.mu.RUnlock()
+			if waiting {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("下载方未进入等待状态")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		providerConn, _ := suite.connectStreamProvider(t, authToken)
+		defer providerConn.Close()
+		go providerConn.Write([]byte(content))
+
+		select {
+		case body := <-result:
+			if body != content {
+				t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("下载超时")
+		}
+	})
+}
+
+// 测试缓存模式：提供端写完即断开，下载方可以分段（Range）下载，完整交付后删除缓存文件
+func TestCacheModeResumableDownload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	cacheDir := t.TempDir()
+	suite.bridge.CacheDir = cacheDir
+
+	content := "0123456789abcdefghij"
+	authToken := suite.registerFile(t, "cached.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	go providerConn.Write([]byte(content))
+
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("读取缓存完成通知失败: %v", err)
+	}
+	if strings.TrimSpace(line) != "TRANSFER_CACHED" {
+		t.Fatalf("期望 TRANSFER_CACHED, 得到 %q", line)
+	}
+
+	rangeGet := func(rangeHeader, session string) (int, string, string) {
+		req, _ := http.NewRequest("GET", suite.bridgeURL+"/download/"+authToken, nil)
+		req.Header.Set("Range", rangeHeader)
+		if session != "" {
+			req.Header.Set("X-FileFlow-Session", session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header.Get("X-FileFlow-Session")
+	}
+
+	status, body, session := rangeGet("bytes=0-9", "")
+	if status != http.StatusPartialContent || body != content[:10] {
+		t.Fatalf("第一段下载期望 206 %q, 得到 %d %q", content[:10], status, body)
+	}
+	if session == "" {
+		t.Fatal("缓存下载响应应携带 X-FileFlow-Session")
+	}
+
+	// 会话占用了唯一的下载次数，其他下载方在会话有效期内无法开始下载
+	if status, _, _ := rangeGet("bytes=0-", ""); status != http.StatusConflict {
+		t.Errorf("会话进行中其他下载方期望 %d, 得到 %d", http.StatusConflict, status)
+	}
+
+	// 只请求末尾的片段会把偏移移到文件末尾，但中间的字节尚未交付，不算完整下载
+	if status, body, _ := rangeGet("bytes=-1", session); status != http.StatusPartialContent || body != content[len(content)-1:] {
+		t.Fatalf("末尾片段期望 206 %q, 得到 %d %q", content[len(content)-1:], status, body)
+	}
+	suite.bridge.mu.RLock()
+	_, stillRegistered := suite.bridge.fileRegistry[authToken]
+	suite.bridge.mu.RUnlock()
+	if !stillRegistered {
+		t.Fatal("只交付了部分区间时注册不应被释放")
+	}
+
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 1 {
+		t.Fatalf("部分下载后缓存文件应保留, 实际有 %d 个文件", len(entries))
+	}
+
+	status, body, _ = rangeGet("bytes=10-", session)
+	if status != http.StatusPartialContent || body != content[10:] {
+		t.Fatalf("续传下载期望 206 %q, 得到 %d %q", content[10:], status, body)
+	}
+
+	suite.bridge.mu.RLock()
+	_, stillRegistered = suite.bridge.fileRegistry[authToken]
+	suite.bridge.mu.RUnlock()
+	if stillRegistered {
+		t.Error("完整交付后注册应被释放")
+	}
+	entries, _ = os.ReadDir(cacheDir)
+	if len(entries) != 0 {
+		t.Errorf("完整交付后缓存文件应被删除, 实际有 %d 个文件", len(entries))
+	}
+}
+
+// 测试缓存尚未写完时的Range续传：已缓存的部分立即返回，尚未缓存的尾部等待上传端写入后返回，
+// If-Range 携带的ETag与缓存一致时才返回片段
+func TestCacheRangeDuringUpload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	suite.bridge.CacheDir = t.TempDir()
+
+	content := "partial-cache-0123456789"
+	authToken := suite.registerFile(t, "partial.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	if _, err := providerConn.Write([]byte(content[:10])); err != nil {
+		t.Fatalf("写入前半部分失败: %v", err)
+	}
+
+	rangeGet := func(rangeHeader, session, ifRange string) *http.Response {
+		req, _ := http.NewRequest("GET", suite.bridgeURL+"/download/"+authToken, nil)
+		req.Header.Set("Range", rangeHeader)
+		if session != "" {
+			req.Header.Set("X-FileFlow-Session", session)
+		}
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		return resp
+	}
+
+	resp := rangeGet("bytes=0-4", "", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != content[:5] {
+		t.Fatalf("已缓存部分期望 206 %q, 得到 %d %q", content[:5], resp.StatusCode, body)
+	}
+	session := resp.Header.Get("X-FileFlow-Session")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("缓存下载响应应携带 ETag")
+	}
+
+	// 与缓存不符的ETag：ServeContent 忽略Range，返回完整内容
+	go providerConn.Write([]byte(content[10:]))
+	resp = rangeGet("bytes=5-", session, `"stale"`)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Fatalf("If-Range 不匹配时期望 200 完整内容, 得到 %d %q", resp.StatusCode, body)
+	}
+	go reader.ReadString('\n')
+
+	// 新的注册：携带正确的ETag从已下载的位置续传
+	authToken = suite.registerFile(t, "partial2.txt", int64(len(content)))
+	providerConn2, _ := suite.connectStreamProvider(t, authToken)
+	defer providerConn2.Close()
+	providerConn2.Write([]byte(content[:10]))
+	resp = rangeGet("bytes=0-9", "", "")
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	session, etag = resp.Header.Get("X-FileFlow-Session"), resp.Header.Get("ETag")
+
+	// 尾部尚未缓存，请求等待上传端写入
+	done := make(chan string, 1)
+	go func() {
+		resp := rangeGet("bytes=10-", session, etag)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			done <- fmt.Sprintf("status %d", resp.StatusCode)
+			return
+		}
+		done <- string(body)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	providerConn2.Write([]byte(content[10:]))
+	select {
+	case got := <-done:
+		if got != content[10:] {
+			t.Errorf("尾部续传期望 %q, 得到 %q", content[10:], got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("尾部写入后续传请求未返回")
+	}
+}
+
+// 测试Range校验：超出注册大小的区间与无法满足的后缀区间返回416，且不占用下载次数
+func TestRangeValidation(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	suite.bridge.CacheDir = t.TempDir()
+
+	content := "range-content-0123456789"
+	authToken := suite.registerFile(t, "range.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "TRANSFER_CACHED" {
+		t.Fatalf("期望 TRANSFER_CACHED, 得到 %q (%v)", line, err)
+	}
+
+	get := func(token, rangeHeader string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", suite.bridgeURL+"/download/"+token, nil)
+		req.Header.Set("Range", rangeHeader)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get(authToken, "bytes=6-12")
+	if resp.StatusCode != http.StatusPartialContent || body != content[6:13] {
+		t.Errorf("有效区间期望 206 %q, 得到 %d %q", content[6:13], resp.StatusCode, body)
+	}
+
+	want := fmt.Sprintf("bytes */%d", len(content))
+	for _, rangeHeader := range []string{"bytes=999999999-", "bytes=-0", "bytes=24-30,100-"} {
+		resp, _ := get(authToken, rangeHeader)
+		if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%s: 期望 416, 得到 %d", rangeHeader, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Range"); got != want {
+			t.Errorf("%s: Content-Range 期望 %q, 得到 %q", rangeHeader, want, got)
+		}
+	}
+
+	// 实时转发的注册同样校验，416 不会消耗唯一的下载次数
+	suite.bridge.CacheDir = ""
+	liveToken := suite.registerFile(t, "live.txt", 10)
+	if resp, _ := get(liveToken, "bytes=10-"); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("实时转发的越界区间期望 416, 得到 %d", resp.StatusCode)
+	}
+	suite.bridge.mu.RLock()
+	_, exists := suite.bridge.fileRegistry[liveToken]
+	suite.bridge.mu.RUnlock()
+	if !exists {
+		t.Error("416 响应不应释放注册")
+	}
+}
+
+// 测试下载租约：下载中途断开后名额被租约保留，租约过期后其他下载方可以重新完整下载
+func TestDownloadLeaseExpiry(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	suite.bridge.CacheDir = t.TempDir()
+	suite.bridge.DownloadLeaseTTL = 200 * time.Millisecond
+
+	content := "lease-content-0123456789"
+	authToken := suite.registerFile(t, "lease.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "TRANSFER_CACHED" {
+		t.Fatalf("期望 TRANSFER_CACHED, 得到 %q (%v)", line, err)
+	}
+
+	get := func(rangeHeader string) (int, string) {
+		req, _ := http.NewRequest("GET", suite.bridgeURL+"/download/"+authToken, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// 第一个下载方只取得前半部分就断开，名额仍被租约占用
+	if status, body := get("bytes=0-9"); status != http.StatusPartialContent || body != content[:10] {
+		t.Fatalf("第一段下载期望 206 %q, 得到 %d %q", content[:10], status, body)
+	}
+	if status, _ := get(""); status != http.StatusConflict {
+		t.Errorf("租约有效期内其他下载方期望 %d, 得到 %d", http.StatusConflict, status)
+	}
+
+	// 租约过期后名额回到可下载状态，新的下载方完整取得文件
+	time.Sleep(300 * time.Millisecond)
+	if status, body := get(""); status != http.StatusOK || body != content {
+		t.Fatalf("租约过期后期望 200 %q, 得到 %d %q", content, status, body)
+	}
+
+	suite.bridge.mu.RLock()
+	_, stillRegistered := suite.bridge.fileRegistry[authToken]
+	suite.bridge.mu.RUnlock()
+	if stillRegistered {
+		t.Error("完整交付后注册应被释放")
+	}
+}
+
+// 测试下载令牌不能用作上传凭证
+func TestDownloadTokenCannotOpenStream(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "secret.bin", 10)
+
+	for _, providerToken := range []string{"", authToken, "wrong-provider-token"} {
+		conn, _, reply := suite.handshakeStreamWithToken(t, authToken, providerToken)
+		conn.Close()
+		if reply != "INVALID_CONNECTION" {
+			t.Errorf("上传端凭证 %q 期望 INVALID_CONNECTION, 得到 %q", providerToken, reply)
+		}
+	}
+
+	wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + authToken
+	if wsConn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		wsConn.Close()
+		t.Error("缺少上传端凭证的WebSocket连接应被拒绝")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("期望WebSocket握手返回 %d, 得到 %v", http.StatusUnauthorized, resp)
+	}
+
+	conn, _ := suite.connectStreamProvider(t, authToken)
+	conn.Close()
+}
+
+// 测试多次下载：每次下载消耗一个流，提供端重新建立流后可再次下载，次数用完后释放注册
+func TestMultipleDownloadsReuseRegistration(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := "多次下载测试内容"
+	jsonPayload, _ := json.Marshal(map[string]interface{}{
+		"filename":      "shared.txt",
+		"size":          len(content),
+		"max_downloads": 2,
+	})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	var registerResp struct {
+		AuthToken    string `json:"auth_token"`
+		MaxDownloads int    `json:"max_downloads"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registerResp)
+	resp.Body.Close()
+	if registerResp.MaxDownloads != 2 {
+		t.Fatalf("期望 max_downloads 为 2, 得到 %d", registerResp.MaxDownloads)
+	}
+	authToken := registerResp.AuthToken
+
+	for i := 1; i <= 2; i++ {
+		providerConn, reader := suite.connectStreamProvider(t, authToken)
+		go providerConn.Write([]byte(content))
+
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			t.Fatalf("第 %d 次下载请求失败: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != content {
+			t.Fatalf("第 %d 次下载内容不匹配, 期望 %q, 得到 %q", i, content, string(body))
+		}
+
+		providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+			t.Fatalf("第 %d 次下载后期望 TRANSFER_COMPLETE, 得到 %q (%v)", i, line, err)
+		}
+		providerConn.Close()
+
+		if i == 1 {
+			suite.bridge.mu.RLock()
+			metadata, exists := suite.bridge.fileRegistry[authToken]
+			suite.bridge.mu.RUnlock()
+			if !exists {
+				t.Fatal("仍有剩余次数时注册不应被释放")
+			}
+			if metadata.DownloadCount != 1 || metadata.Status != "registered" {
+				t.Fatalf("期望 download_count=1 且状态为 registered, 得到 %d/%s", metadata.DownloadCount, metadata.Status)
+			}
+		}
+	}
+
+	// 次数用完后下载链接失效
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		_, exists := suite.bridge.fileRegistry[authToken]
+		suite.bridge.mu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("次数用完后注册应被释放")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 测试中止的单次下载释放名额：注册保留、不计入次数，上传端重新建流后下一个下载方可以完整下载
+func TestAbortedDownloadReleasesSlot(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := "0123456789abcdefghij"
+	authToken := suite.registerFile(t, "retry.txt", int64(len(content)))
+
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", suite.bridgeURL+"/download/"+authToken, nil)
+	go providerConn.Write([]byte(content[:5]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.ReadFull(resp.Body, make([]byte, 5))
+
+	// 下载方中途断开后，再到达的数据使中继发现断开并结束
+	cancel()
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	go providerConn.Write([]byte(content[5:10]))
+
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "TRANSFER_ABORTED" {
+		t.Fatalf("下载中止后期望 TRANSFER_ABORTED, 得到 %q (%v)", line, err)
+	}
+	providerConn.Close()
+
+	suite.bridge.mu.RLock()
+	metadata, exists := suite.bridge.fileRegistry[authToken]
+	var status string
+	var count int
+	if exists {
+		status, count = metadata.Status, metadata.DownloadCount
+	}
+	suite.bridge.mu.RUnlock()
+	if !exists {
+		t.Fatal("中止的单次下载不应释放注册")
+	}
+	if count != 0 || status != STATUS_REGISTERED {
+		t.Fatalf("期望 download_count=0 且状态为 registered, 得到 %d/%s", count, status)
+	}
+
+	// 上传端重新建流后完整下载，之后注册被释放
+	providerConn, reader = suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("重新下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != content {
+		t.Fatalf("重新下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+		t.Fatalf("完整下载后期望 TRANSFER_COMPLETE, 得到 %q (%v)", line, err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		_, exists := suite.bridge.fileRegistry[authToken]
+		suite.bridge.mu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("完整下载后注册应被释放")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 测试注册时指定限速：下载被节流，但字节统计保持准确
+func TestRegistrationRateLimit(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := strings.Repeat("r", 100)
+	jsonPayload, _ := json.Marshal(map[string]interface{}{
+		"filename": "throttled.bin",
+		"size":     len(content),
+		"max_rate": 200,
+	})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	var registerResp struct {
+		AuthToken string `json:"auth_token"`
+		MaxRate   int64  `json:"max_rate"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registerResp)
+	resp.Body.Close()
+	if registerResp.MaxRate != 200 {
+		t.Fatalf("期望 max_rate 为 200, 得到 %d", registerResp.MaxRate)
+	}
+
+	providerConn, reader := suite.connectStreamProvider(t, registerResp.AuthToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	start := time.Now()
+	resp, err = http.Get(suite.bridgeURL + "/download/" + registerResp.AuthToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	if string(body) != content {
+		t.Fatalf("下载内容不匹配, 得到 %d 字节", len(body))
+	}
+	// 100 字节按 200 字节/秒 限速约需 0.5 秒
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("限速未生效, 下载仅耗时 %v", elapsed)
+	}
+
+	// 统计在响应写完后更新，稍作等待
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		transferred := suite.bridge.serverStats.BytesTransferred
+		suite.bridge.mu.RUnlock()
+		if transferred == int64(len(content)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("期望统计传输 %d 字节, 得到 %d", len(content), transferred)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	jsonPayload, _ = json.Marshal(map[string]interface{}{"filename": "bad.bin", "size": 10, "max_rate": -1})
+	resp, err = http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("负数限速期望 %d, 得到 %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// 测试上传流与注册大小不符：多出的数据不转发，提前结束的流不算完成
+func TestStreamSizeMismatch(t *testing.T) {
+	t.Run("超出注册大小", func(t *testing.T) {
+		suite := createIntegrationTestSuite(t)
+		defer suite.cleanup()
+
+		authToken := suite.registerFile(t, "grown.txt", 10)
+		providerConn, reader := suite.connectStreamProvider(t, authToken)
+		defer providerConn.Close()
+		go providerConn.Write([]byte("0123456789abcdefghij"))
+		go reader.ReadString('\n')
+
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "0123456789" {
+			t.Fatalf("期望只转发注册大小的数据, 得到 %q (%v)", string(body), err)
+		}
+	})
+
+	t.Run("短于注册大小", func(t *testing.T) {
+		suite := createIntegrationTestSuite(t)
+		defer suite.cleanup()
+
+		authToken := suite.registerFile(t, "truncated.txt", 20)
+		providerConn, _ := suite.connectStreamProvider(t, authToken)
+		go func() {
+			providerConn.Write([]byte("0123456789"))
+			providerConn.Close()
+		}()
+
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			t.Error("上传流提前结束时下载方应收到错误")
+		}
+		if len(body) != 10 {
+			t.Errorf("期望收到截断前的 10 字节, 得到 %d", len(body))
+		}
+
+		suite.bridge.mu.RLock()
+		completed := suite.bridge.serverStats.FilesCompletedTotal
+		truncated := suite.bridge.serverStats.FilesTruncatedTotal
+		status := suite.bridge.fileRegistry[authToken]
+		suite.bridge.mu.RUnlock()
+		if completed != 0 {
+			t.Errorf("被截断的传输不应计入完成数, 得到 %d", completed)
+		}
+		if truncated != 1 {
+			t.Errorf("files_truncated_total 应为 1, 得到 %d", truncated)
+		}
+		if status != nil && status.Status == STATUS_COMPLETED {
+			t.Error("被截断的传输不应标记为已完成")
+		}
+	})
+}
+
+// 测试空文件：握手后立即返回空响应体，并通知上传端传输完成
+func TestEmptyFileTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "empty.txt", 0)
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	// 测试用的流连接是同步管道，需先读取通知，否则处理器会阻塞在写通知上
+	providerConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	notified := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		notified <- line
+	}()
+
+	start := time.Now()
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("期望状态码 %d, 得到 %d", http.StatusOK, resp.StatusCode)
+	}
+	if len(body) != 0 {
+		t.Errorf("期望空响应体, 得到 %d 字节", len(body))
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "0" {
+		t.Errorf("期望 Content-Length 为 0, 得到 %q", cl)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("空文件下载不应等待数据, 耗时 %v", elapsed)
+	}
+
+	if line := <-notified; strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+		t.Errorf("期望 TRANSFER_COMPLETE, 得到 %q", line)
+	}
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{"filename": "negative.bin", "size": -1})
+	resp, err = http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("负数大小期望 %d, 得到 %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// 测试TCP链路压缩：握手协商gzip后，桥接服务器解压再转发，下载方收到原始内容
+func TestCompressedStreamTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := strings.Repeat("compress", 12)
+	authToken := suite.registerFile(t, "compressed.txt", int64(len(content)))
+	providerConn, reader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     authToken,
+		"provider_token": suite.providerToken(authToken),
+		"compression":    "gzip",
+	})
+	defer providerConn.Close()
+	if reply != "STREAM_READY gzip" {
+		t.Fatalf("期望 STREAM_READY gzip, 得到 %q", reply)
+	}
+
+	go func() {
+		zw := gzip.NewWriter(providerConn)
+		zw.Write([]byte(content))
+		zw.Close()
+	}()
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != content {
+		t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != fmt.Sprint(len(content)) {
+		t.Errorf("Content-Length 应为解压后的大小 %d, 得到 %q", len(content), cl)
+	}
+
+	otherToken := suite.registerFile(t, "brotli.txt", 10)
+	otherConn, _, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     otherToken,
+		"provider_token": suite.providerToken(otherToken),
+		"compression":    "br",
+	})
+	defer otherConn.Close()
+	if reply != "UNSUPPORTED_COMPRESSION" {
+		t.Errorf("期望 UNSUPPORTED_COMPRESSION, 得到 %q", reply)
+	}
+
+	// 关闭压缩后不回显压缩方式，上传流按未压缩处理
+	suite.bridge.DisableCompression = true
+	plainToken := suite.registerFile(t, "plain.txt", int64(len(content)))
+	plainConn, plainReader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     plainToken,
+		"provider_token": suite.providerToken(plainToken),
+		"compression":    "gzip",
+	})
+	defer plainConn.Close()
+	if reply != "STREAM_READY" {
+		t.Fatalf("关闭压缩后期望 STREAM_READY, 得到 %q", reply)
+	}
+	go plainConn.Write([]byte(content))
+	go plainReader.ReadString('\n')
+
+	resp, err = http.Get(suite.bridgeURL + "/download/" + plainToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != content {
+		t.Errorf("下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+}
+
+// 测试压缩炸弹：解压后超过声明大小的上传流被中止，下载方收不到超出的数据
+func TestCompressedStreamBombRejected(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 8<<20))
+	zw.Close()
+	gz := &gzipStreamReader{src: &bomb}
+	out, err := io.ReadAll(&decompressionLimitReader{src: gz, gz: gz, limit: 4096})
+	if !errors.Is(err, errDecompressionLimit) {
+		t.Errorf("期望 errDecompressionLimit, 得到 %v", err)
+	}
+	if len(out) != 4096 {
+		t.Errorf("解压输出应截止在声明的 4096 字节, 得到 %d", len(out))
+	}
+
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	const declared = 64
+	authToken := suite.registerFile(t, "bomb.bin", declared)
+	providerConn, reader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     authToken,
+		"provider_token": suite.providerToken(authToken),
+		"compression":    "gzip",
+	})
+	defer providerConn.Close()
+	if reply != "STREAM_READY gzip" {
+		t.Fatalf("期望 STREAM_READY gzip, 得到 %q", reply)
+	}
+
+	go func() {
+		zw := gzip.NewWriter(providerConn)
+		zw.Write(make([]byte, 64<<20))
+		zw.Close()
+	}()
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) > declared {
+		t.Fatalf("下载方收到 %d 字节, 不应超过声明的 %d 字节", len(body), declared)
+	}
+
+	// 上传流被中止后资源随之释放
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		_, streaming := suite.bridge.activeStreams[authToken]
+		suite.bridge.mu.RUnlock()
+		if !streaming {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("压缩炸弹的流连接未被释放")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 生成仅用于测试的自签名证书
+func generateTestCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("解析证书失败: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// 测试TCP流端口启用TLS：握手、传输以及证书主机名不匹配时的失败
+func TestTLSStreamTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	cert, pool := generateTestCertificate(t, "bridge.test")
+	suite.bridge.TCPTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	content := "encrypted stream"
+	jsonPayload, _ := json.Marshal(map[string]interface{}{"filename": "tls.txt", "size": len(content)})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	var registerResp struct {
+		AuthToken     string `json:"auth_token"`
+		ProviderToken string `json:"provider_token"`
+		TcpEndpoint   struct {
+			TLS bool `json:"tls"`
+		} `json:"tcp_endpoint"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registerResp)
+	resp.Body.Close()
+	if !registerResp.TcpEndpoint.TLS {
+		t.Fatal("注册响应应标明TCP流端口使用TLS")
+	}
+
+	providerConn, bridgeConn := net.Pipe()
+	defer providerConn.Close()
+	go suite.bridge.handleStreamConnection(bridgeConn)
+
+	tlsConn := tls.Client(providerConn, &tls.Config{ServerName: "bridge.test", RootCAs: pool})
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	meta, _ := json.Marshal(map[string]string{"auth_token": registerResp.AuthToken, "provider_token": registerResp.ProviderToken})
+	if _, err := tlsConn.Write(append(meta, '\n')); err != nil {
+		t.Fatalf("TLS握手或发送元数据失败: %v", err)
+	}
+	reader := bufio.NewReader(tlsConn)
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "STREAM_READY" {
+		t.Fatalf("期望 STREAM_READY, 得到 %q (%v)", line, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	go tlsConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	downloadResp, err := http.Get(suite.bridgeURL + "/download/" + registerResp.AuthToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(downloadResp.Body)
+	downloadResp.Body.Close()
+	if string(body) != content {
+		t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+
+	// 证书与连接的主机名不匹配时，握手必须失败
+	otherConn, otherBridgeConn := net.Pipe()
+	defer otherConn.Close()
+	go suite.bridge.handleStreamConnection(otherBridgeConn)
+
+	mismatched := tls.Client(otherConn, &tls.Config{ServerName: "other.test", RootCAs: pool})
+	// net.Pipe 没有缓冲，服务端尚未写完的握手消息会让客户端的告警阻塞到截止时间，因此使用较短的期限
+	mismatched.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	err = mismatched.Handshake()
+	var hostErr x509.HostnameError
+	if !errors.As(err, &hostErr) {
+		t.Errorf("期望主机名不匹配错误, 得到 %v", err)
+	}
+}
+
+// 测试关闭排空阶段：/stats 与 /health 报告关闭状态，新的注册被拒绝
+func TestShutdownStatus(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "draining.txt", 10)
+	providerConn, _ := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	suite.bridge.mu.Lock()
+	suite.bridge.isShuttingDown = true
+	suite.bridge.mu.Unlock()
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{"filename": "late.txt", "size": 10})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "正在关闭") {
+		t.Errorf("关闭期间注册应返回503, 得到 %d: %s", resp.StatusCode, string(body))
+	}
+
+	for _, path := range []string{"/stats", "/health"} {
+		resp, err := http.Get(suite.bridgeURL + path)
+		if err != nil {
+			t.Fatalf("请求 %s 失败: %v", path, err)
+		}
+		var status struct {
+			Status          string `json:"status"`
+			ShuttingDown    bool   `json:"shutting_down"`
+			DrainingStreams int    `json:"draining_streams"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+
+		if status.Status != "shutting_down" || !status.ShuttingDown || status.DrainingStreams != 1 {
+			t.Errorf("%s 应报告关闭状态和1个排空中的流, 得到 %+v", path, status)
+		}
+	}
+}
+
+// 测试上传端在下载方到达前断开：下载返回502，注册保留并可重新建立流
+func TestProviderDisconnectBeforeDownload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "vanished.txt", 10)
+	providerConn, _ := suite.connectStreamProvider(t, authToken)
+	providerConn.Close()
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(body), "上传端已断开") {
+		t.Fatalf("期望 502 上传端已断开, 得到 %d: %s", resp.StatusCode, string(body))
+	}
+
+	suite.bridge.mu.RLock()
+	metadata, exists := suite.bridge.fileRegistry[authToken]
+	_, streamExists := suite.bridge.activeStreams[authToken]
+	suite.bridge.mu.RUnlock()
+	if !exists || metadata.Status != "registered" || streamExists {
+		t.Fatalf("失效的流应被移除且注册保留, 注册存在: %v, 流存在: %v", exists, streamExists)
+	}
+
+	// 上传端重新连接后下载成功
+	content := "0123456789"
+	newConn, reader := suite.connectStreamProvider(t, authToken)
+	defer newConn.Close()
+	go newConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("重新连接后期望下载 %q, 得到 %d: %q", content, resp.StatusCode, string(body))
+	}
+}
+
+// 测试卸载模式：堆内存超过高水位时拒绝新的注册与流连接，回落后恢复
+func TestLoadShedding(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "before.txt", 10)
+
+	suite.bridge.MemoryHighWater = 1
+	suite.bridge.sampleResources()
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{"filename": "shed.txt", "size": 10})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("卸载模式下注册应返回503并带 Retry-After, 得到 %d", resp.StatusCode)
+	}
+
+	providerConn, _, reply := suite.handshakeStream(t, authToken)
+	providerConn.Close()
+	if reply != "SERVER_BUSY" {
+		t.Errorf("卸载模式下流连接应收到 SERVER_BUSY, 得到 %q", reply)
+	}
+
+	resp, err = http.Get(suite.bridgeURL + "/stats")
+	if err != nil {
+		t.Fatalf("统计请求失败: %v", err)
+	}
+	var stats struct {
+		HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+		Shedding       bool   `json:"shedding"`
+	}
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if !stats.Shedding || stats.HeapInuseBytes == 0 {
+		t.Errorf("/stats 应报告卸载模式与堆内存, 得到 %+v", stats)
+	}
+
+	// 高水位调高后恢复
+	suite.bridge.MemoryHighWater = 1 << 40
+	suite.bridge.sampleResources()
+	suite.registerFile(t, "after.txt", 10)
+	providerConn, _ = suite.connectStreamProvider(t, authToken)
+	providerConn.Close()
+}
+
+// 测试分块校验的握手协商与传输
+func TestFramedStreamTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := []byte(strings.Repeat("framed", 10))
+	authToken := suite.registerFile(t, "framed.txt", int64(len(content)))
+	providerConn, reader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     authToken,
+		"provider_token": suite.providerToken(authToken),
+		"compression":    "gzip",
+		"framed":         "true",
+		"chunk_size":     "65536",
+	})
+	defer providerConn.Close()
+	if reply != "STREAM_READY gzip framed" {
+		t.Fatalf("期望 STREAM_READY gzip framed, 得到 %q", reply)
+	}
+
+	go func() {
+		zw := gzip.NewWriter(providerConn)
+		zw.Write(encodeFrame(content[:32], crc32.ChecksumIEEE(content[:32])))
+		zw.Write(encodeFrame(content[32:], crc32.ChecksumIEEE(content[32:])))
+		zw.Write(encodeFrame(nil, 0))
+		zw.Close()
+	}()
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != string(content) {
+		t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, body)
+	}
+
+	otherToken := suite.registerFile(t, "tiny-chunks.txt", 10)
+	otherConn, _, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     otherToken,
+		"provider_token": suite.providerToken(otherToken),
+		"framed":         "true",
+		"chunk_size":     "16",
+	})
+	defer otherConn.Close()
+	if reply != "UNSUPPORTED_FRAMING" {
+		t.Errorf("期望 UNSUPPORTED_FRAMING, 得到 %q", reply)
+	}
+}
+
+// 测试下载就绪探测：等待上传端时返回202，流建立后返回200，且不消耗下载
+func TestDownloadProbe(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	probe := func(authToken string) (int, bool, string) {
+		t.Helper()
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken + "?probe=1")
+		if err != nil {
+			t.Fatalf("探测请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Ready bool `json:"ready"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Ready, resp.Header.Get("Retry-After")
+	}
+
+	if code, _, _ := probe("missing"); code != http.StatusNotFound {
+		t.Errorf("不存在的令牌应返回404, 得到 %d", code)
+	}
+
+	content := "probe data"
+	authToken := suite.registerFile(t, "probe.txt", int64(len(content)))
+	if code, ready, retryAfter := probe(authToken); code != http.StatusAccepted || ready || retryAfter == "" {
+		t.Errorf("等待上传端时应返回202与Retry-After, 得到 %d ready=%v Retry-After=%q", code, ready, retryAfter)
+	}
+
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	for i := 0; i < 3; i++ {
+		if code, ready, _ := probe(authToken); code != http.StatusOK || !ready {
+			t.Fatalf("流建立后应返回200 ready, 得到 %d ready=%v", code, ready)
+		}
+	}
+
+	suite.bridge.mu.RLock()
+	status := suite.bridge.fileRegistry[authToken].Status
+	suite.bridge.mu.RUnlock()
+	if status != STATUS_READY {
+		t.Errorf("探测不应改变文件状态, 得到 %q", status)
+	}
+
+	// 多次探测后仍可正常下载
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != content {
+		t.Errorf("下载内容不匹配, 期望 %q, 得到 %q", content, string(body))
+	}
+}
+
+// 测试WebSocket升级的来源检查
+func TestWebSocketOriginCheck(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	dial := func(origin string) (*websocket.Conn, int, error) {
+		t.Helper()
+		authToken := suite.registerFile(t, "ws-origin.txt", 10)
+		wsURL := strings.Replace(suite.bridgeURL, "http", "ws", 1) + "/ws/" + authToken + "?provider_token=" + suite.providerToken(authToken)
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if resp != nil {
+			return conn, resp.StatusCode, err
+		}
+		return conn, 0, err
+	}
+	expectAllowed := func(origin string) {
+		t.Helper()
+		conn, status, err := dial(origin)
+		if err != nil {
+			t.Errorf("来源 %q 应被允许, 得到 %d: %v", origin, status, err)
+			return
+		}
+		conn.Close()
+	}
+	expectRejected := func(origin string) {
+		t.Helper()
+		conn, status, err := dial(origin)
+		if err == nil {
+			conn.Close()
+		}
+		if status != http.StatusForbidden {
+			t.Errorf("来源 %q 应被拒绝并返回403, 得到 %d: %v", origin, status, err)
+		}
+	}
+
+	// 默认：非浏览器客户端与同源页面可以升级，其他来源被拒绝
+	expectAllowed("")
+	expectAllowed(suite.bridgeURL)
+	expectRejected("https://evil.example.com")
+
+	suite.bridge.CORSOrigins = []string{"https://app.example.com"}
+	expectAllowed("https://app.example.com")
+	expectRejected("https://evil.example.com")
+
+	// 宽松模式，用于本地调试
+	suite.bridge.CORSOrigins = []string{"*"}
+	expectAllowed("https://evil.example.com")
+}
+
+// 测试按下载方IP统计的流量报告：按 X-Forwarded-For 识别真实IP，需要管理令牌
+func TestAdminBandwidthReport(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.AdminToken = "admin-secret"
+
+	content := strings.Repeat("b", 40)
+	authToken := suite.registerFile(t, "egress.bin", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	req, _ := http.NewRequest("GET", suite.bridgeURL+"/download/"+authToken, nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	report := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/bandwidth", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		suite.bridge.handleAdminBandwidth(w, req)
+		return w
+	}
+
+	if w := report(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("缺少管理令牌时应返回401, 得到 %d", w.Code)
+	}
+
+	w := report("admin-secret")
+	var result struct {
+		TrackedClients int `json:"tracked_clients"`
+		Clients        []struct {
+			IP    string `json:"ip"`
+			Bytes int64  `json:"bytes"`
+		} `json:"clients"`
+	}
+	json.NewDecoder(w.Body).Decode(&result)
+	if len(result.Clients) != 1 || result.Clients[0].IP != "203.0.113.7" || result.Clients[0].Bytes != int64(len(content)) {
+		t.Fatalf("期望 203.0.113.7 下载 %d 字节, 得到 %+v", len(content), result)
+	}
+
+	// 超出滚动窗口的IP由清理任务移除
+	suite.bridge.mu.Lock()
+	suite.bridge.bandwidthByIP["203.0.113.7"].lastSeen = time.Now().Add(-2 * time.Hour)
+	suite.bridge.mu.Unlock()
+	suite.bridge.cleanupResources()
+	suite.bridge.mu.RLock()
+	remaining := len(suite.bridge.bandwidthByIP)
+	suite.bridge.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("过期的IP流量记录应被清理, 剩余 %d 条", remaining)
+	}
+}
+
+// 测试握手时限可配置：空闲连接按时限断开，分段到达但在时限内完成的握手仍然成功
+func TestHandshakeTimeout(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.HandshakeTimeout = 300 * time.Millisecond
+
+	// 一个字节都不发送的连接在时限后被关闭
+	idleConn, bridgeConn := net.Pipe()
+	defer idleConn.Close()
+	go suite.bridge.handleStreamConnection(bridgeConn)
+	start := time.Now()
+	idleConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idleConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("空闲连接应被服务器关闭, 得到 %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("空闲连接应在握手时限后关闭, 实际耗时 %v", elapsed)
+	}
+
+	// 元数据分两段到达，总耗时仍在时限内
+	suite.bridge.HandshakeTimeout = 2 * time.Second
+	authToken := suite.registerFile(t, "slow.bin", 10)
+	meta, _ := json.Marshal(map[string]string{"auth_token": authToken, "provider_token": suite.providerToken(authToken)})
+	providerConn, bridgeConn := net.Pipe()
+	defer providerConn.Close()
+	go suite.bridge.handleStreamConnection(bridgeConn)
+	providerConn.SetDeadline(time.Now().Add(5 * time.Second))
+	providerConn.Write(meta[:len(meta)/2])
+	time.Sleep(500 * time.Millisecond)
+	providerConn.Write(append(meta[len(meta)/2:], '\n'))
+	reply, err := bufio.NewReader(providerConn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(reply, "STREAM_READY") {
+		t.Fatalf("缓慢但有效的握手应成功, 得到 %q (%v)", reply, err)
+	}
+
+	// 区分"未发送任何数据"与"发送了不完整的数据"
+	_, err = readHandshakeMetadata(bufio.NewReader(strings.NewReader("")))
+	if !errors.Is(err, errHandshakeIdle) {
+		t.Errorf("未发送数据时应返回 errHandshakeIdle, 得到 %v", err)
+	}
+	_, err = readHandshakeMetadata(bufio.NewReader(strings.NewReader(`{"auth_token":`)))
+	if err == nil || errors.Is(err, errHandshakeIdle) {
+		t.Errorf("不完整的元数据不应视为空闲连接, 得到 %v", err)
+	}
+}
+
+// 测试流端口收到HTTP请求时立即回复提示并关闭，不等待握手超时
+func TestHTTPRequestOnStreamPort(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.HandshakeTimeout = 10 * time.Second
+	suite.bridge.HTTPPort = 8000
+
+	for _, request := range []string{
+		"OPTIONS / HTTP/1.1\r\nHost: bridge\r\n\r\n",
+		"GET /status HTTP/1.1\r\n", // 请求头还没发完
+	} {
+		conn, err := suite.streamListener.Dial()
+		if err != nil {
+			t.Fatalf("连接流端口失败: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		go conn.Write([]byte(request))
+		start := time.Now()
+		reply, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("读取提示失败: %v", err)
+		}
+		if !strings.HasPrefix(string(reply), "HTTP/1.0 400") || !strings.Contains(string(reply), "HTTP端口 8000") {
+			t.Errorf("请求 %q 期望收到改用HTTP端口的提示, 得到 %q", request, reply)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("HTTP请求应立即得到回复, 实际耗时 %v", elapsed)
+		}
+	}
+
+	for head, expected := range map[string]bool{
+		"PUT /x":             true,
+		"OPTIO":              true, // TLS记录头只有5字节
+		`{"auth_token":"a"}`: false,
+		"GETX":               false,
+		"GE":                 false,
+	} {
+		if got := looksLikeHTTPRequest([]byte(head)); got != expected {
+			t.Errorf("looksLikeHTTPRequest(%q) 期望 %v, 得到 %v", head, expected, got)
+		}
+	}
+}
+
+// 测试同一令牌的重复流连接：并发握手只有一个成功，其余收到 ALREADY_STREAMING，原有的流正常完成下载
+func TestDuplicateStreamRejected(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "dup.txt", 10)
+	meta, _ := json.Marshal(map[string]string{"auth_token": authToken, "provider_token": suite.providerToken(authToken)})
+	metaLine := append(meta, '\n')
+
+	type handshake struct {
+		conn   net.Conn
+		reader *bufio.Reader
+		reply  string
+	}
+	results := make(chan handshake, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			providerConn, bridgeConn := net.Pipe()
+			go suite.bridge.handleStreamConnection(bridgeConn)
+			providerConn.SetDeadline(time.Now().Add(5 * time.Second))
+			providerConn.Write(metaLine)
+			reader := bufio.NewReader(providerConn)
+			line, _ := reader.ReadString('\n')
+			providerConn.SetDeadline(time.Time{})
+			results <- handshake{providerConn, reader, strings.TrimSpace(line)}
+		}()
+	}
+
+	var winner *handshake
+	replies := []string{}
+	for i := 0; i < 2; i++ {
+		h := <-results
+		defer h.conn.Close()
+		replies = append(replies, h.reply)
+		if h.reply == "STREAM_READY" {
+			winner = &h
+		}
+	}
+	if winner == nil || !slices.Contains(replies, "ALREADY_STREAMING") {
+		t.Fatalf("期望一个 STREAM_READY 与一个 ALREADY_STREAMING, 得到 %v", replies)
+	}
+
+	// 流已建立后再次握手同样被拒绝
+	lateConn, _, reply := suite.handshakeStream(t, authToken)
+	lateConn.Close()
+	if reply != "ALREADY_STREAMING" {
+		t.Errorf("传输中的令牌再次握手期望 ALREADY_STREAMING, 得到 %s", reply)
+	}
+
+	content := "0123456789"
+	go winner.conn.Write([]byte(content))
+	go winner.reader.ReadString('\n')
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("原有的流应完成下载 %q, 得到 %d: %q", content, resp.StatusCode, string(body))
+	}
+}
+
+// 测试文件状态流转：registered → ready → downloading → completed，注册移除后 /status 仍返回终态
+func TestStatusLifecycle(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	status := func(token string) (int, string) {
+		resp, err := http.Get(suite.bridgeURL + "/status/" + token)
+		if err != nil {
+			t.Fatalf("状态查询失败: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Status
+	}
+
+	authToken := suite.registerFile(t, "lifecycle.txt", 10)
+	if _, s := status(authToken); s != STATUS_REGISTERED {
+		t.Fatalf("注册后期望 %s, 得到 %q", STATUS_REGISTERED, s)
+	}
+
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	if _, s := status(authToken); s != STATUS_READY {
+		t.Fatalf("流建立后期望 %s, 得到 %q", STATUS_READY, s)
+	}
+
+	// 先发送一部分数据，收到响应头时下载已在进行中
+	go providerConn.Write([]byte("01234"))
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	if _, s := status(authToken); s != STATUS_DOWNLOADING {
+		t.Errorf("下载中期望 %s, 得到 %q", STATUS_DOWNLOADING, s)
+	}
+	go providerConn.Write([]byte("56789"))
+	go reader.ReadString('\n')
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// 下载完成、资源释放后仍可查询到终态
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		_, exists := suite.bridge.fileRegistry[authToken]
+		suite.bridge.mu.RUnlock()
+		if !exists || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code, s := status(authToken); code != http.StatusOK || s != STATUS_COMPLETED {
+		t.Errorf("完成后期望 200 %s, 得到 %d %q", STATUS_COMPLETED, code, s)
+	}
+
+	// 过期清理的注册报告 expired，超过保留期的终态被清除
+	expiredToken := suite.registerFile(t, "expired.txt", 10)
+	suite.bridge.mu.Lock()
+	suite.bridge.fileRegistry[expiredToken].ExpiresAt = time.Now().Add(-time.Minute)
+	suite.bridge.mu.Unlock()
+	if _, s := status(expiredToken); s != STATUS_EXPIRED {
+		t.Errorf("已过期的注册期望 %s, 得到 %q", STATUS_EXPIRED, s)
+	}
+	suite.bridge.cleanupResources()
+	if _, s := status(expiredToken); s != STATUS_EXPIRED {
+		t.Errorf("过期清理后期望 %s, 得到 %q", STATUS_EXPIRED, s)
+	}
+
+	suite.bridge.mu.Lock()
+	suite.bridge.finishedTransfers[expiredToken].FinishedAt = time.Now().Add(-2 * STATUS_RETENTION)
+	suite.bridge.mu.Unlock()
+	suite.bridge.cleanupResources()
+	if code, _ := status(expiredToken); code != http.StatusNotFound {
+		t.Errorf("超过保留期后期望 404, 得到 %d", code)
+	}
+}
+
+// 测试中继缓冲区大小可配置：缓冲区小于文件时数据分多次转发，内容保持完整
+func TestSendBufferSize(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	if got := suite.bridge.sendBufferSize(); got != DEFAULT_SEND_BUFFER_SIZE {
+		t.Errorf("未配置时期望默认值 %d, 得到 %d", DEFAULT_SEND_BUFFER_SIZE, got)
+	}
+	suite.bridge.SendBufferSize = 7
+
+	content := "the quick brown fox jumps over the lazy dog"
+	authToken := suite.registerFile(t, "small-buffer.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != content {
+		t.Errorf("期望下载 %q, 得到 %q", content, string(body))
+	}
+}
+
+// 测试上传端迟迟未连接时返回503与Retry-After和稳定的错误码，注册保留，上传端连接后重试即可成功
+func TestDownloadRetryAfter(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.DownloadWait = 200 * time.Millisecond
+
+	authToken := suite.registerFile(t, "later.txt", 10)
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("上传端未连接时期望 503, 得到 %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != strconv.Itoa(DOWNLOAD_RETRY_AFTER) {
+		t.Errorf("期望 Retry-After %d, 得到 %q", DOWNLOAD_RETRY_AFTER, got)
+	}
+	if resp.Header.Get("X-FileFlow-Error") != "PROVIDER_NOT_CONNECTED" || !strings.HasPrefix(string(body), "PROVIDER_NOT_CONNECTED:") {
+		t.Errorf("期望错误码 PROVIDER_NOT_CONNECTED, 得到 %q: %q", resp.Header.Get("X-FileFlow-Error"), string(body))
+	}
+
+	content := "0123456789"
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("重试时期望下载 %q, 得到 %d: %q", content, resp.StatusCode, string(body))
+	}
+}
+
+// 测试缓存去重：相同摘要的注册直接复用已缓存的文件，上传端握手时被告知无需发送
+func TestCacheDeduplication(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	cacheDir := t.TempDir()
+	suite.bridge.CacheDir = cacheDir
+	suite.bridge.Dedup = true
+
+	content := "dedup-content-0123456789"
+	digest := sha256.Sum256([]byte(content))
+	sum := hex.EncodeToString(digest[:])
+
+	register := func(filename, sha string) (int, map[string]interface{}) {
+		jsonPayload, _ := json.Marshal(map[string]interface{}{
+			"filename":      filename,
+			"size":          len(content),
+			"max_downloads": 2,
+			"sha256":        sha,
+		})
+		resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+		if err != nil {
+			t.Fatalf("注册请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	if status, _ := register("bad.txt", "not-a-digest"); status != http.StatusBadRequest {
+		t.Errorf("无效摘要期望 %d, 得到 %d", http.StatusBadRequest, status)
+	}
+
+	// 第一次注册没有可复用的缓存，需要正常上传
+	_, first := register("first.txt", sum)
+	if first["deduplicated"] != nil {
+		t.Fatal("首次注册不应命中去重")
+	}
+	firstToken := first["download_token"].(string)
+	providerConn, reader := suite.connectStreamProvider(t, firstToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "TRANSFER_CACHED" {
+		t.Fatalf("期望 TRANSFER_CACHED, 得到 %q (%v)", line, err)
+	}
+
+	// 关闭去重 (默认) 时，知道摘要也不能取得已缓存的内容
+	suite.bridge.Dedup = false
+	_, guessed := register("guessed.txt", sum)
+	if guessed["deduplicated"] != nil {
+		t.Fatalf("未启用去重时不应命中缓存, 响应: %v", guessed)
+	}
+	suite.bridge.removeFileResources(guessed["download_token"].(string))
+
+	// 相同内容的第二次注册直接就绪，上传端握手得到 TRANSFER_CACHED
+	suite.bridge.Dedup = true
+	_, second := register("second.txt", sum)
+	if second["deduplicated"] != true {
+		t.Fatalf("相同摘要的注册应命中去重, 响应: %v", second)
+	}
+	secondToken := second["download_token"].(string)
+	conn, _, reply := suite.handshakeStream(t, secondToken)
+	conn.Close()
+	if reply != "TRANSFER_CACHED" {
+		t.Errorf("去重令牌的握手期望 TRANSFER_CACHED, 得到 %q", reply)
+	}
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + secondToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Fatalf("去重下载期望 200 %q, 得到 %d %q", content, resp.StatusCode, body)
+	}
+
+	// 两个令牌共享同一个缓存文件，释放其中一个不影响另一个
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Errorf("去重后应只有 1 个缓存文件, 实际有 %d 个", len(entries))
+	}
+	suite.bridge.removeFileResources(secondToken)
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 1 {
+		t.Errorf("仍有令牌引用时缓存文件应保留, 实际有 %d 个", len(entries))
+	}
+	suite.bridge.removeFileResources(firstToken)
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("所有引用释放后缓存文件应被删除, 实际有 %d 个", len(entries))
+	}
+	suite.bridge.mu.RLock()
+	indexed := len(suite.bridge.cacheByHash)
+	suite.bridge.mu.RUnlock()
+	if indexed != 0 {
+		t.Errorf("所有引用释放后去重索引应为空, 实际有 %d 项", indexed)
+	}
+}
+
+// 测试非ASCII文件名的Content-Disposition：filename 为ASCII兼容名称，filename* 为百分号编码的UTF-8原名
+func TestContentDispositionUnicodeFilename(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	authToken := suite.registerFile(t, "季度报告 2024.pdf", 0)
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected := `attachment; filename="____ 2024.pdf"; filename*=UTF-8''%E5%AD%A3%E5%BA%A6%E6%8A%A5%E5%91%8A%202024.pdf`
+	if got := resp.Header.Get("Content-Disposition"); got != expected {
+		t.Errorf("Content-Disposition 期望 %q, 得到 %q", expected, got)
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatalf("解析 Content-Disposition 失败: %v", err)
+	}
+	if params["filename"] != "季度报告 2024.pdf" {
+		t.Errorf("按 RFC 5987 解码的文件名期望 %q, 得到 %q", "季度报告 2024.pdf", params["filename"])
+	}
+}
+
+// 测试长轮询：多个等待者在传输完成时同时返回最终状态，超时返回当前状态
+func TestWaitForTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	wait := func(token, timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/wait/"+token+"?timeout="+timeout, nil)
+		req = mux.SetURLVars(req, map[string]string{"auth_token": token})
+		w := httptest.NewRecorder()
+		suite.bridge.handleWaitTransfer(w, req)
+		return w
+	}
+	statusOf := func(w *httptest.ResponseRecorder) string {
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		status, _ := body["status"].(string)
+		return status
+	}
+
+	if w := wait("missing", "5"); w.Code != http.StatusNotFound {
+		t.Errorf("不存在的令牌期望 404, 得到 %d", w.Code)
+	}
+	if w := wait("missing", "abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("无效的 timeout 期望 400, 得到 %d", w.Code)
+	}
+
+	content := "long-poll content"
+	authToken := suite.registerFile(t, "wait.txt", int64(len(content)))
+
+	start := time.Now()
+	if w := wait(authToken, "0"); statusOf(w) != STATUS_REGISTERED || time.Since(start) > time.Second {
+		t.Errorf("超时后应立即返回当前状态, 得到 %q", statusOf(w))
+	}
+
+	const waiters = 3
+	results := make(chan string, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() { results <- statusOf(wait(authToken, "10")) }()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		suite.bridge.mu.RLock()
+		_, registered := suite.bridge.transferDone[authToken]
+		suite.bridge.mu.RUnlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("等待者未注册通知通道")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for i := 0; i < waiters; i++ {
+		select {
+		case status := <-results:
+			if status != STATUS_COMPLETED {
+				t.Errorf("传输完成后期望状态 %s, 得到 %q", STATUS_COMPLETED, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("传输完成后等待者未返回")
+		}
+	}
+}
+
+// 测试文件修改时间：注册与握手中的 mtime 作为下载的 Last-Modified，握手中的值优先
+func TestModTimeAsLastModified(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	registered := time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)
+	handshake := registered.Add(time.Hour)
+	content := "mtime content"
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{
+		"filename": "mtime.txt",
+		"size":     len(content),
+		"mtime":    registered.Unix(),
+	})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	var registerResp struct {
+		AuthToken string `json:"auth_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&registerResp)
+	resp.Body.Close()
+	authToken := registerResp.AuthToken
+
+	resp, err = http.Get(suite.bridgeURL + "/status/" + authToken)
+	if err != nil {
+		t.Fatalf("状态请求失败: %v", err)
+	}
+	var status map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status["mtime"] != registered.Format(time.RFC3339) {
+		t.Errorf("/status 的 mtime 期望 %s, 得到 %v", registered.Format(time.RFC3339), status["mtime"])
+	}
+
+	providerConn, reader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     authToken,
+		"provider_token": suite.providerToken(authToken),
+		"mtime":          fmt.Sprint(handshake.Unix()),
+	})
+	defer providerConn.Close()
+	if reply != "STREAM_READY" {
+		t.Fatalf("期望 STREAM_READY, 得到 %q", reply)
+	}
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	lastModified := resp.Header.Get("Last-Modified")
+	if lastModified != "Fri, 01 Mar 2024 09:30:00 GMT" {
+		t.Errorf("Last-Modified 应为RFC 1123格式的握手 mtime, 得到 %q", lastModified)
+	}
+	if parsed, err := http.ParseTime(lastModified); err != nil || !parsed.Equal(handshake) {
+		t.Errorf("Last-Modified 解析失败或不一致: %v (%v)", parsed, err)
+	}
+}
+
+// 测试分块下载：不声明Content-Length；上传流提前结束时中止响应，下载方不会把截断的数据当作完整文件
+func TestChunkedDownload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	register := func(filename string, size int, chunked bool) string {
+		jsonPayload, _ := json.Marshal(map[string]interface{}{
+			"filename": filename,
+			"size":     size,
+			"chunked":  chunked,
+		})
+		resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+		if err != nil {
+			t.Fatalf("注册请求失败: %v", err)
+		}
+		defer resp.Body.Close()
+		var registerResp struct {
+			AuthToken string `json:"auth_token"`
+			Chunked   bool   `json:"chunked"`
+		}
+		json.NewDecoder(resp.Body).Decode(&registerResp)
+		if registerResp.Chunked != chunked {
+			t.Errorf("注册响应的 chunked 期望 %v, 得到 %v", chunked, registerResp.Chunked)
+		}
+		return registerResp.AuthToken
+	}
+
+	content := "chunked-download-content"
+	authToken := register("chunked.txt", len(content), true)
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != content {
+		t.Fatalf("分块下载期望 %q, 得到 %q (%v)", content, body, err)
+	}
+	if resp.ContentLength != -1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("分块下载不应声明长度, 得到 Content-Length %d, Transfer-Encoding %v", resp.ContentLength, resp.TransferEncoding)
+	}
+
+	// 服务器默认开启时，注册可以单独关闭
+	suite.bridge.ChunkedDownloads = true
+	authToken = register("sized.txt", len(content), false)
+	providerConn2, reader2 := suite.connectStreamProvider(t, authToken)
+	defer providerConn2.Close()
+	go providerConn2.Write([]byte(content))
+	go reader2.ReadString('\n')
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ContentLength != int64(len(content)) {
+		t.Errorf("关闭分块的注册期望 Content-Length %d, 得到 %d", len(content), resp.ContentLength)
+	}
+
+	// 上传流提前结束
+	authToken = register("short.txt", 20, true)
+	providerConn3, _ := suite.connectStreamProvider(t, authToken)
+	go func() {
+		providerConn3.Write([]byte("0123456789"))
+		providerConn3.Close()
+	}()
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Error("分块下载的上传流提前结束时下载方应收到错误")
+	}
+}
+
+// 测试自定义元数据：注册时附带，/status 原样返回，下载时作为 X-FileFlow-Meta-* 响应头；非法的键值被拒绝
+func TestCustomMetadata(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	register := func(metadata interface{}) *http.Response {
+		payload, _ := json.Marshal(map[string]interface{}{"filename": "meta.txt", "size": 4, "metadata": metadata})
+		resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("注册请求失败: %v", err)
+		}
+		return resp
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= MAX_METADATA_KEYS; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	for name, metadata := range map[string]map[string]string{
+		"换行注入":  {"project": "x\r\nSet-Cookie: a=b"},
+		"非法键":   {"bad key": "v"},
+		"响应头重复": {"uploaded_by": "a", "Uploaded-By": "b"},
+		"键过多":   tooMany,
+		"总大小超限": {"big": strings.Repeat("v", MAX_METADATA_SIZE)},
+	} {
+		resp := register(metadata)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: 期望 400, 得到 %d", name, resp.StatusCode)
+		}
+	}
+
+	metadata := map[string]string{"project": "apollo", "uploaded_by": "ci-bot", "备注": "ok", "note": "中文说明"}
+	resp := register(metadata)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("非ASCII键期望 400, 得到 %d", resp.StatusCode)
+	}
+	delete(metadata, "备注")
+	resp = register(metadata)
+	var reg struct {
+		AuthToken string `json:"auth_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("注册期望 200, 得到 %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(suite.bridgeURL + "/status/" + reg.AuthToken)
+	if err != nil {
+		t.Fatalf("状态查询失败: %v", err)
+	}
+	var status struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status.Metadata) != len(metadata) || status.Metadata["note"] != "中文说明" || status.Metadata["uploaded_by"] != "ci-bot" {
+		t.Errorf("/status 应原样返回 metadata, 得到 %v", status.Metadata)
+	}
+
+	providerConn, _ := suite.connectStreamProvider(t, reg.AuthToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte("data"))
+	resp, err = http.Get(suite.bridgeURL + "/download/" + reg.AuthToken)
+	if err != nil {
+		t.Fatalf("下载失败: %v", err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("X-FileFlow-Meta-Project"); got != "apollo" {
+		t.Errorf("X-FileFlow-Meta-Project 期望 apollo, 得到 %q", got)
+	}
+	if got := resp.Header.Get("X-FileFlow-Meta-Uploaded-By"); got != "ci-bot" {
+		t.Errorf("X-FileFlow-Meta-Uploaded-By 期望 ci-bot, 得到 %q", got)
+	}
+	if _, ok := resp.Header[http.CanonicalHeaderKey("X-FileFlow-Meta-Note")]; ok {
+		t.Error("含非ASCII字符的值不应写入响应头")
+	}
+}
+
+// 测试同一实时流的并发下载：两个下载方同时等到流连接时只有一个读取，另一个收到409，内容不被交错读取
+func TestConcurrentDownloadsOfLiveStream(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := strings.Repeat("0123456789", 8)
+	payload, _ := json.Marshal(map[string]interface{}{"filename": "shared.txt", "size": len(content), "max_downloads": 2})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	var reg struct {
+		AuthToken string `json:"auth_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+
+	type result struct {
+		status int
+		body   string
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(suite.bridgeURL + "/download/" + reg.AuthToken)
+			if err != nil {
+				results <- result{}
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			results <- result{resp.StatusCode, string(body)}
+		}()
+	}
+
+	// 两个下载方都在等待上传端时建立流，然后分段缓慢写入
+	time.Sleep(100 * time.Millisecond)
+	providerConn, _ := suite.connectStreamProvider(t, reg.AuthToken)
+	defer providerConn.Close()
+	go func() {
+		for i := 0; i < len(content); i += 10 {
+			providerConn.Write([]byte(content[i : i+10]))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	statuses := map[int]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-results:
+			statuses[res.status]++
+			if res.status == http.StatusOK && res.body != content {
+				t.Errorf("成功的下载内容不完整: %q", res.body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("并发下载未返回")
+		}
+	}
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusConflict] != 1 {
+		t.Errorf("期望一个 200 与一个 409, 得到 %v", statuses)
+	}
+}
+
+// 测试上传端发送完毕后半关闭写端：内容逐字节完整到达下载方，健康检查不把半关闭视为断线，
+// 上传端读到结果通知之后得到正常的EOF而不是RST
+func TestHalfCloseTransfer(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.healthCheckInterval = 50 * time.Millisecond
+	suite.bridge.MaxFileSize = 16 * 1024 * 1024
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go suite.bridge.handleStreamConnection(conn)
+		}
+	}()
+
+	transfer := func(t *testing.T, size int, waitBeforeDownload time.Duration) {
+		content := make([]byte, size)
+		rand.Read(content)
+		authToken := suite.registerFile(t, "half-close.bin", int64(size))
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("连接TCP流端口失败: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		meta, _ := json.Marshal(map[string]string{"auth_token": authToken, "provider_token": suite.providerToken(authToken)})
+		conn.Write(append(meta, '\n'))
+		reader := bufio.NewReader(conn)
+		if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "STREAM_READY" {
+			t.Fatalf("期望 STREAM_READY, 得到 %q (%v)", line, err)
+		}
+
+		writeErr := make(chan error, 1)
+		go func() {
+			if _, err := conn.Write(content); err != nil {
+				writeErr <- err
+				return
+			}
+			writeErr <- conn.(*net.TCPConn).CloseWrite()
+		}()
+		time.Sleep(waitBeforeDownload)
+
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			t.Fatalf("下载请求失败: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("下载失败: 状态码 %d, %v", resp.StatusCode, err)
+		}
+		if len(body) != size || !bytes.Equal(body, content) {
+			t.Fatalf("下载内容与发送内容不一致: 期望 %d 字节, 得到 %d 字节", size, len(body))
+		}
+		if err := <-writeErr; err != nil {
+			t.Fatalf("发送数据失败: %v", err)
+		}
+
+		if line, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "TRANSFER_COMPLETE" {
+			t.Fatalf("期望 TRANSFER_COMPLETE, 得到 %q (%v)", line, err)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("结果通知之后期望连接正常关闭 (EOF), 得到 %v", err)
+		}
+	}
+
+	t.Run("LargeFile", func(t *testing.T) {
+		transfer(t, 8*1024*1024, 0)
+	})
+	t.Run("HalfClosedWhileWaiting", func(t *testing.T) {
+		// 小文件在下载方到达之前就已全部发出并半关闭，期间经过多次健康检查
+		transfer(t, 4096, 300*time.Millisecond)
+	})
+}
+
+// 测试按需发送：下载方占用流之后服务器才通知上传端开始发送；
+// 文件在注册之后变大，下载不声明长度，得到上传端发送的全部内容
+func TestOnDemandStream(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	content := "contents at download time, appended after registration"
+	authToken := suite.registerFile(t, "live.log", 8)
+	providerConn, reader, reply := suite.handshakeStreamWithMeta(t, map[string]string{
+		"auth_token":     authToken,
+		"provider_token": suite.providerToken(authToken),
+		STREAM_ON_DEMAND: "true",
+	})
+	defer providerConn.Close()
+	if reply != "STREAM_READY "+STREAM_ON_DEMAND {
+		t.Fatalf("期望服务器回显 %s, 得到 %q", STREAM_ON_DEMAND, reply)
+	}
+
+	// 下载方到达之前上传端不会收到通知
+	providerConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if line, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("下载方到达之前不应收到通知, 得到 %q", line)
+	}
+
+	type result struct {
+		body          string
+		contentLength int64
+		err           error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{string(body), resp.ContentLength, err}
+	}()
+
+	providerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "DOWNLOAD_STARTED" {
+		t.Fatalf("期望收到 DOWNLOAD_STARTED, 得到 %q (%v)", line, err)
+	}
+	providerConn.SetReadDeadline(time.Time{})
+	// 发送完毕后关闭连接，服务器读到EOF即知数据结束
+	go func() {
+		providerConn.Write([]byte(content))
+		providerConn.Close()
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.body != content {
+			t.Errorf("下载内容期望 %q, 得到 %q (%v)", content, res.body, res.err)
+		}
+		if res.contentLength != -1 {
+			t.Errorf("按需发送的下载不应声明长度, 得到 Content-Length %d", res.contentLength)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("按需发送的下载未完成")
+	}
+}
+
+// 测试打包下载：多个令牌的内容实时写成一个zip，同名文件加序号区分，每个令牌消耗一次下载
+func TestZipDownload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	first := suite.registerFile(t, "notes.txt", 5)
+	second := suite.registerFile(t, "notes.txt", 6)
+	empty := suite.registerFile(t, "empty.bin", 0)
+	tokens := strings.Join([]string{first, second, empty}, ",")
+
+	get := func(query string) *http.Response {
+		resp, err := http.Get(suite.bridgeURL + "/download-zip?" + query)
+		if err != nil {
+			t.Fatalf("打包下载请求失败: %v", err)
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"tokens=" + first + "," + first, http.StatusBadRequest},
+		{"tokens=missing," + first, http.StatusNotFound},
+		{"tokens=" + tokens, http.StatusServiceUnavailable}, // 上传端均未连接
+	} {
+		resp := get(tc.query)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("查询 %q 期望状态码 %d, 得到 %d", tc.query, tc.status, resp.StatusCode)
+		}
+	}
+
+	contents := map[string]string{first: "hello", second: "world!"}
+	for _, token := range []string{first, second, empty} {
+		providerConn, reader := suite.connectStreamProvider(t, token)
+		defer providerConn.Close()
+		if content := contents[token]; content != "" {
+			go providerConn.Write([]byte(content))
+		}
+		go reader.ReadString('\n')
+	}
+
+	resp := get("tokens=" + tokens)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("读取打包内容失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("期望状态码 200, 得到 %d: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("Content-Type 期望 application/zip, 得到 %s", ct)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("解析zip失败: %v", err)
+	}
+	want := []struct{ name, content string }{{"notes.txt", "hello"}, {"notes (2).txt", "world!"}, {"empty.bin", ""}}
+	if len(archive.File) != len(want) {
+		t.Fatalf("期望 %d 个条目, 得到 %d", len(want), len(archive.File))
+	}
+	for i, f := range archive.File {
+		if f.Name != want[i].name || f.Method != zip.Store {
+			t.Errorf("条目 %d 期望 %s (STORE), 得到 %s (方法 %d)", i, want[i].name, f.Name, f.Method)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("打开条目 %s 失败: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(data) != want[i].content {
+			t.Errorf("条目 %s 期望内容 %q, 得到 %q (%v)", f.Name, want[i].content, data, err)
+		}
+	}
+
+	// 各令牌按单次下载的规则被消耗
+	resp = get("tokens=" + tokens)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("令牌已消耗后期望 410 或 404, 得到 %d", resp.StatusCode)
+	}
+
+	// 条目中途失败时中止连接，下载方不会得到看似完整的压缩包
+	short := suite.registerFile(t, "short.txt", 10)
+	shortConn, _ := suite.connectStreamProvider(t, short)
+	go func() {
+		shortConn.Write([]byte("01234"))
+		shortConn.Close()
+	}()
+	resp = get("tokens=" + short)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		t.Error("条目未完整写入时下载方应收到错误")
+	}
+}
+
+// 测试打包下载在写出数据前占用全部条目：其他下载方不能取走后面的条目，任一条目不可用时已占用的条目被释放
+func TestZipDownloadClaimsAllEntries(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	first := suite.registerFile(t, "first.txt", 5)
+	second := suite.registerFile(t, "second.txt", 6)
+	missing := suite.registerFile(t, "missing.txt", 7)
+	status := func(token string) string {
+		suite.bridge.mu.RLock()
+		defer suite.bridge.mu.RUnlock()
+		return suite.bridge.fileRegistry[token].Status
+	}
+
+	firstConn, firstReader := suite.connectStreamProvider(t, first)
+	defer firstConn.Close()
+	go firstReader.ReadString('\n')
+	secondConn, secondReader := suite.connectStreamProvider(t, second)
+	defer secondConn.Close()
+	go secondConn.Write([]byte("world!"))
+	go secondReader.ReadString('\n')
+
+	// 上传端未连接的条目使打包下载失败，已占用的条目恢复原状态
+	before := status(first)
+	resp, err := http.Get(suite.bridgeURL + "/download-zip?tokens=" + first + "," + missing)
+	if err != nil {
+		t.Fatalf("打包下载请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("期望状态码 %d, 得到 %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if got := status(first); got != before {
+		t.Fatalf("打包下载失败后 %s 的状态期望 %s, 得到 %s", first, before, got)
+	}
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(suite.bridgeURL + "/download-zip?tokens=" + first + "," + second)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{body, err}
+	}()
+
+	// 第一个条目等待上传端发送数据时，第二个条目已被打包下载占用
+	deadline := time.Now().Add(5 * time.Second)
+	for status(first) != STATUS_DOWNLOADING {
+		if time.Now().After(deadline) {
+			t.Fatal("打包下载未开始")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, err = http.Get(suite.bridgeURL + "/download/" + second)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("已被打包下载占用的条目期望 409, 得到 %d", resp.StatusCode)
+	}
+
+	firstConn.Write([]byte("hello"))
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("读取打包内容失败: %v", res.err)
+		}
+		archive, err := zip.NewReader(bytes.NewReader(res.body), int64(len(res.body)))
+		if err != nil {
+			t.Fatalf("解析zip失败: %v", err)
+		}
+		if len(archive.File) != 2 {
+			t.Fatalf("期望 2 个条目, 得到 %d", len(archive.File))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("打包下载未完成")
+	}
+}
+
+// 测试令牌枚举防护：不存在的令牌延迟响应，同一IP查找失败过多后下载与状态查询返回429，其他IP不受影响
+func TestTokenLookupBruteForceMitigation(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.NotFoundDelay = 100 * time.Millisecond
+	suite.bridge.MaxFailedLookups = 3
+
+	authToken := suite.registerFile(t, "guarded.txt", 10)
+	get := func(path, forwardedFor string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", suite.bridgeURL+path, nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("请求失败: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	start := time.Now()
+	for i, path := range []string{"/download/missing1", "/status/missing2", "/download/missing3?probe=1"} {
+		if resp := get(path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("第 %d 次失败查找期望 404, 得到 %d", i+1, resp.StatusCode)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("不存在的令牌应延迟响应, 3 次查找只用了 %v", elapsed)
+	}
+
+	// 达到上限后，即使是有效令牌也被拒绝
+	for _, path := range []string{"/download/missing4", "/status/" + authToken, "/download/" + authToken} {
+		resp := get(path, "")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s: 期望 429, 得到 %d", path, resp.StatusCode)
+		}
+		if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retry < 1 || retry > 60 {
+			t.Errorf("%s: Retry-After 应在 1-60 秒之间, 得到 %q", path, resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// 经由可信代理的其他下载方IP单独计数
+	if resp := get("/status/"+authToken, "203.0.113.9"); resp.StatusCode != http.StatusOK {
+		t.Errorf("其他IP的查找不应受影响, 得到 %d", resp.StatusCode)
+	}
+
+	// 窗口结束后恢复，并由清理任务移除记录
+	suite.bridge.mu.Lock()
+	for _, failures := range suite.bridge.failedLookups {
+		failures.windowStart = failures.windowStart.Add(-FAILED_LOOKUP_WINDOW)
+	}
+	suite.bridge.mu.Unlock()
+	if resp := get("/status/"+authToken, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("窗口结束后期望 200, 得到 %d", resp.StatusCode)
+	}
+	suite.bridge.cleanupResources()
+	suite.bridge.mu.RLock()
+	remaining := len(suite.bridge.failedLookups)
+	suite.bridge.mu.RUnlock()
+	if remaining != 0 {
+		t.Errorf("清理后应不再保留已结束窗口的记录, 剩余 %d", remaining)
+	}
+}
+
+// 测试在途字节上限：等待下载方的流不占用预算，不会拖住其他流的传输
+func TestInflightBudgetIgnoresWaitingStreams(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.MaxInflightBytes = 64
+
+	// 第一个流发送了数据但一直没有下载方
+	waitingContent := strings.Repeat("w", 60)
+	waitingToken := suite.registerFile(t, "waiting.txt", int64(len(waitingContent)))
+	waitingConn, _ := suite.connectStreamProvider(t, waitingToken)
+	defer waitingConn.Close()
+	go waitingConn.Write([]byte(waitingContent))
+
+	content := strings.Repeat("d", 60)
+	authToken := suite.registerFile(t, "download.txt", int64(len(content)))
+	providerConn, _ := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	time.Sleep(100 * time.Millisecond)
+	if used := suite.bridge.inflight.current(); used != 0 {
+		t.Errorf("等待下载方的流不应占用在途预算, 当前 %d 字节", used)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败 (可能被等待中的流占用的预算拖住): %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != content {
+		t.Fatalf("下载内容不一致: %q (%v)", body, err)
+	}
+}
+
+// 测试内存传输：注册、经接受循环建立流、下载真实字节，全程不绑定任何端口
+func TestMemoryStreamTransport(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+
+	listener, err := suite.bridge.listenStream()
+	if err != nil || listener != net.Listener(suite.streamListener) {
+		t.Fatalf("期望使用注入的内存监听器, 得到 %v (%v)", listener, err)
+	}
+
+	content := []byte("in-memory stream leg")
+	authToken := suite.registerFile(t, "memory.txt", int64(len(content)))
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	suite.bridge.mu.RLock()
+	stream, ok := suite.bridge.activeStreams[authToken].(*StreamConnection)
+	suite.bridge.mu.RUnlock()
+	if !ok || stream.Conn == nil {
+		t.Fatalf("活跃流应为该令牌的 *StreamConnection, 得到 %T", suite.bridge.activeStreams[authToken])
+	}
+
+	go providerConn.Write(content)
+	result := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		result <- strings.TrimSpace(line)
+	}()
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, content) {
+		t.Fatalf("下载内容不匹配, 期望 %q, 得到 %q", content, body)
+	}
+	select {
+	case line := <-result:
+		if line != "TRANSFER_COMPLETE" {
+			t.Errorf("期望 TRANSFER_COMPLETE, 得到 %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("上传端未收到结果通知")
+	}
+
+	// 关闭后不再接受连接，接受循环按正常停止退出
+	suite.cleanup()
+	if _, err := suite.streamListener.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("监听关闭后期望 net.ErrClosed, 得到 %v", err)
+	}
+}
+
+// 测试口令模式：下载令牌为单词口令，并可直接用于下载路由
+func TestWordCodeDownload(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.WordCodes = true
+
+	content := "口令模式下载"
+	authToken := suite.registerFile(t, "word.txt", int64(len(content)))
+	if !regexp.MustCompile(`^[1-9][0-9]{0,2}-[a-z]+-[a-z]+$`).MatchString(authToken) {
+		t.Fatalf("口令格式不符: %q", authToken)
+	}
+
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+
+	resp, err := http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != content {
+		t.Fatalf("期望通过口令下载 %q, 得到 %d %q", content, resp.StatusCode, string(body))
+	}
+}
+
+// 测试维护暂停：拒绝新的注册与流连接，已建立的传输继续完成
+func TestAdminPauseResume(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.AdminToken = "admin-secret"
+
+	admin := func(handler http.HandlerFunc, token string) int {
+		req := httptest.NewRequest("POST", "/admin/pause", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	content := "暂停前已建立的传输"
+	authToken := suite.registerFile(t, "active.txt", int64(len(content)))
+	idleToken := suite.registerFile(t, "idle.txt", 10)
+	providerConn, reader := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	if code := admin(suite.bridge.handleAdminPause, "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("错误的管理令牌期望 %d, 得到 %d", http.StatusUnauthorized, code)
+	}
+	// 查询参数只对事件流有效
+	queryReq := httptest.NewRequest("POST", "/admin/pause?admin_token=admin-secret", nil)
+	queryRec := httptest.NewRecorder()
+	suite.bridge.handleAdminPause(queryRec, queryReq)
+	if queryRec.Code != http.StatusUnauthorized {
+		t.Fatalf("通过查询参数传递管理令牌期望 %d, 得到 %d", http.StatusUnauthorized, queryRec.Code)
+	}
+	if code := admin(suite.bridge.handleAdminPause, "admin-secret"); code != http.StatusOK {
+		t.Fatalf("暂停请求期望 %d, 得到 %d", http.StatusOK, code)
+	}
+
+	jsonPayload, _ := json.Marshal(map[string]interface{}{"filename": "new.txt", "size": 10})
+	resp, err := http.Post(suite.bridgeURL+"/register", "application/json", bytes.NewReader(jsonPayload))
+	if err != nil {
+		t.Fatalf("注册请求失败: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("暂停期间注册期望 %d, 得到 %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	conn, _, reply := suite.handshakeStream(t, idleToken)
+	conn.Close()
+	if reply != "SERVER_PAUSED" {
+		t.Errorf("暂停期间新的流握手期望 SERVER_PAUSED, 得到 %q", reply)
+	}
+
+	// 已建立的流不受影响
+	go providerConn.Write([]byte(content))
+	go reader.ReadString('\n')
+	resp, err = http.Get(suite.bridgeURL + "/download/" + authToken)
+	if err != nil {
+		t.Fatalf("下载请求失败: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != content {
+		t.Errorf("暂停期间已建立的传输应继续, 得到 %d %q", resp.StatusCode, string(body))
+	}
+
+	if code := admin(suite.bridge.handleAdminResume, "admin-secret"); code != http.StatusOK {
+		t.Fatalf("恢复请求期望 %d, 得到 %d", http.StatusOK, code)
+	}
+	suite.registerFile(t, "resumed.txt", 10)
+}
+
+// 测试SSE事件推送：订阅者收到注册与建立流事件，超过上限的订阅被拒绝，断开后释放名额
+func TestEventStream(t *testing.T) {
+	suite := createIntegrationTestSuite(t)
+	defer suite.cleanup()
+	suite.bridge.AdminToken = "admin-secret"
+	suite.bridge.MaxEventSubscribers = 1
+	suite.bridge.events = newEventBus()
+
+	eventServer := httptest.NewServer(http.HandlerFunc(suite.bridge.handleEvents))
+	defer eventServer.Close()
+
+	if resp, err := http.Get(eventServer.URL); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("缺少管理令牌期望 %d, 得到 %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", eventServer.URL+"?admin_token=admin-secret", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("订阅事件失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("期望 text/event-stream, 得到 %q", ct)
+	}
+
+	second, err := http.Get(eventServer.URL + "?admin_token=admin-secret")
+	if err != nil {
+		t.Fatalf("第二个订阅请求失败: %v", err)
+	}
+	second.Body.Close()
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("超过订阅者上限期望 %d, 得到 %d", http.StatusServiceUnavailable, second.StatusCode)
+	}
+
+	authToken := suite.registerFile(t, "events.txt", 10)
+	providerConn, _ := suite.connectStreamProvider(t, authToken)
+	defer providerConn.Close()
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for _, want := range []string{"event: registered", "event: stream_established"} {
+		deadline := time.After(2 * time.Second)
+	wait:
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("事件流提前结束, 未收到 %q", want)
+				}
+				if line == want {
+					break wait
+				}
+			case <-deadline:
+				t.Fatalf("未收到 %q", want)
+			}
+		}
+	}
+
+	// 订阅者断开后释放名额
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for suite.bridge.events.count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("断开的订阅者未被移除")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"math"
 	"math/big"
+	mrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -25,30 +42,696 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"golang.org/x/text/unicode/norm"
 )
 
 // 文件元数据结构
+// 文件状态：registered 等待上传端连接 → ready 流已建立（或已缓存），等待下载方 → downloading 下载中，
+// 最终为 completed / expired / aborted 之一。多次下载的分享在每次下载完成后回到 registered
+const (
+	STATUS_REGISTERED  = "registered"
+	STATUS_READY       = "ready"
+	STATUS_DOWNLOADING = "downloading"
+	STATUS_COMPLETED   = "completed"
+	STATUS_EXPIRED     = "expired"
+	STATUS_ABORTED     = "aborted"
+)
+
+// 注册移除后终态的保留时长，期间 /status 仍能查询到传输结果
+const STATUS_RETENTION = 10 * time.Minute
+
+// 已结束传输的终态记录
+type finishedTransfer struct {
+	Filename         string
+	OriginalFilename string
+	Size             int64
+	Status           string
+	FinishedAt       time.Time
+}
+
 type FileMetadata struct {
-	Filename         string    `json:"filename"`
-	OriginalFilename string    `json:"original_filename"`
-	Size             int64     `json:"size"`
-	Status           string    `json:"status"`
-	ClientIP         string    `json:"client_ip"`
-	AuthToken        string    `json:"auth_token"`
-	RegisteredAt     time.Time `json:"registered_at"`
-	ExpiresAt        time.Time `json:"expires_at"`
-	StreamStarted    time.Time `json:"stream_started,omitempty"`
-	ClientAddress    string    `json:"client_address,omitempty"`
+	Filename         string            `json:"filename"`
+	OriginalFilename string            `json:"original_filename"`
+	Size             int64             `json:"size"`
+	Status           string            `json:"status"`
+	ClientIP         string            `json:"client_ip"`
+	AuthToken        string            `json:"auth_token"`
+	RegisteredAt     time.Time         `json:"registered_at"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+	StreamStarted    time.Time         `json:"stream_started,omitempty"`
+	ClientAddress    string            `json:"client_address,omitempty"`
+	CachePath        string            `json:"-"`                          // 缓存模式下上传流的本地缓存文件
+	MaxDownloads     int               `json:"max_downloads"`              // 允许完整下载的次数
+	DownloadCount    int               `json:"download_count"`             // 已完整下载的次数
+	MaxRate          int64             `json:"max_rate"`                   // 该分享的下载限速 (字节/秒)，0 表示不限速
+	Compression      string            `json:"compression,omitempty"`      // 上传流在TCP链路上的压缩方式，空值表示未压缩
+	FrameChunkSize   int               `json:"frame_chunk_size,omitempty"` // 分块校验的块大小 (字节)，0 表示未分块
+	ProviderToken    string            `json:"-"`                          // 上传端凭证，仅在注册响应中返回一次，不随下载链接公开
+	SHA256           string            `json:"sha256,omitempty"`           // 上传端声明的内容摘要 (十六进制)，用于缓存去重
+	Deduplicated     bool              `json:"deduplicated,omitempty"`     // 注册时已命中相同内容的缓存，无需再次上传
+	ModTime          time.Time         `json:"mtime,omitempty"`            // 上传端提供的文件修改时间，下载时作为 Last-Modified
+	Chunked          bool              `json:"chunked,omitempty"`          // 实时转发的下载不声明Content-Length，使用分块传输编码
+	Metadata         map[string]string `json:"metadata,omitempty"`         // 注册时附带的自定义键值，/status 返回，下载时作为 X-FileFlow-Meta-* 响应头
+
+	sessions map[string]*downloadSession // 缓存模式下未完成的下载会话，按会话ID索引
+}
+
+// 下载响应的 Last-Modified：优先使用上传端提供的文件修改时间，没有时使用注册时间
+func (m *FileMetadata) lastModified() time.Time {
+	if !m.ModTime.IsZero() {
+		return m.ModTime
+	}
+	return m.RegisteredAt
+}
+
+// 缓存模式的下载会话：开始下载即占用一次下载次数，完整交付后才计入完成；断线后携带会话ID续传
+type downloadSession struct {
+	startedAt  time.Time
+	lastActive time.Time
+	inflight   int        // 正在进行中的请求数，大于0时会话不会过期
+	delivered  byteRanges // 缓存模式下已完整交付的字节区间，覆盖整个文件才算一次完整下载
+}
+
+// 已交付的字节区间 [start, end)，按起点排序且互不重叠
+type byteRanges [][2]int64
+
+// add 加入区间 [start, end)，与重叠或相邻的区间合并
+func (br byteRanges) add(start, end int64) byteRanges {
+	if start >= end {
+		return br
+	}
+	merged := make(byteRanges, 0, len(br)+1)
+	inserted := false
+	for _, r := range br {
+		switch {
+		case r[1] < start:
+			merged = append(merged, r)
+		case r[0] > end:
+			if !inserted {
+				merged = append(merged, [2]int64{start, end})
+				inserted = true
+			}
+			merged = append(merged, r)
+		default:
+			start, end = min(start, r[0]), max(end, r[1])
+		}
+	}
+	if !inserted {
+		merged = append(merged, [2]int64{start, end})
+	}
+	return merged
+}
+
+// covers 区间是否覆盖了 [0, size)
+func (br byteRanges) covers(size int64) bool {
+	return size <= 0 || (len(br) > 0 && br[0][0] <= 0 && br[0][1] >= size)
 }
 
 // 服务器统计信息
 type ServerStats struct {
-	StartTime         time.Time `json:"start_time"`
-	FilesRegistered   int       `json:"files_registered"`
-	FilesTransferred  int       `json:"files_transferred"`
-	BytesTransferred  int64     `json:"bytes_transferred"`
-	ActiveConnections int       `json:"active_connections"`
-	PeakConnections   int       `json:"peak_connections"`
+	StartTime            time.Time `json:"start_time"`
+	FilesRegisteredTotal int       `json:"files_registered_total"` // 累计注册数，只增不减
+	FilesTransferred     int       `json:"files_transferred"`
+	FilesExpiredTotal    int       `json:"files_expired_total"`   // 累计因过期被清理的注册数
+	FilesCompletedTotal  int       `json:"files_completed_total"` // 累计完整下载完成的注册数
+	FilesTruncatedTotal  int       `json:"files_truncated_total"` // 累计因上传流提前结束而失败的传输数
+	BytesTransferred     int64     `json:"bytes_transferred"`
+	ActiveConnections    int       `json:"active_connections"`
+	PeakConnections      int       `json:"peak_connections"`
+	PeakBytesPerSec      float64   `json:"peak_bytes_per_sec"`
+}
+
+// 持久化的累计统计：只包含计数器与峰值，不包含活跃连接数等实时值
+type persistedStats struct {
+	Since                time.Time `json:"since"` // 开始累计的时间，即首次启用持久化的启动时间
+	SavedAt              time.Time `json:"saved_at"`
+	FilesRegisteredTotal int       `json:"files_registered_total"`
+	FilesTransferred     int       `json:"files_transferred"`
+	FilesExpiredTotal    int       `json:"files_expired_total"`
+	FilesCompletedTotal  int       `json:"files_completed_total"`
+	FilesTruncatedTotal  int       `json:"files_truncated_total"`
+	BytesTransferred     int64     `json:"bytes_transferred"`
+	PeakConnections      int       `json:"peak_connections"`
+	PeakBytesPerSec      float64   `json:"peak_bytes_per_sec"`
+}
+
+// 吞吐量采样窗口：中继循环最多按此间隔更新一次吞吐量，避免每个数据块都加锁
+const THROUGHPUT_SAMPLE_INTERVAL = 500 * time.Millisecond
+
+// TCP流连接的默认握手时限：TLS握手与元数据读取各自不得超过该时长
+const STREAM_HANDSHAKE_TIMEOUT = 15 * time.Second
+
+// TCP握手元数据行的最大长度，超出即断开，避免恶意客户端发送超长行耗尽内存
+const MAX_HANDSHAKE_METADATA_SIZE = 4096
+
+// 握手阶段客户端一个字节都没有发送（端口扫描或空闲连接），与发送了无效数据区分开
+var errHandshakeIdle = errors.New("客户端未发送任何数据")
+
+// 中继缓冲区大小：每次从上传流读取、向下载方写出的最大字节数。越小数据越早到达下载方，越大吞吐越高
+const (
+	DEFAULT_SEND_BUFFER_SIZE = 256 * 1024
+	MIN_SEND_BUFFER_SIZE     = 4 * 1024
+	MAX_SEND_BUFFER_SIZE     = 16 * 1024 * 1024
+)
+
+// /wait 长轮询的默认与最长等待时间
+const (
+	DEFAULT_WAIT_TIMEOUT = 60 * time.Second
+	MAX_WAIT_TIMEOUT     = 300 * time.Second
+)
+
+// 上传流空闲上限：等待上传端数据超过该时长没有任何字节到达时视为停滞，中止传输
+const STREAM_IDLE_TIMEOUT = 5 * time.Minute
+
+// 传输完成后等待上传端半关闭写端 (读到EOF) 的最长时间，之后才关闭连接
+const STREAM_DRAIN_TIMEOUT = 5 * time.Second
+
+// 流连接健康检查的默认间隔
+const HEALTH_CHECK_INTERVAL = 30 * time.Second
+
+// 资源看门狗的采样间隔
+const WATCHDOG_INTERVAL = 5 * time.Second
+
+// 启用 --stats-path 时累计统计的保存间隔，关闭时另外保存一次
+const STATS_SAVE_INTERVAL = time.Minute
+
+// 卸载模式的恢复阈值：堆内存回落到高水位的该比例以下才恢复接收新工作，避免在高水位附近反复切换
+const SHED_RECOVERY_RATIO = 0.9
+
+// 注册的有效期，过期后由清理任务回收
+const FILE_TTL = 2 * time.Hour
+
+// 下载方等待流连接建立的默认时长
+const DEFAULT_DOWNLOAD_WAIT = 30 * time.Second
+
+// 等待超时后仍无上传端连接时，建议下载方重试的间隔 (秒)
+const DOWNLOAD_RETRY_AFTER = 10
+
+// 过期资源清理的默认间隔
+const DEFAULT_CLEANUP_INTERVAL = 5 * time.Minute
+
+// 事件推送：订阅者上限默认值、每个订阅者的缓冲事件数、保活注释的发送间隔
+const (
+	DEFAULT_MAX_EVENT_SUBSCRIBERS = 16
+	EVENT_BUFFER_SIZE             = 64
+	EVENT_KEEPALIVE_INTERVAL      = 15 * time.Second
+)
+
+// 注册幂等键的有效期与最大长度
+const (
+	IDEMPOTENCY_KEY_TTL        = 10 * time.Minute
+	IDEMPOTENCY_KEY_MAX_LENGTH = 255
+)
+
+// 下载字节数写入服务器统计的默认粒度
+const DEFAULT_STATS_FLUSH_BYTES int64 = 10 * 1024 * 1024
+
+// 口令模式中数字部分的上限，口令形如 1-999 加两个单词
+const WORD_CODE_MAX_NUMBER = 999
+
+// 跨域请求中允许浏览器脚本读取的响应头
+const CORS_EXPOSE_HEADERS = "X-FileFlow-FileID, X-FileFlow-Original-Filename, X-FileFlow-Session, X-FileFlow-Error, Retry-After, Content-Disposition"
+
+// 下载会话（下载名额的租约）在没有请求进行时保留的默认时长，过期后释放占用的下载次数
+const DOWNLOAD_SESSION_TTL = 30 * time.Minute
+
+// 上传流支持的压缩方式，在TCP握手元数据的 compression 字段中协商
+const STREAM_COMPRESSION_GZIP = "gzip"
+
+// 分块校验：握手元数据中 framed 为 "true" 时，上传流按 chunk_size 分块，每块带长度与CRC32前缀
+const (
+	STREAM_FRAMING       = "framed"
+	MIN_FRAME_CHUNK_SIZE = 64 * 1024
+	MAX_FRAME_CHUNK_SIZE = 16 * 1024 * 1024
+)
+
+// 按需发送：握手元数据中 on_demand 为 "true" 时，服务器在下载方占用流后发送 DOWNLOAD_STARTED，
+// 上传端收到后才读取并发送文件 (提供端 --follow 模式据此发送下载时的最新内容)；缓存模式下不启用
+const STREAM_ON_DEMAND = "on_demand"
+
+// 按下载方IP统计下行流量的滚动窗口 (分钟)，以及 /admin/bandwidth 默认返回的条目数
+const (
+	BANDWIDTH_WINDOW_MINUTES = 60
+	BANDWIDTH_TOP_DEFAULT    = 20
+)
+
+// 单个注册允许的最大下载次数
+const MAX_DOWNLOADS_LIMIT = 100
+
+// 令牌枚举防护：查找失败次数的统计窗口、不存在令牌响应延迟的上限 (避免大量延迟中的请求占用资源)，
+// 以及未启用查找失败限制时建议的最低令牌熵 (位)；默认的8位字母数字令牌约48位，8位十六进制只有32位
+const (
+	FAILED_LOOKUP_WINDOW       = time.Minute
+	MAX_NOT_FOUND_DELAY        = 5 * time.Second
+	MIN_RECOMMENDED_TOKEN_BITS = 44
+)
+
+// 打包下载 (/download-zip) 一次最多包含的令牌数，以及打包文件的默认名称
+const (
+	MAX_ZIP_TOKENS    = 64
+	ZIP_DOWNLOAD_NAME = "fileflow.zip"
+)
+
+// 默认只信任本机回环地址上的反向代理 (如同机部署的 Caddy)；--trusted-proxies=none 表示不信任任何代理
+const (
+	DEFAULT_TRUSTED_PROXIES = "127.0.0.0/8,::1/128"
+	TRUSTED_PROXIES_NONE    = "none"
+)
+
+// 文件名长度上限 (字节，按UTF-8计)，与常见文件系统的单个文件名上限一致
+const DEFAULT_MAX_FILENAME_LENGTH = 255
+
+// 注册请求体 (JSON) 的大小上限 (字节)：正常的注册请求只有几百字节，上限防止超大请求体在校验前耗尽内存
+const DEFAULT_MAX_REGISTER_BODY = 64 * 1024
+
+// 注册请求可以单独指定下载令牌长度 (token_length)：下限与 --token-len 的下限一致，
+// 上限默认 DEFAULT_MAX_TOKEN_LENGTH，可通过 --max-token-len 调整但不超过 MAX_TOKEN_LENGTH_LIMIT
+const (
+	MIN_TOKEN_LENGTH         = 6
+	DEFAULT_MAX_TOKEN_LENGTH = 32
+	MAX_TOKEN_LENGTH_LIMIT   = 128
+)
+
+// 注册时附带的自定义元数据：键的数量、单个键的长度、所有键与值的总字节数上限
+const (
+	MAX_METADATA_KEYS       = 16
+	MAX_METADATA_KEY_LENGTH = 64
+	MAX_METADATA_SIZE       = 4096
+)
+
+// 自定义元数据在下载响应中的响应头前缀
+const METADATA_HEADER_PREFIX = "X-FileFlow-Meta-"
+
+// 上传端凭证长度，与公开的下载令牌分开且更长
+const PROVIDER_TOKEN_LENGTH = 32
+
+// 单个文件大小的默认上限
+const DEFAULT_MAX_FILE_SIZE int64 = 100 * 1024 * 1024 * 1024
+
+// 未带单位的 --max-file-size 不超过该值时按 GiB 解释 (兼容旧配置)，超过时按字节解释
+const BARE_SIZE_GIB_LIMIT = 1024
+
+// 大小单位，大小写不敏感：KiB/MiB/GiB/TiB 为1024进制，KB/MB/GB/TB 为1000进制，B 为字节；
+// 按后缀长度从长到短匹配
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+	{"b", 1},
+}
+
+// 缓存目录的默认总容量
+const DEFAULT_CACHE_MAX_SIZE int64 = 10 * 1024 * 1024 * 1024
+
+// 缓存被释放时唤醒等待中的读取方
+var errCacheReleased = errors.New("缓存已释放")
+
+// 传输生命周期事件，通过 /events 以SSE推送给订阅者
+type TransferEvent struct {
+	Type      string    `json:"type"` // registered、stream_established、progress、completed、expired、error
+	Token     string    `json:"token,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// 事件总线：处理器发布事件，每个SSE订阅者一个带缓冲的通道
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan TransferEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan TransferEvent]struct{})}
+}
+
+// 新增订阅者，已达上限时返回false
+func (b *eventBus) subscribe(limit int) (chan TransferEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) >= limit {
+		return nil, false
+	}
+	ch := make(chan TransferEvent, EVENT_BUFFER_SIZE)
+	b.subscribers[ch] = struct{}{}
+	return ch, true
+}
+
+func (b *eventBus) unsubscribe(ch chan TransferEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// 向所有订阅者发布事件；订阅者处理不过来时丢弃该事件，不阻塞传输
+func (b *eventBus) publish(ev TransferEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (b *eventBus) count() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// 注册幂等键记录
+type idempotencyEntry struct {
+	authToken string
+	expiresAt time.Time
+}
+
+// 上传流的本地缓存文件
+type cacheEntry struct {
+	path      string
+	size      int64 // 注册时声明的文件大小
+	createdAt time.Time
+	file      *os.File // 写入端，仅由 fillCache 使用
+	sha256    string   // 写入完成且与声明摘要一致后才设置，非空表示已登记到 cacheByHash
+	refs      int      // 引用该缓存文件的令牌数，去重时多个令牌共享同一文件
+
+	mu      sync.Mutex
+	written int64
+	done    bool
+	err     error
+	updated chan struct{} // 每次写入或结束时关闭并替换，用于唤醒等待数据的读取方
+}
+
+// 写入缓存文件并唤醒等待数据的读取方
+func (c *cacheEntry) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	c.mu.Lock()
+	c.written += int64(n)
+	close(c.updated)
+	c.updated = make(chan struct{})
+	c.mu.Unlock()
+	return n, err
+}
+
+// 标记缓存写入结束，err 为 nil 表示已完整写入
+func (c *cacheEntry) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	c.done = true
+	c.err = err
+	close(c.updated)
+	c.updated = make(chan struct{})
+}
+
+// 等待缓存至少写入 need 字节，返回当前已写入的字节数
+func (c *cacheEntry) waitFor(ctx context.Context, need int64) (int64, error) {
+	for {
+		c.mu.Lock()
+		written, done, err, updated := c.written, c.done, c.err, c.updated
+		c.mu.Unlock()
+
+		if written >= need {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if done {
+			return written, io.ErrUnexpectedEOF
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+	}
+}
+
+// 从缓存文件读取，读到尚未写入的部分时等待上传端继续写入
+// 实现 io.ReadSeeker，交给 http.ServeContent 处理 Range 请求
+type cacheReader struct {
+	ctx     context.Context
+	cache   *cacheEntry
+	file    *os.File
+	offset  int64
+	limiter *rateLimiter
+	read    byteRanges // 本次请求实际读出的区间；Seek 只移动偏移，不算交付
+}
+
+func (cr *cacheReader) Read(p []byte) (int, error) {
+	if cr.offset >= cr.cache.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	available, err := cr.cache.waitFor(cr.ctx, cr.offset+1)
+	if err != nil {
+		return 0, err
+	}
+	if remaining := available - cr.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	p = p[:cr.limiter.chunk(len(p))]
+
+	n, err := cr.file.ReadAt(p, cr.offset)
+	cr.read = cr.read.add(cr.offset, cr.offset+int64(n))
+	cr.offset += int64(n)
+	cr.limiter.wait(cr.ctx, n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (cr *cacheReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.offset
+	case io.SeekEnd:
+		offset += cr.cache.size
+	default:
+		return 0, errors.New("无效的whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("无效的偏移量")
+	}
+	cr.offset = offset
+	return offset, nil
+}
+
+// 统计实际写出字节数的ResponseWriter
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+	err     error
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// 下载字节计数器：按flushAt粒度批量累加到服务器统计与下载方IP的流量，避免每次写入都加锁
+type byteCounter struct {
+	ffb      *FileFlowBridge
+	clientIP string
+	pending  int64
+	flushAt  int64
+}
+
+func (ffb *FileFlowBridge) newByteCounter(clientIP string) *byteCounter {
+	flushAt := ffb.StatsFlushBytes
+	if flushAt <= 0 {
+		flushAt = DEFAULT_STATS_FLUSH_BYTES
+	}
+	return &byteCounter{ffb: ffb, clientIP: clientIP, flushAt: flushAt}
+}
+
+// 记录n字节，累计达到刷新粒度时写入统计
+func (bc *byteCounter) add(n int64) {
+	bc.pending += n
+	if bc.pending >= bc.flushAt {
+		bc.flush()
+	}
+}
+
+// 把尚未写入的字节计入统计并清零，重复调用不会重复计数
+func (bc *byteCounter) flush() {
+	if bc.pending == 0 {
+		return
+	}
+	bc.ffb.addBytesTransferred(bc.clientIP, bc.pending)
+	bc.pending = 0
+}
+
+// 传输分布直方图的桶上界，固定的桶使内存占用与传输次数无关
+var (
+	transferSizeBuckets       = []float64{1 << 10, 64 << 10, 1 << 20, 16 << 20, 128 << 20, 1 << 30, 4 << 30, 16 << 30, 64 << 30}
+	transferDurationBuckets   = []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600, 4 * 3600}
+	transferThroughputBuckets = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// 按固定桶计数的直方图，输出为Prometheus的histogram格式；nil 直方图忽略所有记录
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // 各桶的非累计计数，最后一个为超出所有上界的部分
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.bounds, v) // 第一个 >= v 的上界，即 le 语义
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// 以Prometheus文本格式写出，桶计数按 le 累计
+func (h *histogram) writeProm(w io.Writer, name, help string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// 全局在途字节预算：已从上传端读出、尚未交给下载方的数据总量
+type inflightBudget struct {
+	mu       sync.Mutex
+	used     int64
+	released chan struct{} // 每次归还时关闭并替换，唤醒等待预算的读取方
+}
+
+// 申请最多want字节的预算，limit<=0时只统计不限制；预算用尽时等待其他流归还，
+// 返回实际获得的字节数，done关闭时返回0
+func (b *inflightBudget) acquire(want int, limit int64, done <-chan struct{}) int {
+	for {
+		b.mu.Lock()
+		if limit <= 0 || b.used < limit {
+			n := want
+			if limit > 0 && int64(n) > limit-b.used {
+				n = int(limit - b.used)
+			}
+			b.used += int64(n)
+			b.mu.Unlock()
+			return n
+		}
+		if b.released == nil {
+			b.released = make(chan struct{})
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-done:
+			return 0
+		}
+	}
+}
+
+// 归还预算并唤醒等待方
+func (b *inflightBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= int64(n)
+	if b.released != nil {
+		close(b.released)
+		b.released = nil
+	}
+}
+
+// 当前在途字节数
+func (b *inflightBudget) current() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// 按字节数节流的限速器，保证平均速率不超过limit；nil表示不限速
+type rateLimiter struct {
+	limit int64 // 字节/秒
+	start time.Time
+	sent  int64
+}
+
+func newRateLimiter(limit int64) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit}
+}
+
+// 单次读取的最大字节数，避免低速率下一次读取过多造成长时间停顿
+func (rl *rateLimiter) chunk(size int) int {
+	if rl != nil && rl.limit < int64(size) {
+		return int(rl.limit)
+	}
+	return size
+}
+
+// 记录n字节，超出速率时休眠到允许发送的时间点，ctx结束时提前返回
+func (rl *rateLimiter) wait(ctx context.Context, n int) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	// 从第一次发送开始计时，等待上传端期间不累积可突发的额度
+	if rl.start.IsZero() {
+		rl.start = time.Now()
+	}
+	rl.sent += int64(n)
+	allowedAt := rl.start.Add(time.Duration(float64(rl.sent) / float64(rl.limit) * float64(time.Second)))
+	delay := time.Until(allowedAt)
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
 
 // TCP连接信息
@@ -56,6 +739,104 @@ type StreamConnection struct {
 	Reader io.Reader
 	Writer io.Writer
 	Conn   net.Conn
+	Pipe   *io.PipeReader // 管道模式下下载方读取的一端，Reader 即为该管道
+
+	lastActivity   atomic.Int64 // 最近一次从上传端读到数据的时间 (UnixNano)，健康检查据此跳过正在传输的连接
+	uploadComplete atomic.Bool  // 已从上传流读到注册大小的全部内容；上传端随后会半关闭写端，健康检查不再把EOF视为断线
+
+	done     chan struct{} // 流从活跃列表摘下时关闭，健康检查协程随之退出；为nil时表示没有健康检查
+	doneOnce sync.Once
+
+	demand     chan struct{} // 管道模式的流在下载方占用时关闭，此后搬运协程才申请在途预算并读取上传端；为nil时立即读取
+	demandOnce sync.Once
+	onDemand   bool // 上传端按需发送：下载方占用时通知上传端 DOWNLOAD_STARTED
+}
+
+// 读取上传内容 (TCP流的管道或HTTP上传的数据通道)
+func (sc *StreamConnection) Read(p []byte) (int, error) {
+	return sc.Reader.Read(p)
+}
+
+// 通过TCP控制通道向上传端发送消息
+func (sc *StreamConnection) Write(p []byte) (int, error) {
+	if sc.Writer == nil {
+		return 0, errNoControlChannel
+	}
+	return sc.Writer.Write(p)
+}
+
+// 关闭TCP连接与管道；HTTP上传没有底层连接，只关闭管道
+func (sc *StreamConnection) Close() error {
+	var err error
+	if sc.Conn != nil {
+		err = sc.Conn.Close()
+	}
+	sc.closePipe()
+	return err
+}
+
+func (sc *StreamConnection) RemoteAddr() string {
+	if sc.Conn == nil {
+		return ""
+	}
+	return sc.Conn.RemoteAddr().String()
+}
+
+// 上传端连接的读取期限只由搬运协程按 STREAM_IDLE_TIMEOUT 设置，上传停滞时管道随之返回错误；
+// HTTP上传的停滞由上传处理协程的超时负责。两种情况都无需中继再设期限
+func (sc *StreamConnection) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// 关闭管道读取端，使阻塞在写入上的搬运协程退出
+func (sc *StreamConnection) closePipe() {
+	if sc.Pipe != nil {
+		sc.Pipe.Close()
+	}
+}
+
+// 传输完成后读空上传流直到EOF (上传端半关闭写端或在收到结果后关闭连接)，最多等待 timeout。
+// 接收缓冲区中留有未读数据时关闭连接会发出RST，上传端可能因此丢失尚未读取的结果通知
+func (sc *StreamConnection) drainUpload(timeout time.Duration) {
+	if sc.Pipe == nil {
+		return
+	}
+	drained := make(chan struct{})
+	go func() {
+		// 超时后调用者关闭管道，读取随之结束
+		io.Copy(io.Discard, sc.Pipe)
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+	}
+}
+
+// 标记流已结束，通知健康检查协程退出；可重复调用
+func (sc *StreamConnection) stop() {
+	sc.doneOnce.Do(func() {
+		if sc.done != nil {
+			close(sc.done)
+		}
+	})
+}
+
+// 下载方已占用流：放行搬运协程，按需发送的流同时通知上传端开始发送；没有搬运协程的流不做任何事
+func (sc *StreamConnection) signalDemand(authToken string) {
+	if sc.demand == nil {
+		return
+	}
+	sc.demandOnce.Do(func() {
+		if sc.onDemand {
+			sc.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := sc.Conn.Write([]byte("DOWNLOAD_STARTED\n")); err != nil {
+				log.Printf("发送下载开始通知失败: %s - %v", authToken, err)
+			}
+			sc.Conn.SetWriteDeadline(time.Time{})
+		}
+		close(sc.demand)
+	})
 }
 
 // 用于从channel读取数据的Reader
@@ -96,39 +877,110 @@ func (cr *ChannelReader) Read(p []byte) (n int, err error) {
 	}
 }
 
-// 全局WebSocket升级器
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// 允许来自相同主机的连接
-		return true
-	},
-}
+// 全局WebSocket升级器，来源检查在升级时按服务器的 CORSOrigins 设置
+var upgrader = websocket.Upgrader{}
 
 // 文件流桥服务器
 type FileFlowBridge struct {
-	HTTPPort      int
-	TCPPort       int
-	MaxFileSize   int64
-	TokenLength   int
-	ShutdownEvent chan struct{}
+	HTTPPort                int
+	TCPPort                 int
+	HTTPListen              string // HTTP服务器监听地址 (host:port)，为空时监听所有网卡的 HTTPPort
+	TCPListen               string // TCP流服务器监听地址 (host:port)，为空时监听所有网卡的 TCPPort
+	PprofAddr               string // 性能分析 (net/http/pprof) 的独立监听地址 (host:port)，为空时不启用
+	MaxFileSize             int64
+	TokenLength             int
+	DownloadWait            time.Duration // 下载方等待上传端建立流连接的最长时间
+	CleanupInterval         time.Duration // 过期资源清理间隔（实际间隔带有 ±10% 抖动）
+	MaxActiveStreams        int           // 同时活跃的流连接上限，0 表示不限制
+	CacheDir                string        // 非空时启用缓存模式：上传流先写入该目录下的临时文件
+	CacheMaxSize            int64         // 缓存目录总容量 (字节)，超出时淘汰最早的缓存
+	Dedup                   bool          // 缓存去重：注册附带的SHA-256命中已缓存内容时直接复用；知道摘要即可取得内容，默认关闭
+	MaxRate                 int64         // 每个下载的全局限速 (字节/秒)，0 表示不限速
+	IdleRegistrationTimeout time.Duration // 注册后从未建立流的条目在此时间后被清理，0 表示只按过期时间清理
+	WordCodes               bool          // 使用单词口令代替随机字符串作为下载令牌
+	ChunkedDownloads        bool          // 实时转发的下载默认不声明Content-Length，改用分块传输编码；注册时可单独指定
+	DisableCompression      bool          // 关闭TCP链路压缩：握手请求的压缩被忽略，STREAM_READY 不回显压缩方式，提供端改为不压缩传输
+	AdminToken              string        // 管理接口令牌，为空时管理接口不可用
+	StatsFlushBytes         int64         // 下载字节数写入统计的粒度 (字节)，越小统计越实时
+	MaxEventSubscribers     int           // /events 同时订阅者上限
+	MaxInflightBytes        int64         // 所有流在途字节的总上限，达到后暂停从上传端读取，0 表示不限制
+	TCPTLSConfig            *tls.Config   // 非nil时TCP流端口使用TLS，注册响应的 tcp_endpoint.tls 告知提供端
+	NotFoundRedirect        string        // 下载不存在的令牌时重定向到的地址，为空时返回404
+	NotFoundPage            []byte        // 下载不存在的令牌时返回的HTML页面，NotFoundRedirect 优先
+	MemoryHighWater         int64         // 堆内存高水位 (字节)，超过后进入卸载模式拒绝新的注册与流连接，0 表示不启用
+	CORSOrigins             []string      // 允许的跨域来源；为空时HTTP接口允许任意来源、WebSocket只接受同源，包含 "*" 时完全放开
+	TrustedProxies          []*net.IPNet  // 可信反向代理网段，只有来自其中的请求才采用 X-Forwarded-* 头；nil 表示使用 DEFAULT_TRUSTED_PROXIES，空切片表示不信任任何代理
+	HandshakeTimeout        time.Duration // TCP流连接的握手时限，0 表示使用 STREAM_HANDSHAKE_TIMEOUT
+	SendBufferSize          int           // 中继缓冲区大小 (字节)，0 表示使用 DEFAULT_SEND_BUFFER_SIZE
+	MaxFilenameLength       int           // 文件名长度上限 (字节)，0 表示使用 DEFAULT_MAX_FILENAME_LENGTH
+	MaxRegisterBody         int64         // 注册请求体的大小上限 (字节)，0 表示使用 DEFAULT_MAX_REGISTER_BODY
+	MaxTokenLength          int           // 注册请求中 token_length 的上限，0 表示使用 DEFAULT_MAX_TOKEN_LENGTH
+	TokenCharset            string        // 下载令牌字符集的名称 (见 tokenCharsets)，为空时使用 DEFAULT_TOKEN_CHARSET
+	TokenPrefix             string        // 加在下载令牌前的固定前缀 (如 ffb_)，不计入令牌长度
+	MaxTotalSize            int64         // 所有有效注册声明大小之和的上限 (字节)，0 表示不限制
+	DownloadLeaseTTL        time.Duration // 缓存模式下载会话在下载方断开后保留名额的时长，0 表示使用 DOWNLOAD_SESSION_TTL
+	NotFoundDelay           time.Duration // 令牌不存在时延迟响应的时长 (另加至多25%的随机抖动)，0 表示不延迟
+	MaxFailedLookups        int           // 每个IP在 FAILED_LOOKUP_WINDOW 内允许的令牌查找失败次数，超出后查找返回429，0 表示不限制
+	StatsPath               string        // 累计统计的持久化文件，非空时启动时载入、定期与关闭时保存，计数跨重启累加
+	ShutdownEvent           chan struct{}
+
+	healthCheckInterval time.Duration                // 流连接健康检查间隔，0 表示使用 HEALTH_CHECK_INTERVAL
+	streamListener      func() (net.Listener, error) // 创建流端口的监听器，nil 时监听 TCPListen/TCPPort；测试据此注入内存管道实现的监听器
 
 	fileRegistry      map[string]*FileMetadata
-	activeStreams     map[string]interface{} // 使用interface{}以支持多种连接类型
+	activeStreams     map[string]Stream
 	downloadCompleted map[string]bool
+	streamThroughput  map[string]float64           // 各活跃下载最近一个采样窗口的速率 (bytes/sec)
+	streamReady       map[string]chan struct{}     // 流连接建立时关闭，用于唤醒等待中的下载方
+	transferDone      map[string]chan struct{}     // 一次下载结束或资源移除时关闭，用于唤醒 /wait 长轮询
+	cacheEntries      map[string]*cacheEntry       // 缓存模式下各令牌的缓存文件
+	cacheByHash       map[string]*cacheEntry       // 已完整缓存且摘要校验一致的文件，按SHA-256索引，用于去重
+	staleCacheFiles   []string                     // 已释放、等待在解锁后删除的缓存文件
+	idempotencyKeys   map[string]idempotencyEntry  // 注册请求的幂等键，重试时返回原注册
+	bandwidthByIP     map[string]*ipBandwidth      // 各下载方IP在滚动窗口内的下行流量
+	finishedTransfers map[string]*finishedTransfer // 已移除注册的终态，保留 STATUS_RETENTION
+	failedLookups     map[string]*lookupFailures   // 各IP在当前窗口内的令牌查找失败次数，首次失败时创建
 	serverStats       ServerStats
+	statsBase         persistedStats // 之前各次运行的累计统计，从 StatsPath 载入
 	isShuttingDown    bool
+	paused            bool // 维护暂停：不接受新的注册与流连接，已有传输继续
+	events            *eventBus
+	transferSizes     *histogram // 完整下载的文件大小 (字节)
+	transferDurations *histogram // 完整下载的耗时 (秒)
+	transferRates     *histogram // 完整下载的平均速度 (字节/秒)
+	tcpListening      bool       // TCP监听已建立且仍在接受连接
+	tcpListenerFailed bool       // TCP监听在非关闭期间意外终止，进程已无法完成传输
+	inflight          inflightBudget
+	shedding          bool   // 卸载模式：堆内存超过高水位，拒绝新的注册与流连接，已有传输继续
+	heapInUse         uint64 // 看门狗最近一次采样的堆内存 (字节)
 
 	// 用于同步访问共享资源
 	mu sync.RWMutex
 }
 
-// 流连接接口
-type StreamConnectionInterface interface {
-	io.Reader
+// 下载中继读取的上传源：TCP流连接 (HTTP multipart 上传同样包装为 StreamConnection) 与WebSocket流连接都实现该接口，
+// relayDownload 用同一个中继循环转发。RemoteAddr 为上传端地址，未知时为空字符串；
+// WebSocket流连接的 SetReadDeadline 限定后续 Read 的阻塞时间，超时返回 os.ErrDeadlineExceeded；
+// TCP流连接的 SetReadDeadline 不生效，空闲超时由 pumpStream 读取上传端时按 STREAM_IDLE_TIMEOUT 执行，超时后 Read 返回该错误
+type StreamSource interface {
+	Read(p []byte) (int, error)
+	Close() error
+	RemoteAddr() string
+	SetReadDeadline(t time.Time) error
 }
 
+// 活跃的上传流：在上传源之外通过 Write 向上传端发送控制消息。
+// 各传输方式特有的协议 (如TCP的按需发送、WebSocket的JSON命令) 仍通过类型断言处理
+type Stream interface {
+	StreamSource
+	io.Writer
+}
+
+// 上传流没有可写回上传端的控制通道 (如HTTP multipart 上传)
+var errNoControlChannel = errors.New("上传流没有控制通道")
+
 // 处理流错误
-func (ffb *FileFlowBridge) handleStreamError(authToken string, err error, conn net.Conn) {
+func (ffb *FileFlowBridge) handleStreamError(authToken string, err error) {
 	if err == io.EOF {
 		log.Printf("连接正常关闭: %s", authToken)
 		return
@@ -137,24 +989,19 @@ func (ffb *FileFlowBridge) handleStreamError(authToken string, err error, conn n
 	if netErr, ok := err.(net.Error); ok {
 		if netErr.Timeout() {
 			log.Printf("连接超时: %s - %v", authToken, netErr)
-			// 尝试重置连接
-			if conn != nil {
-				conn.SetReadDeadline(time.Time{})
-			}
 		} else {
 			log.Printf("网络错误: %s - %v", authToken, netErr)
 		}
 	} else {
 		log.Printf("流错误: %s - %v", authToken, err)
 	}
+	ffb.publishEvent(TransferEvent{Type: "error", Token: authToken, Message: err.Error()})
 
 	// 清理资源
 	ffb.mu.Lock()
 	defer ffb.mu.Unlock()
 
-	if _, exists := ffb.activeStreams[authToken]; exists {
-		delete(ffb.activeStreams, authToken)
-	}
+	ffb.deleteActiveStreamLocked(authToken)
 }
 
 // 检查连接状态
@@ -179,56 +1026,327 @@ func NewFileFlowBridge(httpPort, tcpPort int, maxFileSize int64, tokenLength int
 		TCPPort:           tcpPort,
 		MaxFileSize:       maxFileSize,
 		TokenLength:       tokenLength,
+		DownloadWait:      DEFAULT_DOWNLOAD_WAIT,
+		CleanupInterval:   DEFAULT_CLEANUP_INTERVAL,
 		ShutdownEvent:     make(chan struct{}),
 		fileRegistry:      make(map[string]*FileMetadata),
-		activeStreams:     make(map[string]interface{}),
+		activeStreams:     make(map[string]Stream),
 		downloadCompleted: make(map[string]bool),
+		streamThroughput:  make(map[string]float64),
+		streamReady:       make(map[string]chan struct{}),
+		transferDone:      make(map[string]chan struct{}),
+		cacheEntries:      make(map[string]*cacheEntry),
+		cacheByHash:       make(map[string]*cacheEntry),
+		idempotencyKeys:   make(map[string]idempotencyEntry),
+		bandwidthByIP:     make(map[string]*ipBandwidth),
+		finishedTransfers: make(map[string]*finishedTransfer),
+		events:            newEventBus(),
+		transferSizes:     newHistogram(transferSizeBuckets),
+		transferDurations: newHistogram(transferDurationBuckets),
+		transferRates:     newHistogram(transferThroughputBuckets),
 		serverStats: ServerStats{
 			StartTime: time.Now(),
 		},
 	}
 }
 
-// 生成指定长度的随机字符串
-func (ffb *FileFlowBridge) createNewID() string {
-	if ffb.TokenLength < 6 || ffb.TokenLength > 32 {
-		return uuid.New().String()
+// 生成指定长度的随机字符串，length 为0时使用全局的 TokenLength；启用口令模式时生成单词口令。
+// 随机部分取自 TokenCharset，TokenPrefix 加在前面，不计入长度
+func (ffb *FileFlowBridge) createNewID(length int) string {
+	if ffb.WordCodes {
+		return wordCode()
 	}
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	ret := make([]byte, ffb.TokenLength)
-	for i := 0; i < ffb.TokenLength; i++ {
-		num, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		ret[i] = charset[num.Int64()]
+	if length <= 0 {
+		length = ffb.TokenLength
+		if length < MIN_TOKEN_LENGTH || length > DEFAULT_MAX_TOKEN_LENGTH {
+			return ffb.TokenPrefix + uuidToken()
+		}
 	}
-	return string(ret)
+	// 注册请求指定的长度已在注册时校验
+	return ffb.TokenPrefix + randomTokenFrom(ffb.tokenCharset(), length)
 }
 
-// 启动服务器
-func (ffb *FileFlowBridge) StartServer() error {
-	// 启动HTTP服务器
-	router := mux.NewRouter()
+// 下载令牌使用的字符集，未配置或名称未知时使用 TOKEN_CHARSET
+func (ffb *FileFlowBridge) tokenCharset() string {
+	if charset, ok := tokenCharsets[ffb.TokenCharset]; ok {
+		return charset
+	}
+	return TOKEN_CHARSET
+}
 
-	// API路由
+// 生成未被占用的下载令牌，无论长度如何都检查冲突，调用者需持有写锁
+func (ffb *FileFlowBridge) createUniqueIDLocked(length int) string {
+	for {
+		id := ffb.createNewID(length)
+		if _, taken := ffb.fileRegistry[id]; !taken {
+			return id
+		}
+	}
+}
+
+// 下载令牌的熵 (位)：随机字符串为 长度×log2(字符集大小)，单词口令为编号与两个单词的组合数取对数；前缀不计入
+func (ffb *FileFlowBridge) tokenEntropyBits() float64 {
+	if ffb.WordCodes {
+		return math.Log2(float64(WORD_CODE_MAX_NUMBER) * float64(len(pgpOddWords)) * float64(len(pgpEvenWords)))
+	}
+	return float64(ffb.TokenLength) * math.Log2(float64(len(ffb.tokenCharset())))
+}
+
+// 生成类似 magic-wormhole 的口令，如 7-crossover-clockwork，便于口头分享
+func wordCode() string {
+	number := randomIndex(WORD_CODE_MAX_NUMBER)
+	odd := randomIndex(int64(len(pgpOddWords)))
+	even := randomIndex(int64(len(pgpEvenWords)))
+	return fmt.Sprintf("%d-%s-%s", number+1, pgpOddWords[odd], pgpEvenWords[even])
+}
+
+// 返回 [0, n) 内的随机数；随机源失败时不能把出错返回的 nil 当作0使用，改用 math/rand 兜底
+func randomIndex(n int64) int64 {
+	num, err := rand.Int(randReader, big.NewInt(n))
+	if err != nil {
+		log.Printf("⚠️ 警告: 读取系统随机源失败，改用备用随机数: %v", err)
+		return mrand.Int64N(n)
+	}
+	return num.Int64()
+}
+
+// PGP词表中的三音节词（原用于奇数位字节）
+var pgpOddWords = [256]string{
+	"adroitness", "adviser", "aftermath", "aggregate", "alkali", "almighty", "amulet", "amusement",
+	"antenna", "applicant", "apollo", "armistice", "article", "asteroid", "atlantic", "atmosphere",
+	"autopsy", "babylon", "backwater", "barbecue", "belowground", "bifocals", "bodyguard", "bookseller",
+	"borderline", "bottomless", "bradbury", "bravado", "brazilian", "breakaway", "burlington", "businessman",
+	"butterfat", "camelot", "candidate", "cannonball", "capricorn", "caravan", "caretaker", "celebrate",
+	"cellulose", "certify", "chambermaid", "cherokee", "chicago", "clergyman", "coherence", "combustion",
+	"commando", "company", "component", "concurrent", "confidence", "conformist", "congregate", "consensus",
+	"consulting", "corporate", "corrosion", "councilman", "crossover", "crucifix", "cumbersome", "customer",
+	"dakota", "decadence", "december", "decimal", "designing", "detector", "detergent", "determine",
+	"dictator", "dinosaur", "direction", "disable", "disbelief", "disruptive", "distortion", "document",
+	"embezzle", "enchanting", "enrollment", "enterprise", "equation", "equipment", "escapade", "eskimo",
+	"everyday", "examine", "existence", "exodus", "fascinate", "filament", "finicky", "forever",
+	"fortitude", "frequency", "gadgetry", "galveston", "getaway", "glossary", "gossamer", "graduate",
+	"gravity", "guitarist", "hamburger", "hamilton", "handiwork", "hazardous", "headwaters", "hemisphere",
+	"hesitate", "hideaway", "holiness", "hurricane", "hydraulic", "impartial", "impetus", "inception",
+	"indigo", "inertia", "infancy", "inferno", "informant", "insincere", "insurgent", "integrate",
+	"intention", "inventive", "istanbul", "jamaica", "jupiter", "leprosy", "letterhead", "liberty",
+	"maritime", "matchmaker", "maverick", "medusa", "megaton", "microscope", "microwave", "midsummer",
+	"millionaire", "miracle", "misnomer", "molasses", "molecule", "montana", "monument", "mosquito",
+	"narrative", "nebula", "newsletter", "norwegian", "october", "ohio", "onlooker", "opulent",
+	"orlando", "outfielder", "pacific", "pandemic", "pandora", "paperweight", "paragon", "paragraph",
+	"paramount", "passenger", "pedigree", "pegasus", "penetrate", "perceptive", "performance", "pharmacy",
+	"phonetic", "photograph", "pioneer", "pocketful", "politeness", "positive", "potato", "processor",
+	"provincial", "proximate", "puberty", "publisher", "pyramid", "quantity", "racketeer", "rebellion",
+	"recipe", "recover", "repellent", "replica", "reproduce", "resistor", "responsive", "retraction",
+	"retrieval", "retrospect", "revenue", "revival", "revolver", "sandalwood", "sardonic", "saturday",
+	"savagery", "scavenger", "sensation", "sociable", "souvenir", "specialist", "speculate", "stethoscope",
+	"stupendous", "supportive", "surrender", "suspicious", "sympathy", "tambourine", "telephone", "therapist",
+	"tobacco", "tolerance", "tomorrow", "torpedo", "tradition", "travesty", "trombonist", "truncated",
+	"typewriter", "ultimate", "undaunted", "underfoot", "unicorn", "unify", "universe", "unravel",
+	"upcoming", "vacancy", "vagabond", "vertigo", "virginia", "visitor", "vocalist", "voyager",
+	"warranty", "waterloo", "whimsical", "wichita", "wilmington", "wyoming", "yesteryear", "yucatan",
+}
+
+// PGP词表中的双音节词（原用于偶数位字节）
+var pgpEvenWords = [256]string{
+	"aardvark", "absurd", "accrue", "acme", "adrift", "adult", "afflict", "ahead",
+	"aimless", "algol", "allow", "alone", "ammo", "ancient", "apple", "artist",
+	"assume", "athens", "atlas", "aztec", "baboon", "backfield", "backward", "banjo",
+	"beaming", "bedlamp", "beehive", "beeswax", "befriend", "belfast", "berserk", "billiard",
+	"bison", "blackjack", "blockade", "blowtorch", "bluebird", "bombast", "bookshelf", "brackish",
+	"breadline", "breakup", "brickyard", "briefcase", "burbank", "button", "buzzard", "cement",
+	"chairlift", "chatter", "checkup", "chisel", "choking", "chopper", "christmas", "clamshell",
+	"classic", "classroom", "cleanup", "clockwork", "cobra", "commence", "concert", "cowbell",
+	"crackdown", "cranky", "crowfoot", "crucial", "crumpled", "crusade", "cubic", "dashboard",
+	"deadbolt", "deckhand", "dogsled", "dragnet", "drainage", "dreadful", "drifter", "dropper",
+	"drumbeat", "drunken", "dupont", "dwelling", "eating", "edict", "egghead", "eightball",
+	"endorse", "endow", "enlist", "erase", "escape", "exceed", "eyeglass", "eyetooth",
+	"facial", "fallout", "flagpole", "flatfoot", "flytrap", "fracture", "framework", "freedom",
+	"frighten", "gazelle", "geiger", "glitter", "glucose", "goggles", "goldfish", "gremlin",
+	"guidance", "hamlet", "highchair", "hockey", "indoors", "indulge", "inverse", "involve",
+	"island", "jawbone", "keyboard", "kickoff", "kiwi", "klaxon", "locale", "lockup",
+	"merit", "minnow", "miser", "mohawk", "mural", "music", "necklace", "neptune",
+	"newborn", "nightbird", "oakland", "obtuse", "offload", "optic", "orca", "payday",
+	"peachy", "pheasant", "physique", "playhouse", "pluto", "preclude", "prefer", "preshrunk",
+	"printer", "prowler", "pupil", "puppy", "python", "quadrant", "quiver", "quota",
+	"ragtime", "ratchet", "rebirth", "reform", "regain", "reindeer", "rematch", "repay",
+	"retouch", "revenge", "reward", "rhythm", "ribcage", "ringbolt", "robust", "rocker",
+	"ruffled", "sailboat", "sawdust", "scallion", "scenic", "scorecard", "scotland", "seabird",
+	"select", "sentence", "shadow", "shamrock", "showgirl", "skullcap", "skydive", "slingshot",
+	"slowdown", "snapline", "snapshot", "snowcap", "snowslide", "solo", "southward", "soybean",
+	"spaniel", "spearhead", "spellbind", "spheroid", "spigot", "spindle", "spyglass", "stagehand",
+	"stagnate", "stairway", "standard", "stapler", "steamship", "sterling", "stockman", "stopwatch",
+	"stormy", "sugar", "surmount", "suspense", "sweatband", "swelter", "tactics", "talon",
+	"tapeworm", "tempest", "tiger", "tissue", "tonic", "topmost", "tracker", "transit",
+	"trauma", "treadmill", "trojan", "trouble", "tumor", "tunnel", "tycoon", "uncut",
+	"unearth", "unwind", "uproot", "upset", "upshot", "vapor", "village", "virus",
+	"vulcan", "waffle", "wallet", "watchword", "wayside", "willow", "woodlark", "zulu",
+}
+
+const TOKEN_CHARSET = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// --token-charset 可选的下载令牌字符集：lowercase 适合不区分大小写的系统，
+// base58 去掉了易混淆的 0/O、I/l，适合需要念出或抄写的令牌
+const DEFAULT_TOKEN_CHARSET = "alphanumeric"
+
+var tokenCharsets = map[string]string{
+	"alphanumeric": TOKEN_CHARSET,
+	"lowercase":    "abcdefghijklmnopqrstuvwxyz0123456789",
+	"hex":          "0123456789abcdef",
+	"base58":       "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+}
+
+// 下载令牌前缀 (如 ffb_) 的长度上限；前缀出现在下载链接中，只允许字母、数字、下划线与连字符
+const MAX_TOKEN_PREFIX_LENGTH = 16
+
+// 校验 --token-prefix
+func validateTokenPrefix(prefix string) error {
+	if len(prefix) > MAX_TOKEN_PREFIX_LENGTH {
+		return fmt.Errorf("前缀长度 %d 超过上限 %d", len(prefix), MAX_TOKEN_PREFIX_LENGTH)
+	}
+	for _, c := range prefix {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("前缀 %q 包含字符 %q，只允许字母、数字、下划线与连字符", prefix, c)
+		}
+	}
+	return nil
+}
+
+// 令牌使用的随机源，测试中可替换为会失败的读取器
+var randReader io.Reader = rand.Reader
+
+// 读取随机源失败后的重试次数，仍失败则改用UUID
+const RANDOM_READ_RETRIES = 3
+
+// 使用加密安全的随机数从默认字符集生成令牌
+func randomToken(length int) string {
+	return randomTokenFrom(TOKEN_CHARSET, length)
+}
+
+// 使用加密安全的随机数从 charset 生成令牌：批量读取随机字节并做拒绝采样，避免逐字符分配 big.Int
+func randomTokenFrom(charset string, length int) string {
+	// 随机字节不小于该值时丢弃，使 b % len(charset) 均匀分布
+	threshold := 256 - 256%len(charset)
+	ret := make([]byte, 0, length)
+	// 内置字符集下每个字节被丢弃的概率不超过约 10%，多读一些通常一次即可填满
+	buf := make([]byte, length+length/4+4)
+	failures := 0
+	for len(ret) < length {
+		if _, err := io.ReadFull(randReader, buf); err != nil {
+			failures++
+			if failures <= RANDOM_READ_RETRIES {
+				continue
+			}
+			log.Printf("⚠️ 警告: 读取系统随机源失败 %d 次，改用UUID作为令牌: %v", failures, err)
+			return uuidToken()
+		}
+		for _, b := range buf {
+			if int(b) >= threshold {
+				continue
+			}
+			ret = append(ret, charset[int(b)%len(charset)])
+			if len(ret) == length {
+				break
+			}
+		}
+	}
+	return string(ret)
+}
+
+// 生成UUID形式的令牌。uuid.New 在随机源失败时会 panic，这里改用 uuid.NewRandom 检查错误，
+// 仍失败时用 math/rand（运行时以系统熵播种）生成32位令牌，保证令牌不会退化为固定值
+func uuidToken() string {
+	id, err := uuid.NewRandom()
+	if err == nil {
+		return id.String()
+	}
+	log.Printf("⚠️ 警告: 生成UUID失败，改用备用随机数生成令牌: %v", err)
+	ret := make([]byte, DEFAULT_MAX_TOKEN_LENGTH)
+	for i := range ret {
+		ret[i] = TOKEN_CHARSET[mrand.IntN(len(TOKEN_CHARSET))]
+	}
+	return string(ret)
+}
+
+// 配置CORS
+func corsMiddleware(next http.Handler, allowedOrigins []string) http.Handler {
+	permissive := len(allowedOrigins) == 0 || slices.Contains(allowedOrigins, "*")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if permissive {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// 只回显允许的来源，其他来源的浏览器脚本无法读取响应
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); originListed(allowedOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		// 允许浏览器脚本读取下载响应中的自定义头，用于显示原始文件名
+		w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSE_HEADERS)
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 判断来源是否在允许列表中，忽略大小写与末尾的斜杠
+func originListed(allowedOrigins []string, origin string) bool {
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocket升级的来源检查：链接中携带令牌，若接受任意来源，恶意页面可借用户的浏览器劫持上传流。
+// 没有 Origin 的非浏览器客户端、同源页面以及 CORSOrigins 中列出的来源可以升级；CORSOrigins 包含 "*" 时不做检查
+func (ffb *FileFlowBridge) checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originListed(ffb.CORSOrigins, origin) {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	log.Printf("⛔ 拒绝跨域WebSocket升级: %s (来源: %s)", r.URL.Path, origin)
+	return false
+}
+
+// 启动服务器
+func (ffb *FileFlowBridge) StartServer() error {
+	// 启动HTTP服务器
+	router := mux.NewRouter()
+
+	// API路由
 	router.HandleFunc("/register", ffb.handleFileRegistration).Methods("POST")
 	router.HandleFunc("/upload/{auth_token}", ffb.handleFileUpload).Methods("POST")
 	router.HandleFunc("/ws/{auth_token}", ffb.handleWebSocketConnection).Methods("GET")
 	router.HandleFunc("/download/{auth_token}", ffb.handleFileDownload)
 	router.HandleFunc("/download/{auth_token}/{filename}", ffb.handleFileDownloadWithName)
+	router.HandleFunc("/download-zip", ffb.handleZipDownload).Methods("GET")
 	router.HandleFunc("/status/{auth_token}", ffb.handleStatusCheck)
+	router.HandleFunc("/wait/{auth_token}", ffb.handleWaitTransfer).Methods("GET")
 	router.HandleFunc("/stats", ffb.handleServerStats)
+	router.HandleFunc("/stats.txt", ffb.handleServerStatsText)
+	router.HandleFunc("/metrics", ffb.handleMetrics).Methods("GET")
 	router.HandleFunc("/health", ffb.handleHealthCheck)
+	router.HandleFunc("/ready", ffb.handleReadyCheck)
+	router.HandleFunc("/config", ffb.handleConfig).Methods("GET")
+	router.HandleFunc("/events", ffb.handleEvents).Methods("GET")
+	router.HandleFunc("/admin/pause", ffb.handleAdminPause).Methods("POST")
+	router.HandleFunc("/admin/resume", ffb.handleAdminResume).Methods("POST")
+	router.HandleFunc("/admin/bandwidth", ffb.handleAdminBandwidth).Methods("GET")
 
 	// WebSocket路由
 	router.HandleFunc("/ws/{auth_token}", ffb.handleWebSocketConnection).Methods("GET")
 
-	// 配置WebSocket升级器
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// 允许来自相同主机的连接
-			return true
-		},
-	}
-
 	// 添加静态文件服务 - 放在最后以避免覆盖API路由
 	staticDir := "./static"
 	if _, err := os.Stat(staticDir); err == nil {
@@ -242,40 +1360,68 @@ func (ffb *FileFlowBridge) StartServer() error {
 		router.PathPrefix("/").Handler(staticFS).Methods("GET")
 	}
 
-	// 配置CORS
-	corsMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			next.ServeHTTP(w, r)
-		})
-	}
-
 	httpServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", ffb.HTTPPort),
-		Handler: corsMiddleware(router),
+		Addr:    listenAddr(ffb.HTTPListen, ffb.HTTPPort),
+		Handler: corsMiddleware(router, ffb.CORSOrigins),
 	}
 
 	// 启动TCP服务器
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", ffb.TCPPort))
+	listener, err := ffb.listenStream()
 	if err != nil {
 		return fmt.Errorf("TCP服务器启动失败: %v", err)
 	}
+	ffb.mu.Lock()
+	ffb.tcpListening = true
+	ffb.mu.Unlock()
+
+	// 准备缓存目录
+	if ffb.CacheDir != "" {
+		if err := os.MkdirAll(ffb.CacheDir, 0700); err != nil {
+			return fmt.Errorf("创建缓存目录失败: %v", err)
+		}
+		log.Printf("💾 缓存模式已启用: %s", ffb.CacheDir)
+	}
+
+	// 性能分析使用独立的监听地址，不挂在对外的HTTP端口上
+	var pprofServer *http.Server
+	if ffb.PprofAddr != "" {
+		pprofListener, err := net.Listen("tcp", ffb.PprofAddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("性能分析服务启动失败: %v", err)
+		}
+		pprofServer = &http.Server{Handler: pprofHandler()}
+		go func() {
+			log.Printf("🩺 性能分析运行在 %s/debug/pprof/", pprofListener.Addr().String())
+			if err := pprofServer.Serve(pprofListener); err != nil && err != http.ErrServerClosed {
+				log.Printf("性能分析服务错误: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("🧩 功能开关: %s", ffb.featureSummary())
+
+	// 载入之前保存的累计统计；文件损坏时拒绝启动，避免覆盖已有的历史数据
+	if ffb.StatsPath != "" {
+		if err := ffb.loadStats(); err != nil {
+			listener.Close()
+			return err
+		}
+		log.Printf("📊 累计统计持久化已启用: %s (自 %s 起)", ffb.StatsPath, ffb.lifetimeStats().Since.Format(time.RFC3339))
+		go ffb.runStatsPersistence()
+	}
 
 	// 启动清理任务
-	go ffb.cleanupResources()
+	go ffb.runCleanupLoop()
+	go ffb.runWatchdog()
 
 	// 启动HTTP服务器
 	go func() {
-		log.Printf("🌐 HTTP服务器运行在端口 %d", ffb.HTTPPort)
-		log.Printf("📦 最大文件大小限制: %.1f GiB", float64(ffb.MaxFileSize)/(1024*1024*1024))
+		log.Printf("🌐 HTTP服务器运行在 %s", httpServer.Addr)
+		log.Printf("📦 最大文件大小限制: %.1f GiB (%d 字节)", float64(ffb.MaxFileSize)/(1024*1024*1024), ffb.MaxFileSize)
+		if ffb.MaxActiveStreams > 0 {
+			log.Printf("🚦 活跃流上限: %d", ffb.MaxActiveStreams)
+		}
 
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Printf("HTTP服务器错误: %v", err)
@@ -284,37 +1430,200 @@ func (ffb *FileFlowBridge) StartServer() error {
 
 	// 处理TCP连接
 	go func() {
-		log.Printf("🔌 TCP服务器运行在端口 %d", ffb.TCPPort)
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if ffb.isShuttingDown {
-					break
-				}
-				log.Printf("TCP连接接受错误: %v", err)
-				continue
-			}
-
-			go ffb.handleStreamConnection(conn)
-		}
+		log.Printf("🔌 TCP服务器运行在 %s", listener.Addr().String())
+		ffb.acceptStreamConnections(listener)
 	}()
 
 	// 等待关闭信号
 	<-ffb.ShutdownEvent
+	ffb.mu.Lock()
 	ffb.isShuttingDown = true
+	ffb.mu.Unlock()
+
+	// 性能分析直接关闭，正在采集的 profile 不拖延优雅关闭
+	if pprofServer != nil {
+		pprofServer.Close()
+	}
 
 	// 优雅关闭
 	ffb.gracefulShutdown(httpServer, listener)
+	if ffb.StatsPath != "" {
+		if err := ffb.saveStats(); err != nil {
+			log.Printf("⚠️ 保存累计统计失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 之前各次运行的累计值加上本次启动以来的值，峰值取两者较大者
+func (ffb *FileFlowBridge) lifetimeStats() persistedStats {
+	ffb.mu.RLock()
+	defer ffb.mu.RUnlock()
+	return ffb.lifetimeStatsLocked()
+}
+
+// 同 lifetimeStats，调用者需持有锁
+func (ffb *FileFlowBridge) lifetimeStatsLocked() persistedStats {
+	base, current := ffb.statsBase, ffb.serverStats
+	lifetime := persistedStats{
+		Since:                base.Since,
+		SavedAt:              base.SavedAt,
+		FilesRegisteredTotal: base.FilesRegisteredTotal + current.FilesRegisteredTotal,
+		FilesTransferred:     base.FilesTransferred + current.FilesTransferred,
+		FilesExpiredTotal:    base.FilesExpiredTotal + current.FilesExpiredTotal,
+		FilesCompletedTotal:  base.FilesCompletedTotal + current.FilesCompletedTotal,
+		FilesTruncatedTotal:  base.FilesTruncatedTotal + current.FilesTruncatedTotal,
+		BytesTransferred:     base.BytesTransferred + current.BytesTransferred,
+		PeakConnections:      max(base.PeakConnections, current.PeakConnections),
+		PeakBytesPerSec:      max(base.PeakBytesPerSec, current.PeakBytesPerSec),
+	}
+	if lifetime.Since.IsZero() {
+		lifetime.Since = current.StartTime
+	}
+	return lifetime
+}
+
+// 载入 StatsPath 中之前保存的累计统计，文件不存在时从本次启动开始累计
+func (ffb *FileFlowBridge) loadStats() error {
+	data, err := os.ReadFile(ffb.StatsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取统计文件失败: %v", err)
+	}
+	var saved persistedStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("解析统计文件 %s 失败: %v", ffb.StatsPath, err)
+	}
+	ffb.mu.Lock()
+	ffb.statsBase = saved
+	ffb.mu.Unlock()
 	return nil
 }
 
+// 保存累计统计：先写临时文件再重命名，进程在写入中途退出也不会留下损坏的统计文件
+func (ffb *FileFlowBridge) saveStats() error {
+	lifetime := ffb.lifetimeStats()
+	lifetime.SavedAt = time.Now()
+	data, err := json.MarshalIndent(lifetime, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化统计失败: %v", err)
+	}
+	tmp := ffb.StatsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("写入统计文件失败: %v", err)
+	}
+	if err := os.Rename(tmp, ffb.StatsPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("替换统计文件失败: %v", err)
+	}
+	return nil
+}
+
+// 按 STATS_SAVE_INTERVAL 定期保存累计统计，收到关闭信号时退出，最后一次保存在优雅关闭之后进行
+func (ffb *FileFlowBridge) runStatsPersistence() {
+	ticker := time.NewTicker(STATS_SAVE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ffb.saveStats(); err != nil {
+				log.Printf("⚠️ 保存累计统计失败: %v", err)
+			}
+		case <-ffb.ShutdownEvent:
+			return
+		}
+	}
+}
+
+// 启动时记录最终生效的功能开关 (环境变量与命令行参数合并之后)，便于核对部署配置
+func (ffb *FileFlowBridge) featureSummary() string {
+	onOff := func(enabled bool) string {
+		if enabled {
+			return "开"
+		}
+		return "关"
+	}
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"compression", !ffb.DisableCompression},
+		{"cache", ffb.CacheDir != ""},
+		{"dedup", ffb.Dedup && ffb.CacheDir != ""},
+		{"tcp_tls", ffb.TCPTLSConfig != nil},
+		{"word_codes", ffb.WordCodes},
+		{"chunked_downloads", ffb.ChunkedDownloads},
+		{"admin", ffb.AdminToken != ""},
+		{"pprof", ffb.PprofAddr != ""},
+	}
+	parts := make([]string, 0, len(features))
+	for _, f := range features {
+		parts = append(parts, f.name+"="+onOff(f.enabled))
+	}
+	return strings.Join(parts, " ")
+}
+
+// 性能分析路由：导入 net/http/pprof 会注册到 http.DefaultServeMux，对外的HTTP服务使用自己的路由，
+// 这里显式挂载到独立的 ServeMux，只由 --pprof-addr 的监听地址提供
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// 监听地址：显式配置的 host:port 优先，否则监听所有网卡的指定端口
+func listenAddr(addr string, port int) string {
+	if addr != "" {
+		return addr
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+// 告知提供端的TCP主机：TCP流只监听某个具体地址 (如VPN网卡) 时使用该地址，否则沿用访问HTTP接口的主机
+func (ffb *FileFlowBridge) tcpEndpointHost(requestHost string) string {
+	if host, _, err := net.SplitHostPort(ffb.TCPListen); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			return host
+		}
+	}
+	return requestHost
+}
+
+// 校验 host:port 形式的监听地址并返回端口；主机部分可以为空 (所有网卡)，但必须是IP或可解析的主机名
+func parseListenAddr(addr string) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("监听地址格式错误: %v", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("监听端口无效: %q", portStr)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return 0, fmt.Errorf("无法解析监听主机 %q: %v", host, err)
+		}
+	}
+	return port, nil
+}
+
 // 处理流连接
 func (ffb *FileFlowBridge) handleStreamConnection(conn net.Conn) {
 	isHandover := false
+	httpProbe := false
 	defer func() {
 		if !isHandover {
 			conn.Close()
-			log.Printf("🔌 未完成握手的连接已释放: %s", conn.RemoteAddr().String())
+			if !httpProbe {
+				log.Printf("🔌 未完成握手的连接已释放: %s", conn.RemoteAddr().String())
+			}
 		}
 	}()
 	ffb.mu.Lock()
@@ -338,1076 +1647,3936 @@ func (ffb *FileFlowBridge) handleStreamConnection(conn net.Conn) {
 		tcpConn.SetKeepAlivePeriod(30 * time.Second)
 	}
 
+	// TLS模式：先完成TLS握手，之后的元数据与文件数据都经过加密
+	if ffb.TCPTLSConfig != nil {
+		tlsConn := tls.Server(conn, ffb.TCPTLSConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), ffb.handshakeTimeout())
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			// 明文HTTP请求发到了TLS流端口，与 net/http 的做法一样用明文回复提示
+			var recordErr tls.RecordHeaderError
+			if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTPRequest(recordErr.RecordHeader[:]) {
+				httpProbe = true
+				log.Printf("🌐 TCP流端口收到HTTP请求，已提示改用HTTP端口: %s", conn.RemoteAddr().String())
+				recordErr.Conn.Write(ffb.streamPortHTTPHint())
+				return
+			}
+			log.Printf("🔒 TLS握手失败: %s - %v", conn.RemoteAddr().String(), err)
+			return
+		}
+		conn = tlsConn
+	}
+
 	// 设置读取超时（仅用于元数据读取）
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(ffb.handshakeTimeout()))
 
-	// 读取元数据
-	reader := bufio.NewReader(conn)
-	metadataRaw, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("无效的连接元数据: %v", err)
-		return
+	// 读取并解析元数据，缓冲区大小即元数据行的长度上限
+	reader := bufio.NewReaderSize(conn, MAX_HANDSHAKE_METADATA_SIZE)
+
+	// 端口扫描或把流端口误当作API地址时收到的是HTTP请求：立即回复提示并关闭，不等待握手超时
+	if _, err := reader.Peek(1); err == nil {
+		if head, _ := reader.Peek(min(reader.Buffered(), HTTP_PROBE_SIZE)); looksLikeHTTPRequest(head) {
+			httpProbe = true
+			log.Printf("🌐 TCP流端口收到HTTP请求，已提示改用HTTP端口: %s", conn.RemoteAddr().String())
+			conn.Write(ffb.streamPortHTTPHint())
+			return
+		}
 	}
 
-	// 解析元数据
-	var metadata map[string]string
-	if err := json.Unmarshal([]byte(metadataRaw), &metadata); err != nil {
-		log.Printf("元数据解析错误: %v", err)
+	metadata, err := readHandshakeMetadata(reader)
+	if err != nil {
+		switch {
+		case errors.Is(err, errHandshakeIdle):
+			log.Printf("⌛ 流连接未发送握手数据即超时或关闭: %s - %v", conn.RemoteAddr().String(), err)
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			log.Printf("⌛ 流连接握手超时 (%v)，元数据未发送完整: %s - %v", ffb.handshakeTimeout(), conn.RemoteAddr().String(), err)
+		default:
+			log.Printf("❌ 无效的连接元数据: %s - %v", conn.RemoteAddr().String(), err)
+		}
 		return
 	}
 
 	authToken := metadata["auth_token"]
+	providerToken := metadata["provider_token"]
+	compression := metadata["compression"]
+	onDemand := metadata[STREAM_ON_DEMAND] == "true"
 
-	// 验证连接 - 修复重复声明问题
-	valid := ffb.validateStreamConnection(authToken)
+	// 验证连接：下载令牌定位文件，上传端凭证证明身份
+	valid := ffb.validateStreamConnection(authToken, providerToken)
 	if !valid {
+		// 注册时已命中缓存去重：内容已在服务器上，告知上传端无需发送
+		if ffb.isDeduplicatedWithProvider(authToken, providerToken) {
+			log.Printf("♻️ 内容已缓存，上传端无需发送: %s (%s)", authToken, conn.RemoteAddr().String())
+			conn.Write([]byte("TRANSFER_CACHED\n"))
+			return
+		}
+		// 凭证正确但该令牌已在传输中：明确告知，原有的流不受影响
+		if ffb.isStreamingWithProvider(authToken, providerToken) {
+			log.Printf("🔁 令牌已有活跃的流连接，拒绝重复连接: %s (%s)", authToken, conn.RemoteAddr().String())
+			conn.Write([]byte("ALREADY_STREAMING\n"))
+			return
+		}
 		log.Printf("⛔ 无效的连接尝试: %s", authToken)
 		conn.Write([]byte("INVALID_CONNECTION\n"))
 		conn.Close()
 		return
 	}
 
-	// 更新文件状态
-	ffb.mu.Lock()
-	ffb.fileRegistry[authToken].Status = "streaming"
-	ffb.fileRegistry[authToken].StreamStarted = time.Now()
-	ffb.fileRegistry[authToken].ClientAddress = conn.RemoteAddr().String()
-	fileName := ffb.fileRegistry[authToken].OriginalFilename
-	ffb.mu.Unlock()
+	// 压缩已关闭时按未压缩处理；提供端从 STREAM_READY 的回显得知，改为不压缩发送
+	if compression != "" && ffb.DisableCompression {
+		log.Printf("🗜️ 压缩已关闭，忽略上传端请求的 %s 压缩: %s", compression, authToken)
+		compression = ""
+	}
+
+	// 注册声明的大小始终指解压后的内容，压缩只作用于TCP链路
+	if compression != "" && compression != STREAM_COMPRESSION_GZIP {
+		log.Printf("⛔ 不支持的压缩方式: %s (token_id: %s)", compression, authToken)
+		conn.Write([]byte("UNSUPPORTED_COMPRESSION\n"))
+		return
+	}
+
+	// 分块大小决定校验前需要缓冲的数据量，限制在合理范围内
+	frameChunkSize := 0
+	if metadata["framed"] == "true" {
+		size, err := strconv.Atoi(metadata["chunk_size"])
+		if err != nil || size < MIN_FRAME_CHUNK_SIZE || size > MAX_FRAME_CHUNK_SIZE {
+			log.Printf("⛔ 不支持的分块大小: %q (token_id: %s)", metadata["chunk_size"], authToken)
+			conn.Write([]byte("UNSUPPORTED_FRAMING\n"))
+			return
+		}
+		frameChunkSize = size
+	}
+
+	// 握手中的修改时间 (Unix秒) 比注册时更接近实际读取的文件，无效值忽略
+	var modTime time.Time
+	if v := metadata["mtime"]; v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds > 0 {
+			modTime = time.Unix(seconds, 0)
+		}
+	}
 
 	// 取消读取超时（重要修改）
 	conn.SetReadDeadline(time.Time{})
 
-	// 存储流连接
 	streamConn := &StreamConnection{
 		Reader: reader,
 		Writer: conn,
 		Conn:   conn,
+		done:   make(chan struct{}),
 	}
 
+	// 容量检查与登记在同一把锁内完成，避免并发握手同时越过上限
 	ffb.mu.Lock()
-	ffb.activeStreams[authToken] = streamConn
-	ffb.mu.Unlock()
+	// 校验与登记之间可能有同一令牌的另一个握手抢先完成，重新检查，避免覆盖正在进行的流
+	if md, ok := ffb.fileRegistry[authToken]; !ok || md.Status != STATUS_REGISTERED || ffb.activeStreams[authToken] != nil {
+		ffb.mu.Unlock()
+		if ok {
+			log.Printf("🔁 令牌已有活跃的流连接，拒绝重复连接: %s (%s)", authToken, conn.RemoteAddr().String())
+			conn.Write([]byte("ALREADY_STREAMING\n"))
+		} else {
+			log.Printf("⛔ 无效的连接尝试: %s", authToken)
+			conn.Write([]byte("INVALID_CONNECTION\n"))
+		}
+		return
+	}
+	if ffb.pausedForNewStreamLocked(authToken) {
+		ffb.mu.Unlock()
+		log.Printf("⏸️ 服务器已暂停，拒绝新的流连接: %s", authToken)
+		conn.Write([]byte("SERVER_PAUSED\n"))
+		return
+	}
+	if ffb.streamCapacityReachedLocked(authToken) {
+		activeCount := len(ffb.activeStreams)
+		shedding := ffb.shedding
+		ffb.mu.Unlock()
+		if shedding {
+			log.Printf("🚨 卸载模式中，拒绝连接: %s", authToken)
+		} else {
+			log.Printf("🚦 活跃流已达上限 (%d/%d)，拒绝连接: %s", activeCount, ffb.MaxActiveStreams, authToken)
+		}
+		conn.Write([]byte("SERVER_BUSY\n"))
+		return
+	}
+
+	// 更新文件状态
+	ffb.fileRegistry[authToken].Status = STATUS_READY
+	ffb.fileRegistry[authToken].StreamStarted = time.Now()
+	ffb.fileRegistry[authToken].ClientAddress = conn.RemoteAddr().String()
+	ffb.fileRegistry[authToken].Compression = compression
+	ffb.fileRegistry[authToken].FrameChunkSize = frameChunkSize
+	if !modTime.IsZero() {
+		ffb.fileRegistry[authToken].ModTime = modTime
+	}
+	fileName := ffb.fileRegistry[authToken].OriginalFilename
+	size := ffb.fileRegistry[authToken].Size
+
+	// 缓存模式：上传流写入本地缓存文件，下载方从缓存读取，上传端写完即可断开
+	var cache *cacheEntry
+	if ffb.CacheDir != "" {
+		var cacheErr error
+		cache, cacheErr = ffb.createCacheEntryLocked(authToken, size)
+		if cacheErr != nil {
+			log.Printf("⚠️ 无法缓存文件，改用实时转发: %s - %v", authToken, cacheErr)
+		}
+	}
+
+	// 管道模式：上传端的数据经由内存管道交给下载方，无论哪一方先到达，双方就绪后数据立即开始流动
+	var pipeWriter *io.PipeWriter
+	if cache == nil {
+		streamConn.Pipe, pipeWriter = io.Pipe()
+		streamConn.Reader = streamConn.Pipe
+		streamConn.demand = make(chan struct{})
+		streamConn.onDemand = onDemand
+	}
+
+	// 存储流连接；分配缓存时淘汰的缓存文件在解锁后删除
+	ffb.setActiveStreamLocked(authToken, streamConn)
+	ffb.unlockAndRemoveStaleCaches()
 
 	log.Printf("✅ 流隧道已建立: %s (token_id: %s)", fileName, authToken)
 
-	// 发送准备确认
-	conn.Write([]byte("STREAM_READY\n"))
+	// 发送准备确认，在确认中回显接受的压缩方式与分块校验，旧版本服务器只会回复 STREAM_READY
+	// 只有读取上传流的协程设置读取期限，其他协程不再触碰，避免互相覆盖
+	var src io.Reader = &idleDeadlineReader{src: reader, conn: conn, activity: &streamConn.lastActivity}
+	ready := "STREAM_READY"
+	var gz *gzipStreamReader
+	if compression != "" {
+		log.Printf("🗜️ 上传流使用 %s 压缩: %s", compression, authToken)
+		gz = &gzipStreamReader{src: src}
+		src = gz
+		ready += " " + compression
+	}
+	if frameChunkSize > 0 {
+		// 分块在压缩之前进行，校验失败时报告的偏移即文件内的偏移
+		log.Printf("🧩 上传流使用分块校验，块大小 %d 字节: %s", frameChunkSize, authToken)
+		src = &framedStreamReader{src: src, chunkSize: frameChunkSize}
+		ready += " " + STREAM_FRAMING
+	}
+	if streamConn.onDemand {
+		log.Printf("⏳ 上传流按需发送，等待下载方: %s", authToken)
+		ready += " " + STREAM_ON_DEMAND
+	}
+	if gz != nil {
+		src = &decompressionLimitReader{src: src, gz: gz, limit: ffb.streamLimit(size, streamConn.onDemand), authToken: authToken}
+	}
+	conn.Write([]byte(ready + "\n"))
 
 	// 保持连接活跃（使用TCP KeepAlive替代应用层心跳）
 	isHandover = true
+	if cache != nil {
+		go ffb.fillCache(authToken, cache, src, conn)
+	} else {
+		src = &uploadProgressReader{src: src, size: size, complete: &streamConn.uploadComplete}
+		go func() {
+			// 下载方到达之前不读取上传端：读出的数据只能阻塞在管道写入上，此时占用的在途预算会拖住其他流的传输。
+			// 空闲时限从开始读取时算起；等待期间上传端断开由健康检查发现
+			if streamConn.demand != nil {
+				select {
+				case <-streamConn.demand:
+				case <-streamConn.done:
+					pipeWriter.CloseWithError(errors.New("流已结束"))
+					return
+				case <-ffb.ShutdownEvent:
+					pipeWriter.CloseWithError(errors.New("服务器正在关闭"))
+					return
+				}
+			}
+			ffb.pumpStream(authToken, src, conn, pipeWriter)
+		}()
+	}
 	go ffb.monitorConnectionHealth(streamConn, authToken)
 }
 
-// 验证流连接
-func (ffb *FileFlowBridge) validateStreamConnection(authToken string) bool {
-	ffb.mu.RLock()
-	defer ffb.mu.RUnlock()
+// 创建流端口的监听器；接受循环与握手只依赖 net.Listener/net.Conn，不关心底层是否为真实的TCP端口
+func (ffb *FileFlowBridge) listenStream() (net.Listener, error) {
+	if ffb.streamListener != nil {
+		return ffb.streamListener()
+	}
+	return net.Listen("tcp", listenAddr(ffb.TCPListen, ffb.TCPPort))
+}
 
-	metadata, exists := ffb.fileRegistry[authToken]
-	if !exists {
-		return false
-	}
-
-	// 检查认证令牌
-	if metadata.AuthToken != authToken {
-		return false
-	}
-
-	// 检查文件状态
-	if metadata.Status != "registered" {
-		return false
-	}
-
-	// 检查过期时间
-	if metadata.ExpiresAt.Before(time.Now()) {
-		return false
-	}
-
-	// 检查是否已经下载完成
-	if ffb.downloadCompleted[authToken] {
-		return false
-	}
-
-	return true
-}
-
-// 监控连接健康状态
-func (ffb *FileFlowBridge) monitorConnectionHealth(conn *StreamConnection, authToken string) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	ffb.mu.RLock()
-	filename := "未知文件"
-	if meta, ok := ffb.fileRegistry[authToken]; ok {
-		filename = meta.OriginalFilename
-	}
-	ffb.mu.RUnlock()
+// 接受TCP流连接直到监听关闭；非关闭期间监听意外终止时标记为故障，由 /health 与 /ready 反映
+func (ffb *FileFlowBridge) acceptStreamConnections(listener net.Listener) {
+	defer func() {
+		ffb.mu.Lock()
+		ffb.tcpListening = false
+		ffb.mu.Unlock()
+	}()
 
+	var backoff time.Duration
 	for {
-		select {
-		case <-ticker.C:
+		conn, err := listener.Accept()
+		if err != nil {
 			ffb.mu.RLock()
-			isCompleted := ffb.downloadCompleted[authToken]
-			_, isActive := ffb.activeStreams[authToken]
+			shuttingDown := ffb.isShuttingDown
 			ffb.mu.RUnlock()
-
-			if isCompleted || !isActive {
-				log.Printf("📭 文件 %s (token_id: %s) 传输结束或资源已释放，停止监控", filename, authToken)
+			if shuttingDown {
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("❌ TCP监听已终止，无法再接受流连接: %v", err)
+				ffb.mu.Lock()
+				ffb.tcpListenerFailed = true
+				ffb.mu.Unlock()
 				return
 			}
 
-			isBroken := false
-			if tcpConn, ok := conn.Conn.(*net.TCPConn); ok {
-				rawConn, err := tcpConn.SyscallConn()
-				if err == nil {
-					rawConn.Control(func(fd uintptr) {
-						// 1. 底层探测：尝试窥视缓冲区 (Peek)
-						// MSG_PEEK: 不取走数据; MSG_DONTWAIT: 非阻塞
-						var buf [1]byte
-						n, _, recvErr := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
-
-						// 2. 获取 TCP 状态
-						var info syscall.TCPInfo
-						size := uint32(unsafe.Sizeof(info))
-						ptr := uintptr(unsafe.Pointer(&info))
-						_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
-							syscall.IPPROTO_TCP, syscall.TCP_INFO, ptr, uintptr(unsafe.Pointer(&size)), 0)
+			// 文件描述符耗尽等错误通常可以恢复，退避后重试，避免空转刷屏
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Printf("TCP连接接受错误，%v 后重试: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
 
-						if n == 0 && recvErr == nil {
-							isBroken = true
-							return
-						}
+		go ffb.handleStreamConnection(conn)
+	}
+}
 
-						if errno == 0 && info.State != 1 {
-							isBroken = true
-							return
-						}
+// 为令牌创建缓存文件，容量不足时淘汰最早的可淘汰缓存；没有可淘汰的缓存时返回错误，由调用者改用实时转发。调用者需持有写锁
+func (ffb *FileFlowBridge) createCacheEntryLocked(authToken string, size int64) (*cacheEntry, error) {
+	budget := ffb.CacheMaxSize
+	if budget <= 0 {
+		budget = DEFAULT_CACHE_MAX_SIZE
+	}
+	if size > budget {
+		return nil, fmt.Errorf("文件大小 %d 超过缓存总容量 %d", size, budget)
+	}
 
-						if recvErr != nil && recvErr != syscall.EAGAIN && recvErr != syscall.EWOULDBLOCK {
-							isBroken = true
-							return
-						}
-					})
-				}
+	for ffb.cacheUsageLocked()+size > budget {
+		oldest := ""
+		for token, c := range ffb.cacheEntries {
+			if !ffb.cacheEvictableLocked(c) {
+				continue
 			}
-
-			if isBroken {
-				log.Printf("🔌 检测到物理连接已断开，正在清理: %s (token_id: %s)", filename, authToken)
-				ffb.removeFileResources(authToken)
-				return
+			if oldest == "" || c.createdAt.Before(ffb.cacheEntries[oldest].createdAt) {
+				oldest = token
 			}
+		}
+		if oldest == "" {
+			return nil, fmt.Errorf("缓存容量不足，其余缓存正在写入或下载中，无法腾出 %d 字节", size)
+		}
+		log.Printf("🧹 缓存容量不足，淘汰最早的缓存: %s", oldest)
+		ffb.removeFileResourcesLocked(oldest)
+	}
 
-			log.Printf("📡 连接健康检查: %s (token_id: %s) - 活跃中", filename, authToken)
+	file, err := os.CreateTemp(ffb.CacheDir, "ffb-*.cache")
+	if err != nil {
+		return nil, fmt.Errorf("创建缓存文件失败: %v", err)
+	}
 
-		case <-ffb.ShutdownEvent:
-			log.Printf("🛑 服务器关闭，停止监控: %s (token_id: %s)", filename, authToken)
-			return
-		}
+	cache := &cacheEntry{
+		path:      file.Name(),
+		size:      size,
+		createdAt: time.Now(),
+		file:      file,
+		refs:      1,
+		updated:   make(chan struct{}),
+	}
+	ffb.cacheEntries[authToken] = cache
+	if metadata, ok := ffb.fileRegistry[authToken]; ok {
+		metadata.CachePath = cache.path
 	}
+	return cache, nil
 }
 
-func getScheme(r *http.Request) string {
-	// 检查反向代理头
-	if scheme := r.Header.Get("X-Forwarded-Proto"); scheme != "" {
-		return scheme
+// 缓存能否被淘汰：已完整写入，且共享该缓存的注册都没有进行中或仍在租约期内的下载会话。
+// 淘汰会释放对应的注册，正在写入或下载的缓存被淘汰会中断进行中的传输。调用者需持有写锁
+func (ffb *FileFlowBridge) cacheEvictableLocked(cache *cacheEntry) bool {
+	cache.mu.Lock()
+	complete := cache.done && cache.err == nil
+	cache.mu.Unlock()
+	if !complete {
+		return false
 	}
-	if scheme := r.Header.Get("X-Forwarded-Scheme"); scheme != "" {
-		return scheme
+	now := time.Now()
+	for token, c := range ffb.cacheEntries {
+		if c != cache {
+			continue
+		}
+		metadata, ok := ffb.fileRegistry[token]
+		if !ok {
+			continue
+		}
+		for _, s := range metadata.sessions {
+			if s.inflight > 0 || now.Sub(s.lastActive) <= ffb.downloadLeaseTTL() {
+				return false
+			}
+		}
 	}
-	// 默认基于TLS判断
-	if r.TLS != nil {
-		return "https"
+	return true
+}
+
+// 缓存占用的总容量（按注册时声明的大小预留，去重共享的文件只计一次），调用者需持有锁
+func (ffb *FileFlowBridge) cacheUsageLocked() int64 {
+	var total int64
+	seen := make(map[*cacheEntry]bool, len(ffb.cacheEntries))
+	for _, c := range ffb.cacheEntries {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		total += c.size
 	}
-	return "http"
+	return total
 }
 
-// 处理根页面
-func (ffb *FileFlowBridge) handleRootPage(w http.ResponseWriter, r *http.Request) {
-	// 返回index.html
-	http.ServeFile(w, r, "./static/index.html")
+// 查找可供去重复用的缓存：摘要一致、已完整写入且大小相同，调用者需持有锁
+func (ffb *FileFlowBridge) dedupCacheLocked(sum string, size int64) *cacheEntry {
+	if !ffb.Dedup || ffb.CacheDir == "" || sum == "" {
+		return nil
+	}
+	cache, ok := ffb.cacheByHash[sum]
+	if !ok || cache.size != size {
+		return nil
+	}
+	cache.mu.Lock()
+	complete := cache.done && cache.err == nil
+	cache.mu.Unlock()
+	if !complete {
+		return nil
+	}
+	return cache
 }
 
-// 获取正确的主机名（去除端口号）
-func getHost(r *http.Request) string {
-	host := r.Host
-	// 移除端口号部分
-	if strings.Contains(host, ":") {
-		return strings.Split(host, ":")[0]
+// 缓存目录所在文件系统的可用空间 (字节)
+func (ffb *FileFlowBridge) cacheDiskFree() (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(ffb.CacheDir, &fs); err != nil {
+		return 0, fmt.Errorf("读取缓存目录可用空间失败: %v", err)
 	}
-	return host
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
 }
 
-// 处理文件注册
-func (ffb *FileFlowBridge) handleFileRegistration(w http.ResponseWriter, r *http.Request) {
-	if r.Body == nil {
-		http.Error(w, "无效的请求体", http.StatusBadRequest)
-		return
+// 缓存目录中已承诺、但尚未写入磁盘的字节数：正在写入的缓存剩余部分，加上尚未连接、连接后会被缓存的注册，调用者需持有锁
+func (ffb *FileFlowBridge) pendingCacheBytesLocked() int64 {
+	var pending int64
+	seen := make(map[*cacheEntry]bool, len(ffb.cacheEntries))
+	for _, c := range ffb.cacheEntries {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		c.mu.Lock()
+		if !c.done {
+			pending += c.size - c.written
+		}
+		c.mu.Unlock()
+	}
+	for token, metadata := range ffb.fileRegistry {
+		if metadata.Status == STATUS_REGISTERED && ffb.cacheEntries[token] == nil && ffb.fitsCache(metadata.Size) {
+			pending += metadata.Size
+		}
 	}
+	return pending
+}
 
-	var data struct {
-		Filename string `json:"filename"`
-		Size     int64  `json:"size"`
+// 文件能否进入缓存；超过缓存总容量的文件改用实时转发，不占用磁盘
+func (ffb *FileFlowBridge) fitsCache(size int64) bool {
+	budget := ffb.CacheMaxSize
+	if budget <= 0 {
+		budget = DEFAULT_CACHE_MAX_SIZE
 	}
+	return ffb.CacheDir != "" && size <= budget
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
-		return
+// 所有有效注册声明的大小之和，调用者需持有锁
+func (ffb *FileFlowBridge) registeredBytesLocked() int64 {
+	var total int64
+	for _, metadata := range ffb.fileRegistry {
+		total += metadata.Size
 	}
+	return total
+}
 
-	// 验证输入
-	if data.Filename == "" {
-		http.Error(w, "文件名是必需的", http.StatusBadRequest)
-		return
+// 剩余可接受的注册容量：总量配额与缓存磁盘空间中较小的一个，limited 为 false 表示不受限制。
+// diskFree 为缓存目录的可用空间，未启用缓存时忽略，调用者需持有锁
+func (ffb *FileFlowBridge) remainingCapacityLocked(diskFree int64) (remaining int64, limited bool) {
+	if ffb.MaxTotalSize > 0 {
+		remaining, limited = max(ffb.MaxTotalSize-ffb.registeredBytesLocked(), 0), true
+	}
+	if ffb.CacheDir != "" && diskFree >= 0 {
+		disk := max(diskFree-ffb.pendingCacheBytesLocked(), 0)
+		if !limited || disk < remaining {
+			remaining, limited = disk, true
+		}
 	}
+	return remaining, limited
+}
 
-	if data.Size > ffb.MaxFileSize {
-		http.Error(w, "文件大小超过限制", http.StatusRequestEntityTooLarge)
-		return
+// 注册前的容量预检：声明的大小超出总量配额，或会进入缓存但磁盘放不下时返回原因，避免传输到中途才失败。调用者需持有锁
+func (ffb *FileFlowBridge) checkCapacityLocked(size int64, diskFree int64) error {
+	if ffb.MaxTotalSize > 0 {
+		if remaining := ffb.MaxTotalSize - ffb.registeredBytesLocked(); size > remaining {
+			return fmt.Errorf("注册总量已达上限，剩余 %d 字节，文件需要 %d 字节", max(remaining, 0), size)
+		}
+	}
+	if diskFree >= 0 && ffb.fitsCache(size) {
+		if remaining := diskFree - ffb.pendingCacheBytesLocked(); size > remaining {
+			return fmt.Errorf("缓存目录磁盘空间不足，剩余 %d 字节，文件需要 %d 字节", max(remaining, 0), size)
+		}
 	}
+	return nil
+}
 
-	// 生成文件ID和认证令牌
-	authToken := ffb.createNewID()
-	clientIP := r.RemoteAddr
+// 获取令牌的缓存，未启用缓存或尚未建立时返回nil
+func (ffb *FileFlowBridge) cacheEntryFor(authToken string) *cacheEntry {
+	ffb.mu.RLock()
+	defer ffb.mu.RUnlock()
+	return ffb.cacheEntries[authToken]
+}
 
-	// 存储文件元数据
-	metadata := &FileMetadata{
-		Filename:         data.Filename,
-		OriginalFilename: data.Filename,
-		Size:             data.Size,
-		Status:           "registered",
-		ClientIP:         clientIP,
-		AuthToken:        authToken,
-		RegisteredAt:     time.Now(),
-		ExpiresAt:        time.Now().Add(2 * time.Hour),
+// 把上传端的数据写入缓存文件，写满声明的大小后通知上传端可以断开
+func (ffb *FileFlowBridge) fillCache(authToken string, cache *cacheEntry, src io.Reader, conn net.Conn) {
+	hasher := sha256.New()
+	_, err := io.CopyN(io.MultiWriter(cache, hasher), src, cache.size)
+	cache.file.Close()
+
+	if err != nil {
+		log.Printf("❌ 缓存写入中断: %s - %v", authToken, err)
+		if err == io.EOF {
+			// 上传流在写满声明的大小之前结束
+			ffb.mu.Lock()
+			ffb.serverStats.FilesTruncatedTotal++
+			ffb.mu.Unlock()
+		}
+		cache.finish(err)
+		ffb.removeFileResources(authToken)
+		return
 	}
+	cache.finish(nil)
 
+	// 缓存完成后上传端不再需要保持在线，释放流连接占用的名额
+	// 内容与声明的摘要一致时登记到去重索引，之后相同内容的注册可以直接复用该文件
+	sum := hex.EncodeToString(hasher.Sum(nil))
 	ffb.mu.Lock()
-	ffb.fileRegistry[authToken] = metadata
-	ffb.serverStats.FilesRegistered++
+	ffb.deleteActiveStreamLocked(authToken)
+	if metadata, ok := ffb.fileRegistry[authToken]; ok && ffb.Dedup && metadata.SHA256 != "" && ffb.cacheEntries[authToken] == cache {
+		if metadata.SHA256 != sum {
+			log.Printf("⚠️ 缓存内容与声明的摘要不一致，不用于去重: %s (声明 %s, 实际 %s)", authToken, metadata.SHA256, sum)
+		} else if _, exists := ffb.cacheByHash[sum]; !exists {
+			cache.sha256 = sum
+			ffb.cacheByHash[sum] = cache
+		}
+	}
 	ffb.mu.Unlock()
 
-	scheme := getScheme(r)
-	host := r.Host
-	if h, _, err := net.SplitHostPort(host); err == nil {
-		host = h
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("TRANSFER_CACHED\n")); err != nil {
+		log.Printf("发送缓存完成通知失败: %s - %v", authToken, err)
 	}
-	var portStr string
-	if scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https" {
-		// 隐藏端口，因为 Caddy 已经处理了 443 -> 8000 的映射
-		portStr = ""
-	} else {
-		// 本地测试或非加密访问，显示程序真实的监听端口
-		portStr = fmt.Sprintf(":%d", ffb.HTTPPort)
+	// 与实时转发相同：读到上传端的EOF后再关闭，避免RST截断尚未读取的通知；
+	// 直接读取底层连接，不经过会重设读取期限的 idleDeadlineReader
+	conn.SetReadDeadline(time.Now().Add(STREAM_DRAIN_TIMEOUT))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	log.Printf("💾 文件已完整缓存: %s (%d 字节)", authToken, cache.size)
+}
+
+// 从缓存文件提供下载，支持Range断点续传；同一会话交付的区间覆盖整个文件后才算一次完整下载
+func (ffb *FileFlowBridge) serveFromCache(w http.ResponseWriter, r *http.Request, authToken string, metadata *FileMetadata, cache *cacheEntry) {
+	file, err := os.Open(cache.path)
+	if err != nil {
+		http.Error(w, "缓存文件不可用", http.StatusGone)
+		return
 	}
-	safeFilename := url.PathEscape(data.Filename)
+	defer file.Close()
 
-	// 生成响应
-	responseData := map[string]interface{}{
-		"auth_token": authToken,
-		"tcp_endpoint": map[string]interface{}{
-			"host": host,
-			"port": ffb.TCPPort,
-		},
-		"download_url": fmt.Sprintf("%s://%s%s/download/%s/%s", scheme, host, portStr, authToken, safeFilename),
-		// "direct_download_url": fmt.Sprintf("%s://%s%d/download/%s", scheme, host, ffb.HTTPPort, authToken),
-		// "status_url":		  fmt.Sprintf("%s://%s%d/status/%s", scheme, host, ffb.HTTPPort, authToken),
-		"expires_at":        metadata.ExpiresAt.Format(time.RFC3339),
-		"original_filename": data.Filename,
+	// HEAD 请求只查询元信息，不占用下载次数
+	sessionID := ""
+	if r.Method != http.MethodHead {
+		sessionID = r.Header.Get("X-FileFlow-Session")
+		if sessionID == "" {
+			sessionID = r.URL.Query().Get("session")
+		}
+		ffb.mu.Lock()
+		sessionID = ffb.acquireDownloadSessionLocked(metadata, sessionID)
+		if sessionID != "" {
+			metadata.Status = STATUS_DOWNLOADING
+		}
+		ffb.mu.Unlock()
+		if sessionID == "" {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "文件正在被其他下载方下载，请稍后重试", http.StatusConflict)
+			return
+		}
+		defer ffb.releaseDownloadSession(metadata, sessionID)
+		w.Header().Set("X-FileFlow-Session", sessionID)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(responseData)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDisposition(metadata.OriginalFilename))
+	w.Header().Set("X-FileFlow-FileID", authToken)
+	w.Header().Set("X-FileFlow-Original-Filename", metadata.OriginalFilename)
+	metadata.setMetadataHeaders(w.Header())
+	// 令牌对应的缓存内容不会改变，令牌加大小即可作为强校验的ETag；
+	// 续传时携带 If-Range 由 ServeContent 校验，内容不符时返回完整内容而不是错位的片段
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, authToken, cache.size))
 
-	log.Printf("📝 文件注册成功: %s (token_id: %s)", data.Filename, authToken)
-}
+	log.Printf("⬇️ 从缓存下载: %s (token_id: %s)", metadata.OriginalFilename, authToken)
 
-// 处理文件上传
-func (ffb *FileFlowBridge) handleFileUpload(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	authToken := vars["auth_token"]
+	reader := &cacheReader{ctx: r.Context(), cache: cache, file: file, limiter: newRateLimiter(ffb.effectiveRate(metadata))}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, metadata.OriginalFilename, metadata.lastModified(), reader)
 
-	// 验证文件令牌
-	ffb.mu.RLock()
-	metadata, exists := ffb.fileRegistry[authToken]
-	ffb.mu.RUnlock()
+	ffb.addBytesTransferred(ffb.downloaderIP(r), cw.written)
 
-	if !exists {
-		http.Error(w, "无效的认证令牌", http.StatusUnauthorized)
+	// 中途断开的下载保留缓存与会话，下载方可以携带会话ID通过Range继续；
+	// 失败的请求不记录区间，续传时重新请求
+	if sessionID == "" || cw.err != nil || r.Context().Err() != nil {
 		return
 	}
 
-	// 验证请求内容类型
-	contentType := r.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "multipart/form-data") {
-		http.Error(w, "请求必须是multipart/form-data格式", http.StatusBadRequest)
+	ffb.mu.Lock()
+	session, ok := metadata.sessions[sessionID]
+	if !ok {
+		ffb.mu.Unlock()
 		return
 	}
-
-	// 限制上传大小
-	r.ParseMultipartForm(32 << 20) // 32MB
-
-	// 获取上传的文件
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("获取上传文件失败: %v", err)
-		http.Error(w, "获取上传文件失败", http.StatusBadRequest)
+	for _, rg := range reader.read {
+		session.delivered = session.delivered.add(rg[0], rg[1])
+	}
+	// 只请求末尾的Range (如 bytes=-1) 或并行下载的一部分不算完整交付
+	if !session.delivered.covers(cache.size) {
+		ffb.mu.Unlock()
 		return
 	}
-	defer file.Close()
-
-	// 更新文件状态
-	ffb.mu.Lock()
-	if ffb.fileRegistry[authToken] != nil {
-		ffb.fileRegistry[authToken].Status = "streaming"
-		ffb.fileRegistry[authToken].StreamStarted = time.Now()
+	// 续传的下载从会话开始计时，包括中途断开的时间
+	ffb.recordTransfer(cache.size, time.Since(session.startedAt))
+	delete(metadata.sessions, sessionID)
+	ffb.serverStats.FilesTransferred++
+	ffb.serverStats.FilesCompletedTotal++
+	metadata.DownloadCount++
+	downloadCount, maxDownloads := metadata.DownloadCount, metadata.MaxDownloads
+	exhausted := downloadCount >= maxDownloads
+	if exhausted {
+		metadata.Status = STATUS_COMPLETED
 	}
+	ffb.notifyTransferDoneLocked(authToken)
 	ffb.mu.Unlock()
 
-	// 创建一个通道来处理数据流
-	dataChan := make(chan []byte, 10)
+	log.Printf("✅ 缓存文件已交付完毕: %s (token_id: %s, %d/%d)", metadata.OriginalFilename, authToken, downloadCount, maxDownloads)
+	ffb.publishEvent(TransferEvent{Type: "completed", Token: authToken, Filename: metadata.OriginalFilename, Bytes: cw.written, Size: metadata.Size})
+	if exhausted {
+		ffb.removeFileResources(authToken)
+	}
+}
 
-	// 启动goroutine读取上传的文件数据
-	go func() {
-		defer close(dataChan)
-		buffer := make([]byte, 32*1024) // 32KB buffer
-		for {
-			// 检查下载是否已完成
-			ffb.mu.RLock()
-			completed := ffb.downloadCompleted[authToken]
-			ffb.mu.RUnlock()
+// 取得下载会话：已有的会话继续使用，否则在剩余下载次数允许时创建新会话；返回空字符串表示次数已被占满
+// 会话即下载名额的租约：下载方断开后租约保留 downloadLeaseTTL，期间可携带会话ID续传；
+// 过期后名额回到可下载状态，由新的下载方取得，而不是被中断的下载永久占用。调用者需持有写锁
+func (ffb *FileFlowBridge) acquireDownloadSessionLocked(metadata *FileMetadata, sessionID string) string {
+	now := time.Now()
+	for id, s := range metadata.sessions {
+		if s.inflight == 0 && now.Sub(s.lastActive) > ffb.downloadLeaseTTL() {
+			delete(metadata.sessions, id)
+		}
+	}
 
-			if completed {
-				log.Printf("⚠️ 下载已完成，停止上传: %s", authToken)
+	session, ok := metadata.sessions[sessionID]
+	if !ok {
+		maxDownloads := metadata.MaxDownloads
+		if maxDownloads < 1 {
+			maxDownloads = 1
+		}
+		if metadata.DownloadCount+len(metadata.sessions) >= maxDownloads {
+			return ""
+		}
+		if metadata.sessions == nil {
+			metadata.sessions = make(map[string]*downloadSession)
+		}
+		sessionID = uuidToken()
+		session = &downloadSession{startedAt: now}
+		metadata.sessions[sessionID] = session
+	}
+	session.inflight++
+	session.lastActive = now
+	return sessionID
+}
+
+// 请求结束时刷新会话的活动时间
+func (ffb *FileFlowBridge) releaseDownloadSession(metadata *FileMetadata, sessionID string) {
+	ffb.mu.Lock()
+	defer ffb.mu.Unlock()
+	if session, ok := metadata.sessions[sessionID]; ok {
+		session.inflight--
+		session.lastActive = time.Now()
+	}
+	// 没有进行中的下载请求时回到等待下载的状态
+	if metadata.Status == STATUS_DOWNLOADING {
+		for _, s := range metadata.sessions {
+			if s.inflight > 0 {
 				return
 			}
+		}
+		metadata.Status = STATUS_READY
+	}
+}
 
-			n, err := file.Read(buffer)
-			if n > 0 {
-				data := make([]byte, n)
-				copy(data, buffer[:n])
-				select {
-				case dataChan <- data:
-				case <-time.After(5 * time.Second): // 减少超时时间以快速响应
-					log.Printf("数据通道超时，可能下载端已断开: %s", authToken)
-					return
-				}
+// 把上传端的TCP数据搬运到管道中
+// 下载方尚未开始读取时写入会阻塞，数据留在TCP缓冲区内，对上传端形成自然的背压
+func (ffb *FileFlowBridge) pumpStream(authToken string, src io.Reader, conn net.Conn, pipeWriter *io.PipeWriter) {
+	buf := make([]byte, ffb.sendBufferSize())
+	for {
+		// 在途字节达到上限时暂停读取，数据留在上传端与TCP缓冲区内，而不是堆积在内存中
+		grant := ffb.inflight.acquire(len(buf), ffb.MaxInflightBytes, ffb.ShutdownEvent)
+		if grant == 0 {
+			pipeWriter.CloseWithError(errors.New("服务器正在关闭"))
+			return
+		}
+		n, err := src.Read(buf[:grant])
+		if n > 0 {
+			_, writeErr := pipeWriter.Write(buf[:n])
+			if writeErr != nil {
+				// 读取端已关闭（下载结束或资源已释放）
+				ffb.inflight.release(grant)
+				return
 			}
-			if err != nil {
-				break
+		}
+		ffb.inflight.release(grant)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("⏱️ 上传流空闲超过 %v，中止传输: %s", STREAM_IDLE_TIMEOUT, authToken)
 			}
+			// io.EOF 会作为正常结束传递给下载方，其他错误使下载方中止
+			pipeWriter.CloseWithError(err)
+			return
 		}
-	}()
+	}
+}
 
-	// 创建一个reader来从channel读取数据
-	reader := &ChannelReader{
-		dataChan: dataChan,
-		buffer:   nil,
-		index:    0,
-		done:     nil,
+// 读取一行握手元数据并解析为键值对；行长度受reader缓冲区大小限制，元数据之后的数据仍留在reader中
+func readHandshakeMetadata(reader *bufio.Reader) (map[string]string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("元数据超过 %d 字节", reader.Size())
+	}
+	if err != nil {
+		if len(line) == 0 {
+			return nil, fmt.Errorf("%w: %w", errHandshakeIdle, err)
+		}
+		return nil, fmt.Errorf("元数据不完整 (已收到 %d 字节): %w", len(line), err)
 	}
 
-	// 将reader包装为StreamConnection
-	streamConn := &StreamConnection{
-		Reader: reader,
-		Writer: nil,
-		Conn:   nil,
+	var metadata map[string]string
+	if err := json.Unmarshal(line, &metadata); err != nil {
+		return nil, fmt.Errorf("元数据解析错误: %v", err)
 	}
+	return metadata, nil
+}
 
-	ffb.mu.Lock()
-	ffb.activeStreams[authToken] = streamConn
-	ffb.mu.Unlock()
+// 识别流端口上的HTTP请求时查看的字节数，足以容纳最长的方法名 "OPTIONS "
+const HTTP_PROBE_SIZE = 8
 
-	// 等待下载完成
-	downloadWaitStart := time.Now()
-	for {
-		ffb.mu.RLock()
-		completed := ffb.downloadCompleted[authToken]
-		_, exists := ffb.activeStreams[authToken]
-		ffb.mu.RUnlock()
+var httpRequestMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
 
-		if completed || !exists {
-			break
+// 判断连接的首批字节是否像HTTP请求行。握手元数据是JSON，以 { 开头，不会与方法名混淆；
+// head 不足一个完整方法名时 (如TLS记录头只有5字节) 只要是某个方法名的开头也算
+func looksLikeHTTPRequest(head []byte) bool {
+	s := string(head)
+	for _, method := range httpRequestMethods {
+		if strings.HasPrefix(s, method) || (len(s) >= 4 && strings.HasPrefix(method, s)) {
+			return true
 		}
+	}
+	return false
+}
 
-		if time.Since(downloadWaitStart) > 10*time.Minute { // 增加超时时间
-			break // 下载超时
-		}
+// 回复发到流端口的HTTP请求：一个最简的HTTP响应，正文一行提示改用HTTP端口
+func (ffb *FileFlowBridge) streamPortHTTPHint() []byte {
+	body := fmt.Sprintf("这是 FileFlow Bridge 的TCP流端口，API与下载请使用HTTP端口 %d\n", ffb.HTTPPort)
+	return []byte(fmt.Sprintf("HTTP/1.0 400 Bad Request\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body))
+}
 
-		time.Sleep(500 * time.Millisecond)
+// gzip压缩的上传流，首次读取时才解析gzip头，避免握手阶段阻塞在等待上传数据上
+type gzipStreamReader struct {
+	src        io.Reader
+	zr         *gzip.Reader
+	compressed int64 // 已从链路读取的压缩数据量
+	out        int64 // 已解压的数据量
+}
+
+func (g *gzipStreamReader) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(readerFunc(func(b []byte) (int, error) {
+			n, err := g.src.Read(b)
+			g.compressed += int64(n)
+			return n, err
+		}))
+		if err != nil {
+			return 0, fmt.Errorf("解析gzip压缩流失败: %v", err)
+		}
+		// 上传端发送完毕后仍保持连接等待结果通知，读完一个gzip成员即视为结束
+		zr.Multistream(false)
+		g.zr = zr
 	}
+	n, err := g.zr.Read(p)
+	g.out += int64(n)
+	return n, err
+}
 
-	// 不要在这里删除流连接，让handleDownloadRequest完成后删除
-	log.Printf("✅ 文件上传处理完成: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+// 把函数适配为 io.Reader
+type readerFunc func([]byte) (int, error)
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"success": true, "message": "文件上传处理完成"}`)
-}
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
 
-// WebSocket流连接
-type WebSocketStreamConnection struct {
-	Conn      *websocket.Conn
-	Buffer    []byte
-	Index     int
-	Mutex     sync.Mutex
-	DataChan  chan []byte
-	CloseChan chan struct{}
+// 解压后的数据超过注册声明的大小，视为压缩炸弹并中止上传流
+var errDecompressionLimit = errors.New("解压后的数据超过声明的大小")
+
+// 压缩上传流的解压上限：交给下游的数据不得超过limit (注册声明的大小)，
+// 防止极高压缩比的数据耗尽内存或磁盘；位于分块校验之后，分块头不计入上限
+type decompressionLimitReader struct {
+	src       io.Reader
+	gz        *gzipStreamReader
+	limit     int64
+	authToken string
+	n         int64
 }
 
-// 实现io.Reader接口，从WebSocket读取数据
-func (wsConn *WebSocketStreamConnection) Read(p []byte) (n int, err error) {
-	// 如果有缓冲数据，先使用缓冲数据
-	if wsConn.Buffer != nil && wsConn.Index < len(wsConn.Buffer) {
-		remaining := len(wsConn.Buffer) - wsConn.Index
-		toCopy := len(p)
-		if toCopy > remaining {
-			toCopy = remaining
+func (d *decompressionLimitReader) Read(p []byte) (int, error) {
+	if d.n > d.limit {
+		return 0, errDecompressionLimit
+	}
+	// 多读一个字节即可判断是否超出声明的大小
+	if remaining := d.limit - d.n + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := d.src.Read(p)
+	d.n += int64(n)
+	if d.n > d.limit {
+		ratio := float64(d.gz.out)
+		if d.gz.compressed > 0 {
+			ratio /= float64(d.gz.compressed)
 		}
-
-		copy(p, wsConn.Buffer[wsConn.Index:wsConn.Index+toCopy])
-		wsConn.Index += toCopy
-		return toCopy, nil
+		log.Printf("💣 解压后的数据超过声明的 %d 字节，中止上传流: %s (已读取压缩数据 %d 字节, 解压 %d 字节, 压缩比约 %.1f:1)",
+			d.limit, d.authToken, d.gz.compressed, d.gz.out, ratio)
+		return n - int(d.n-d.limit), errDecompressionLimit
 	}
+	return n, err
+}
 
-	// 从WebSocket连接读取新数据
-	select {
-	case data, ok := <-wsConn.DataChan:
-		if !ok {
-			// 通道已关闭，表示没有更多数据
+// 分块校验的上传流：每块以4字节长度与4字节CRC32 (IEEE，大端序) 开头，整块校验通过后才交给下游；
+// 长度为0的块表示数据结束
+type framedStreamReader struct {
+	src       io.Reader
+	chunkSize int
+	buf       []byte
+	pending   []byte
+	offset    int64 // 已校验通过的数据量，即下一块在文件中的偏移
+}
+
+func (f *framedStreamReader) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(f.src, header[:]); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint32(header[:4]))
+		if length == 0 {
 			return 0, io.EOF
 		}
-
-		// 使用新数据作为缓冲
-		wsConn.Buffer = data
-		wsConn.Index = 0
-
-		// 返回一部分数据
-		remaining := len(wsConn.Buffer) - wsConn.Index
-		toCopy := len(p)
-		if toCopy > remaining {
-			toCopy = remaining
+		if length > f.chunkSize {
+			return 0, fmt.Errorf("偏移 %d 处的分块长度 %d 超过协商的 %d 字节", f.offset, length, f.chunkSize)
 		}
-
-		copy(p, wsConn.Buffer[wsConn.Index:wsConn.Index+toCopy])
-		wsConn.Index += toCopy
-		return toCopy, nil
-	case <-wsConn.CloseChan:
-		return 0, io.EOF
+		if f.buf == nil {
+			f.buf = make([]byte, f.chunkSize)
+		}
+		chunk := f.buf[:length]
+		if _, err := io.ReadFull(f.src, chunk); err != nil {
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(chunk) != binary.BigEndian.Uint32(header[4:]) {
+			return 0, fmt.Errorf("分块校验失败: 偏移 %d 起的 %d 字节数据已损坏", f.offset, length)
+		}
+		f.offset += int64(length)
+		f.pending = chunk
 	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
 }
 
-// 请求文件数据
-func (ffb *FileFlowBridge) requestFileData(authToken string, offset, size int64) {
-	// 向上传端请求特定偏移量和大小的数据块
-	conn, exists := ffb.activeStreams[authToken]
-	if !exists {
-		log.Printf("找不到连接: %s", authToken)
-		return
+// 统计从上传流读到的内容字节数 (解压、去掉分块之后)，达到注册大小时标记上传完成
+type uploadProgressReader struct {
+	src      io.Reader
+	size     int64
+	read     int64
+	complete *atomic.Bool
+}
+
+func (u *uploadProgressReader) Read(p []byte) (int, error) {
+	n, err := u.src.Read(p)
+	u.read += int64(n)
+	if u.read >= u.size {
+		u.complete.Store(true)
 	}
+	return n, err
+}
 
-	if wsConn, ok := conn.(*WebSocketStreamConnection); ok {
-		request := map[string]interface{}{
-			"command": "send_chunk",
-			"offset":  offset,
-			"size":    size,
-		}
+// 上传流的读取期限由读取协程独占：每次读取前重新设置，读到数据时记录活动时间。
+// 期限只覆盖真正等待上传端的时间，写入管道时被下载方阻塞不会消耗空闲额度
+type idleDeadlineReader struct {
+	src      io.Reader
+	conn     net.Conn
+	activity *atomic.Int64
+}
 
-		err := wsConn.Conn.WriteJSON(request)
-		if err != nil {
-			log.Printf("发送数据请求失败: %v", err)
-		}
+func (d *idleDeadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(STREAM_IDLE_TIMEOUT))
+	n, err := d.src.Read(p)
+	if n > 0 {
+		d.activity.Store(time.Now().UnixNano())
 	}
+	return n, err
 }
 
-// 处理WebSocket连接
-func (ffb *FileFlowBridge) handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	authToken := vars["auth_token"]
-
-	// 验证认证令牌
+// 验证流连接
+func (ffb *FileFlowBridge) validateStreamConnection(authToken, providerToken string) bool {
 	ffb.mu.RLock()
-	_, exists := ffb.fileRegistry[authToken]
-	ffb.mu.RUnlock()
+	defer ffb.mu.RUnlock()
 
+	metadata, exists := ffb.fileRegistry[authToken]
 	if !exists {
-		http.Error(w, "无效的认证令牌", http.StatusUnauthorized)
-		return
+		return false
 	}
 
-	// 升级到WebSocket连接
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket升级失败: %v", err)
-		return
+	// 检查认证令牌
+	if metadata.AuthToken != authToken {
+		return false
 	}
 
-	log.Printf("🔗 WebSocket连接已建立: %s", authToken)
+	// 检查上传端凭证，下载令牌是公开的，不能用来建立上传流
+	if !providerTokenMatches(metadata, providerToken) {
+		return false
+	}
 
-	// 创建WebSocket流连接
-	wsStreamConn := &WebSocketStreamConnection{
-		Conn:      conn,
-		Buffer:    nil,
-		Index:     0,
-		DataChan:  make(chan []byte, 50), // 增加缓冲区大小 to handle browser uploads
-		CloseChan: make(chan struct{}),
+	// 检查文件状态
+	if metadata.Status != STATUS_REGISTERED {
+		return false
 	}
 
-	// 更新文件状态
-	ffb.mu.Lock()
-	if ffb.fileRegistry[authToken] != nil {
-		ffb.fileRegistry[authToken].Status = "streaming"
-		ffb.fileRegistry[authToken].StreamStarted = time.Now()
+	// 检查过期时间
+	if metadata.ExpiresAt.Before(time.Now()) {
+		return false
 	}
-	ffb.activeStreams[authToken] = wsStreamConn
-	ffb.mu.Unlock()
 
-	// Send READY message to indicate connection is established
-	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"command":"READY"}`))
-	if err != nil {
-		log.Printf("发送READY消息失败: %v", err)
-		conn.Close()
-		return
+	// 检查是否已经下载完成
+	if ffb.downloadCompleted[authToken] {
+		return false
 	}
 
-	// 启动数据读取协程
-	go func() {
-		defer close(wsStreamConn.DataChan)
-		defer close(wsStreamConn.CloseChan)
-		defer conn.Close()
+	return true
+}
 
-		for {
-			messageType, message, err := conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket意外关闭: %v", err)
-				} else {
-					log.Printf("WebSocket连接关闭: %v", err)
-				}
-				break
-			}
+// 凭证正确且该令牌正在传输中，用于区分重复连接与无效连接
+func (ffb *FileFlowBridge) isStreamingWithProvider(authToken, providerToken string) bool {
+	ffb.mu.RLock()
+	defer ffb.mu.RUnlock()
 
-			if messageType == websocket.BinaryMessage {
-				// 检查是否有活跃的下载连接
-				ffb.mu.RLock()
-				isDownloadCompleted := ffb.downloadCompleted[authToken]
-				ffb.mu.RUnlock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	return exists && (metadata.Status == STATUS_READY || metadata.Status == STATUS_DOWNLOADING) && providerTokenMatches(metadata, providerToken)
+}
 
-				if isDownloadCompleted {
-					log.Printf("⚠️ 下载已完成，忽略上传数据: %s", authToken)
-					continue
-				}
+// 令牌注册时已命中缓存去重，且上传端凭证正确
+func (ffb *FileFlowBridge) isDeduplicatedWithProvider(authToken, providerToken string) bool {
+	ffb.mu.RLock()
+	defer ffb.mu.RUnlock()
 
-				// 接收到文件数据，发送到数据通道
-				data := make([]byte, len(message))
-				copy(data, message)
+	metadata, exists := ffb.fileRegistry[authToken]
+	return exists && metadata.Deduplicated && providerTokenMatches(metadata, providerToken)
+}
 
-				select {
-				case wsStreamConn.DataChan <- data:
-				case <-time.After(10 * time.Second): // 增加超时时间 to handle slower downloads
-					log.Printf("WebSocket数据通道阻塞，可能下载端已断开: %s", authToken)
-					return
-				}
-			} else if messageType == websocket.TextMessage {
-				// 处理文本消息
-				var msg map[string]interface{}
-				if err := json.Unmarshal(message, &msg); err == nil {
-					if cmd, ok := msg["command"]; ok {
-						switch cmd {
-						case "request_data":
-							// 客户端请求数据块
-							offset, _ := msg["offset"].(float64)
-							size, _ := msg["size"].(float64)
-							ffb.requestFileData(authToken, int64(offset), int64(size))
-						case "download_started":
-							// 下载端已开始下载
-							log.Printf("下载已开始: %s", authToken)
-						case "stop_upload":
-							// 客户端请求停止上传 (when download is cancelled)
-							log.Printf("客户端请求停止上传: %s", authToken)
-							ffb.removeFileResources(authToken)
+// 以常量时间比较上传端凭证
+func providerTokenMatches(metadata *FileMetadata, providerToken string) bool {
+	if metadata.ProviderToken == "" || providerToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(metadata.ProviderToken), []byte(providerToken)) == 1
+}
+
+// 从HTTP上传请求（WebSocket、multipart上传）中取出上传端凭证
+func requestProviderToken(r *http.Request) string {
+	if token := r.Header.Get("X-FileFlow-Provider-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("provider_token")
+}
+
+// 监控连接健康状态
+func (ffb *FileFlowBridge) monitorConnectionHealth(conn *StreamConnection, authToken string) {
+	interval := ffb.healthCheckInterval
+	if interval <= 0 {
+		interval = HEALTH_CHECK_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ffb.mu.RLock()
+	filename := "未知文件"
+	if meta, ok := ffb.fileRegistry[authToken]; ok {
+		filename = meta.OriginalFilename
+	}
+	ffb.mu.RUnlock()
+
+	for {
+		select {
+		case <-ticker.C:
+			ffb.mu.RLock()
+			isCompleted := ffb.downloadCompleted[authToken]
+			_, isActive := ffb.activeStreams[authToken]
+			ffb.mu.RUnlock()
+
+			if isCompleted || !isActive {
+				log.Printf("📭 文件 %s (token_id: %s) 传输结束或资源已释放，停止监控", filename, authToken)
+				return
+			}
+
+			// 上一个检查周期内仍有数据到达，连接显然存活，无需探测
+			if time.Since(time.Unix(0, conn.lastActivity.Load())) < interval {
+				continue
+			}
+			// 数据已全部到达：上传端半关闭写端后连接处于 CLOSE_WAIT，并非断线，剩余数据等待下载方读取
+			if conn.uploadComplete.Load() {
+				continue
+			}
+
+			isBroken := false
+			rawConn := conn.Conn
+			if tlsConn, ok := rawConn.(*tls.Conn); ok {
+				// TLS连接探测底层TCP连接的状态
+				rawConn = tlsConn.NetConn()
+			}
+			if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+				rawConn, err := tcpConn.SyscallConn()
+				if err == nil {
+					rawConn.Control(func(fd uintptr) {
+						// 1. 底层探测：尝试窥视缓冲区 (Peek)
+						// MSG_PEEK: 不取走数据; MSG_DONTWAIT: 非阻塞
+						var buf [1]byte
+						n, _, recvErr := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+
+						// 2. 获取 TCP 状态
+						var info syscall.TCPInfo
+						size := uint32(unsafe.Sizeof(info))
+						ptr := uintptr(unsafe.Pointer(&info))
+						_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+							syscall.IPPROTO_TCP, syscall.TCP_INFO, ptr, uintptr(unsafe.Pointer(&size)), 0)
+
+						if n == 0 && recvErr == nil {
+							isBroken = true
 							return
 						}
-					}
+
+						// 状态 1 为 ESTABLISHED；8 为 CLOSE_WAIT，上传端发完数据后半关闭了写端，
+						// 缓冲区中仍有未读数据时是在等待下载方 (搬运协程在下载方到达前不读取)，并非断线
+						if errno == 0 && info.State != 1 && !(info.State == 8 && n > 0) {
+							isBroken = true
+							return
+						}
+
+						if recvErr != nil && recvErr != syscall.EAGAIN && recvErr != syscall.EWOULDBLOCK {
+							isBroken = true
+							return
+						}
+					})
 				}
 			}
+
+			if isBroken {
+				log.Printf("🔌 检测到物理连接已断开，正在清理: %s (token_id: %s)", filename, authToken)
+				ffb.removeFileResources(authToken)
+				return
+			}
+
+			log.Printf("📡 连接健康检查: %s (token_id: %s) - 活跃中", filename, authToken)
+
+		case <-conn.done:
+			// 流已从活跃列表摘下 (传输完成、资源释放或被新连接替换)，不再等到下一次检查
+			return
+
+		case <-ffb.ShutdownEvent:
+			log.Printf("🛑 服务器关闭，停止监控: %s (token_id: %s)", filename, authToken)
+			return
+		}
+	}
+}
+
+// 解析逗号分隔的可信代理列表，每项为CIDR网段或单个IP；"none" 表示不信任任何代理 (返回空切片)
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	if strings.TrimSpace(s) == TRUSTED_PROXIES_NONE {
+		return proxies, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("无效的IP地址: %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-	}()
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段 %q: %v", item, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
 
-	// 连接关闭时清理资源
-	defer func() {
-		ffb.mu.Lock()
-		delete(ffb.activeStreams, authToken)
-		ffb.mu.Unlock()
-		log.Printf("🔗 WebSocket连接已关闭: %s", authToken)
-	}()
+// 默认可信代理网段，由 DEFAULT_TRUSTED_PROXIES 解析而来
+var defaultTrustedProxyNets, _ = parseTrustedProxies(DEFAULT_TRUSTED_PROXIES)
 
-	// 保持连接活跃
-	<-wsStreamConn.CloseChan
+// 请求是否直接来自可信的反向代理；只有此时 X-Forwarded-* 头才可信，否则任何客户端都能伪造
+func (ffb *FileFlowBridge) fromTrustedProxy(r *http.Request) bool {
+	proxies := ffb.TrustedProxies
+	if proxies == nil {
+		proxies = defaultTrustedProxyNets
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// 处理文件下载
-func (ffb *FileFlowBridge) handleFileDownload(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	authToken := vars["auth_token"]
-	ffb.handleDownloadRequest(w, r, authToken)
+func (ffb *FileFlowBridge) getScheme(r *http.Request) string {
+	// 检查反向代理头，只采信可信代理转发的请求
+	if ffb.fromTrustedProxy(r) {
+		if scheme := r.Header.Get("X-Forwarded-Proto"); scheme != "" {
+			return scheme
+		}
+		if scheme := r.Header.Get("X-Forwarded-Scheme"); scheme != "" {
+			return scheme
+		}
+	}
+	// 默认基于TLS判断
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
 
+// 处理根页面
+func (ffb *FileFlowBridge) handleRootPage(w http.ResponseWriter, r *http.Request) {
+	// 返回index.html
+	http.ServeFile(w, r, "./static/index.html")
 }
 
-// 处理带文件名的下载
-func (ffb *FileFlowBridge) handleFileDownloadWithName(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	authToken := vars["auth_token"]
-	ffb.handleDownloadRequest(w, r, authToken)
+// 获取正确的主机名（去除端口号）
+func getHost(r *http.Request) string {
+	host := r.Host
+	// 移除端口号部分
+	if strings.Contains(host, ":") {
+		return strings.Split(host, ":")[0]
+	}
+	return host
 }
 
-// 处理下载请求的核心逻辑
-func (ffb *FileFlowBridge) handleDownloadRequest(w http.ResponseWriter, r *http.Request, authToken string) {
-	ffb.mu.RLock()
-	metadata, exists := ffb.fileRegistry[authToken]
-	isCompleted := ffb.downloadCompleted[authToken]
-	ffb.mu.RUnlock()
+// 注册响应中的多种访问地址
+type FileURLs struct {
+	Download       string `json:"download"`        // 经由客户端实际访问地址（通常是反向代理）的下载链接
+	DirectDownload string `json:"direct_download"` // 直连桥接服务器HTTP端口的下载链接
+	Status         string `json:"status"`          // 状态查询链接
+}
 
-	if !exists {
-		http.Error(w, "文件不存在", http.StatusNotFound)
-		return
+// 文件名中不可见、但会改变显示效果的字符：双向文本控制符可以让 "gpj.exe" 显示成 "exe.jpg"，
+// 零宽字符可以让两个看起来相同的文件名实际不同
+func isInvisibleFilenameRune(c rune) bool {
+	switch {
+	case c >= 0x202a && c <= 0x202e: // LRE、RLE、PDF、LRO、RLO
+		return true
+	case c >= 0x2066 && c <= 0x2069: // LRI、RLI、FSI、PDI
+		return true
+	case c == 0x200e, c == 0x200f, c == 0x061c: // LRM、RLM、ALM
+		return true
+	case c >= 0x200b && c <= 0x200d: // 零宽空格、零宽非连接符、零宽连接符
+		return true
+	case c == 0x2060, c == 0xfeff: // 词连接符、零宽不换行空格 (BOM)
+		return true
 	}
+	return false
+}
 
-	if isCompleted {
-		http.Error(w, "文件下载已完成，资源已释放", http.StatusGone)
-		return
+// 规范化注册的文件名：去除双向控制符与零宽字符后转换为NFC，
+// 同一个名字无论客户端以组合字符还是预组字符发送，得到的文件名都相同
+func normalizeFilename(name string) string {
+	name = strings.Map(func(c rune) rune {
+		if isInvisibleFilenameRune(c) {
+			return -1
+		}
+		return c
+	}, name)
+	return norm.NFC.String(name)
+}
+
+// 检查文件名是否包含非法字符
+// 文件名会出现在下载路径和Content-Disposition头中，不允许路径分隔符、引号和控制字符
+func validateFilename(name string) error {
+	if name == "." || name == ".." {
+		return fmt.Errorf("文件名无效: %s", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == '\\' || c == '"' || c < 0x20 || c == 0x7f {
+			return fmt.Errorf("文件名包含非法字符: %q", c)
+		}
 	}
+	return nil
+}
 
-	// 不要在这里设置downloadCompleted为false或true
-	// 现有的状态管理逻辑是正确的
+// 自定义元数据会被写入响应头：键只允许字母、数字、'-' 与 '_'，且转换为响应头名后不能重复；
+// 值不允许控制字符 (包括换行)，避免响应头注入
+func validateCustomMetadata(m map[string]string) error {
+	if len(m) > MAX_METADATA_KEYS {
+		return fmt.Errorf("metadata 最多 %d 个键", MAX_METADATA_KEYS)
+	}
+	total := 0
+	headers := make(map[string]string, len(m))
+	for key, value := range m {
+		if key == "" || len(key) > MAX_METADATA_KEY_LENGTH {
+			return fmt.Errorf("metadata 键长度必须在 1-%d 之间: %q", MAX_METADATA_KEY_LENGTH, key)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("metadata 键包含非法字符: %q", key)
+			}
+		}
+		for _, c := range value {
+			if c < 0x20 || c == 0x7f {
+				return fmt.Errorf("metadata 值包含控制字符: %q", key)
+			}
+		}
+		name := metadataHeaderName(key)
+		if other, ok := headers[name]; ok {
+			return fmt.Errorf("metadata 键 %q 与 %q 对应同一个响应头", key, other)
+		}
+		headers[name] = key
+		total += len(key) + len(value)
+	}
+	if total > MAX_METADATA_SIZE {
+		return fmt.Errorf("metadata 总大小超过 %d 字节", MAX_METADATA_SIZE)
+	}
+	return nil
+}
 
-	defer ffb.removeFileResources(authToken)
+// 自定义元数据键对应的响应头名：'_' 换成 '-' 后规范化大小写，如 uploaded_by -> X-Fileflow-Meta-Uploaded-By
+func metadataHeaderName(key string) string {
+	return http.CanonicalHeaderKey(METADATA_HEADER_PREFIX + strings.ReplaceAll(key, "_", "-"))
+}
 
-	// 检查文件状态 - 允许"registered"状态的文件开始下载
-	if metadata.Status != "streaming" && metadata.Status != "registered" {
-		http.Error(w, "文件尚未准备好下载", http.StatusServiceUnavailable)
+// 把自定义元数据写入下载响应头；含非ASCII字符的值无法可靠地放入响应头，只通过 /status 返回
+func (m *FileMetadata) setMetadataHeaders(h http.Header) {
+	for key, value := range m.Metadata {
+		ascii := true
+		for i := 0; i < len(value); i++ {
+			if value[i] >= 0x80 {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			h.Set(metadataHeaderName(key), value)
+		}
+	}
+}
+
+// 按 RFC 7233 判断 Range 请求能否由注册大小满足：只要有一个区间与文件有重叠即可满足。
+// 无法解析的 Range 视为可满足，交由后续处理忽略。注册时已拒绝负数大小，size 总是已知的
+func rangeSatisfiable(header string, size int64) bool {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return true
+	}
+	for _, part := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return true
+		}
+		if first == "" {
+			// 后缀区间 bytes=-N：N 为0或文件为空时无法满足
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				return true
+			}
+			if n > 0 && size > 0 {
+				return true
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return true
+		}
+		if start < size {
+			return true
+		}
+	}
+	return false
+}
+
+// 生成下载响应的Content-Disposition：filename 给出只含ASCII的兼容名称，
+// filename* 按 RFC 5987/6266 给出百分号编码的UTF-8原始名称，现代浏览器优先使用后者
+func contentDisposition(filename string) string {
+	var fallback, encoded strings.Builder
+	for _, c := range filename {
+		switch {
+		case c == '"' || c == '\\':
+			fallback.WriteByte('_')
+		case c < 0x20 || c >= 0x7f:
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+	for _, b := range []byte(filename) {
+		// RFC 5987 attr-char，其余字节一律编码
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+// 生成兼容旧版本的download_url（https时隐藏端口，否则显示监听端口）
+func (ffb *FileFlowBridge) legacyDownloadURL(r *http.Request, scheme, host, authToken, filename string) string {
+	var portStr string
+	if scheme == "https" {
+		// 隐藏端口，因为 Caddy 已经处理了 443 -> 8000 的映射
+		portStr = ""
+	} else {
+		// 本地测试或非加密访问，显示程序真实的监听端口
+		portStr = fmt.Sprintf(":%d", ffb.HTTPPort)
+	}
+	return fmt.Sprintf("%s://%s%s/download/%s/%s", scheme, host, portStr, authToken, url.PathEscape(filename))
+}
+
+// 生成结构化的访问地址：代理地址沿用请求的Host，直连地址使用真实的HTTP端口
+func (ffb *FileFlowBridge) buildFileURLs(r *http.Request, host, authToken, filename string) FileURLs {
+	proxiedBase := fmt.Sprintf("%s://%s", ffb.getScheme(r), r.Host)
+	directBase := fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(ffb.HTTPPort)))
+	downloadPath := fmt.Sprintf("/download/%s/%s", authToken, url.PathEscape(filename))
+
+	return FileURLs{
+		Download:       proxiedBase + downloadPath,
+		DirectDownload: directBase + downloadPath,
+		Status:         fmt.Sprintf("%s/status/%s", proxiedBase, authToken),
+	}
+}
+
+// 处理文件注册
+func (ffb *FileFlowBridge) handleFileRegistration(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "无效的请求体", http.StatusBadRequest)
 		return
 	}
 
-	// 检查流是否可用，如果不可用则等待一段时间
-	var streamConn interface{}
-	var exists1 bool
+	var data struct {
+		Filename     string            `json:"filename"`
+		Size         int64             `json:"size"`
+		MaxDownloads int               `json:"max_downloads"` // 可选，默认1次
+		MaxRate      int64             `json:"max_rate"`      // 可选，下载限速 (字节/秒)
+		SHA256       string            `json:"sha256"`        // 可选，文件内容的SHA-256摘要，缓存模式下用于去重
+		TokenLength  int               `json:"token_length"`  // 可选，本次注册的下载令牌长度，超出范围时使用服务器默认值
+		MTime        int64             `json:"mtime"`         // 可选，文件修改时间 (Unix秒)，下载时作为 Last-Modified
+		Chunked      *bool             `json:"chunked"`       // 可选，覆盖服务器的 --chunked-downloads 设置
+		Metadata     map[string]string `json:"metadata"`      // 可选，自定义键值，下载时作为 X-FileFlow-Meta-* 响应头
+	}
+
+	// 限制请求体大小，超出上限时停止读取，不会把整个请求体读入内存
+	r.Body = http.MaxBytesReader(w, r.Body, ffb.maxRegisterBody())
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("请求体过大，上限为 %d 字节", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "无效的JSON数据", http.StatusBadRequest)
+		return
+	}
+
+	ffb.mu.RLock()
+	paused := ffb.paused
+	shuttingDown := ffb.isShuttingDown
+	shedding := ffb.shedding
+	ffb.mu.RUnlock()
+	if shuttingDown {
+		http.Error(w, "服务器正在关闭，不再接收新的注册", http.StatusServiceUnavailable)
+		return
+	}
+	if shedding {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "服务器负载过高，暂时拒绝新的注册", http.StatusServiceUnavailable)
+		return
+	}
+	if paused {
+		http.Error(w, "服务器维护中，暂停接收新的注册", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 验证输入
+	data.Filename = normalizeFilename(data.Filename)
+	if data.Filename == "" {
+		http.Error(w, "文件名是必需的", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateFilename(data.Filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(data.Filename) > ffb.maxFilenameLength() {
+		http.Error(w, fmt.Sprintf("文件名过长，最多 %d 字节", ffb.maxFilenameLength()), http.StatusBadRequest)
+		return
+	}
+
+	if data.Size < 0 {
+		http.Error(w, "文件大小无效", http.StatusBadRequest)
+		return
+	}
+
+	if data.Size > ffb.MaxFileSize {
+		http.Error(w, "文件大小超过限制", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if data.MaxDownloads == 0 {
+		data.MaxDownloads = 1
+	}
+	if data.MaxDownloads < 1 || data.MaxDownloads > MAX_DOWNLOADS_LIMIT {
+		http.Error(w, fmt.Sprintf("下载次数必须在 1-%d 之间", MAX_DOWNLOADS_LIMIT), http.StatusBadRequest)
+		return
+	}
+
+	if data.MaxRate < 0 {
+		http.Error(w, "下载限速不能为负数", http.StatusBadRequest)
+		return
+	}
+
+	if data.MTime < 0 {
+		http.Error(w, "修改时间无效", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateCustomMetadata(data.Metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data.SHA256 = strings.ToLower(data.SHA256)
+	if data.SHA256 != "" {
+		if decoded, err := hex.DecodeString(data.SHA256); err != nil || len(decoded) != sha256.Size {
+			http.Error(w, "sha256 必须是64位十六进制摘要", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 令牌长度只影响本次注册，不合法时不拒绝注册，在响应中给出警告
+	var warning string
+	if data.TokenLength != 0 {
+		switch {
+		case ffb.WordCodes:
+			warning = "口令模式下忽略 token_length"
+			data.TokenLength = 0
+		case data.TokenLength < MIN_TOKEN_LENGTH || data.TokenLength > ffb.maxTokenLength():
+			warning = fmt.Sprintf("token_length %d 不在有效范围 (%d-%d)，已使用默认长度", data.TokenLength, MIN_TOKEN_LENGTH, ffb.maxTokenLength())
+			data.TokenLength = 0
+		}
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		http.Error(w, "Idempotency-Key 过长", http.StatusBadRequest)
+		return
+	}
+
+	// 生成文件ID和认证令牌：authToken 作为公开的下载令牌，providerToken 仅交给上传端
+	providerToken := randomToken(PROVIDER_TOKEN_LENGTH)
+	clientIP := r.RemoteAddr
+
+	// 磁盘空间在加锁前读取；读取失败时不做磁盘预检，交给写入缓存时的错误处理
+	diskFree := int64(-1)
+	if ffb.CacheDir != "" && data.Size > 0 {
+		if free, err := ffb.cacheDiskFree(); err == nil {
+			diskFree = free
+		} else {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	ffb.mu.Lock()
+	// 相同幂等键的重试直接返回原注册，避免网络抖动后重复注册
+	if original := ffb.idempotentRegistrationLocked(idempotencyKey); original != nil {
+		ffb.mu.Unlock()
+		if original.OriginalFilename != data.Filename || original.Size != data.Size {
+			http.Error(w, "Idempotency-Key 已用于不同的注册", http.StatusConflict)
+			return
+		}
+		log.Printf("🔁 注册重试，返回原注册: %s (token_id: %s)", original.OriginalFilename, original.AuthToken)
+		ffb.writeRegistrationResponse(w, r, original, "")
+		return
+	}
+	if err := ffb.checkCapacityLocked(data.Size, diskFree); err != nil {
+		ffb.mu.Unlock()
+		log.Printf("💽 容量不足，拒绝注册: %s - %v", data.Filename, err)
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	authToken := ffb.createUniqueIDLocked(data.TokenLength)
+
+	// 存储文件元数据
+	metadata := &FileMetadata{
+		Filename:         data.Filename,
+		OriginalFilename: data.Filename,
+		Size:             data.Size,
+		Status:           STATUS_REGISTERED,
+		ClientIP:         clientIP,
+		AuthToken:        authToken,
+		ProviderToken:    providerToken,
+		MaxDownloads:     data.MaxDownloads,
+		MaxRate:          data.MaxRate,
+		SHA256:           data.SHA256,
+		Metadata:         data.Metadata,
+		RegisteredAt:     time.Now(),
+		ExpiresAt:        time.Now().Add(FILE_TTL),
+	}
+	if data.MTime > 0 {
+		metadata.ModTime = time.Unix(data.MTime, 0)
+	}
+	metadata.Chunked = ffb.ChunkedDownloads
+	if data.Chunked != nil {
+		metadata.Chunked = *data.Chunked
+	}
+
+	// 缓存中已有相同内容：新令牌直接共享该缓存文件，立即可以下载
+	if cache := ffb.dedupCacheLocked(data.SHA256, data.Size); cache != nil {
+		cache.refs++
+		ffb.cacheEntries[authToken] = cache
+		metadata.CachePath = cache.path
+		metadata.Status = STATUS_READY
+		metadata.Deduplicated = true
+		log.Printf("♻️ 内容已在缓存中，注册直接复用: %s (token_id: %s)", data.Filename, authToken)
+	}
+
+	ffb.fileRegistry[authToken] = metadata
+	ffb.serverStats.FilesRegisteredTotal++
+	if idempotencyKey != "" {
+		ffb.idempotencyKeys[idempotencyKey] = idempotencyEntry{
+			authToken: authToken,
+			expiresAt: time.Now().Add(IDEMPOTENCY_KEY_TTL),
+		}
+	}
+	ffb.mu.Unlock()
+
+	ffb.writeRegistrationResponse(w, r, metadata, warning)
+
+	log.Printf("📝 文件注册成功: %s (token_id: %s)", data.Filename, authToken)
+	ffb.publishEvent(TransferEvent{Type: "registered", Token: authToken, Filename: data.Filename, Size: data.Size})
+}
+
+// 查找幂等键对应且仍然有效的原注册，调用者需持有写锁
+func (ffb *FileFlowBridge) idempotentRegistrationLocked(key string) *FileMetadata {
+	if key == "" {
+		return nil
+	}
+	entry, ok := ffb.idempotencyKeys[key]
+	if !ok {
+		return nil
+	}
+	original, exists := ffb.fileRegistry[entry.authToken]
+	if !exists || entry.expiresAt.Before(time.Now()) {
+		delete(ffb.idempotencyKeys, key)
+		return nil
+	}
+	return original
+}
+
+// 输出注册响应，首次注册与幂等重试共用；warning 非空时附带在响应中
+func (ffb *FileFlowBridge) writeRegistrationResponse(w http.ResponseWriter, r *http.Request, metadata *FileMetadata, warning string) {
+	authToken := metadata.AuthToken
+	filename := metadata.OriginalFilename
+
+	scheme := ffb.getScheme(r)
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	urls := ffb.buildFileURLs(r, host, authToken, filename)
+
+	// 生成响应
+	responseData := map[string]interface{}{
+		"auth_token":     authToken, // 兼容旧字段，等同于 download_token
+		"download_token": authToken,
+		"provider_token": metadata.ProviderToken,
+		"tcp_endpoint": map[string]interface{}{
+			"host": ffb.tcpEndpointHost(host),
+			"port": ffb.TCPPort,
+			"tls":  ffb.TCPTLSConfig != nil,
+		},
+		"download_url":      ffb.legacyDownloadURL(r, scheme, host, authToken, filename),
+		"urls":              urls,
+		"expires_at":        metadata.ExpiresAt.Format(time.RFC3339),
+		"original_filename": filename,
+		"max_downloads":     metadata.MaxDownloads,
+		"max_rate":          metadata.MaxRate,
+	}
+	if metadata.Deduplicated {
+		responseData["deduplicated"] = true
+	}
+	if metadata.Chunked {
+		responseData["chunked"] = true
+	}
+	if ffb.WordCodes {
+		responseData["word_code"] = authToken
+	}
+	if warning != "" {
+		responseData["warning"] = warning
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responseData)
+}
+
+// 处理文件上传
+func (ffb *FileFlowBridge) handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	authToken := vars["auth_token"]
+
+	// 验证文件令牌与上传端凭证
+	ffb.mu.RLock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	paused := ffb.pausedForNewStreamLocked(authToken)
+	busy := ffb.streamCapacityReachedLocked(authToken)
+	ffb.mu.RUnlock()
+
+	if !exists || !providerTokenMatches(metadata, requestProviderToken(r)) {
+		http.Error(w, "无效的认证令牌", http.StatusUnauthorized)
+		return
+	}
+
+	if paused {
+		http.Error(w, "服务器维护中，暂停接收新的传输", http.StatusServiceUnavailable)
+		return
+	}
+
+	if busy {
+		http.Error(w, "服务器繁忙，活跃流已达上限", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 验证请求内容类型
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "multipart/form-data") {
+		http.Error(w, "请求必须是multipart/form-data格式", http.StatusBadRequest)
+		return
+	}
+
+	// 限制上传大小
+	r.ParseMultipartForm(32 << 20) // 32MB
+
+	// 获取上传的文件
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("获取上传文件失败: %v", err)
+		http.Error(w, "获取上传文件失败", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	// 更新文件状态
+	ffb.mu.Lock()
+	if ffb.fileRegistry[authToken] != nil {
+		ffb.fileRegistry[authToken].Status = STATUS_READY
+		ffb.fileRegistry[authToken].StreamStarted = time.Now()
+	}
+	ffb.mu.Unlock()
+
+	// 创建一个通道来处理数据流
+	dataChan := make(chan []byte, 10)
+
+	// 启动goroutine读取上传的文件数据
+	go func() {
+		defer close(dataChan)
+		buffer := make([]byte, 32*1024) // 32KB buffer
+		for {
+			// 检查下载是否已完成
+			ffb.mu.RLock()
+			completed := ffb.downloadCompleted[authToken]
+			ffb.mu.RUnlock()
+
+			if completed {
+				log.Printf("⚠️ 下载已完成，停止上传: %s", authToken)
+				return
+			}
+
+			n, err := file.Read(buffer)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buffer[:n])
+				select {
+				case dataChan <- data:
+				case <-time.After(5 * time.Second): // 减少超时时间以快速响应
+					log.Printf("数据通道超时，可能下载端已断开: %s", authToken)
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	// 创建一个reader来从channel读取数据
+	reader := &ChannelReader{
+		dataChan: dataChan,
+		buffer:   nil,
+		index:    0,
+		done:     nil,
+	}
+
+	// 将reader包装为StreamConnection
+	streamConn := &StreamConnection{
+		Reader: reader,
+		Writer: nil,
+		Conn:   nil,
+	}
+
+	ffb.mu.Lock()
+	ffb.setActiveStreamLocked(authToken, streamConn)
+	ffb.mu.Unlock()
+
+	// 等待下载完成
+	downloadWaitStart := time.Now()
+	for {
+		ffb.mu.RLock()
+		completed := ffb.downloadCompleted[authToken]
+		_, exists := ffb.activeStreams[authToken]
+		ffb.mu.RUnlock()
+
+		if completed || !exists {
+			break
+		}
+
+		if time.Since(downloadWaitStart) > 10*time.Minute { // 增加超时时间
+			break // 下载超时
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// 不要在这里删除流连接，让handleDownloadRequest完成后删除
+	log.Printf("✅ 文件上传处理完成: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"success": true, "message": "文件上传处理完成"}`)
+}
+
+// WebSocket流连接
+type WebSocketStreamConnection struct {
+	Conn      *websocket.Conn
+	Buffer    []byte
+	Index     int
+	Mutex     sync.Mutex
+	DataChan  chan []byte
+	CloseChan chan struct{}
+
+	deadline atomic.Int64 // Read 等待数据帧的期限 (UnixNano)，0 表示不限
+}
+
+// 实现io.Reader接口，从WebSocket读取数据
+func (wsConn *WebSocketStreamConnection) Read(p []byte) (n int, err error) {
+	// 如果有缓冲数据，先使用缓冲数据
+	if wsConn.Buffer != nil && wsConn.Index < len(wsConn.Buffer) {
+		remaining := len(wsConn.Buffer) - wsConn.Index
+		toCopy := len(p)
+		if toCopy > remaining {
+			toCopy = remaining
+		}
+
+		copy(p, wsConn.Buffer[wsConn.Index:wsConn.Index+toCopy])
+		wsConn.Index += toCopy
+		return toCopy, nil
+	}
+
+	var timeout <-chan time.Time
+	if d := wsConn.deadline.Load(); d != 0 {
+		wait := time.Until(time.Unix(0, d))
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// 从WebSocket连接读取新数据
+	select {
+	case data, ok := <-wsConn.DataChan:
+		if !ok {
+			// 通道已关闭，表示没有更多数据
+			return 0, io.EOF
+		}
+
+		// 使用新数据作为缓冲
+		wsConn.Buffer = data
+		wsConn.Index = 0
+
+		// 返回一部分数据
+		remaining := len(wsConn.Buffer) - wsConn.Index
+		toCopy := len(p)
+		if toCopy > remaining {
+			toCopy = remaining
+		}
+
+		copy(p, wsConn.Buffer[wsConn.Index:wsConn.Index+toCopy])
+		wsConn.Index += toCopy
+		return toCopy, nil
+	case <-wsConn.CloseChan:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// 以文本消息向上传端发送控制命令，与数据读取协程并发时由 Mutex 串行化写入
+func (wsConn *WebSocketStreamConnection) Write(p []byte) (int, error) {
+	if wsConn.Conn == nil {
+		return 0, errNoControlChannel
+	}
+	wsConn.Mutex.Lock()
+	defer wsConn.Mutex.Unlock()
+	if err := wsConn.Conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 发送JSON命令，经由 Write 与其他控制消息串行化
+func (wsConn *WebSocketStreamConnection) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = wsConn.Write(data)
+	return err
+}
+
+func (wsConn *WebSocketStreamConnection) Close() error {
+	if wsConn.Conn == nil {
+		return nil
+	}
+	return wsConn.Conn.Close()
+}
+
+func (wsConn *WebSocketStreamConnection) RemoteAddr() string {
+	if wsConn.Conn == nil {
+		return ""
+	}
+	return wsConn.Conn.RemoteAddr().String()
+}
+
+// 数据帧由读取协程放入 DataChan，期限作用于 Read 等待下一帧的时间，不影响WebSocket连接本身
+func (wsConn *WebSocketStreamConnection) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		wsConn.deadline.Store(0)
+	} else {
+		wsConn.deadline.Store(t.UnixNano())
+	}
+	return nil
+}
+
+// 请求文件数据
+func (ffb *FileFlowBridge) requestFileData(authToken string, offset, size int64) {
+	// 向上传端请求特定偏移量和大小的数据块
+	conn, exists := ffb.activeStreams[authToken]
+	if !exists {
+		log.Printf("找不到连接: %s", authToken)
+		return
+	}
+
+	if wsConn, ok := conn.(*WebSocketStreamConnection); ok {
+		request := map[string]interface{}{
+			"command": "send_chunk",
+			"offset":  offset,
+			"size":    size,
+		}
+
+		err := wsConn.writeJSON(request)
+		if err != nil {
+			log.Printf("发送数据请求失败: %v", err)
+		}
+	}
+}
+
+// 处理WebSocket连接
+func (ffb *FileFlowBridge) handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	authToken := vars["auth_token"]
+
+	// 验证认证令牌与上传端凭证
+	ffb.mu.RLock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	paused := ffb.pausedForNewStreamLocked(authToken)
+	busy := ffb.streamCapacityReachedLocked(authToken)
+	ffb.mu.RUnlock()
+
+	if !exists || !providerTokenMatches(metadata, requestProviderToken(r)) {
+		http.Error(w, "无效的认证令牌", http.StatusUnauthorized)
+		return
+	}
+
+	if paused {
+		http.Error(w, "服务器维护中，暂停接收新的传输", http.StatusServiceUnavailable)
+		return
+	}
+
+	if busy {
+		http.Error(w, "服务器繁忙，活跃流已达上限", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 升级到WebSocket连接，来源不被允许时升级器返回403
+	wsUpgrader := upgrader
+	wsUpgrader.CheckOrigin = ffb.checkWebSocketOrigin
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket升级失败: %v", err)
+		return
+	}
+
+	log.Printf("🔗 WebSocket连接已建立: %s", authToken)
+
+	// 创建WebSocket流连接
+	wsStreamConn := &WebSocketStreamConnection{
+		Conn:      conn,
+		Buffer:    nil,
+		Index:     0,
+		DataChan:  make(chan []byte, 50), // 增加缓冲区大小 to handle browser uploads
+		CloseChan: make(chan struct{}),
+	}
+
+	// 更新文件状态
+	ffb.mu.Lock()
+	if ffb.fileRegistry[authToken] != nil {
+		ffb.fileRegistry[authToken].Status = STATUS_READY
+		ffb.fileRegistry[authToken].StreamStarted = time.Now()
+	}
+	ffb.setActiveStreamLocked(authToken, wsStreamConn)
+	ffb.mu.Unlock()
+
+	// Send READY message to indicate connection is established
+	// 流已对下载方可见，经由 Write 与中继发出的控制命令串行化
+	_, err = wsStreamConn.Write([]byte(`{"command":"READY"}`))
+	if err != nil {
+		log.Printf("发送READY消息失败: %v", err)
+		conn.Close()
+		return
+	}
+
+	// 启动数据读取协程
+	go func() {
+		defer close(wsStreamConn.DataChan)
+		defer close(wsStreamConn.CloseChan)
+		defer conn.Close()
+
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Printf("WebSocket意外关闭: %v", err)
+				} else {
+					log.Printf("WebSocket连接关闭: %v", err)
+				}
+				break
+			}
+
+			if messageType == websocket.BinaryMessage {
+				// 检查是否有活跃的下载连接
+				ffb.mu.RLock()
+				isDownloadCompleted := ffb.downloadCompleted[authToken]
+				ffb.mu.RUnlock()
+
+				if isDownloadCompleted {
+					log.Printf("⚠️ 下载已完成，忽略上传数据: %s", authToken)
+					continue
+				}
+
+				// 接收到文件数据，发送到数据通道
+				data := make([]byte, len(message))
+				copy(data, message)
+
+				select {
+				case wsStreamConn.DataChan <- data:
+				case <-time.After(10 * time.Second): // 增加超时时间 to handle slower downloads
+					log.Printf("WebSocket数据通道阻塞，可能下载端已断开: %s", authToken)
+					return
+				}
+			} else if messageType == websocket.TextMessage {
+				// 处理文本消息
+				var msg map[string]interface{}
+				if err := json.Unmarshal(message, &msg); err == nil {
+					if cmd, ok := msg["command"]; ok {
+						switch cmd {
+						case "request_data":
+							// 客户端请求数据块
+							offset, _ := msg["offset"].(float64)
+							size, _ := msg["size"].(float64)
+							ffb.requestFileData(authToken, int64(offset), int64(size))
+						case "download_started":
+							// 下载端已开始下载
+							log.Printf("下载已开始: %s", authToken)
+						case "stop_upload":
+							// 客户端请求停止上传 (when download is cancelled)
+							log.Printf("客户端请求停止上传: %s", authToken)
+							ffb.removeFileResources(authToken)
+							return
+						}
+					}
+				}
+			}
+		}
+	}()
+
+	// 连接关闭时清理资源
+	defer func() {
+		ffb.mu.Lock()
+		delete(ffb.activeStreams, authToken)
+		ffb.mu.Unlock()
+		log.Printf("🔗 WebSocket连接已关闭: %s", authToken)
+	}()
+
+	// 保持连接活跃
+	<-wsStreamConn.CloseChan
+}
+
+// 处理文件下载
+func (ffb *FileFlowBridge) handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	authToken := vars["auth_token"]
+	ffb.handleDownloadRequest(w, r, authToken)
+
+}
+
+// 处理带文件名的下载：文件名段必须与注册时的文件名一致，不一致时重定向到规范地址
+func (ffb *FileFlowBridge) handleFileDownloadWithName(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	authToken := vars["auth_token"]
+
+	ffb.mu.RLock()
+	canonical := ""
+	if metadata, ok := ffb.fileRegistry[authToken]; ok {
+		canonical = metadata.OriginalFilename
+	}
+	ffb.mu.RUnlock()
+
+	if canonical != "" && vars["filename"] != canonical {
+		// 使用相对地址，经由带路径前缀的反向代理访问时同样有效；重定向不会消耗下载令牌
+		location := url.PathEscape(canonical)
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	ffb.handleDownloadRequest(w, r, authToken)
+}
+
+// 把单个文件的下载响应写成 zip 条目，使打包下载沿用单个下载的转发与缓存逻辑 (下载次数、统计与通知)：
+// 响应头被丢弃，200 响应的正文写入条目，其他状态码的正文 (错误信息) 只保留用于日志
+type zipEntryWriter struct {
+	header  http.Header
+	zw      *zip.Writer
+	out     http.ResponseWriter
+	entry   *zip.FileHeader
+	w       io.Writer
+	status  int
+	written int64
+	errMsg  strings.Builder
+	err     error
+}
+
+func (z *zipEntryWriter) Header() http.Header { return z.header }
+
+func (z *zipEntryWriter) WriteHeader(code int) {
+	if z.status != 0 {
+		return
+	}
+	z.status = code
+	if code == http.StatusOK {
+		z.w, z.err = z.zw.CreateHeader(z.entry)
+	}
+}
+
+func (z *zipEntryWriter) Write(p []byte) (int, error) {
+	if z.status == 0 {
+		z.WriteHeader(http.StatusOK)
+	}
+	if z.status != http.StatusOK {
+		if z.errMsg.Len() < 256 {
+			z.errMsg.Write(p)
+		}
+		return len(p), nil
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, err := z.w.Write(p)
+	z.written += int64(n)
+	if err != nil {
+		z.err = err
+	}
+	return n, err
+}
+
+// 转发时逐块刷新，下载方尽快收到数据
+func (z *zipEntryWriter) Flush() {
+	if z.w == nil || z.err != nil {
+		return
+	}
+	if err := z.zw.Flush(); err != nil {
+		z.err = err
+		return
+	}
+	if flusher, ok := z.out.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// 同名文件在打包中加序号区分，如 a.txt、a (2).txt
+func uniqueZipName(name string, used map[string]bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// 打包下载事先占用的条目：实时转发的流，或缓存文件的下载会话
+type zipClaim struct {
+	token     string
+	metadata  *FileMetadata
+	stream    Stream
+	status    string // 占用前的注册状态，未转发的流恢复为该状态
+	used      bool   // 流已交给 relayDownload，状态由其负责
+	cache     *cacheEntry
+	sessionID string
+}
+
+// 释放打包下载的占用：未转发的流恢复占用前的状态，缓存会话直接删除 (打包下载无法续传)。调用者需持有写锁
+func (ffb *FileFlowBridge) releaseZipClaimsLocked(claims []*zipClaim) {
+	for _, claim := range claims {
+		metadata := claim.metadata
+		if claim.cache != nil {
+			delete(metadata.sessions, claim.sessionID)
+			if metadata.Status != STATUS_DOWNLOADING {
+				continue
+			}
+			inflight := false
+			for _, s := range metadata.sessions {
+				inflight = inflight || s.inflight > 0
+			}
+			if !inflight {
+				metadata.Status = STATUS_READY
+			}
+			continue
+		}
+		if !claim.used && metadata.Status == STATUS_DOWNLOADING && ffb.activeStreams[claim.token] == claim.stream {
+			metadata.Status = claim.status
+		}
+	}
+}
+
+// 处理打包下载：GET /download-zip?tokens=a,b,c 把多个令牌的内容按顺序实时写成一个 zip (STORE，不压缩)。
+// 每个令牌按单独下载的规则消耗一次下载次数；zip 响应开始后无法再返回错误状态码，
+// 因此所有令牌必须事先就绪 (流已建立或已缓存)，并在写出第一个字节前一次性占用，其他下载方无法取走后面的条目；
+// 中途某个条目失败时中止连接并释放其余条目，下载方不会得到缺少条目的完整压缩包
+func (ffb *FileFlowBridge) handleZipDownload(w http.ResponseWriter, r *http.Request) {
+	if ffb.rejectLookupFlood(w, r) {
+		return
+	}
+
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, token := range strings.Split(r.URL.Query().Get("tokens"), ",") {
+		if token = strings.TrimSpace(token); token == "" {
+			continue
+		}
+		if seen[token] {
+			http.Error(w, fmt.Sprintf("令牌重复: %s", token), http.StatusBadRequest)
+			return
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+	if len(tokens) == 0 {
+		http.Error(w, "缺少 tokens 参数", http.StatusBadRequest)
+		return
+	}
+	if len(tokens) > MAX_ZIP_TOKENS {
+		http.Error(w, fmt.Sprintf("打包下载最多包含 %d 个文件", MAX_ZIP_TOKENS), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]*zip.FileHeader, len(tokens))
+	claims := make([]*zipClaim, 0, len(tokens))
+	used := make(map[string]bool)
+	// 同一把写锁下检查并占用全部条目，任一条目不可用时释放已占用的条目
+	ffb.mu.Lock()
+	abort := func() {
+		ffb.releaseZipClaimsLocked(claims)
+		ffb.mu.Unlock()
+	}
+	for i, token := range tokens {
+		metadata, exists := ffb.fileRegistry[token]
+		stream, streaming := ffb.activeStreams[token]
+		cache := ffb.cacheEntries[token]
+		claim := &zipClaim{token: token, metadata: metadata}
+		switch {
+		case !exists:
+			abort()
+			ffb.penalizeFailedLookup(r)
+			http.Error(w, fmt.Sprintf("文件不存在: %s", token), http.StatusNotFound)
+			return
+		case ffb.downloadCompleted[token]:
+			abort()
+			http.Error(w, fmt.Sprintf("文件下载已完成，资源已释放: %s", token), http.StatusGone)
+			return
+		case cache != nil:
+			// 缓存模式占用一个下载会话，条目下载时沿用该会话
+			claim.cache = cache
+			claim.sessionID = ffb.acquireDownloadSessionLocked(metadata, "")
+			if claim.sessionID == "" {
+				abort()
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, fmt.Sprintf("文件正在被其他下载方下载，请稍后重试: %s", token), http.StatusConflict)
+				return
+			}
+		case metadata.Status == STATUS_DOWNLOADING:
+			abort()
+			http.Error(w, fmt.Sprintf("文件正在被其他下载方下载，请稍后重试: %s", token), http.StatusConflict)
+			return
+		case !streaming:
+			abort()
+			respondRetryLater(w, "PROVIDER_NOT_CONNECTED", DOWNLOAD_RETRY_AFTER, fmt.Sprintf("文件尚未就绪，上传端尚未连接: %s", token))
+			return
+		case metadata.Status != STATUS_READY && metadata.Status != STATUS_REGISTERED:
+			abort()
+			http.Error(w, fmt.Sprintf("文件尚未准备好下载: %s", token), http.StatusServiceUnavailable)
+			return
+		default:
+			claim.stream = stream
+			claim.status = metadata.Status
+		}
+		metadata.Status = STATUS_DOWNLOADING
+		claims = append(claims, claim)
+		entries[i] = &zip.FileHeader{
+			Name:     uniqueZipName(metadata.OriginalFilename, used),
+			Method:   zip.Store,
+			Modified: metadata.lastModified(),
+		}
+	}
+	ffb.mu.Unlock()
+	defer func() {
+		ffb.mu.Lock()
+		ffb.releaseZipClaimsLocked(claims)
+		ffb.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(ZIP_DOWNLOAD_NAME))
+	log.Printf("📦 开始打包下载: %d 个文件 (%s)", len(tokens), strings.Join(tokens, ","))
+
+	zw := zip.NewWriter(w)
+	for i, token := range tokens {
+		// 每个条目以不带 Range、条件头与查询参数的普通下载请求获取，缓存下载不会返回206或304；会话只使用事先占用的那个
+		sub := r.Clone(r.Context())
+		sub.URL.RawQuery = ""
+		for _, name := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "X-FileFlow-Session"} {
+			sub.Header.Del(name)
+		}
+
+		claim := claims[i]
+		ew := &zipEntryWriter{header: make(http.Header), zw: zw, out: w, entry: entries[i]}
+		if claim.cache != nil {
+			sub.Header.Set("X-FileFlow-Session", claim.sessionID)
+			ffb.serveFromCache(ew, sub, token, claim.metadata, claim.cache)
+		} else {
+			claim.used = true
+			if err := ffb.relayDownload(ew, sub, token, claim.metadata, claim.stream); err != nil && ew.err == nil {
+				ew.err = err
+			}
+		}
+		if ew.status == 0 {
+			// 空文件的转发不会写出任何数据
+			ew.WriteHeader(http.StatusOK)
+		}
+
+		size := claim.metadata.Size
+		if claim.stream != nil && isOnDemandStream(claim.stream) {
+			size = -1
+		}
+		if ew.status != http.StatusOK || ew.err != nil || (size >= 0 && ew.written != size) {
+			log.Printf("❌ 打包下载中止: %s (token_id: %s, 状态 %d, 已写入 %d 字节) %s %v",
+				entries[i].Name, token, ew.status, ew.written, strings.TrimSpace(ew.errMsg.String()), ew.err)
+			abortResponse(w, fmt.Errorf("打包条目 %s 未完整写入", entries[i].Name))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("❌ 打包下载写入目录失败: %v", err)
+		abortResponse(w, err)
+		return
+	}
+	log.Printf("✅ 打包下载完成: %d 个文件", len(tokens))
+}
+
+// 摘下尚未交付任何数据就已断开的流，注册恢复为等待上传端连接的状态
+func (ffb *FileFlowBridge) discardDeadStream(authToken string, stream Stream) {
+	ffb.mu.Lock()
+	if ffb.activeStreams[authToken] == stream {
+		ffb.deleteActiveStreamLocked(authToken)
+	}
+	if metadata, ok := ffb.fileRegistry[authToken]; ok {
+		metadata.Status = STATUS_REGISTERED
+	}
+	ffb.mu.Unlock()
+
+	stream.Close()
+	ffb.publishEvent(TransferEvent{Type: "error", Token: authToken, Message: "上传端已断开连接"})
+}
+
+// 下载方中途断开时通知WebSocket上传端停止发送；TCP上传端通过 TRANSFER_ABORTED 与连接关闭得知
+func requestStopUpload(stream Stream) {
+	if wsConn, ok := stream.(*WebSocketStreamConnection); ok && wsConn.Conn != nil {
+		if err := wsConn.writeJSON(map[string]interface{}{"command": "stop_upload"}); err != nil {
+			log.Printf("无法发送停止上传命令: %v", err)
+		}
+	}
+}
+
+// 暂时无法下载时返回503：Retry-After 告知重试间隔，错误码 (同时写入 X-FileFlow-Error 与响应体开头) 保持稳定，
+// 下载工具可以据此区分"稍后重试即可"与真正的失败
+func respondRetryLater(w http.ResponseWriter, code string, retryAfter int, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("X-FileFlow-Error", code)
+	http.Error(w, code+": "+message, http.StatusServiceUnavailable)
+}
+
+// 按需发送的流 (--follow) 在下载开始时才读取文件，实际长度可能与注册大小不同
+func isOnDemandStream(stream Stream) bool {
+	tcpConn, ok := stream.(*StreamConnection)
+	return ok && tcpConn.onDemand
+}
+
+// 上传流最多转发的数据量：通常为注册大小；按需发送的流不受注册大小限制，以最大文件大小为上限
+func (ffb *FileFlowBridge) streamLimit(size int64, onDemand bool) int64 {
+	if !onDemand {
+		return size
+	}
+	if ffb.MaxFileSize > 0 {
+		return ffb.MaxFileSize
+	}
+	return math.MaxInt64
+}
+
+// 中止已经开始的响应：接管并关闭底层连接，下载方看到连接错误，而不是一个看似完整的响应。
+// 无法接管连接 (如HTTP/2) 时只记录日志
+func abortResponse(w http.ResponseWriter, reason error) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("⚠️ 无法中止响应: %v (%v)", err, reason)
+		return
+	}
+	conn.Close()
+	log.Printf("✂️ 已中止响应: %v", reason)
+}
+
+// 下载不存在的令牌：按配置重定向到落地页、返回自定义页面，或返回简短的404
+func (ffb *FileFlowBridge) respondDownloadNotFound(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case ffb.NotFoundRedirect != "":
+		http.Redirect(w, r, ffb.NotFoundRedirect, http.StatusFound)
+	case ffb.NotFoundPage != nil:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(ffb.NotFoundPage)
+	default:
+		http.Error(w, "文件不存在", http.StatusNotFound)
+	}
+}
+
+// 单个IP在当前窗口内的令牌查找失败次数
+type lookupFailures struct {
+	count       int
+	windowStart time.Time
+}
+
+// 该IP在当前窗口内的查找失败次数已达 MaxFailedLookups 时返回429，窗口结束前该IP的所有令牌查找都被拒绝
+func (ffb *FileFlowBridge) rejectLookupFlood(w http.ResponseWriter, r *http.Request) bool {
+	if ffb.MaxFailedLookups <= 0 {
+		return false
+	}
+	now := time.Now()
+	ffb.mu.RLock()
+	failures := ffb.failedLookups[ffb.downloaderIP(r)]
+	var remaining time.Duration
+	if failures != nil && failures.count >= ffb.MaxFailedLookups {
+		remaining = FAILED_LOOKUP_WINDOW - now.Sub(failures.windowStart)
+	}
+	ffb.mu.RUnlock()
+	if remaining <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int((remaining+time.Second-1)/time.Second)))
+	http.Error(w, "令牌查找失败次数过多，请稍后重试", http.StatusTooManyRequests)
+	return true
+}
+
+// 令牌不存在：计入该IP的查找失败次数，并按 NotFoundDelay 延迟响应，提高逐个枚举令牌的成本。
+// 延迟附加随机抖动，使响应时间无法区分不同的失败原因
+func (ffb *FileFlowBridge) penalizeFailedLookup(r *http.Request) {
+	if ffb.MaxFailedLookups > 0 {
+		ip := ffb.downloaderIP(r)
+		now := time.Now()
+		ffb.mu.Lock()
+		if ffb.failedLookups == nil {
+			ffb.failedLookups = make(map[string]*lookupFailures)
+		}
+		failures := ffb.failedLookups[ip]
+		if failures == nil || now.Sub(failures.windowStart) >= FAILED_LOOKUP_WINDOW {
+			failures = &lookupFailures{windowStart: now}
+			ffb.failedLookups[ip] = failures
+		}
+		failures.count++
+		if failures.count == ffb.MaxFailedLookups {
+			log.Printf("🛡️ 令牌查找失败次数达到上限 (%d 次/%v)，暂时拒绝该IP的查找: %s", ffb.MaxFailedLookups, FAILED_LOOKUP_WINDOW, ip)
+		}
+		ffb.mu.Unlock()
+	}
+
+	if ffb.NotFoundDelay > 0 {
+		timer := time.NewTimer(ffb.NotFoundDelay + time.Duration(mrand.Int64N(int64(ffb.NotFoundDelay)/4+1)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// 下载就绪探测 (?probe=1)：不占用下载次数、不改变任何状态。流已建立或缓存可用时返回200，
+// 仍在等待上传端时返回202与Retry-After，客户端可以低成本轮询而不必发起会阻塞等待的下载
+func (ffb *FileFlowBridge) handleDownloadProbe(w http.ResponseWriter, r *http.Request, authToken string) {
+	ffb.mu.RLock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	completed := ffb.downloadCompleted[authToken]
+	_, streaming := ffb.activeStreams[authToken]
+	_, cached := ffb.cacheEntries[authToken]
+	var status, filename string
+	var size int64
+	if exists {
+		status, filename, size = metadata.Status, metadata.OriginalFilename, metadata.Size
+	}
+	ffb.mu.RUnlock()
+
+	switch {
+	case !exists:
+		ffb.penalizeFailedLookup(r)
+		http.Error(w, "文件不存在", http.StatusNotFound)
+		return
+	case completed:
+		http.Error(w, "文件下载已完成，资源已释放", http.StatusGone)
+		return
+	case status == STATUS_DOWNLOADING && !cached:
+		http.Error(w, "文件正在被其他下载方下载，请稍后重试", http.StatusConflict)
+		return
+	}
+
+	ready := streaming || cached
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":    ready,
+		"status":   status,
+		"filename": filename,
+		"size":     size,
+	})
+}
+
+// 处理下载请求的核心逻辑
+func (ffb *FileFlowBridge) handleDownloadRequest(w http.ResponseWriter, r *http.Request, authToken string) {
+	if ffb.rejectLookupFlood(w, r) {
+		return
+	}
+	if r.URL.Query().Get("probe") == "1" {
+		ffb.handleDownloadProbe(w, r, authToken)
+		return
+	}
+
+	ffb.mu.RLock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	isCompleted := ffb.downloadCompleted[authToken]
+	// 缓存模式允许多个下载会话并行，由会话数限制
+	isTransferring := exists && metadata.Status == STATUS_DOWNLOADING && ffb.cacheEntries[authToken] == nil
+	var size int64
+	if exists {
+		size = metadata.Size
+	}
+	ffb.mu.RUnlock()
+
+	if !exists {
+		ffb.penalizeFailedLookup(r)
+		ffb.respondDownloadNotFound(w, r)
+		return
+	}
+
+	// 超出注册大小的 Range 在占用下载次数与会话之前返回416；携带 If-Range 时由缓存下载自行判断是否忽略 Range
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && r.Header.Get("If-Range") == "" && !rangeSatisfiable(rangeHeader, size) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "请求的范围超出文件大小", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if isCompleted {
+		http.Error(w, "文件下载已完成，资源已释放", http.StatusGone)
+		return
+	}
+
+	if isTransferring {
+		http.Error(w, "文件正在被其他下载方下载，请稍后重试", http.StatusConflict)
+		return
+	}
+
+	// 不要在这里设置downloadCompleted为false或true
+	// 现有的状态管理逻辑是正确的
+
+	// 缓存模式下文件可以多次、分段下载，不走单次转发的资源释放逻辑
+	if cache := ffb.cacheEntryFor(authToken); cache != nil {
+		ffb.serveFromCache(w, r, authToken, metadata, cache)
+		return
+	}
+
+	// 单次下载结束后释放资源；多次下载的分享只在次数用完后释放
+	releaseOnReturn := metadata.MaxDownloads <= 1
+	defer func() {
+		if releaseOnReturn {
+			ffb.removeFileResources(authToken)
+		}
+	}()
+
+	// 检查文件状态 - 允许流尚未建立的文件开始下载，等待上传端连接
+	if metadata.Status != STATUS_READY && metadata.Status != STATUS_REGISTERED {
+		http.Error(w, "文件尚未准备好下载", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 流尚未建立且活跃流已满或服务器已暂停时，等待也无法成功，直接返回繁忙
+	ffb.mu.RLock()
+	paused := ffb.pausedForNewStreamLocked(authToken)
+	busy := ffb.streamCapacityReachedLocked(authToken)
+	ffb.mu.RUnlock()
+	// 以下几种情况只是暂时无法下载，保留注册，下载方按 Retry-After 重试即可
+	if paused {
+		log.Printf("⏸️ 服务器已暂停且尚无流连接，拒绝下载: %s", authToken)
+		releaseOnReturn = false
+		respondRetryLater(w, "SERVER_PAUSED", 60, "服务器维护中，暂停接收新的传输")
+		return
+	}
+	if busy {
+		log.Printf("🚦 活跃流已达上限，拒绝下载: %s", authToken)
+		releaseOnReturn = false
+		respondRetryLater(w, "SERVER_BUSY", 30, "服务器繁忙，活跃流已达上限")
+		return
+	}
+
+	// 检查流是否可用，如果不可用则等待流连接建立的通知
+	streamConn, exists1 := ffb.waitForStream(r.Context(), authToken, ffb.downloadWaitTimeout())
+
+	if !exists1 {
+		log.Printf("⚠️ 文件源不可用，可能流连接尚未建立: %s", authToken)
+		releaseOnReturn = false
+		respondRetryLater(w, "PROVIDER_NOT_CONNECTED", DOWNLOAD_RETRY_AFTER, "文件源不可用，上传端尚未连接，请稍后重试")
+		return
+	}
+
+	// 等待期间上传端以缓存模式接入
+	if cache := ffb.cacheEntryFor(authToken); cache != nil {
+		releaseOnReturn = false
+		ffb.serveFromCache(w, r, authToken, metadata, cache)
+		return
+	}
+
+	// 占用流连接，同一时刻只允许一个下载方读取：多个下载方可能同时等到同一个流，
+	// 只有第一个占用成功；等待与占用之间流已被其他下载方读完并摘下时同样拒绝，不读取已结束的旧流
+	ffb.mu.Lock()
+	if metadata.Status == STATUS_DOWNLOADING || ffb.activeStreams[authToken] != streamConn {
+		ffb.mu.Unlock()
+		releaseOnReturn = false
+		http.Error(w, "文件正在被其他下载方下载，请稍后重试", http.StatusConflict)
+		return
+	}
+	metadata.Status = STATUS_DOWNLOADING
+	ffb.mu.Unlock()
+	releaseOnReturn = false
+	if err := ffb.relayDownload(w, r, authToken, metadata, streamConn); err != nil {
+		abortResponse(w, err)
+	}
+}
+
+// 把已占用的流转发给下载方，结束后记录统计、更新注册状态并通知上传端；调用者需已把注册标记为下载中。
+// 返回错误表示响应已经开始但数据不完整，调用者需中止响应而不是正常结束
+func (ffb *FileFlowBridge) relayDownload(w http.ResponseWriter, r *http.Request, authToken string, metadata *FileMetadata, streamConn Stream) error {
+	// 单次下载完成后释放资源；多次下载的分享只在次数用完后释放，中止的下载不占用名额
+	releaseOnReturn := metadata.MaxDownloads <= 1
+	defer func() {
+		if releaseOnReturn {
+			ffb.removeFileResources(authToken)
+		}
+	}()
+
+	if tcpConn, ok := streamConn.(*StreamConnection); ok {
+		tcpConn.signalDemand(authToken)
+	}
+
+	// 准备响应头
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDisposition(metadata.OriginalFilename))
+	w.Header().Set("X-FileFlow-FileID", authToken)
+	w.Header().Set("X-FileFlow-Original-Filename", metadata.OriginalFilename)
+	metadata.setMetadataHeaders(w.Header())
+	if !metadata.ModTime.IsZero() {
+		// http.TimeFormat 即RFC 1123格式，必须使用GMT
+		w.Header().Set("Last-Modified", metadata.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	// 空文件同样声明长度，下载方无需等待连接关闭即可判断结束；
+	// 分块模式不声明长度，下载方看不到进度百分比，但不会因长度不符而挂起
+	// 按需发送的流同样不声明长度，读到上传端的EOF为止
+	onDemand := isOnDemandStream(streamConn)
+	size := ffb.streamLimit(metadata.Size, onDemand)
+	chunked := metadata.Chunked || onDemand
+	if !chunked {
+		w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
+	}
+
+	// 开始传输
+	log.Printf("⬇️ 开始下载: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+
+	startTime := time.Now()
+	var totalTransferred int64
+	bytesCounter := ffb.newByteCounter(ffb.downloaderIP(r))
+	// 提前返回或中止响应时同样计入已转发的字节
+	defer bytesCounter.flush()
+	buf := make([]byte, ffb.sendBufferSize())
+
+	// 吞吐量采样
+	windowStart := startTime
+	var windowBytes int64
+	defer ffb.clearThroughput(authToken)
+
+	// 是否完整地把数据交付给了下载方（而不是因错误或客户端断开而中止）
+	transferFinished := false
+	truncated := false // 上传流在达到注册大小之前结束
+
+	limiter := newRateLimiter(ffb.effectiveRate(metadata))
+
+	// 所有上传源共用下面的中继循环；WebSocket上传端收到命令后才开始发送
+	if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok {
+		// 对于WebSocket连接，发送请求数据的命令
+		// 这将触发上传端开始发送数据
+		request := map[string]interface{}{
+			"command": "download_started", // 通知上传端下载已开始
+			"offset":  0,                  // 从开头开始
+			"size":    metadata.Size,      // 请求整个文件
+		}
+		err := wsConn.writeJSON(request)
+		if err != nil {
+			log.Printf("发送下载开始通知失败: %v", err)
+		} else {
+			log.Printf("✅ 已通知上传端下载已开始: %s", authToken)
+		}
+
+		// 然后发送实际的数据请求
+		request = map[string]interface{}{
+			"command": "send_chunk",
+			"offset":  0,             // 从开头开始
+			"size":    metadata.Size, // 请求整个文件
+		}
+		err = wsConn.writeJSON(request)
+		if err != nil {
+			// 上传端的WebSocket已不可用：摘下该流并恢复为等待上传端连接的状态，
+			// 否则注册停留在下载中，之后的下载 (多次下载的分享) 都会收到409
+			log.Printf("发送数据请求失败: %s - %v", authToken, err)
+			ffb.discardDeadStream(authToken, streamConn)
+			releaseOnReturn = false
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "无法从上传端请求数据", http.StatusBadGateway)
+			return nil
+		}
+	}
+
+	// 检查客户端连接是否断开的函数
+	clientClosed := func() bool {
+		select {
+		case <-r.Context().Done():
+			return true
+		default:
+			return false
+		}
+	}
+
+	for {
+		// 检查客户端是否已断开连接
+		if clientClosed() {
+			log.Printf("❌ 客户端连接断开，停止传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+			// 通知上传端停止上传
+			requestStopUpload(streamConn)
+			break
+		}
+
+		// 最多读取到注册声明的大小，多出的数据不再转发，避免与Content-Length不符
+		remaining := size - totalTransferred
+		if remaining <= 0 {
+			// 空文件无需等待上传流
+			transferFinished = true
+			break
+		}
+		readLen := limiter.chunk(len(buf))
+		if int64(readLen) > remaining {
+			readLen = int(remaining)
+		}
+		streamConn.SetReadDeadline(time.Now().Add(STREAM_IDLE_TIMEOUT))
+		n, err := streamConn.Read(buf[:readLen])
+		var netErr net.Error
+		if n == 0 && totalTransferred == 0 && (err == io.EOF || errors.As(err, &netErr)) && !clientClosed() {
+			// 上传端在下载方到达前已断开：返回502而不是空的成功响应，注册保留以便上传端重新连接
+			log.Printf("❌ 上传端已断开连接，流不可用: %s (token_id: %s) - %v", metadata.OriginalFilename, authToken, err)
+			ffb.discardDeadStream(authToken, streamConn)
+			releaseOnReturn = false
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "上传端已断开连接", http.StatusBadGateway)
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				if totalTransferred < metadata.Size && !onDemand {
+					// 上传流提前结束（如文件在注册后被截断或上传端过早关闭写端），只有转发满注册大小才算完成；
+					// 响应头已发出，下载方会因Content-Length不足而报错
+					log.Printf("❌ 上传流提前结束，文件被截断: %s (token_id: %s, 已传输 %d / %d 字节)", metadata.OriginalFilename, authToken, totalTransferred, metadata.Size)
+					truncated = true
+					break
+				}
+				transferFinished = true
+				break
+			}
+
+			ffb.handleStreamError(authToken, err)
+			break
+		}
+
+		if n == 0 {
+			break
+		}
+
+		// 再次检查客户端是否已断开连接
+		if clientClosed() {
+			log.Printf("❌ 客户端连接断开，停止传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+			// 通知上传端停止上传
+			requestStopUpload(streamConn)
+			break
+		}
+
+		// 按限速节流后写入响应
+		limiter.wait(r.Context(), n)
+		if _, err := w.Write(buf[:n]); err != nil {
+			log.Printf("❌ 客户端断开连接: %v", err)
+			// 通知上传端停止上传
+			requestStopUpload(streamConn)
+			break
+		}
+
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		totalTransferred += int64(n)
+		bytesCounter.add(int64(n))
+		windowBytes += int64(n)
+
+		if elapsed := time.Since(windowStart); elapsed >= THROUGHPUT_SAMPLE_INTERVAL {
+			ffb.recordThroughput(authToken, float64(windowBytes)/elapsed.Seconds())
+			ffb.publishEvent(TransferEvent{Type: "progress", Token: authToken, Filename: metadata.OriginalFilename, Bytes: totalTransferred, Size: metadata.Size})
+			windowStart = time.Now()
+			windowBytes = 0
+		}
+
+		// 检查是否已传输完整个文件
+		if totalTransferred >= size {
+			log.Printf("✅ 文件数据已全部传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+			transferFinished = true
+			break
+		}
+	}
+
+	// 传输完成
+	transferTime := time.Since(startTime).Seconds()
+	ffb.mu.Lock()
+	ffb.serverStats.FilesTransferred++
+	if transferFinished {
+		ffb.serverStats.FilesCompletedTotal++
+		metadata.DownloadCount++
+		ffb.recordTransfer(totalTransferred, time.Since(startTime))
+	}
+	if truncated {
+		ffb.serverStats.FilesTruncatedTotal++
+	}
+
+	// 次数用完前保留注册，等待上传端重新建立流；只有完整交付才计入次数，
+	// 中止的下载 (包括单次下载的分享) 释放名额，由下一个下载方取得
+	downloadCount, maxDownloads := metadata.DownloadCount, max(metadata.MaxDownloads, 1)
+	reusable := downloadCount < maxDownloads
+	if reusable {
+		metadata.Status = STATUS_REGISTERED
+	} else {
+		metadata.Status = STATUS_COMPLETED
+		ffb.downloadCompleted[authToken] = true
+	}
+	releaseOnReturn = !reusable
+	ffb.notifyTransferDoneLocked(authToken)
+
+	// 先摘下当前流再通知上传端，避免上传端重连后新流被误删
+	stream, exists := ffb.activeStreams[authToken]
+	ffb.deleteActiveStreamLocked(authToken)
+	ffb.mu.Unlock()
+
+	ev := TransferEvent{Type: "completed", Token: authToken, Filename: metadata.OriginalFilename, Bytes: totalTransferred, Size: metadata.Size}
+	if !transferFinished {
+		ev.Type = "error"
+		ev.Message = "下载中止"
+		if truncated {
+			ev.Message = "上传流提前结束"
+		}
+	}
+	ffb.publishEvent(ev)
+
+	if transferTime > 0 {
+		sizeMiB := float64(totalTransferred) / (1024 * 1024)
+		speedValue := float64(totalTransferred) / transferTime / 1024
+		speedUnit := "KiB/s"
+		if speedValue >= 1024 {
+			speedValue /= 1024
+			speedUnit = "MiB/s"
+		}
+
+		log.Printf("✅ 传输完成: %s (token_id: %s), 大小: %.2f MiB, 耗时: %.2fs, 速度: %.2f %s",
+			metadata.OriginalFilename,
+			authToken,
+			sizeMiB,
+			transferTime,
+			speedValue,
+			speedUnit,
+		)
+	}
+
+	// 通知上传端传输已完成
+	if exists {
+		if tcpConn, ok := stream.(*StreamConnection); ok && tcpConn.Conn != nil {
+			// 关闭前通过控制通道告知上传端下载结果
+			notification := "TRANSFER_COMPLETE\n"
+			if !transferFinished {
+				notification = "TRANSFER_ABORTED\n"
+			}
+			tcpConn.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := tcpConn.Conn.Write([]byte(notification)); err != nil {
+				log.Printf("发送传输结果通知失败: %s - %v", authToken, err)
+			}
+			if transferFinished {
+				// 等上传端结束发送后再关闭，避免RST截断上传端尚未读取的结果通知；在后台等待，不拖延下载响应的结束
+				go func() {
+					tcpConn.drainUpload(STREAM_DRAIN_TIMEOUT)
+					tcpConn.Conn.Close()
+					tcpConn.closePipe()
+					log.Printf("🔌 关闭已完成文件的TCP连接: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+				}()
+			} else {
+				// 中止的传输不再读取剩余数据
+				tcpConn.Conn.Close()
+				tcpConn.closePipe()
+				log.Printf("🔌 关闭已完成文件的TCP连接: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+			}
+		} else if wsConn, ok := stream.(*WebSocketStreamConnection); ok {
+			// 与TCP的 TRANSFER_COMPLETE / TRANSFER_ABORTED 对应，告知上传端下载结果
+			notification := map[string]interface{}{
+				"command": "transfer_complete",
+				"message": "文件传输已完成",
+			}
+			if !transferFinished {
+				notification = map[string]interface{}{
+					"command": "transfer_aborted",
+					"message": "下载未完成",
+				}
+			}
+
+			// 检查WebSocket连接是否仍然开放
+			if wsConn.Conn != nil {
+				// 尝试发送传输完成通知
+				err := wsConn.writeJSON(notification)
+				if err != nil {
+					log.Printf("发送传输完成通知失败: %v", err)
+				} else {
+					log.Printf("✅ 已通知上传端传输完成: %s", authToken)
+				}
+			} else {
+				log.Printf("WebSocket连接已关闭，无法发送传输完成通知: %s", authToken)
+			}
+
+			if wsConn.Conn != nil {
+				wsConn.Conn.Close()
+			}
+			log.Printf("🔌 关闭已完成文件的WebSocket连接: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+		}
+	} else {
+		log.Printf("⚠️ 传输完成时未找到活动连接: %s", authToken)
+	}
+
+	if reusable {
+		log.Printf("🔁 已完成 %d/%d 次下载，等待上传端重新建立流: %s (token_id: %s)", downloadCount, maxDownloads, metadata.OriginalFilename, authToken)
+	} else {
+		log.Printf("🏁 文件标记为已完成: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+	}
+
+	if chunked && !transferFinished {
+		// 没有Content-Length时正常返回会写出结束块，下载方会把不完整的数据当作完整文件；
+		// 由调用者中止响应，下载方看到的是连接错误而不是被截断的文件
+		return fmt.Errorf("分块下载未完整交付: 已传输 %d / %d 字节", totalTransferred, metadata.Size)
+	}
+	return nil
+}
+
+// 把一次完整下载计入大小、耗时与速度分布
+func (ffb *FileFlowBridge) recordTransfer(size int64, duration time.Duration) {
+	ffb.transferSizes.observe(float64(size))
+	ffb.transferDurations.observe(duration.Seconds())
+	if duration > 0 {
+		ffb.transferRates.observe(float64(size) / duration.Seconds())
+	}
+}
+
+// 以Prometheus文本格式输出传输分布，可直接作为抓取目标，用 histogram_quantile 计算分位数
+func (ffb *FileFlowBridge) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ffb.transferSizes.writeProm(w, "fileflow_transfer_size_bytes", "完整下载的文件大小 (字节)")
+	ffb.transferDurations.writeProm(w, "fileflow_transfer_duration_seconds", "完整下载的耗时 (秒)，缓存模式下从下载会话开始计时")
+	ffb.transferRates.writeProm(w, "fileflow_transfer_throughput_bytes_per_second", "完整下载的平均速度 (字节/秒)")
+}
+
+// 累加已传输字节数，并计入下载方IP在滚动窗口内的流量
+func (ffb *FileFlowBridge) addBytesTransferred(clientIP string, n int64) {
+	ffb.mu.Lock()
+	ffb.serverStats.BytesTransferred += n
+	if clientIP != "" {
+		usage, ok := ffb.bandwidthByIP[clientIP]
+		if !ok {
+			usage = &ipBandwidth{}
+			ffb.bandwidthByIP[clientIP] = usage
+		}
+		usage.add(time.Now(), n)
+	}
+	ffb.mu.Unlock()
+}
+
+// 单个下载方IP在滚动窗口内的下行字节数，按分钟分桶
+type ipBandwidth struct {
+	buckets  [BANDWIDTH_WINDOW_MINUTES]int64
+	minutes  [BANDWIDTH_WINDOW_MINUTES]int64 // 各桶对应的分钟序号 (Unix秒/60)
+	lastSeen time.Time
+}
+
+func (b *ipBandwidth) add(now time.Time, n int64) {
+	minute := now.Unix() / 60
+	i := minute % BANDWIDTH_WINDOW_MINUTES
+	if b.minutes[i] != minute {
+		b.minutes[i] = minute
+		b.buckets[i] = 0
+	}
+	b.buckets[i] += n
+	b.lastSeen = now
+}
+
+// 窗口内的字节总数，过期的桶不计入
+func (b *ipBandwidth) total(now time.Time) int64 {
+	minute := now.Unix() / 60
+	var sum int64
+	for i, bucketMinute := range b.minutes {
+		if minute-bucketMinute < BANDWIDTH_WINDOW_MINUTES {
+			sum += b.buckets[i]
+		}
+	}
+	return sum
+}
+
+// 下载方的真实IP：经由可信反向代理时取 X-Forwarded-For 的第一个地址，否则使用连接的对端地址
+func (ffb *FileFlowBridge) downloaderIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && ffb.fromTrustedProxy(r) {
+		first, _, _ := strings.Cut(forwarded, ",")
+		if ip := strings.TrimSpace(first); ip != "" {
+			return ip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// 下载实际生效的限速：注册时的max_rate与服务器全局限速取较小值，0 表示不限速
+func (ffb *FileFlowBridge) effectiveRate(metadata *FileMetadata) int64 {
+	rate := metadata.MaxRate
+	if ffb.MaxRate > 0 && (rate <= 0 || ffb.MaxRate < rate) {
+		rate = ffb.MaxRate
+	}
+	return rate
+}
+
+// 判断是否已无法为该令牌建立新的流：活跃流已满或处于卸载模式（已有流的令牌不受影响），调用者需持有锁
+func (ffb *FileFlowBridge) streamCapacityReachedLocked(authToken string) bool {
+	if _, exists := ffb.activeStreams[authToken]; exists {
+		return false
+	}
+	if ffb.shedding {
+		return true
+	}
+	return ffb.MaxActiveStreams > 0 && len(ffb.activeStreams) >= ffb.MaxActiveStreams
+}
+
+// 资源看门狗：定期采样堆内存，超过高水位时进入卸载模式，回落后恢复
+func (ffb *FileFlowBridge) runWatchdog() {
+	ticker := time.NewTicker(WATCHDOG_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		ffb.sampleResources()
+		select {
+		case <-ticker.C:
+		case <-ffb.ShutdownEvent:
+			return
+		}
+	}
+}
+
+// 采样一次堆内存并按高水位切换卸载模式
+func (ffb *FileFlowBridge) sampleResources() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	heapMiB := float64(ms.HeapInuse) / (1024 * 1024)
+
+	ffb.mu.Lock()
+	ffb.heapInUse = ms.HeapInuse
+	wasShedding := ffb.shedding
+	if ffb.MemoryHighWater > 0 {
+		if !ffb.shedding && int64(ms.HeapInuse) >= ffb.MemoryHighWater {
+			ffb.shedding = true
+		} else if ffb.shedding && float64(ms.HeapInuse) < float64(ffb.MemoryHighWater)*SHED_RECOVERY_RATIO {
+			ffb.shedding = false
+		}
+	}
+	shedding := ffb.shedding
+	connections := ffb.serverStats.ActiveConnections
+	ffb.mu.Unlock()
+
+	highWaterMiB := float64(ffb.MemoryHighWater) / (1024 * 1024)
+	if shedding && !wasShedding {
+		log.Printf("🚨 堆内存 %.1f MiB 超过高水位 %.1f MiB，进入卸载模式，拒绝新的注册与流连接 (活跃连接: %d)", heapMiB, highWaterMiB, connections)
+	} else if !shedding && wasShedding {
+		log.Printf("✅ 堆内存回落到 %.1f MiB，退出卸载模式 (活跃连接: %d)", heapMiB, connections)
+	}
+}
+
+// 判断暂停期间是否拒绝为该令牌建立新的流（已有流的令牌不受影响），调用者需持有锁
+func (ffb *FileFlowBridge) pausedForNewStreamLocked(authToken string) bool {
+	if !ffb.paused {
+		return false
+	}
+	_, exists := ffb.activeStreams[authToken]
+	return !exists
+}
+
+// 保存活跃流并唤醒等待该令牌的下载方，调用者需持有写锁
+func (ffb *FileFlowBridge) setActiveStreamLocked(authToken string, stream Stream) {
+	if prev, ok := ffb.activeStreams[authToken].(*StreamConnection); ok && prev != stream {
+		prev.stop()
+	}
+	ffb.activeStreams[authToken] = stream
+	if ready, ok := ffb.streamReady[authToken]; ok {
+		close(ready)
+		delete(ffb.streamReady, authToken)
+	}
+
+	ev := TransferEvent{Type: "stream_established", Token: authToken}
+	if metadata, ok := ffb.fileRegistry[authToken]; ok {
+		ev.Filename = metadata.OriginalFilename
+		ev.Size = metadata.Size
+	}
+	ffb.publishEvent(ev)
+}
+
+// 从活跃列表摘下流连接，并让其健康检查协程随之退出。调用者需持有写锁
+func (ffb *FileFlowBridge) deleteActiveStreamLocked(authToken string) {
+	if tcpConn, ok := ffb.activeStreams[authToken].(*StreamConnection); ok {
+		tcpConn.stop()
+	}
+	delete(ffb.activeStreams, authToken)
+}
+
+// 发布传输事件，补全时间戳
+func (ffb *FileFlowBridge) publishEvent(ev TransferEvent) {
+	ev.Timestamp = time.Now()
+	ffb.events.publish(ev)
+}
+
+// 下载方等待流连接的最长时间，未配置时使用默认值
+func (ffb *FileFlowBridge) downloadWaitTimeout() time.Duration {
+	if ffb.DownloadWait > 0 {
+		return ffb.DownloadWait
+	}
+	return DEFAULT_DOWNLOAD_WAIT
+}
+
+// TCP流连接的握手时限，未配置时使用默认值
+func (ffb *FileFlowBridge) handshakeTimeout() time.Duration {
+	if ffb.HandshakeTimeout > 0 {
+		return ffb.HandshakeTimeout
+	}
+	return STREAM_HANDSHAKE_TIMEOUT
+}
+
+// 中继缓冲区大小，未配置时使用默认值
+func (ffb *FileFlowBridge) sendBufferSize() int {
+	if ffb.SendBufferSize > 0 {
+		return ffb.SendBufferSize
+	}
+	return DEFAULT_SEND_BUFFER_SIZE
+}
+
+// 下载会话的租约时长，未配置时使用默认值
+func (ffb *FileFlowBridge) downloadLeaseTTL() time.Duration {
+	if ffb.DownloadLeaseTTL > 0 {
+		return ffb.DownloadLeaseTTL
+	}
+	return DOWNLOAD_SESSION_TTL
+}
+
+// 文件名长度上限，未配置时使用默认值
+func (ffb *FileFlowBridge) maxFilenameLength() int {
+	if ffb.MaxFilenameLength > 0 {
+		return ffb.MaxFilenameLength
+	}
+	return DEFAULT_MAX_FILENAME_LENGTH
+}
+
+// 注册请求体的大小上限，未配置时使用默认值
+func (ffb *FileFlowBridge) maxRegisterBody() int64 {
+	if ffb.MaxRegisterBody > 0 {
+		return ffb.MaxRegisterBody
+	}
+	return DEFAULT_MAX_REGISTER_BODY
+}
+
+// 注册请求可指定的下载令牌长度上限
+func (ffb *FileFlowBridge) maxTokenLength() int {
+	if ffb.MaxTokenLength > 0 {
+		return ffb.MaxTokenLength
+	}
+	return DEFAULT_MAX_TOKEN_LENGTH
+}
+
+// 等待令牌对应的流连接建立，流就绪时立即返回而不是轮询
+// 超时、客户端断开或文件资源被移除时返回false
+func (ffb *FileFlowBridge) waitForStream(ctx context.Context, authToken string, timeout time.Duration) (Stream, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		ffb.mu.Lock()
+		if stream, ok := ffb.activeStreams[authToken]; ok {
+			ffb.mu.Unlock()
+			return stream, true
+		}
+		if _, ok := ffb.fileRegistry[authToken]; !ok {
+			ffb.mu.Unlock()
+			return nil, false
+		}
+		ready, ok := ffb.streamReady[authToken]
+		if !ok {
+			ready = make(chan struct{})
+			ffb.streamReady[authToken] = ready
+		}
+		ffb.mu.Unlock()
+
+		select {
+		case <-ready:
+			// 流已就绪或资源已移除，重新检查
+		case <-timer.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		case <-ffb.ShutdownEvent:
+			return nil, false
+		}
+	}
+}
+
+// 唤醒等待该令牌传输结束的 /wait 长轮询，调用者需持有写锁
+func (ffb *FileFlowBridge) notifyTransferDoneLocked(authToken string) {
+	if done, ok := ffb.transferDone[authToken]; ok {
+		close(done)
+		delete(ffb.transferDone, authToken)
+	}
+}
 
-	// 等待最多30秒让流连接建立 (增加等待时间以适应高并发场景)
-	// 使用指数退避策略来减少锁竞争
-	waitDuration := 100 * time.Millisecond
-	maxRetries := 60 // 60 * 100ms = 6秒; 或者调整为 300 * 100ms = 30秒
-	for i := 0; i < maxRetries; i++ {
-		ffb.mu.RLock()
-		streamConn, exists1 = ffb.activeStreams[authToken]
-		ffb.mu.RUnlock()
+// 长轮询等待传输结束：下载完成、中止或注册被移除时立即返回当前状态，超时同样返回当前状态，
+// 响应格式与 /status 相同；同一令牌的多个等待者共用一个通知通道
+func (ffb *FileFlowBridge) handleWaitTransfer(w http.ResponseWriter, r *http.Request) {
+	authToken := mux.Vars(r)["auth_token"]
 
-		if exists1 {
-			break
+	timeout := DEFAULT_WAIT_TIMEOUT
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			http.Error(w, "无效的 timeout 参数", http.StatusBadRequest)
+			return
 		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > MAX_WAIT_TIMEOUT {
+			timeout = MAX_WAIT_TIMEOUT
+		}
+	}
 
-		time.Sleep(waitDuration)
-		// 可选：使用轻微的指数退避
-		if i > 5 { // 前几次快速检查，之后稍微减慢
-			waitDuration = 200 * time.Millisecond
+	ffb.mu.Lock()
+	_, exists := ffb.fileRegistry[authToken]
+	var done chan struct{}
+	if exists && !ffb.downloadCompleted[authToken] {
+		done = ffb.transferDone[authToken]
+		if done == nil {
+			done = make(chan struct{})
+			ffb.transferDone[authToken] = done
 		}
 	}
+	ffb.mu.Unlock()
 
-	if !exists1 {
-		log.Printf("⚠️ 文件源不可用，可能流连接尚未建立: %s", authToken)
-		http.Error(w, "文件源不可用", http.StatusServiceUnavailable)
-		return
+	// 已结束或不存在的令牌不必等待
+	if done != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		case <-ffb.ShutdownEvent:
+		}
 	}
 
-	// 准备响应头
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, metadata.OriginalFilename))
-	w.Header().Set("X-FileFlow-FileID", authToken)
-	w.Header().Set("X-FileFlow-Original-Filename", metadata.OriginalFilename)
+	ffb.handleStatusCheck(w, r)
+}
 
-	if metadata.Size > 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
-	}
+// 记录某个下载的采样速率，并更新峰值吞吐量
+func (ffb *FileFlowBridge) recordThroughput(authToken string, bytesPerSec float64) {
+	ffb.mu.Lock()
+	defer ffb.mu.Unlock()
 
-	// 开始传输
-	log.Printf("⬇️ 开始下载: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+	ffb.streamThroughput[authToken] = bytesPerSec
 
-	startTime := time.Now()
-	var totalTransferred int64
-	var localChunk int64
-	buf := make([]byte, 256*1024)
+	var total float64
+	for _, rate := range ffb.streamThroughput {
+		total += rate
+	}
+	if total > ffb.serverStats.PeakBytesPerSec {
+		ffb.serverStats.PeakBytesPerSec = total
+	}
+}
 
-	// 根据连接类型进行处理
-	var reader io.Reader
-	var conn net.Conn
+// 下载结束后移除其速率采样
+func (ffb *FileFlowBridge) clearThroughput(authToken string) {
+	ffb.mu.Lock()
+	delete(ffb.streamThroughput, authToken)
+	ffb.mu.Unlock()
+}
 
-	if tcpConn, ok := streamConn.(*StreamConnection); ok {
-		reader = tcpConn.Reader
-		conn = tcpConn.Conn
-		// 设置合理的读取超时（5分钟）
-		if conn != nil {
-			conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-		}
-	} else if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok {
-		reader = wsConn
+// 当前所有活跃下载的总吞吐量，调用者需持有读锁
+func (ffb *FileFlowBridge) currentThroughputLocked() float64 {
+	var total float64
+	for _, rate := range ffb.streamThroughput {
+		total += rate
+	}
+	return total
+}
 
-		// 对于WebSocket连接，发送请求数据的命令
-		// 这将触发上传端开始发送数据
-		request := map[string]interface{}{
-			"command": "download_started", // 通知上传端下载已开始
-			"offset":  0,                 // 从开头开始
-			"size":    metadata.Size,      // 请求整个文件
-		}
-		err := wsConn.Conn.WriteJSON(request)
-		if err != nil {
-			log.Printf("发送下载开始通知失败: %v", err)
-		} else {
-			log.Printf("✅ 已通知上传端下载已开始: %s", authToken)
-		}
+// 检查文件状态
+func (ffb *FileFlowBridge) handleStatusCheck(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	authToken := vars["auth_token"]
+	if ffb.rejectLookupFlood(w, r) {
+		return
+	}
 
-		// 然后发送实际的数据请求
-		request = map[string]interface{}{
-			"command": "send_chunk",
-			"offset":  0,             // 从开头开始
-			"size":    metadata.Size, // 请求整个文件
-		}
-		err = wsConn.Conn.WriteJSON(request)
-		if err != nil {
-			log.Printf("发送数据请求失败: %v", err)
-			http.Error(w, "无法从上传端请求数据", http.StatusInternalServerError)
+	ffb.mu.RLock()
+	metadata, exists := ffb.fileRegistry[authToken]
+	completed := ffb.downloadCompleted[authToken]
+	var status string
+	if exists {
+		status = metadata.Status
+	}
+	finished := ffb.finishedTransfers[authToken]
+	ffb.mu.RUnlock()
+
+	if !exists {
+		// 注册已移除但仍在保留期内：返回最终状态
+		if finished != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"filename":           finished.Filename,
+				"original_filename":  finished.OriginalFilename,
+				"size":               finished.Size,
+				"status":             finished.Status,
+				"finished_at":        finished.FinishedAt.Format(time.RFC3339),
+				"download_completed": finished.Status == STATUS_COMPLETED,
+			})
 			return
 		}
-
-		conn = nil // WebSocket连接不需要设置超时
-	} else {
-		http.Error(w, "未知的连接类型", http.StatusInternalServerError)
+		ffb.penalizeFailedLookup(r)
+		http.Error(w, "文件未找到", http.StatusNotFound)
 		return
 	}
 
-	// 检查客户端连接是否断开的函数
-	clientClosed := func() bool {
-		select {
-		case <-r.Context().Done():
-			return true
-		default:
-			return false
-		}
+	// 已过期但尚未被清理任务移除
+	if metadata.ExpiresAt.Before(time.Now()) {
+		status = STATUS_EXPIRED
 	}
 
-	for {
-		// 检查客户端是否已断开连接
-		if clientClosed() {
-			log.Printf("❌ 客户端连接断开，停止传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
-			// 通知上传端停止上传
-			if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok {
-				stopRequest := map[string]interface{}{
-					"command": "stop_upload",
-				}
-				// Attempt to send stop command but don't fail if connection is closed
-				if wsConn.Conn != nil {
-					err := wsConn.Conn.WriteJSON(stopRequest)
-					if err != nil {
-						log.Printf("无法发送停止上传命令: %v", err)
-					}
-				}
-			}
-			break
-		}
+	// 创建响应数据
+	responseData := map[string]interface{}{
+		"filename":           metadata.Filename,
+		"original_filename":  metadata.OriginalFilename,
+		"size":               metadata.Size,
+		"status":             status,
+		"client_ip":          metadata.ClientIP,
+		"registered_at":      metadata.RegisteredAt.Format(time.RFC3339),
+		"expires_at":         metadata.ExpiresAt.Format(time.RFC3339),
+		"download_completed": completed,
+		"max_downloads":      metadata.MaxDownloads,
+		"download_count":     metadata.DownloadCount,
+		"max_rate":           ffb.effectiveRate(metadata),
+	}
 
-		n, err := reader.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+	if !metadata.StreamStarted.IsZero() {
+		responseData["stream_started"] = metadata.StreamStarted.Format(time.RFC3339)
+	}
 
-			// 检查是否是超时错误
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("⚠️ 读取超时，但继续尝试: %v", err)
+	if !metadata.ModTime.IsZero() {
+		responseData["mtime"] = metadata.ModTime.Format(time.RFC3339)
+	}
 
-				// 重置超时并继续尝试
-				if conn != nil {
-					conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-				}
-				continue
-			}
+	if metadata.ClientAddress != "" {
+		responseData["client_address"] = metadata.ClientAddress
+	}
 
-			ffb.handleStreamError(authToken, err, conn)
-			break
-		}
+	if metadata.Compression != "" {
+		responseData["compression"] = metadata.Compression
+	}
 
-		if n == 0 {
-			break
-		}
+	if metadata.FrameChunkSize > 0 {
+		responseData["frame_chunk_size"] = metadata.FrameChunkSize
+	}
 
-		// 再次检查客户端是否已断开连接
-		if clientClosed() {
-			log.Printf("❌ 客户端连接断开，停止传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
-			// 通知上传端停止上传
-			if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok {
-				stopRequest := map[string]interface{}{
-					"command": "stop_upload",
-				}
-				// Attempt to send stop command but don't fail if connection is closed
-				if wsConn.Conn != nil {
-					err := wsConn.Conn.WriteJSON(stopRequest)
-					if err != nil {
-						log.Printf("无法发送停止上传命令: %v", err)
-					}
-				}
-			}
-			break
-		}
+	if len(metadata.Metadata) > 0 {
+		responseData["metadata"] = metadata.Metadata
+	}
 
-		// 写入响应
-		if _, err := w.Write(buf[:n]); err != nil {
-			log.Printf("❌ 客户端断开连接: %v", err)
-			// 通知上传端停止上传
-			if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok {
-				stopRequest := map[string]interface{}{
-					"command": "stop_upload",
-				}
-				// Attempt to send stop command but don't fail if connection is closed
-				if wsConn.Conn != nil {
-					err := wsConn.Conn.WriteJSON(stopRequest)
-					if err != nil {
-						log.Printf("无法发送停止上传命令: %v", err)
-					}
-				}
-			}
-			break
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responseData)
+}
 
-		if flusher, ok := w.(http.Flusher); ok {
-			flusher.Flush()
-		}
+// 获取服务器统计信息；Accept 为 text/plain 时输出与 /stats.txt 相同的纯文本
+func (ffb *FileFlowBridge) handleServerStats(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		ffb.handleServerStatsText(w, r)
+		return
+	}
 
-		totalTransferred += int64(n)
-		localChunk += int64(n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ffb.serverStatsSnapshot())
+}
 
-		// 检查是否已传输完整个文件
-		if totalTransferred >= metadata.Size {
-			log.Printf("✅ 文件数据已全部传输: %s (token_id: %s)", metadata.OriginalFilename, authToken)
-			break
+// 纯文本统计信息：每行 "键 值"，键名与 /stats 的JSON字段相同，按键名排序，便于 grep/awk 直接读取
+func (ffb *FileFlowBridge) handleServerStatsText(w http.ResponseWriter, r *http.Request) {
+	stats := ffb.serverStatsSnapshot()
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, key := range keys {
+		value := stats[key]
+		if f, ok := value.(float64); ok {
+			// 不使用科学计数法，awk 的数值比较更直观
+			value = strconv.FormatFloat(f, 'f', -1, 64)
 		}
+		fmt.Fprintf(w, "%s %v\n", key, value)
+	}
+}
 
-		if localChunk >= 10*1024*1024 {
-			ffb.mu.Lock()
-			ffb.serverStats.BytesTransferred += localChunk
-			ffb.mu.Unlock()
-			localChunk = 0
+// 收集服务器统计信息，JSON与纯文本输出共用
+func (ffb *FileFlowBridge) serverStatsSnapshot() map[string]interface{} {
+	diskFree := int64(-1)
+	if ffb.CacheDir != "" {
+		if free, err := ffb.cacheDiskFree(); err == nil {
+			diskFree = free
 		}
+	}
 
-		// 每次成功读取后重置超时
-		if conn != nil {
-			conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-		}
+	ffb.mu.RLock()
+	stats := map[string]interface{}{
+		"status":                     "running",
+		"uptime":                     time.Since(ffb.serverStats.StartTime).Seconds(),
+		"files_registered_total":     ffb.serverStats.FilesRegisteredTotal,
+		"files_currently_registered": len(ffb.fileRegistry),
+		"files_expired_total":        ffb.serverStats.FilesExpiredTotal,
+		"files_completed_total":      ffb.serverStats.FilesCompletedTotal,
+		"files_truncated_total":      ffb.serverStats.FilesTruncatedTotal,
+		"files_transferred":          ffb.serverStats.FilesTransferred,
+		"bytes_transferred":          ffb.serverStats.BytesTransferred,
+		"active_connections":         ffb.serverStats.ActiveConnections,
+		"peak_connections":           ffb.serverStats.PeakConnections,
+		"peak_bytes_per_sec":         ffb.serverStats.PeakBytesPerSec,
+		"current_throughput_bps":     ffb.currentThroughputLocked(),
+		"registered_files":           len(ffb.fileRegistry),
+		"active_streams":             len(ffb.activeStreams),
+		"max_active_streams":         ffb.MaxActiveStreams,
+		"cache_entries":              len(ffb.cacheEntries),
+		"cache_used_bytes":           ffb.cacheUsageLocked(),
+		"inflight_bytes":             ffb.inflight.current(),
+		"max_inflight_bytes":         ffb.MaxInflightBytes,
+		"completed_downloads":        len(ffb.downloadCompleted),
+		"heap_inuse_bytes":           ffb.heapInUse,
+		"memory_high_water_bytes":    ffb.MemoryHighWater,
+		"shedding":                   ffb.shedding,
+		"registered_bytes":           ffb.registeredBytesLocked(),
+		"max_total_size":             ffb.MaxTotalSize,
+	}
+	// 剩余容量只在配置了总量配额或启用缓存时给出，新的注册超过该值会返回507
+	if remaining, limited := ffb.remainingCapacityLocked(diskFree); limited {
+		stats["remaining_capacity_bytes"] = remaining
+	}
+	if diskFree >= 0 {
+		stats["cache_disk_free_bytes"] = diskFree
+	}
+	// 上面的计数器从本次启动开始 (与 uptime 一致)；启用持久化时另给出跨重启累加的值
+	if ffb.StatsPath != "" {
+		lifetime := ffb.lifetimeStatsLocked()
+		stats["lifetime_since"] = lifetime.Since.Format(time.RFC3339)
+		stats["lifetime_files_registered_total"] = lifetime.FilesRegisteredTotal
+		stats["lifetime_files_transferred"] = lifetime.FilesTransferred
+		stats["lifetime_files_expired_total"] = lifetime.FilesExpiredTotal
+		stats["lifetime_files_completed_total"] = lifetime.FilesCompletedTotal
+		stats["lifetime_files_truncated_total"] = lifetime.FilesTruncatedTotal
+		stats["lifetime_bytes_transferred"] = lifetime.BytesTransferred
+		stats["lifetime_peak_connections"] = lifetime.PeakConnections
+		stats["lifetime_peak_bytes_per_sec"] = lifetime.PeakBytesPerSec
 	}
+	// 关闭排空阶段，让负载均衡和运维人员能区分"正在关闭"与连接被拒绝
+	if ffb.isShuttingDown {
+		stats["status"] = "shutting_down"
+		stats["shutting_down"] = true
+		stats["draining_streams"] = len(ffb.activeStreams)
+	}
+	ffb.mu.RUnlock()
 
-	// 传输完成
-	transferTime := time.Since(startTime).Seconds()
-	ffb.mu.Lock()
-	ffb.serverStats.FilesTransferred++
-	ffb.serverStats.BytesTransferred += localChunk
-	ffb.downloadCompleted[authToken] = true
-	ffb.mu.Unlock()
+	return stats
+}
 
-	if transferTime > 0 {
-		sizeMiB := float64(totalTransferred) / (1024 * 1024)
-		speedValue := float64(totalTransferred) / transferTime / 1024
-		speedUnit := "KiB/s"
-		if speedValue >= 1024 {
-			speedValue /= 1024
-			speedUnit = "MiB/s"
-		}
+// 健康检查
+func (ffb *FileFlowBridge) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"status":    "healthy",
+		"timestamp": time.Now().Format(time.RFC3339),
+		"version":   "1.0.0",
+	}
 
-		log.Printf("✅ 传输完成: %s (token_id: %s), 大小: %.2f MiB, 耗时: %.2fs, 速度: %.2f %s",
-			metadata.OriginalFilename,
-			authToken,
-			sizeMiB,
-			transferTime,
-			speedValue,
-			speedUnit,
-		)
+	// TCP监听意外终止后HTTP仍可响应，但已无法建立任何传输，需要重启进程
+	ffb.mu.RLock()
+	listenerFailed := ffb.tcpListenerFailed
+	shuttingDown := ffb.isShuttingDown
+	drainingStreams := len(ffb.activeStreams)
+	ffb.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case listenerFailed:
+		response["status"] = "unhealthy"
+		response["reasons"] = []string{"tcp_listener_down"}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case shuttingDown:
+		response["status"] = "shutting_down"
+		response["shutting_down"] = true
+		response["draining_streams"] = drainingStreams
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}
+	json.NewEncoder(w).Encode(response)
+}
 
-	// 通知上传端传输已完成
-	if conn, exists := ffb.activeStreams[authToken]; exists {
-		if tcpConn, ok := conn.(*StreamConnection); ok && tcpConn.Conn != nil {
-			tcpConn.Conn.Close()
-			log.Printf("🔌 关闭已完成文件的TCP连接: %s (token_id: %s)", metadata.OriginalFilename, authToken)
-		} else if wsConn, ok := conn.(*WebSocketStreamConnection); ok {
-			// 发送传输完成通知给WebSocket连接
-			notification := map[string]interface{}{
-				"command": "transfer_complete",
-				"message": "文件传输已完成",
-			}
+// 就绪检查：与只表示进程存活的 /health 不同，只有能够接受新传输时才返回200
+func (ffb *FileFlowBridge) handleReadyCheck(w http.ResponseWriter, r *http.Request) {
+	ffb.mu.RLock()
+	reasons := []string{}
+	if ffb.isShuttingDown {
+		reasons = append(reasons, "shutting_down")
+	}
+	if !ffb.tcpListening {
+		reasons = append(reasons, "tcp_listener_down")
+	}
+	if ffb.MaxActiveStreams > 0 && len(ffb.activeStreams) >= ffb.MaxActiveStreams {
+		reasons = append(reasons, "at_capacity")
+	}
+	if ffb.paused {
+		reasons = append(reasons, "paused")
+	}
+	if ffb.shedding {
+		reasons = append(reasons, "shedding")
+	}
+	response := map[string]interface{}{
+		"status":             "ready",
+		"timestamp":          time.Now().Format(time.RFC3339),
+		"active_streams":     len(ffb.activeStreams),
+		"max_active_streams": ffb.MaxActiveStreams,
+	}
+	ffb.mu.RUnlock()
 
-			// 检查WebSocket连接是否仍然开放
-			if wsConn.Conn != nil {
-				// 尝试发送传输完成通知
-				err := wsConn.Conn.WriteJSON(notification)
-				if err != nil {
-					log.Printf("发送传输完成通知失败: %v", err)
-				} else {
-					log.Printf("✅ 已通知上传端传输完成: %s", authToken)
-				}
-			} else {
-				log.Printf("WebSocket连接已关闭，无法发送传输完成通知: %s", authToken)
-			}
+	w.Header().Set("Content-Type", "application/json")
+	if len(reasons) > 0 {
+		response["status"] = "not_ready"
+		response["reasons"] = reasons
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
 
-			if wsConn.Conn != nil {
-				wsConn.Conn.Close()
-			}
-			log.Printf("🔌 关闭已完成文件的WebSocket连接: %s (token_id: %s)", metadata.OriginalFilename, authToken)
-		}
-		delete(ffb.activeStreams, authToken)
-	} else {
-		log.Printf("⚠️ 传输完成时未找到活动连接: %s", authToken)
+// 公开的服务器配置，供客户端在注册前预先校验文件大小、选择传输方式；不包含令牌、路径等敏感信息
+func (ffb *FileFlowBridge) handleConfig(w http.ResponseWriter, r *http.Request) {
+	ffb.mu.RLock()
+	tcpListening := ffb.tcpListening
+	ffb.mu.RUnlock()
+
+	tokenCharset := ffb.TokenCharset
+	if tokenCharset == "" {
+		tokenCharset = DEFAULT_TOKEN_CHARSET
+	}
+
+	response := map[string]interface{}{
+		"max_file_size_bytes": ffb.MaxFileSize,
+		"file_ttl_seconds":    int64(FILE_TTL / time.Second),
+		"tcp_port":            ffb.TCPPort,
+		"token_length":        ffb.TokenLength,
+		"max_token_length":    ffb.maxTokenLength(),
+		"token_charset":       tokenCharset,
+		"token_prefix":        ffb.TokenPrefix,
+		"max_downloads_limit": MAX_DOWNLOADS_LIMIT,
+		"max_rate":            ffb.MaxRate,
+		"features": map[string]bool{
+			"tls":         ffb.TCPTLSConfig != nil, // 服务器自身配置的TLS；HTTP端口不终止TLS，HTTPS由反向代理提供，与本次请求的协议无关
+			"tcp_tls":     ffb.TCPTLSConfig != nil,
+			"compression": !ffb.DisableCompression, // TCP链路gzip压缩，见握手元数据的 compression 字段
+			"framing":     true,                    // 分块校验，见握手元数据的 framed 与 chunk_size 字段
+			"on_demand":   true,                    // 按需发送，见握手元数据的 on_demand 字段
+			"upload_http": true,                    // 同 http_upload，保留用于兼容旧版提供端
+			"websocket":   true,                    // 同 websocket_upload，保留用于兼容
+			"cache":       ffb.CacheDir != "",
+			"dedup":       ffb.Dedup && ffb.CacheDir != "", // 注册附带 sha256 时复用已缓存的相同内容
+			"word_codes":  ffb.WordCodes,
+			// 提供端据此选择传输通道，依次为 TCP流、WebSocket、HTTP multipart 上传
+			"tcp_stream":       tcpListening,
+			"websocket_upload": true,
+			"http_upload":      true,
+			"resume":           ffb.CacheDir != "", // 缓存模式下下载支持 Range 续传
+		},
 	}
 
-	log.Printf("🏁 文件标记为已完成: %s (token_id: %s)", metadata.OriginalFilename, authToken)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// 检查文件状态
-func (ffb *FileFlowBridge) handleStatusCheck(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	authToken := vars["auth_token"]
+// 校验管理接口令牌（Authorization: Bearer <token>），未配置管理令牌时一律拒绝
+func (ffb *FileFlowBridge) adminAuthorized(r *http.Request) bool {
+	return ffb.adminTokenValid(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
 
-	ffb.mu.RLock()
-	metadata, exists := ffb.fileRegistry[authToken]
-	completed := ffb.downloadCompleted[authToken]
-	ffb.mu.RUnlock()
+// 以常量时间比较管理令牌，空令牌无效
+func (ffb *FileFlowBridge) adminTokenValid(token string) bool {
+	if ffb.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ffb.AdminToken), []byte(token)) == 1
+}
 
-	if !exists {
-		http.Error(w, "文件未找到", http.StatusNotFound)
+// 以SSE推送传输生命周期事件，事件包含下载令牌，因此需要管理令牌
+func (ffb *FileFlowBridge) handleEvents(w http.ResponseWriter, r *http.Request) {
+	// 浏览器的EventSource无法设置请求头，只有事件流允许通过查询参数传递令牌；
+	// 查询参数会留在访问日志与浏览器历史中，其他管理接口只接受请求头
+	if !ffb.adminAuthorized(r) && !ffb.adminTokenValid(r.URL.Query().Get("admin_token")) {
+		http.Error(w, "无效的管理令牌", http.StatusUnauthorized)
 		return
 	}
 
-	// 创建响应数据
-	responseData := map[string]interface{}{
-		"filename":           metadata.Filename,
-		"original_filename":  metadata.OriginalFilename,
-		"size":               metadata.Size,
-		"status":             metadata.Status,
-		"client_ip":          metadata.ClientIP,
-		"registered_at":      metadata.RegisteredAt.Format(time.RFC3339),
-		"expires_at":         metadata.ExpiresAt.Format(time.RFC3339),
-		"download_completed": completed,
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持流式响应", http.StatusInternalServerError)
+		return
 	}
 
-	if !metadata.StreamStarted.IsZero() {
-		responseData["stream_started"] = metadata.StreamStarted.Format(time.RFC3339)
+	limit := ffb.MaxEventSubscribers
+	if limit <= 0 {
+		limit = DEFAULT_MAX_EVENT_SUBSCRIBERS
 	}
-
-	if metadata.ClientAddress != "" {
-		responseData["client_address"] = metadata.ClientAddress
+	ch, ok := ffb.events.subscribe(limit)
+	if !ok {
+		http.Error(w, "事件订阅者已达上限", http.StatusServiceUnavailable)
+		return
 	}
+	defer ffb.events.unsubscribe(ch)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(responseData)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	log.Printf("📡 事件订阅者已连接: %s (当前 %d 个)", r.RemoteAddr, ffb.events.count())
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			// 注释行保持连接活跃，便于及时发现断开的订阅者
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Printf("📡 事件订阅者已断开: %s", r.RemoteAddr)
+			return
+		case <-ffb.ShutdownEvent:
+			return
+		}
+	}
 }
 
-// 获取服务器统计信息
-func (ffb *FileFlowBridge) handleServerStats(w http.ResponseWriter, r *http.Request) {
+// 按滚动窗口内的下行流量列出消耗最多的下载方IP，limit 参数控制返回条数
+func (ffb *FileFlowBridge) handleAdminBandwidth(w http.ResponseWriter, r *http.Request) {
+	if !ffb.adminAuthorized(r) {
+		http.Error(w, "无效的管理令牌", http.StatusUnauthorized)
+		return
+	}
+
+	limit := BANDWIDTH_TOP_DEFAULT
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "无效的 limit 参数", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	type clientUsage struct {
+		IP       string    `json:"ip"`
+		Bytes    int64     `json:"bytes"`
+		LastSeen time.Time `json:"last_seen"`
+	}
+	now := time.Now()
 	ffb.mu.RLock()
-	stats := map[string]interface{}{
-		"status":              "running",
-		"uptime":              time.Since(ffb.serverStats.StartTime).Seconds(),
-		"files_registered":    ffb.serverStats.FilesRegistered,
-		"files_transferred":   ffb.serverStats.FilesTransferred,
-		"bytes_transferred":   ffb.serverStats.BytesTransferred,
-		"active_connections":  ffb.serverStats.ActiveConnections,
-		"peak_connections":    ffb.serverStats.PeakConnections,
-		"registered_files":    len(ffb.fileRegistry),
-		"active_streams":      len(ffb.activeStreams),
-		"completed_downloads": len(ffb.downloadCompleted),
+	clients := make([]clientUsage, 0, len(ffb.bandwidthByIP))
+	for ip, usage := range ffb.bandwidthByIP {
+		if total := usage.total(now); total > 0 {
+			clients = append(clients, clientUsage{IP: ip, Bytes: total, LastSeen: usage.lastSeen})
+		}
 	}
 	ffb.mu.RUnlock()
 
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Bytes > clients[j].Bytes })
+	tracked := len(clients)
+	if len(clients) > limit {
+		clients = clients[:limit]
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window_seconds":  BANDWIDTH_WINDOW_MINUTES * 60,
+		"tracked_clients": tracked,
+		"clients":         clients,
+	})
 }
 
-// 健康检查
-func (ffb *FileFlowBridge) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"version":   "1.0.0",
+// 暂停：停止接受新的注册与流连接，已建立的传输继续完成
+func (ffb *FileFlowBridge) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	ffb.setPaused(w, r, true)
+}
+
+// 恢复：重新接受新的注册与流连接
+func (ffb *FileFlowBridge) handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	ffb.setPaused(w, r, false)
+}
+
+func (ffb *FileFlowBridge) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if !ffb.adminAuthorized(r) {
+		http.Error(w, "无效的管理令牌", http.StatusUnauthorized)
+		return
+	}
+
+	ffb.mu.Lock()
+	ffb.paused = paused
+	activeCount := len(ffb.activeStreams)
+	ffb.mu.Unlock()
+
+	if paused {
+		log.Printf("⏸️ 服务器已暂停，不再接受新的注册与流连接，%d 个活跃流继续传输", activeCount)
+	} else {
+		log.Printf("▶️ 服务器已恢复接受新的注册与流连接")
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"paused":         paused,
+		"active_streams": activeCount,
+	})
 }
 
-// 清理资源
-func (ffb *FileFlowBridge) cleanupResources() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// 定期清理任务，每次间隔加入随机抖动，避免多个实例或大量令牌同时触发清理
+func (ffb *FileFlowBridge) runCleanupLoop() {
+	timer := time.NewTimer(ffb.nextCleanupDelay())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-timer.C:
 			if ffb.isShuttingDown {
 				return
 			}
+			ffb.cleanupResources()
+			timer.Reset(ffb.nextCleanupDelay())
+
+		case <-ffb.ShutdownEvent:
+			return
+		}
+	}
+}
 
-			currentTime := time.Now()
-			var expiredFiles []string
+// 计算下一次清理的等待时间：配置间隔 ±10% 抖动
+func (ffb *FileFlowBridge) nextCleanupDelay() time.Duration {
+	interval := ffb.CleanupInterval
+	if interval <= 0 {
+		interval = DEFAULT_CLEANUP_INTERVAL
+	}
+	jitter := time.Duration(mrand.Int64N(int64(interval)/5+1)) - interval/10
+	return interval + jitter
+}
 
-			ffb.mu.RLock()
-			for authToken, metadata := range ffb.fileRegistry {
-				if metadata.ExpiresAt.Before(currentTime) {
-					expiredFiles = append(expiredFiles, authToken)
-				}
-			}
-			ffb.mu.RUnlock()
+// 清理过期资源：在同一次加锁内批量移除，避免逐个令牌重复加锁
+func (ffb *FileFlowBridge) cleanupResources() {
+	currentTime := time.Now()
 
-			for _, authToken := range expiredFiles {
-				ffb.removeFileResources(authToken)
-				log.Printf("🧹 清理过期文件: %s", authToken)
-			}
+	ffb.mu.Lock()
+	defer ffb.unlockAndRemoveStaleCaches()
+
+	for authToken, metadata := range ffb.fileRegistry {
+		if metadata.ExpiresAt.Before(currentTime) {
+			metadata.Status = STATUS_EXPIRED
+			ffb.removeFileResourcesLocked(authToken)
+			ffb.serverStats.FilesExpiredTotal++
+			log.Printf("🧹 清理过期文件: %s", authToken)
+			ffb.publishEvent(TransferEvent{Type: "expired", Token: authToken, Filename: metadata.OriginalFilename})
+		} else if ffb.isIdleRegistrationLocked(authToken, metadata, currentTime) {
+			metadata.Status = STATUS_EXPIRED
+			ffb.removeFileResourcesLocked(authToken)
+			log.Printf("🧹 清理未使用的注册: %s (注册于 %s)", authToken, metadata.RegisteredAt.Format(time.RFC3339))
+			ffb.publishEvent(TransferEvent{Type: "expired", Token: authToken, Filename: metadata.OriginalFilename, Message: "未使用的注册"})
+		}
+	}
 
-		case <-ffb.ShutdownEvent:
-			return
+	// 终态记录只保留 STATUS_RETENTION
+	for authToken, finished := range ffb.finishedTransfers {
+		if currentTime.Sub(finished.FinishedAt) > STATUS_RETENTION {
+			delete(ffb.finishedTransfers, authToken)
+		}
+	}
+
+	// 清理窗口已结束的令牌查找失败记录
+	for ip, failures := range ffb.failedLookups {
+		if currentTime.Sub(failures.windowStart) >= FAILED_LOOKUP_WINDOW {
+			delete(ffb.failedLookups, ip)
+		}
+	}
+
+	// 清理滚动窗口内已没有流量的下载方IP
+	for ip, usage := range ffb.bandwidthByIP {
+		if currentTime.Sub(usage.lastSeen) > BANDWIDTH_WINDOW_MINUTES*time.Minute {
+			delete(ffb.bandwidthByIP, ip)
+		}
+	}
+
+	// 清理过期或对应注册已不存在的幂等键
+	for key, entry := range ffb.idempotencyKeys {
+		if _, exists := ffb.fileRegistry[entry.authToken]; !exists || entry.expiresAt.Before(currentTime) {
+			delete(ffb.idempotencyKeys, key)
 		}
 	}
 }
 
+// 判断注册是否一直未被使用：仍处于registered状态、从未建立流、没有下载方在等待，且超过空闲时限，调用者需持有锁
+func (ffb *FileFlowBridge) isIdleRegistrationLocked(authToken string, metadata *FileMetadata, now time.Time) bool {
+	if ffb.IdleRegistrationTimeout <= 0 || metadata.Status != STATUS_REGISTERED || !metadata.StreamStarted.IsZero() {
+		return false
+	}
+	if _, waiting := ffb.streamReady[authToken]; waiting {
+		return false
+	}
+	return now.Sub(metadata.RegisteredAt) > ffb.IdleRegistrationTimeout
+}
+
 // 移除文件资源
 func (ffb *FileFlowBridge) removeFileResources(authToken string) {
 	ffb.mu.Lock()
-	defer ffb.mu.Unlock()
+	defer ffb.unlockAndRemoveStaleCaches()
+
+	ffb.removeFileResourcesLocked(authToken)
+}
+
+// 释放写锁，再删除持锁期间释放的缓存文件。移除注册后以此代替 ffb.mu.Unlock
+func (ffb *FileFlowBridge) unlockAndRemoveStaleCaches() {
+	paths := ffb.staleCacheFiles
+	ffb.staleCacheFiles = nil
+	ffb.mu.Unlock()
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ 删除缓存文件失败: %s - %v", path, err)
+		}
+	}
+}
+
+// 移除文件资源，调用者需持有写锁
+func (ffb *FileFlowBridge) removeFileResourcesLocked(authToken string) {
+	// 保留终态供 /status 查询；不是正常完成或过期的一律视为中止
+	if metadata, ok := ffb.fileRegistry[authToken]; ok {
+		status := metadata.Status
+		if status != STATUS_COMPLETED && status != STATUS_EXPIRED {
+			status = STATUS_ABORTED
+		}
+		ffb.finishedTransfers[authToken] = &finishedTransfer{
+			Filename:         metadata.Filename,
+			OriginalFilename: metadata.OriginalFilename,
+			Size:             metadata.Size,
+			Status:           status,
+			FinishedAt:       time.Now(),
+		}
+	}
 
 	// 移除注册信息
 	delete(ffb.fileRegistry, authToken)
 
-	// 关闭TCP连接
+	// 关闭上传端连接
 	if streamConn, exists := ffb.activeStreams[authToken]; exists {
-		if tcpConn, ok := streamConn.(*StreamConnection); ok && tcpConn.Conn != nil {
-			tcpConn.Conn.Close()
-		} else if wsConn, ok := streamConn.(*WebSocketStreamConnection); ok && wsConn.Conn != nil {
-			wsConn.Conn.Close()
-		}
-		delete(ffb.activeStreams, authToken)
+		streamConn.Close()
+		ffb.deleteActiveStreamLocked(authToken)
 	}
 
 	// 移除下载完成标记
 	delete(ffb.downloadCompleted, authToken)
 
+	// 唤醒仍在等待该令牌流连接的下载方与 /wait 长轮询
+	if ready, ok := ffb.streamReady[authToken]; ok {
+		close(ready)
+		delete(ffb.streamReady, authToken)
+	}
+	ffb.notifyTransferDoneLocked(authToken)
+
+	// 删除缓存文件；去重共享的文件在最后一个引用的令牌释放后才删除
+	if cache, ok := ffb.cacheEntries[authToken]; ok {
+		delete(ffb.cacheEntries, authToken)
+		cache.refs--
+		if cache.refs <= 0 {
+			cache.finish(errCacheReleased)
+			// 文件在释放写锁后由 unlockAndRemoveStaleCaches 删除，不在持锁期间操作文件系统
+			ffb.staleCacheFiles = append(ffb.staleCacheFiles, cache.path)
+			if cache.sha256 != "" && ffb.cacheByHash[cache.sha256] == cache {
+				delete(ffb.cacheByHash, cache.sha256)
+			}
+		}
+	}
+
 	log.Printf("🗑️ 文件资源已清理: %s", authToken)
 }
 
 // 优雅关闭
 func (ffb *FileFlowBridge) gracefulShutdown(httpServer *http.Server, listener net.Listener) {
 	log.Println("🛑 开始优雅关闭...")
-	ffb.isShuttingDown = true
 
 	// 关闭所有TCP连接
 	ffb.mu.Lock()
+	ffb.isShuttingDown = true
 	for authToken := range ffb.activeStreams {
-		ffb.removeFileResources(authToken)
+		ffb.removeFileResourcesLocked(authToken)
 	}
-	ffb.mu.Unlock()
+	ffb.unlockAndRemoveStaleCaches()
 
 	// 关闭HTTP服务器
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -1488,6 +5657,14 @@ func contains(s, substr string) bool {
 	return len(s) >= len(substr) && s[:len(substr)] == substr
 }
 
+// 辅助函数：获取字符串环境变量，不存在则返回默认值
+func getEnvString(key string, defaultVal string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
 // 辅助函数：获取整数环境变量，不存在则返回默认值
 func getEnvInt(key string, defaultVal int) int {
 	if val := os.Getenv(key); val != "" {
@@ -1508,6 +5685,73 @@ func getEnvInt64(key string, defaultVal int64) int64 {
 	return defaultVal
 }
 
+// 解析带单位的大小 (如 100MB、5GiB、1.5GB、4096B)，hasUnit 为false表示未带单位的纯数字
+func parseByteSize(s string) (n int64, hasUnit bool, err error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range sizeUnits {
+		number, ok := strings.CutSuffix(value, unit.suffix)
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil || f < 0 {
+			return 0, true, fmt.Errorf("无效的大小: %q", s)
+		}
+		bytes := f * float64(unit.factor)
+		if bytes >= math.MaxInt64 {
+			return 0, true, fmt.Errorf("大小超出范围: %q", s)
+		}
+		return int64(bytes), true, nil
+	}
+	n, err = strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("无效的大小: %q (示例: 100MB、5GiB)", s)
+	}
+	return n, false, nil
+}
+
+// 解析 --max-file-size / FFB_MAX_FILE_SIZE 并返回字节数。未带单位的数字含义不明确：
+// 不超过 BARE_SIZE_GIB_LIMIT 时按 GiB 解释 (与旧版本一致)，否则显然不是 GiB，按字节解释；两种情况都返回警告
+func parseMaxFileSize(s string) (int64, string, error) {
+	n, hasUnit, err := parseByteSize(s)
+	if err != nil {
+		return 0, "", err
+	}
+	var warning string
+	if !hasUnit {
+		if n <= BARE_SIZE_GIB_LIMIT {
+			warning = fmt.Sprintf("最大文件大小 %q 未带单位，按 GiB 解释，请写作 %dGiB", s, n)
+			n <<= 30
+		} else {
+			warning = fmt.Sprintf("最大文件大小 %q 未带单位且超过 %d，按字节解释，请写作 %dB", s, BARE_SIZE_GIB_LIMIT, n)
+		}
+	}
+	if n <= 0 {
+		return 0, warning, fmt.Errorf("最大文件大小必须大于0: %q", s)
+	}
+	return n, warning, nil
+}
+
+// 辅助函数：获取布尔环境变量，除 strconv.ParseBool 的写法外还接受 yes/no、on/off；
+// 无法识别的值记录警告并使用默认值，避免 FFB_ENABLE_* 拼写错误时静默生效
+func getEnvBool(key string, defaultVal bool) bool {
+	val := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	switch val {
+	case "":
+		return defaultVal
+	case "yes", "on":
+		return true
+	case "no", "off":
+		return false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("⚠️ 警告: 环境变量 %s=%q 不是有效的布尔值，将使用默认值 %v", key, os.Getenv(key), defaultVal)
+		return defaultVal
+	}
+	return b
+}
+
 // 主函数
 func main() {
 	fmt.Println("🌊 FileFlow Bridge - 文件流桥接服务器")
@@ -1519,27 +5763,310 @@ func main() {
 	// 获取环境变量配置
 	defaultHTTPPort := getEnvInt("FFB_HTTP_PORT", 8000)
 	defaultTCPPort := getEnvInt("FFB_TCP_PORT", 8888)
-	defaultMaxFileSize := getEnvInt64("FFB_MAX_FILE_SIZE", 100)
+	defaultMaxFileSize := getEnvString("FFB_MAX_FILE_SIZE", "100GiB")
 	defaultTokenLength := getEnvInt("FFB_TOKEN_LEN", 8)
+	defaultDownloadWait := getEnvInt("FFB_DOWNLOAD_WAIT", int(DEFAULT_DOWNLOAD_WAIT/time.Second))
+	defaultCleanupInterval := getEnvInt("FFB_CLEANUP_INTERVAL", int(DEFAULT_CLEANUP_INTERVAL/time.Second))
+	defaultMaxActiveStreams := getEnvInt("FFB_MAX_ACTIVE_STREAMS", 0)
+	defaultCacheDir := getEnvString("FFB_CACHE_DIR", "")
+	defaultCacheMaxSize := getEnvInt64("FFB_CACHE_MAX_SIZE", DEFAULT_CACHE_MAX_SIZE/(1024*1024*1024))
+	defaultMaxRate := getEnvInt64("FFB_MAX_RATE", 0)
+	defaultIdleRegistrationTimeout := getEnvInt("FFB_IDLE_REGISTRATION_TIMEOUT", 0)
+	defaultWordCodes := getEnvBool("FFB_WORD_CODES", false)
+	defaultChunkedDownloads := getEnvBool("FFB_CHUNKED_DOWNLOADS", false)
+	defaultEnableCompression := getEnvBool("FFB_ENABLE_COMPRESSION", true)
+	defaultEnableCache := getEnvBool("FFB_ENABLE_CACHE", true)
+	defaultEnableDedup := getEnvBool("FFB_ENABLE_DEDUP", false)
+	defaultAdminToken := getEnvString("FFB_ADMIN_TOKEN", "")
+	defaultMaxEventSubscribers := getEnvInt("FFB_MAX_EVENT_SUBSCRIBERS", DEFAULT_MAX_EVENT_SUBSCRIBERS)
+	defaultStatsFlushSize := getEnvInt64("FFB_STATS_FLUSH_SIZE", DEFAULT_STATS_FLUSH_BYTES/1024)
+	defaultMaxInflightBytes := getEnvInt64("FFB_MAX_INFLIGHT_BYTES", 0)
+	defaultMaxTotalSize := getEnvInt64("FFB_MAX_TOTAL_SIZE", 0)
+	defaultDownloadLeaseTTL := getEnvInt("FFB_DOWNLOAD_LEASE_TTL", int(DOWNLOAD_SESSION_TTL/time.Second))
+	defaultTCPTLSCert := getEnvString("FFB_TCP_TLS_CERT", "")
+	defaultTCPTLSKey := getEnvString("FFB_TCP_TLS_KEY", "")
+	defaultNotFoundRedirect := getEnvString("FFB_NOT_FOUND_REDIRECT", "")
+	defaultNotFoundPage := getEnvString("FFB_NOT_FOUND_PAGE", "")
+	defaultNotFoundDelay := getEnvInt("FFB_NOT_FOUND_DELAY", 0)
+	defaultMaxFailedLookups := getEnvInt("FFB_MAX_FAILED_LOOKUPS", 0)
+	defaultMemoryHighWater := getEnvInt64("FFB_MEMORY_HIGH_WATER", 0)
+	defaultCORSOrigin := getEnvString("FFB_CORS_ORIGIN", "")
+	defaultTrustedProxies := getEnvString("FFB_TRUSTED_PROXIES", DEFAULT_TRUSTED_PROXIES)
+	defaultHTTPListen := getEnvString("FFB_HTTP_LISTEN", "")
+	defaultTCPListen := getEnvString("FFB_TCP_LISTEN", "")
+	defaultSendBufferSize := getEnvInt("FFB_SEND_BUFFER_SIZE", DEFAULT_SEND_BUFFER_SIZE/1024)
+	defaultHandshakeTimeout := getEnvInt("FFB_HANDSHAKE_TIMEOUT", int(STREAM_HANDSHAKE_TIMEOUT/time.Second))
+	defaultMaxFilenameLength := getEnvInt("FFB_MAX_FILENAME_LENGTH", DEFAULT_MAX_FILENAME_LENGTH)
+	defaultMaxTokenLength := getEnvInt("FFB_MAX_TOKEN_LEN", DEFAULT_MAX_TOKEN_LENGTH)
+	defaultTokenCharset := getEnvString("FFB_TOKEN_CHARSET", DEFAULT_TOKEN_CHARSET)
+	defaultTokenPrefix := getEnvString("FFB_TOKEN_PREFIX", "")
+	defaultMaxRegisterBody := getEnvInt("FFB_MAX_REGISTER_BODY", DEFAULT_MAX_REGISTER_BODY/1024)
+	defaultPprofAddr := getEnvString("FFB_PPROF_ADDR", "")
+	defaultStatsPath := getEnvString("FFB_STATS_PATH", "")
 
 	httpPort := flag.Int("http-port", defaultHTTPPort, "HTTP 服务器端口")
 	tcpPort := flag.Int("tcp-port", defaultTCPPort, "TCP 流服务器端口")
-	maxFileSize := flag.Int64("max-file-size", defaultMaxFileSize, "最大允许文件大小 (GiB)")
+	httpListen := flag.String("http-listen", defaultHTTPListen, "HTTP 服务器监听地址 (host:port)，设置后覆盖 --http-port")
+	tcpListen := flag.String("tcp-listen", defaultTCPListen, "TCP 流服务器监听地址 (host:port)，设置后覆盖 --tcp-port")
+	pprofAddr := flag.String("pprof-addr", defaultPprofAddr, "性能分析 (net/http/pprof) 的独立监听地址 (如 127.0.0.1:6060)，为空时不启用")
+	maxFileSize := flag.String("max-file-size", defaultMaxFileSize, "最大允许文件大小，需带单位 (如 500MB、100GiB)；未带单位的数字不超过1024时按 GiB 解释")
+	maxTotalSize := flag.Int64("max-total-size", defaultMaxTotalSize, "所有有效注册的文件大小之和的上限 (GiB)，超出时注册返回507，0 表示不限制")
+	maxFilenameLength := flag.Int("max-filename-length", defaultMaxFilenameLength, "注册文件名的长度上限 (字节，按UTF-8计)")
+	maxRegisterBody := flag.Int("max-register-body", defaultMaxRegisterBody, "注册请求体的大小上限 (KiB)，超出时返回413")
 	tokenLength := flag.Int("token-len", defaultTokenLength, "随机token长度，默认8位")
+	maxTokenLength := flag.Int("max-token-len", defaultMaxTokenLength, "注册请求通过 token_length 单独指定的令牌长度上限")
+	tokenCharset := flag.String("token-charset", defaultTokenCharset, "下载令牌的字符集: alphanumeric、lowercase、hex、base58 (不含易混淆字符)")
+	tokenPrefix := flag.String("token-prefix", defaultTokenPrefix, "加在下载令牌前的固定前缀 (如 ffb_)，不计入令牌长度")
+	downloadWait := flag.Int("download-wait", defaultDownloadWait, "下载方等待上传端建立流连接的最长时间 (秒)")
+	handshakeTimeout := flag.Int("handshake-timeout", defaultHandshakeTimeout, "TCP流连接的握手时限 (秒)，高延迟链路上可适当调大")
+	cleanupInterval := flag.Int("cleanup-interval", defaultCleanupInterval, "过期资源清理间隔 (秒)")
+	maxActiveStreams := flag.Int("max-active-streams", defaultMaxActiveStreams, "同时活跃的流连接上限，0 表示不限制")
+	enableCompression := flag.Bool("enable-compression", defaultEnableCompression, "允许提供端在TCP链路上使用gzip压缩，--enable-compression=false 时一律不压缩传输")
+	enableCache := flag.Bool("enable-cache", defaultEnableCache, "启用缓存模式 (需同时设置 --cache-dir)，--enable-cache=false 时忽略缓存目录，按实时转发运行")
+	enableDedup := flag.Bool("enable-dedup", defaultEnableDedup, "缓存模式下按注册附带的SHA-256复用已缓存的相同内容；知道摘要即可取得该内容，只应在提供端互相信任时启用")
+	cacheDir := flag.String("cache-dir", defaultCacheDir, "缓存目录，设置后上传流先写入本地临时文件，支持断点续传")
+	cacheMaxSize := flag.Int64("cache-max-size", defaultCacheMaxSize, "缓存目录总容量 (GiB)")
+	downloadLeaseTTL := flag.Int("download-lease-ttl", defaultDownloadLeaseTTL, "缓存模式下中断的下载保留下载名额的时长 (秒)，期间可携带会话ID续传，过期后名额释放给其他下载方")
+	maxRate := flag.Int64("max-rate", defaultMaxRate, "每个下载的限速 (字节/秒)，0 表示不限速")
+	wordCodes := flag.Bool("word-codes", defaultWordCodes, "使用单词口令 (如 7-crossover-clockwork) 代替随机字符串作为下载令牌")
+	chunkedDownloads := flag.Bool("chunked-downloads", defaultChunkedDownloads, "实时转发的下载不声明Content-Length，改用分块传输编码；注册时可通过 chunked 单独指定")
+	maxEventSubscribers := flag.Int("max-event-subscribers", defaultMaxEventSubscribers, "/events 同时订阅者上限")
+	sendBufferSize := flag.Int("send-buffer-size", defaultSendBufferSize, "中继缓冲区大小 (KiB)：较小时小文件与交互式数据更快到达下载方，较大时吞吐更高")
+	statsPath := flag.String("stats-path", defaultStatsPath, "累计统计的持久化文件，设置后定期与关闭时保存，重启后继续累加 (/stats 中的 lifetime_* 字段)")
+	statsFlushSize := flag.Int64("stats-flush-size", defaultStatsFlushSize, "下载字节数写入统计的粒度 (KiB)")
+	tcpTLSCert := flag.String("tcp-tls-cert", defaultTCPTLSCert, "TCP流端口的TLS证书文件 (PEM)，与 --tcp-tls-key 同时设置时启用TLS")
+	tcpTLSKey := flag.String("tcp-tls-key", defaultTCPTLSKey, "TCP流端口的TLS私钥文件 (PEM)")
+	notFoundRedirect := flag.String("not-found-redirect", defaultNotFoundRedirect, "下载不存在的令牌时重定向到的地址 (http/https URL)")
+	notFoundPage := flag.String("not-found-page", defaultNotFoundPage, "下载不存在的令牌时返回的HTML页面文件")
+	notFoundDelay := flag.Int("not-found-delay", defaultNotFoundDelay, "令牌不存在时延迟响应的时长 (毫秒，另加至多25%随机抖动)，提高枚举令牌的成本，0 表示不延迟")
+	maxFailedLookups := flag.Int("max-failed-lookups", defaultMaxFailedLookups, "每个IP每分钟允许的令牌查找失败次数 (下载、状态查询)，超出后返回429，0 表示不限制")
+	corsOrigin := flag.String("cors-origin", defaultCORSOrigin, "允许的跨域来源，多个用逗号分隔 (如 https://app.example.com)；\"*\" 表示允许任意来源，包括WebSocket升级")
+	trustedProxies := flag.String("trusted-proxies", defaultTrustedProxies, "可信反向代理的网段或IP，多个用逗号分隔；只有来自这些地址的请求才采用 X-Forwarded-Proto/X-Forwarded-For 等头，\"none\" 表示不信任任何代理")
+	memoryHighWater := flag.Int64("memory-high-water", defaultMemoryHighWater, "堆内存高水位 (MiB)，超过后拒绝新的注册与流连接直到内存回落，0 表示不启用")
+	maxInflightBytes := flag.Int64("max-inflight-bytes", defaultMaxInflightBytes, "所有流在途字节的总上限 (字节)，达到后暂停从上传端读取，0 表示不限制")
+	adminToken := flag.String("admin-token", defaultAdminToken, "管理接口令牌 (/admin/*)，为空时管理接口不可用")
+	idleRegistrationTimeout := flag.Int("idle-registration-timeout", defaultIdleRegistrationTimeout, "注册后从未建立流的条目的清理时限 (秒)，0 表示只按过期时间清理")
 
 	flag.Parse()
 
 	finalTokenLen := tokenLength
-	calcBytes := (*maxFileSize) * 1024 * 1024 * 1024
-	maxFileSizeBytes := &calcBytes
-	if *finalTokenLen < 6 || *finalTokenLen > 32 {
-		log.Printf("⚠️ 警告: ID 长度 %d 不在有效范围 (6-32)，将恢复默认值 8", *finalTokenLen)
+	maxFileSizeBytes, warning, err := parseMaxFileSize(*maxFileSize)
+	if warning != "" {
+		log.Printf("⚠️ 警告: %s", warning)
+	}
+	if err != nil {
+		log.Printf("⚠️ 警告: %v，将使用默认值 %d GiB", err, DEFAULT_MAX_FILE_SIZE>>30)
+		maxFileSizeBytes = DEFAULT_MAX_FILE_SIZE
+	}
+	if *finalTokenLen < MIN_TOKEN_LENGTH || *finalTokenLen > DEFAULT_MAX_TOKEN_LENGTH {
+		log.Printf("⚠️ 警告: ID 长度 %d 不在有效范围 (%d-%d)，将恢复默认值 8", *finalTokenLen, MIN_TOKEN_LENGTH, DEFAULT_MAX_TOKEN_LENGTH)
 		defaultVal := 8
 		finalTokenLen = &defaultVal
 	}
 
+	// 监听地址在启动前校验；其中的端口同时用于生成下载链接与告知提供端的TCP端口
+	if *httpListen != "" {
+		port, err := parseListenAddr(*httpListen)
+		if err != nil {
+			log.Fatalf("💥 --http-listen 无效: %v", err)
+		}
+		*httpPort = port
+	}
+	if *tcpListen != "" {
+		port, err := parseListenAddr(*tcpListen)
+		if err != nil {
+			log.Fatalf("💥 --tcp-listen 无效: %v", err)
+		}
+		*tcpPort = port
+	}
+	if *pprofAddr != "" {
+		port, err := parseListenAddr(*pprofAddr)
+		if err != nil {
+			log.Fatalf("💥 --pprof-addr 无效: %v", err)
+		}
+		if port == *httpPort {
+			log.Fatalf("💥 --pprof-addr 不能使用HTTP服务器端口 %d", port)
+		}
+		host, _, _ := net.SplitHostPort(*pprofAddr)
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			log.Printf("⚠️ 警告: 性能分析监听在所有网卡 (%s)，建议只绑定 127.0.0.1 等私有地址", *pprofAddr)
+		}
+	}
+
 	// 创建服务器实例
-	server := NewFileFlowBridge(*httpPort, *tcpPort, *maxFileSizeBytes, *finalTokenLen)
+	server := NewFileFlowBridge(*httpPort, *tcpPort, maxFileSizeBytes, *finalTokenLen)
+	server.HTTPListen = *httpListen
+	server.TCPListen = *tcpListen
+	server.PprofAddr = *pprofAddr
+	server.StatsPath = *statsPath
+	if *downloadWait > 0 {
+		server.DownloadWait = time.Duration(*downloadWait) * time.Second
+	} else {
+		log.Printf("⚠️ 警告: 下载等待时间 %d 秒无效，将使用默认值 %v", *downloadWait, DEFAULT_DOWNLOAD_WAIT)
+	}
+	if *handshakeTimeout > 0 {
+		server.HandshakeTimeout = time.Duration(*handshakeTimeout) * time.Second
+	} else {
+		log.Printf("⚠️ 警告: 握手时限 %d 秒无效，将使用默认值 %v", *handshakeTimeout, STREAM_HANDSHAKE_TIMEOUT)
+	}
+	if *cleanupInterval > 0 {
+		server.CleanupInterval = time.Duration(*cleanupInterval) * time.Second
+	} else {
+		log.Printf("⚠️ 警告: 清理间隔 %d 秒无效，将使用默认值 %v", *cleanupInterval, DEFAULT_CLEANUP_INTERVAL)
+	}
+	if *maxActiveStreams >= 0 {
+		server.MaxActiveStreams = *maxActiveStreams
+	} else {
+		log.Printf("⚠️ 警告: 活跃流上限 %d 无效，将不限制活跃流数量", *maxActiveStreams)
+	}
+	server.DisableCompression = !*enableCompression
+	if *enableCache {
+		server.CacheDir = *cacheDir
+	} else if *cacheDir != "" {
+		log.Printf("⚠️ 警告: 缓存已关闭 (--enable-cache=false)，忽略缓存目录 %s", *cacheDir)
+	}
+	server.Dedup = *enableDedup
+	if server.Dedup && server.CacheDir == "" {
+		log.Printf("⚠️ 警告: 缓存去重需要缓存模式，未设置 --cache-dir 时 --enable-dedup 不生效")
+	}
+	if *cacheMaxSize > 0 {
+		server.CacheMaxSize = *cacheMaxSize * 1024 * 1024 * 1024
+	} else {
+		log.Printf("⚠️ 警告: 缓存容量 %d GiB 无效，将使用默认值 %d GiB", *cacheMaxSize, DEFAULT_CACHE_MAX_SIZE/(1024*1024*1024))
+	}
+	if *maxRate >= 0 {
+		server.MaxRate = *maxRate
+	} else {
+		log.Printf("⚠️ 警告: 下载限速 %d 无效，将不限速", *maxRate)
+	}
+	if *idleRegistrationTimeout >= 0 {
+		server.IdleRegistrationTimeout = time.Duration(*idleRegistrationTimeout) * time.Second
+	} else {
+		log.Printf("⚠️ 警告: 空闲注册清理时限 %d 秒无效，将只按过期时间清理", *idleRegistrationTimeout)
+	}
+	server.WordCodes = *wordCodes
+	server.ChunkedDownloads = *chunkedDownloads
+	server.AdminToken = *adminToken
+	if *maxEventSubscribers > 0 {
+		server.MaxEventSubscribers = *maxEventSubscribers
+	} else {
+		log.Printf("⚠️ 警告: 事件订阅者上限 %d 无效，将使用默认值 %d", *maxEventSubscribers, DEFAULT_MAX_EVENT_SUBSCRIBERS)
+	}
+	if size := *sendBufferSize * 1024; size >= MIN_SEND_BUFFER_SIZE && size <= MAX_SEND_BUFFER_SIZE {
+		server.SendBufferSize = size
+	} else {
+		log.Printf("⚠️ 警告: 中继缓冲区大小 %d KiB 无效 (%d-%d)，将使用默认值 %d KiB", *sendBufferSize, MIN_SEND_BUFFER_SIZE/1024, MAX_SEND_BUFFER_SIZE/1024, DEFAULT_SEND_BUFFER_SIZE/1024)
+	}
+	if *maxFilenameLength > 0 {
+		server.MaxFilenameLength = *maxFilenameLength
+	} else {
+		log.Printf("⚠️ 警告: 文件名长度上限 %d 无效，将使用默认值 %d", *maxFilenameLength, DEFAULT_MAX_FILENAME_LENGTH)
+	}
+	if *maxRegisterBody > 0 {
+		server.MaxRegisterBody = int64(*maxRegisterBody) * 1024
+	} else {
+		log.Printf("⚠️ 警告: 注册请求体上限 %d KiB 无效，将使用默认值 %d KiB", *maxRegisterBody, DEFAULT_MAX_REGISTER_BODY/1024)
+	}
+	if _, ok := tokenCharsets[*tokenCharset]; !ok {
+		log.Fatalf("💥 --token-charset 无效: %q，可选 alphanumeric、lowercase、hex、base58", *tokenCharset)
+	}
+	server.TokenCharset = *tokenCharset
+	if err := validateTokenPrefix(*tokenPrefix); err != nil {
+		log.Fatalf("💥 --token-prefix 无效: %v", err)
+	}
+	server.TokenPrefix = *tokenPrefix
+	if *maxTokenLength >= MIN_TOKEN_LENGTH && *maxTokenLength <= MAX_TOKEN_LENGTH_LIMIT {
+		server.MaxTokenLength = *maxTokenLength
+	} else {
+		log.Printf("⚠️ 警告: 令牌长度上限 %d 不在有效范围 (%d-%d)，将使用默认值 %d", *maxTokenLength, MIN_TOKEN_LENGTH, MAX_TOKEN_LENGTH_LIMIT, DEFAULT_MAX_TOKEN_LENGTH)
+	}
+	if *statsFlushSize > 0 {
+		server.StatsFlushBytes = *statsFlushSize * 1024
+	} else {
+		log.Printf("⚠️ 警告: 统计刷新粒度 %d KiB 无效，将使用默认值 %d KiB", *statsFlushSize, DEFAULT_STATS_FLUSH_BYTES/1024)
+	}
+	if *maxInflightBytes >= 0 {
+		server.MaxInflightBytes = *maxInflightBytes
+	} else {
+		log.Printf("⚠️ 警告: 在途字节上限 %d 无效，将不限制", *maxInflightBytes)
+	}
+	if *downloadLeaseTTL > 0 {
+		server.DownloadLeaseTTL = time.Duration(*downloadLeaseTTL) * time.Second
+	} else {
+		log.Printf("⚠️ 警告: 下载租约时长 %d 秒无效，将使用默认值 %v", *downloadLeaseTTL, DOWNLOAD_SESSION_TTL)
+	}
+	if *maxTotalSize >= 0 {
+		server.MaxTotalSize = *maxTotalSize * 1024 * 1024 * 1024
+	} else {
+		log.Printf("⚠️ 警告: 注册总量上限 %d GiB 无效，将不限制", *maxTotalSize)
+	}
+	for _, origin := range strings.Split(*corsOrigin, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			server.CORSOrigins = append(server.CORSOrigins, origin)
+		}
+	}
+	// 可信代理配置错误时拒绝启动，避免静默信任或忽略代理头
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("💥 --trusted-proxies 无效: %v", err)
+	}
+	server.TrustedProxies = proxies
+	if *memoryHighWater >= 0 {
+		server.MemoryHighWater = *memoryHighWater * 1024 * 1024
+	} else {
+		log.Printf("⚠️ 警告: 堆内存高水位 %d MiB 无效，将不启用卸载模式", *memoryHighWater)
+	}
+	if *tcpTLSCert != "" || *tcpTLSKey != "" {
+		// 证书配置错误时拒绝启动，而不是静默退回明文传输
+		cert, err := tls.LoadX509KeyPair(*tcpTLSCert, *tcpTLSKey)
+		if err != nil {
+			log.Fatalf("💥 加载TCP流TLS证书失败: %v", err)
+		}
+		server.TCPTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		log.Printf("🔒 TCP流端口已启用TLS")
+	}
+	if *notFoundRedirect != "" {
+		if u, err := url.Parse(*notFoundRedirect); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			server.NotFoundRedirect = *notFoundRedirect
+		} else {
+			log.Printf("⚠️ 警告: 未找到页面重定向地址 %q 无效，需要完整的 http/https URL，将忽略", *notFoundRedirect)
+		}
+	}
+	if delay := time.Duration(*notFoundDelay) * time.Millisecond; delay >= 0 && delay <= MAX_NOT_FOUND_DELAY {
+		server.NotFoundDelay = delay
+	} else {
+		log.Printf("⚠️ 警告: 不存在令牌的响应延迟 %d 毫秒无效 (0-%d)，将不延迟", *notFoundDelay, MAX_NOT_FOUND_DELAY/time.Millisecond)
+	}
+	if *maxFailedLookups >= 0 {
+		server.MaxFailedLookups = *maxFailedLookups
+	} else {
+		log.Printf("⚠️ 警告: 查找失败次数上限 %d 无效，将不限制", *maxFailedLookups)
+	}
+	if server.WordCodes && (server.TokenCharset != DEFAULT_TOKEN_CHARSET || server.TokenPrefix != "") {
+		log.Printf("⚠️ 警告: 已启用单词口令，--token-charset 与 --token-prefix 不生效")
+	}
+	if bits := server.tokenEntropyBits(); bits < MIN_RECOMMENDED_TOKEN_BITS && server.MaxFailedLookups == 0 {
+		log.Printf("⚠️ 警告: 下载令牌只有约 %.0f 位熵 (建议不少于 %d 位) 且未限制查找失败次数，令牌可能被枚举；建议加长 --token-len、改用更大的 --token-charset，或设置 --max-failed-lookups 与 --not-found-delay", bits, MIN_RECOMMENDED_TOKEN_BITS)
+	}
+	if *notFoundPage != "" {
+		page, err := os.ReadFile(*notFoundPage)
+		if err != nil {
+			log.Fatalf("💥 读取未找到页面失败: %v", err)
+		}
+		server.NotFoundPage = page
+		if server.NotFoundRedirect != "" {
+			log.Printf("⚠️ 警告: 同时设置了 --not-found-redirect 与 --not-found-page，将使用重定向")
+		}
+	}
+
+	// 收到中断或终止信号时优雅关闭，关闭前保存累计统计
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("📴 收到信号 %v，准备关闭", sig)
+		close(server.ShutdownEvent)
+	}()
 
 	// 启动服务器
 	if err := server.StartServer(); err != nil {
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery"
+
+// 加密后一整块密文的长度 (明文块加16字节认证标签)
+const sealedChunkSize = ENCRYPT_CHUNK_SIZE + 16
+
+// encryptForTest 用 encryptWriter 加密 plain，返回完整的加密数据
+func encryptForTest(t *testing.T, plain []byte, passphrase string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(&buf, passphrase)
+	if err != nil {
+		t.Fatalf("创建加密写入器失败: %v", err)
+	}
+	if _, err := ew.Write(plain); err != nil {
+		t.Fatalf("加密写入失败: %v", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("封装最后一块失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("生成随机数据失败: %v", err)
+	}
+	return data
+}
+
+// 测试密文长度：每块附加16字节认证标签，空文件也有一个结束块
+func TestEncryptedSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int64
+		want int64
+	}{
+		{0, int64(encryptHeaderSize) + 16},
+		{1, int64(encryptHeaderSize) + 1 + 16},
+		{ENCRYPT_CHUNK_SIZE, int64(encryptHeaderSize) + ENCRYPT_CHUNK_SIZE + 16},
+		{ENCRYPT_CHUNK_SIZE + 1, int64(encryptHeaderSize) + ENCRYPT_CHUNK_SIZE + 1 + 2*16},
+	} {
+		if got := encryptedSize(tc.size); got != tc.want {
+			t.Errorf("encryptedSize(%d) 期望 %d, 得到 %d", tc.size, tc.want, got)
+		}
+	}
+}
+
+// 测试加密后解密得到原文，且密文长度与 encryptedSize 一致
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, ENCRYPT_CHUNK_SIZE, ENCRYPT_CHUNK_SIZE + 1, 3*ENCRYPT_CHUNK_SIZE + 17} {
+		plain := randomBytes(t, size)
+		sealed := encryptForTest(t, plain, testPassphrase)
+		if int64(len(sealed)) != encryptedSize(int64(size)) {
+			t.Errorf("明文 %d 字节: 密文期望 %d 字节, 得到 %d", size, encryptedSize(int64(size)), len(sealed))
+		}
+
+		var out bytes.Buffer
+		if err := decryptStream(&out, bytes.NewReader(sealed), testPassphrase); err != nil {
+			t.Fatalf("明文 %d 字节: 解密失败: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("明文 %d 字节: 解密结果与原文不一致", size)
+		}
+	}
+}
+
+// 测试被篡改的密文：截断、重排、重复、改动任意字节或使用错误的口令都无法解密
+func TestDecryptRejectsTampering(t *testing.T) {
+	plain := randomBytes(t, 2*ENCRYPT_CHUNK_SIZE+100)
+	sealed := encryptForTest(t, plain, testPassphrase)
+	header := sealed[:encryptHeaderSize]
+	chunk := func(i int) []byte {
+		start := encryptHeaderSize + i*sealedChunkSize
+		return sealed[start:min(start+sealedChunkSize, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		passphrase string
+	}{
+		{"去掉最后一块", join(header, chunk(0), chunk(1)), testPassphrase},
+		{"截断在块中间", sealed[:len(sealed)-50], testPassphrase},
+		{"只有文件头", header, testPassphrase},
+		{"交换前两块", join(header, chunk(1), chunk(0), chunk(2)), testPassphrase},
+		{"重复第一块", join(header, chunk(0), chunk(0), chunk(2)), testPassphrase},
+		{"翻转一个密文字节", func() []byte {
+			data := bytes.Clone(sealed)
+			data[encryptHeaderSize+sealedChunkSize+10] ^= 0x01
+			return data
+		}(), testPassphrase},
+		{"错误的口令", sealed, "wrong passphrase"},
+	} {
+		var out bytes.Buffer
+		err := decryptStream(&out, bytes.NewReader(tc.data), tc.passphrase)
+		if !errors.Is(err, ErrDecryptFailed) {
+			t.Errorf("%s: 期望 ErrDecryptFailed, 得到 %v", tc.name, err)
+		}
+	}
+}
@@ -2,53 +2,201 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	// "log"
+	"math"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/proxy"
 )
 
 // ==================== 全局配置与日志 ====================
 // var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 
+// 面向用户的提示与进度输出；--output-json 模式下改写到标准错误，标准输出只留给JSON结果
+var out io.Writer = os.Stdout
+
+// 退出码，便于脚本区分失败原因（2 保留给 flag 包的参数解析错误）
+const (
+	EXIT_FAILURE         = 1 // 参数错误、注册被拒绝等一般错误
+	EXIT_DOWNLOADER_GONE = 3 // 下载方已断开连接，传输中止
+	EXIT_FILE_ERROR      = 4 // 读取本地文件失败
+	EXIT_NETWORK_ERROR   = 5 // 无法连接桥接服务器或网络中断
+	EXIT_VERIFY_FAILED   = 6 // --verify 自检下载的内容与源文件不一致
+	EXIT_TIMEOUT         = 7 // 超过 --timeout 设置的整体时限
+)
+
+// 注册请求遇到网络错误时的最大尝试次数
+const REGISTER_ATTEMPTS = 3
+
+// 桥接服务器以429 (或带 Retry-After 的503) 要求稍后重试时，注册的最大尝试次数与单次等待上限
+const (
+	REGISTER_THROTTLE_ATTEMPTS = 6
+	MAX_REGISTER_BACKOFF       = 30 * time.Second
+)
+
+// 批量发送时同时进行的注册请求数的默认值与上限
+const (
+	DEFAULT_BATCH_CONCURRENCY = 4
+	MAX_BATCH_CONCURRENCY     = 32
+)
+
+// TCP链路上使用的压缩方式，与桥接服务器在握手时协商
+const STREAM_COMPRESSION = "gzip"
+
+// 分块校验：每块带长度与CRC32前缀，桥接服务器逐块校验后才转发
+const (
+	STREAM_FRAMING   = "framed"
+	FRAME_CHUNK_SIZE = 4 * 1024 * 1024
+)
+
+// 按需发送：--follow 模式在握手中请求，桥接服务器在下载方开始下载时发送 DOWNLOAD_STARTED，收到后才读取文件
+const STREAM_ON_DEMAND = "on_demand"
+
+// 发送缓冲区：每次从文件读取并写入连接的字节数
+const (
+	DEFAULT_SEND_BUFFER_SIZE = 64 * 1024
+	MIN_SEND_BUFFER_SIZE     = 1024
+	MAX_SEND_BUFFER_SIZE     = 16 * 1024 * 1024
+)
+
+// 文本片段模式下默认的下载文件名
+const SNIPPET_FILENAME = "snippet.txt"
+
+// --auto-renew 默认最多重新注册的次数，注册有效期为2小时，合计约一天
+const DEFAULT_MAX_RENEWALS = 12
+
+// 下载中止后重新建立流：连续中止达到次数上限时放弃，每次等待时间翻倍，不超过单次上限
+const (
+	MAX_CONSECUTIVE_ABORTS = 5
+	MAX_ABORT_BACKOFF      = 30 * time.Second
+)
+
+var (
+	ErrDownloaderGone = errors.New("下载方已断开连接，传输中止")
+	ErrFileRead       = errors.New("读取文件失败")
+	ErrVerifyFailed   = errors.New("自检失败，下载内容与源文件不一致")
+	ErrTimeout        = errors.New("超过 --timeout 设置的时限，操作中止")
+	ErrDecryptFailed  = errors.New("解密失败，口令错误或数据已损坏")
+)
+
 // ==================== 数据结构定义 ====================
 
 // FileInfo 文件信息结构体
 type FileInfo struct {
-	Path	 string
-	Name	 string
-	Size	 int64
-	ModTime  int64
+	Path    string
+	Name    string
+	Size    int64
+	ModTime int64
 }
 
 // RegisterResponse 注册文件响应结构体
 type RegisterResponse struct {
-	AuthToken	   string `json:"auth_token"`
-	DownloadURL	 string `json:"download_url"`
+	AuthToken        string `json:"auth_token"`
+	ProviderToken    string `json:"provider_token"`
+	DownloadURL      string `json:"download_url"`
 	OriginalFilename string `json:"original_filename"`
-	TcpEndpoint	 struct {
+	TcpEndpoint      struct {
 		Host string `json:"host"`
-		Port int	`json:"port"`
+		Port int    `json:"port"`
+		TLS  bool   `json:"tls"` // 桥接服务器的TCP流端口使用TLS
 	} `json:"tcp_endpoint"`
+	WordCode     string `json:"word_code,omitempty"`    // 桥接服务器启用口令模式时返回
+	Deduplicated bool   `json:"deduplicated,omitempty"` // 桥接服务器已缓存相同内容，无需上传
+	URLs         struct {
+		Download       string `json:"download"`
+		DirectDownload string `json:"direct_download"`
+		Status         string `json:"status"`
+	} `json:"urls"`
 }
 
 // FlowProvider 主客户端结构体
 type FlowProvider struct {
-	BridgeURL	string
-	AuthToken	string
-	TcpHost	  string
-	TcpPort	  int
-	FileInfo	 FileInfo
-	DownloadURL  string
+	BridgeURL        string
+	AuthToken        string
+	ProviderToken    string // 上传端凭证，只用于TCP握手，不会出现在下载链接中
+	TcpHost          string
+	TcpPort          int
+	TcpTLS           bool           // TCP流端口使用TLS，由注册响应的 tcp_endpoint.tls 决定
+	TLSRootCAs       *x509.CertPool // 校验桥接服务器TLS证书 (HTTPS与TCP流) 的根证书，nil 使用系统根证书
+	TLSInsecure      bool           // 跳过桥接服务器TLS证书校验，仅用于测试自签名证书
+	FileInfo         FileInfo
+	DownloadURL      string
+	ProxyURL         string         // 代理地址：空值跟随环境变量，"direct"表示不使用代理
+	Name             string         // 注册时使用的文件名，空值使用文件路径的基本名
+	MaxDownloads     int            // 允许下载的次数，大于1时常驻进程反复建立流
+	Cached           bool           // 桥接服务器已完整缓存文件，无需再次建立流
+	ShareRate        int64          // 注册时请求的下载限速 (字节/秒)，0 表示不限速
+	UploadLimiter    *uploadLimiter // --max-upload-rate 的令牌桶，批量发送的各文件共享；nil 表示不限速
+	Text             string         // 文本片段模式下发送的内容，此时FileInfo.Path为空
+	Compress         bool           // 在TCP链路上使用gzip压缩数据，桥接服务器不支持时退回不压缩
+	ChunkChecksum    bool           // 按 FRAME_CHUNK_SIZE 分块并附带CRC32，桥接服务器不支持时退回不分块
+	Passphrase       string         // 非空时在提供端加密后发送，桥接服务器只转发密文
+	Dedup            bool           // 注册时附带内容的SHA-256，桥接服务器已缓存相同内容时跳过上传
+	NoDelay          bool           // 关闭TCP流连接的Nagle算法，小块数据立即发出
+	SendBufferSize   int            // 发送缓冲区大小 (字节)，0 表示使用 DEFAULT_SEND_BUFFER_SIZE
+	Deadline         time.Time      // 注册与传输整体的截止时间，零值表示不限制
+	Progress         *MultiProgress // 批量发送时汇总显示的进度，nil 表示单独显示本文件的进度条
+	Transport        string         // 实际使用的传输通道：tcp、websocket 或 http_upload
+	Renewals         int            // --auto-renew 模式下因注册过期而重新注册的次数
+	Follow           bool           // --follow：每次下载开始时重新打开文件，发送当时的最新内容
+	Quiet            bool           // 批量并发注册时不逐个打印链接详情，由汇总列表统一输出
+	progressIndex    int            // 本文件在 Progress 中的序号
+	lastTransferred  int64          // 最近一次传输发送的字节数，传输失败时用于报告完成比例
+	BytesTransferred int64          // 累计推送的字节数（--serve 模式下为多次传输之和）
+	TransferDuration time.Duration  // 累计推送耗时
+}
+
+// TcpEndpoint 桥接服务器的TCP流端点
+type TcpEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	TLS  bool   `json:"tls,omitempty"`
+}
+
+// TransferResult --output-json 模式下输出到标准输出的结果
+type TransferResult struct {
+	AuthToken          string      `json:"auth_token"`
+	DownloadURL        string      `json:"download_url"`
+	TcpEndpoint        TcpEndpoint `json:"tcp_endpoint"`
+	OriginalFilename   string      `json:"original_filename"`
+	Size               int64       `json:"size"`
+	BytesTransferred   int64       `json:"bytes_transferred"`
+	DurationSeconds    float64     `json:"duration_seconds"`
+	PercentTransferred *float64    `json:"percent_transferred,omitempty"` // 失败时最近一次传输完成的比例
+	Status             string      `json:"status"`                        // completed、cached、verified、downloader_gone、failed
+	Transport          string      `json:"transport,omitempty"`           // tcp、websocket 或 http_upload (TCP流端口不可达时的回退)
+	Renewals           int         `json:"renewals,omitempty"`            // --auto-renew 重新注册的次数，auth_token 与 download_url 为最后一次注册
+	Error              string      `json:"error,omitempty"`
 }
 
 // ==================== 核心功能实现 ====================
@@ -57,7 +205,106 @@ type FlowProvider struct {
 func NewFlowProvider(bridgeURL string) *FlowProvider {
 	return &FlowProvider{
 		BridgeURL: strings.TrimSuffix(bridgeURL, "/"),
+		NoDelay:   true,
+	}
+}
+
+// validateFileName 检查--name参数，规则与桥接服务器一致
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("文件名无效: %q", name)
+	}
+	for _, c := range name {
+		if c == '/' || c == '\\' || c == '"' || c < 0x20 || c == 0x7f {
+			return fmt.Errorf("文件名包含非法字符: %q", c)
+		}
+	}
+	return nil
+}
+
+// parseProxyURL 解析--proxy参数，返回nil表示直连
+func (f *FlowProvider) parseProxyURL() (*url.URL, error) {
+	if f.ProxyURL == "" || f.ProxyURL == "direct" || f.ProxyURL == "none" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(f.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("代理地址无效: %v", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxyURL, nil
+	default:
+		return nil, fmt.Errorf("不支持的代理协议: %s (支持 http/https/socks5/socks5h)", proxyURL.Scheme)
+	}
+}
+
+// httpClient 根据代理设置创建HTTP客户端
+func (f *FlowProvider) httpClient(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxyURL, err := f.parseProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case proxyURL != nil:
+		transport.Proxy = http.ProxyURL(proxyURL)
+	case f.ProxyURL != "":
+		// 显式要求直连，忽略HTTP_PROXY/HTTPS_PROXY环境变量
+		transport.Proxy = nil
+	}
+	if f.TLSRootCAs != nil || f.TLSInsecure {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:            f.TLSRootCAs,
+			InsecureSkipVerify: f.TLSInsecure,
+		}
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// operationContext 返回受整体截止时间约束的上下文，用于HTTP请求
+func (f *FlowProvider) operationContext() (context.Context, context.CancelFunc) {
+	if f.Deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), f.Deadline)
+}
+
+// timeoutError 整体截止时间已过时，把由此引起的各类错误统一为ErrTimeout
+func (f *FlowProvider) timeoutError(err error) error {
+	if err == nil || f.Deadline.IsZero() || time.Now().Before(f.Deadline) {
+		return err
+	}
+	if errors.Is(err, ErrTimeout) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrTimeout, err)
+}
+
+// dialStream 建立到桥接服务器TCP端口的连接
+// SOCKS5代理（--proxy 或 ALL_PROXY 环境变量）会用于TCP流，HTTP代理无法承载原始TCP流，此时直连
+func (f *FlowProvider) dialStream(address string, timeout time.Duration) (net.Conn, error) {
+	forward := &net.Dialer{Timeout: timeout, Deadline: f.Deadline}
+
+	proxyURL, err := f.parseProxyURL()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer proxy.Dialer = forward
+	switch {
+	case proxyURL != nil && strings.HasPrefix(proxyURL.Scheme, "socks5"):
+		dialer, err = proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, fmt.Errorf("创建SOCKS5代理失败: %v", err)
+		}
+	case f.ProxyURL == "":
+		dialer = proxy.FromEnvironmentUsing(forward)
 	}
+
+	return dialer.Dial("tcp", address)
 }
 
 // RegisterFile 注册文件到桥接服务器
@@ -68,18 +315,135 @@ func (f *FlowProvider) RegisterFile(filePath string) (*RegisterResponse, error)
 		return nil, fmt.Errorf("文件不存在: %v", err)
 	}
 
+	name := filepath.Base(filePath)
+	if f.Name != "" {
+		name = f.Name
+	}
+
 	f.FileInfo = FileInfo{
-		Path:	filePath,
-		Name:	filepath.Base(filePath),
-		Size:	fileInfo.Size(),
+		Path:    filePath,
+		Name:    name,
+		Size:    fileInfo.Size(),
 		ModTime: fileInfo.ModTime().Unix(),
 	}
 
+	return f.register()
+}
+
+// renew 以新的令牌重新注册同一个文件或文本，并打印新的下载链接
+func (f *FlowProvider) renew() error {
+	// register 会为加密发送追加后缀，重新注册前去掉，避免重复追加
+	if f.Passphrase != "" {
+		f.FileInfo.Name = strings.TrimSuffix(f.FileInfo.Name, ENCRYPT_SUFFIX)
+	}
+	if f.Follow {
+		// --follow 的注册大小在重新注册时更新为文件当前的大小
+		if info, err := os.Stat(f.FileInfo.Path); err == nil {
+			f.FileInfo.Size = info.Size()
+		}
+	}
+	_, err := f.register()
+	return err
+}
+
+// registrationExpired 通过 /status 确认当前注册是否已过期或已被移除
+func (f *FlowProvider) registrationExpired() bool {
+	client, err := f.httpClient(10 * time.Second)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Get(fmt.Sprintf("%s/status/%s", f.BridgeURL, url.PathEscape(f.AuthToken)))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return true
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false
+	}
+	return status.Status == "expired"
+}
+
+// registerBackoff 判断注册响应是否要求稍后重试：429，或带 Retry-After 的503 (桥接服务器暂停或内存压力)；
+// 等待时间取 Retry-After 的秒数，没有时按第 n 次重试递增，不超过 MAX_REGISTER_BACKOFF
+func registerBackoff(resp *http.Response, n int) (time.Duration, bool) {
+	retryAfter := resp.Header.Get("Retry-After")
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusServiceUnavailable && retryAfter != "":
+	default:
+		return 0, false
+	}
+	wait := time.Duration(n) * time.Second
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait > MAX_REGISTER_BACKOFF {
+		wait = MAX_REGISTER_BACKOFF
+	}
+	return wait, true
+}
+
+// newIdempotencyKey 生成一次注册使用的随机幂等键
+func newIdempotencyKey() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// RegisterText 把一段文本作为文件注册，内容保存在内存中，不读取本地文件
+func (f *FlowProvider) RegisterText(text string) (*RegisterResponse, error) {
+	name := SNIPPET_FILENAME
+	if f.Name != "" {
+		name = f.Name
+	}
+
+	f.Text = text
+	f.FileInfo = FileInfo{
+		Name:    name,
+		Size:    int64(len(text)),
+		ModTime: time.Now().Unix(),
+	}
+
+	return f.register()
+}
+
+// register 按FileInfo向桥接服务器发送注册请求
+func (f *FlowProvider) register() (*RegisterResponse, error) {
 	// 准备注册请求
 	registerURL := fmt.Sprintf("%s/register", f.BridgeURL)
+	size := f.FileInfo.Size
+	if f.Passphrase != "" {
+		// 桥接服务器只看到密文：文件名加上 .enc 后缀，注册大小为加密后的长度
+		f.FileInfo.Name += ENCRYPT_SUFFIX
+		size = encryptedSize(size)
+	}
 	payload := map[string]interface{}{
 		"filename": f.FileInfo.Name,
-		"size":	 f.FileInfo.Size,
+		"size":     size,
+	}
+	if f.MaxDownloads > 1 {
+		payload["max_downloads"] = f.MaxDownloads
+	}
+	if f.ShareRate > 0 {
+		payload["max_rate"] = f.ShareRate
+	}
+	if f.Text == "" && f.FileInfo.ModTime > 0 {
+		// 下载方可据此恢复文件的修改时间 (Last-Modified)
+		payload["mtime"] = f.FileInfo.ModTime
+	}
+	if f.Dedup && f.Passphrase == "" {
+		// 每次加密使用随机盐，密文各不相同，去重只对明文发送有意义
+		sum, err := f.contentSHA256()
+		if err != nil {
+			return nil, err
+		}
+		payload["sha256"] = sum
 	}
 
 	jsonPayload, err := json.Marshal(payload)
@@ -87,17 +451,47 @@ func (f *FlowProvider) RegisterFile(filePath string) (*RegisterResponse, error)
 		return nil, fmt.Errorf("JSON序列化失败: %v", err)
 	}
 
-	// 发送HTTP POST请求
-	req, err := http.NewRequest("POST", registerURL, strings.NewReader(string(jsonPayload)))
+	client, err := f.httpClient(30 * time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("创建请求失败: %v", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("网络错误: %v", err)
+	// 发送HTTP POST请求，网络错误时重试；重试携带相同的幂等键，桥接服务器会返回原注册而不是重复创建
+	idempotencyKey := newIdempotencyKey()
+	ctx, cancel := f.operationContext()
+	defer cancel()
+	var resp *http.Response
+	throttled := 0
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", registerURL, bytes.NewReader(jsonPayload))
+		if err != nil {
+			return nil, fmt.Errorf("创建请求失败: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+
+		resp, err = client.Do(req)
+		if err == nil {
+			// 并发注册较多时桥接服务器可能要求放慢速度：按 Retry-After 等待后重试
+			wait, retry := registerBackoff(resp, throttled+1)
+			if !retry || throttled+1 >= REGISTER_THROTTLE_ATTEMPTS {
+				break
+			}
+			throttled++
+			resp.Body.Close()
+			fmt.Fprintf(out, "⏳ 桥接服务器繁忙 (状态码: %d)，%v 后重试注册: %s\n", resp.StatusCode, wait, f.FileInfo.Name)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("网络错误: %w", ctx.Err())
+			}
+			continue
+		}
+		if attempt-throttled >= REGISTER_ATTEMPTS {
+			return nil, fmt.Errorf("网络错误: %w", err)
+		}
+		fmt.Fprintf(out, "⚠️ 注册请求失败，%d 秒后重试: %v\n", attempt-throttled, err)
+		time.Sleep(time.Duration(attempt-throttled) * time.Second)
 	}
 	defer resp.Body.Close()
 
@@ -114,15 +508,18 @@ func (f *FlowProvider) RegisterFile(filePath string) (*RegisterResponse, error)
 
 	// 更新实例状态
 	f.AuthToken = result.AuthToken
+	f.ProviderToken = result.ProviderToken
 	f.TcpHost = result.TcpEndpoint.Host
 	f.TcpPort = result.TcpEndpoint.Port
+	f.TcpTLS = result.TcpEndpoint.TLS
 	f.DownloadURL = result.DownloadURL
+	f.Cached = result.Deduplicated
 
 	// 修复可能的多余端口号
 	if strings.Contains(f.TcpHost, ":") {
 		parts := strings.Split(f.TcpHost, ":")
 		if len(parts) > 1 {
-			f.TcpHost = parts[0]  // 只取主机名部分
+			f.TcpHost = parts[0] // 只取主机名部分
 			// 如果端口被错误地放在了host字段，可以尝试提取
 			if port, err := strconv.Atoi(parts[1]); err == nil && f.TcpPort == 0 {
 				f.TcpPort = port
@@ -130,195 +527,1317 @@ func (f *FlowProvider) RegisterFile(filePath string) (*RegisterResponse, error)
 		}
 	}
 
+	if f.Quiet {
+		return &result, nil
+	}
+
 	// 日志输出
 	// logger.Printf("✅ 文件注册成功")
 	// logger.Printf("📋 文件Token: %s", f.AuthToken)
 	// logger.Printf("🔑 认证令牌: %s", f.AuthToken)
 	// logger.Printf("🔌 TCP端点: %s:%d", f.TcpHost, f.TcpPort)
-	fmt.Println("📁 原始文件名:", result.OriginalFilename)
-	fmt.Println("🔗 点击或双击复制下载地址:")
-	fmt.Println(result.DownloadURL)
+	fmt.Fprintln(out, "📁 原始文件名:", result.OriginalFilename)
+	if result.WordCode != "" {
+		fmt.Fprintln(out, "🗣️ 下载口令:", result.WordCode)
+	}
+	fmt.Fprintln(out, "🔗 点击或双击复制下载地址:")
+	fmt.Fprintln(out, result.DownloadURL)
+	if direct := result.URLs.DirectDownload; direct != "" && direct != result.DownloadURL {
+		fmt.Fprintln(out, "🔀 直连下载地址（绕过反向代理）:")
+		fmt.Fprintln(out, direct)
+	}
+	fmt.Fprintln(out, "💻 命令行下载:")
+	fmt.Fprintln(out, f.CurlCommand())
+	if result.Deduplicated {
+		fmt.Fprintln(out, "♻️ 桥接服务器已缓存相同内容，无需上传")
+	}
 
 	return &result, nil
 }
 
+// contentSHA256 计算待发送内容的SHA-256 (十六进制)，用于注册时的缓存去重
+func (f *FlowProvider) contentSHA256() (string, error) {
+	src, err := f.openSource()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, src); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // EstablishStreamConnection 建立TCP流连接并传输文件
 func (f *FlowProvider) EstablishStreamConnection() error {
 	if f.AuthToken == "" || f.TcpHost == "" || f.TcpPort == 0 {
 		return errors.New("文件未正确注册")
 	}
+	if f.Cached {
+		// 注册时已命中缓存去重，桥接服务器直接服务下载
+		return nil
+	}
 
-	// fmt.Println("🔗 连接到TCP服务器 %s:%d...", f.TcpHost, f.TcpPort)
+	// 先查询桥接服务器支持的传输通道，按 TCP流、WebSocket、HTTP上传 的顺序选择
+	caps, cfgErr := f.serverCapabilities()
+	if cfgErr != nil {
+		fmt.Fprintln(out, "⚠️ 无法查询桥接服务器支持的传输通道:", cfgErr)
+	}
+	if !caps.TCPStream {
+		return f.uploadFallback(caps, errors.New("桥接服务器未开放TCP流端口"))
+	}
 
 	// 建立TCP连接
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", f.TcpHost, f.TcpPort), 30*time.Second)
+	conn, err := f.dialStream(net.JoinHostPort(f.TcpHost, strconv.Itoa(f.TcpPort)), 30*time.Second)
 	if err != nil {
-		return fmt.Errorf("TCP连接失败: %v", err)
+		// TCP流端口可能被出口防火墙拦截，而HTTP已经可以访问：改用桥接服务器支持的其他通道
+		if f.Deadline.IsZero() || time.Now().Before(f.Deadline) {
+			return f.uploadFallback(caps, fmt.Errorf("无法连接TCP流端口 %s:%d (%v)", f.TcpHost, f.TcpPort, err))
+		}
+		return fmt.Errorf("TCP连接失败: %w", err)
+	}
+	f.Transport = "tcp"
+	fmt.Fprintf(out, "🔌 传输通道: TCP流 %s:%d\n", f.TcpHost, f.TcpPort)
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(f.NoDelay)
+	}
+	if f.TcpTLS {
+		if conn, err = f.startTLS(conn); err != nil {
+			return err
+		}
 	}
 	defer conn.Close()
+	if !f.Deadline.IsZero() {
+		// 桥接服务器停止读取或迟迟没有下载方时，读写在截止时间到达后失败，不会无限挂起
+		conn.SetDeadline(f.Deadline)
+	}
 
 	// 发送连接元数据
 	meta := map[string]string{
-		"auth_token": f.AuthToken,
-		"filename":  f.FileInfo.Name,
+		"auth_token":     f.AuthToken,
+		"provider_token": f.ProviderToken,
+		"filename":       f.FileInfo.Name,
+	}
+	if f.Compress {
+		meta["compression"] = STREAM_COMPRESSION
+	}
+	if f.ChunkChecksum {
+		meta["framed"] = "true"
+		meta["chunk_size"] = strconv.Itoa(FRAME_CHUNK_SIZE)
+	}
+	if f.Text == "" && f.FileInfo.ModTime > 0 {
+		meta["mtime"] = strconv.FormatInt(f.FileInfo.ModTime, 10)
+	}
+	if f.Follow {
+		meta[STREAM_ON_DEMAND] = "true"
 	}
 	metaJSON, _ := json.Marshal(meta)
 	if _, err := conn.Write(append(metaJSON, '\n')); err != nil {
-		return fmt.Errorf("发送元数据失败: %v", err)
+		return fmt.Errorf("发送元数据失败: %w", err)
 	}
 
 	// 等待服务器确认
 	reader := bufio.NewReader(conn)
 	response, err := reader.ReadString('\n')
 	if err != nil {
-		return fmt.Errorf("读取服务器响应失败: %v", err)
+		return fmt.Errorf("读取服务器响应失败: %w", err)
 	}
-	if strings.TrimSpace(response) != "STREAM_READY" {
-		return fmt.Errorf("服务器响应错误: %s", response)
+	fields := strings.Fields(response)
+	if len(fields) == 0 || fields[0] != "STREAM_READY" {
+		switch strings.TrimSpace(response) {
+		case "TRANSFER_CACHED":
+			f.Cached = true
+			fmt.Fprintln(out, "♻️ 桥接服务器已缓存相同内容，无需上传")
+			return nil
+		case "UNSUPPORTED_COMPRESSION":
+			return fmt.Errorf("桥接服务器拒绝了压缩方式 %s", STREAM_COMPRESSION)
+		case "UNSUPPORTED_FRAMING":
+			return fmt.Errorf("桥接服务器拒绝了分块大小 %d 字节", FRAME_CHUNK_SIZE)
+		case "SERVER_BUSY":
+			return fmt.Errorf("服务器繁忙 (活跃流已达上限或负载过高)，请稍后重试")
+		case "SERVER_PAUSED":
+			return fmt.Errorf("服务器维护中，暂停接收新的传输，请稍后重试")
+		case "ALREADY_STREAMING":
+			return fmt.Errorf("该分享已有另一个上传连接正在传输")
+		default:
+			return fmt.Errorf("服务器响应错误: %s", response)
+		}
+	}
+	// 服务器在 STREAM_READY 之后回显接受的选项，旧版本服务器只回复 STREAM_READY
+	compress := slices.Contains(fields[1:], STREAM_COMPRESSION)
+	framed := slices.Contains(fields[1:], STREAM_FRAMING)
+	if f.Compress && !compress {
+		fmt.Fprintln(out, "⚠️ 桥接服务器不支持压缩，改为不压缩传输")
+	}
+	if f.ChunkChecksum && !framed {
+		fmt.Fprintln(out, "⚠️ 桥接服务器不支持分块校验，改为不分块传输")
+	}
+	onDemand := false
+	if f.Follow {
+		if !slices.Contains(fields[1:], STREAM_ON_DEMAND) {
+			// 旧版本服务器或缓存模式：数据在建立流时即开始发送
+			fmt.Fprintln(out, "⚠️ 桥接服务器不支持按需发送，下载方得到的是建立流时的文件内容")
+		} else {
+			onDemand = true
+			fmt.Fprintln(out, "⏳ 流连接已建立，等待下载方开始下载...")
+			notice, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("等待下载方失败: %w", err)
+			}
+			if strings.TrimSpace(notice) != "DOWNLOAD_STARTED" {
+				return fmt.Errorf("未知的服务器通知: %s", strings.TrimSpace(notice))
+			}
+		}
 	}
 
-	fmt.Println("✅ 流连接已建立，开始传输文件...")
+	fmt.Fprintln(out, "✅ 流连接已建立，开始传输文件...")
+	streamStart := time.Now()
 
-	// 传输文件内容
-	if err := f.streamFileContent(conn); err != nil {
+	// 传输文件内容；按需发送时发送下载开始时文件的全部内容，大小以当时为准
+	var src io.ReadCloser
+	size := f.FileInfo.Size
+	if onDemand {
+		src, size, err = f.openFollowedSource()
+	} else {
+		src, err = f.openSource()
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := f.streamFileContent(conn, src, size, compress, framed); err != nil {
 		return err
 	}
 
-	fmt.Println("🎉 文件传输完成!")
-	return nil
+	fmt.Fprintln(out, "📨 文件数据已发送，等待下载方完成接收...")
+	return f.waitTransferResult(reader, streamStart)
 }
 
-// FormatSpeed 格式化速度输出
-func FormatSpeed(bytesPerSecond float64) string {
-	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
-	unitIndex := 0
-	for bytesPerSecond >= 1024 && unitIndex < len(units)-1 {
-		bytesPerSecond /= 1024
-		unitIndex++
+// serverCapabilities 桥接服务器支持的传输通道，来自 /config 的 features
+type serverCapabilities struct {
+	TCPStream       bool
+	WebSocketUpload bool
+	HTTPUpload      bool
+}
+
+// serverCapabilities 通过 /config 查询桥接服务器支持的传输通道；查询失败或旧版本服务器没有相应字段时
+// 假定只支持TCP流，与没有回退时的行为一致
+func (f *FlowProvider) serverCapabilities() (serverCapabilities, error) {
+	caps := serverCapabilities{TCPStream: true}
+	client, err := f.httpClient(10 * time.Second)
+	if err != nil {
+		return caps, err
 	}
-	return fmt.Sprintf("%.2f %s", bytesPerSecond, units[unitIndex])
+	ctx, cancel := f.operationContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", f.BridgeURL+"/config", nil)
+	if err != nil {
+		return caps, fmt.Errorf("创建请求失败: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return caps, fmt.Errorf("网络错误: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// 旧版本桥接服务器没有 /config
+		return caps, nil
+	}
+	var config struct {
+		Features map[string]bool `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return caps, fmt.Errorf("解析响应失败: %v", err)
+	}
+	if tcp, ok := config.Features["tcp_stream"]; ok {
+		caps.TCPStream = tcp
+	}
+	caps.WebSocketUpload = config.Features["websocket_upload"]
+	// 旧版本服务器只有 upload_http
+	caps.HTTPUpload = config.Features["http_upload"] || config.Features["upload_http"]
+	return caps, nil
 }
 
-// FormatSize 格式化大小输出
-func FormatSize(bytes int64) string {
-	size := float64(bytes)
-	units := []string{"B", "KiB", "MiB", "GiB"}
-	unitIndex := 0
-	for size >= 1024 && unitIndex < len(units)-1 {
-		size /= 1024
-		unitIndex++
+// uploadFallback TCP流不可用时，按 WebSocket、HTTP上传 的顺序改用桥接服务器支持的通道
+func (f *FlowProvider) uploadFallback(caps serverCapabilities, reason error) error {
+	switch {
+	case caps.WebSocketUpload:
+		fmt.Fprintf(out, "⚠️ %v，改用WebSocket上传\n", reason)
+		return f.UploadWebSocket()
+	case caps.HTTPUpload:
+		fmt.Fprintf(out, "⚠️ %v，改用HTTP上传\n", reason)
+		return f.UploadHTTP()
 	}
-	return fmt.Sprintf("%.2f %s", size, units[unitIndex])
+	return fmt.Errorf("TCP连接失败: %w", reason)
 }
 
-// streamFileContent 流式传输文件内容
-func (f *FlowProvider) streamFileContent(conn net.Conn) error {
-	file, err := os.Open(f.FileInfo.Path)
+// wsMessageWriter 把每次写入作为一条WebSocket二进制消息发送
+type wsMessageWriter struct {
+	conn *websocket.Conn
+}
+
+func (w *wsMessageWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// UploadWebSocket 通过 /ws 上传文件：连接后等待桥接服务器通知下载开始，再以二进制消息发送文件，
+// 最后等待下载结果：只有收到 transfer_complete 才算成功。与HTTP上传一样不支持链路压缩与分块校验；加密 (--encrypt) 照常生效
+func (f *FlowProvider) UploadWebSocket() error {
+	proxyURL, err := f.parseProxyURL()
 	if err != nil {
-		return fmt.Errorf("打开文件失败: %v", err)
+		return err
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: 30 * time.Second, Proxy: http.ProxyFromEnvironment}
+	switch {
+	case proxyURL != nil:
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	case f.ProxyURL != "":
+		dialer.Proxy = nil
+	}
+	if f.TLSRootCAs != nil || f.TLSInsecure {
+		dialer.TLSClientConfig = &tls.Config{
+			RootCAs:            f.TLSRootCAs,
+			InsecureSkipVerify: f.TLSInsecure,
+		}
 	}
-	defer file.Close()
 
-	// 进度条实现
-	progress := &ProgressBar{
-		Total: f.FileInfo.Size,
-		Desc:  "📤 上传中",
-		Units: []string{"B", "KiB", "MiB", "GiB"},
+	wsURL := f.BridgeURL + "/ws/" + f.AuthToken
+	if rest, ok := strings.CutPrefix(wsURL, "https://"); ok {
+		wsURL = "wss://" + rest
+	} else if rest, ok := strings.CutPrefix(wsURL, "http://"); ok {
+		wsURL = "ws://" + rest
+	}
+	header := http.Header{}
+	header.Set("X-FileFlow-Provider-Token", f.ProviderToken)
+	ctx, cancel := f.operationContext()
+	defer cancel()
+	conn, resp, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("WebSocket连接失败: %v (状态码: %d)", err, resp.StatusCode)
+		}
+		return fmt.Errorf("WebSocket连接失败: %w", err)
+	}
+	defer conn.Close()
+	if !f.Deadline.IsZero() {
+		conn.SetReadDeadline(f.Deadline)
+		conn.SetWriteDeadline(f.Deadline)
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		progress.Print()
-	}()
-	defer wg.Wait()
 
-	// 传输文件
-	buffer := make([]byte, 65536)
-	var transferred int64
-	startTime := time.Now()
+	f.Transport = "websocket"
+	fmt.Fprintln(out, "🌐 传输通道: WebSocket", wsURL)
 
-	for {
-		n, err := file.Read(buffer)
-		if n > 0 {
-			if _, writeErr := conn.Write(buffer[:n]); writeErr != nil {
-				return fmt.Errorf("写入数据失败: %v", writeErr)
+	// readCommand 读取下一条控制消息，二进制或无法解析的消息被忽略
+	readCommand := func() (string, error) {
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return "", err
+			}
+			var msg struct {
+				Command string `json:"command"`
+			}
+			if messageType == websocket.TextMessage && json.Unmarshal(message, &msg) == nil && msg.Command != "" {
+				return msg.Command, nil
 			}
-			transferred += int64(n)
-			progress.Set(transferred)
-		}
-		if err == io.EOF {
-			break
 		}
+	}
+
+	// 服务器就绪后等待下载方到来，提前发送的数据会在服务器端堆积
+	for started := false; !started; {
+		command, err := readCommand()
 		if err != nil {
-			return fmt.Errorf("读取文件失败: %v", err)
+			return fmt.Errorf("读取服务器响应失败: %w", err)
+		}
+		switch command {
+		case "READY":
+			fmt.Fprintln(out, "✅ WebSocket连接已建立，等待下载方...")
+		case "download_started", "send_chunk":
+			started = true
+		case "stop_upload":
+			return ErrDownloaderGone
 		}
 	}
 
-	// 计算传输统计
-	duration := time.Since(startTime)
-	// 计算每秒字节数
-	var bps float64
-	if duration.Seconds() > 0 {
-		bps = float64(transferred) / duration.Seconds()
+	streamStart := time.Now()
+	src, err := f.openSource()
+	if err != nil {
+		return err
 	}
-
-	progress.Finish()
-	fmt.Printf(
-		"📊 传输统计: %s, 耗时 %.2f 秒, 平均速度: %s\n",
-		FormatSize(transferred),
-		duration.Seconds(),
-		FormatSpeed(bps),
-	)
-
-	return nil
-}
-
-// GenerateDownloadInfo 生成下载信息
-func (f *FlowProvider) GenerateDownloadInfo() string {
-	if f.AuthToken == "" || f.DownloadURL == "" {
-		return "文件未注册或下载URL不可用"
+	defer src.Close()
+	if err := f.streamFileContent(&wsMessageWriter{conn: conn}, src, f.FileInfo.Size, false, false); err != nil {
+		return err
 	}
 
-	size := float64(f.FileInfo.Size)
-	unit := "Bytes"
-	units := []string{"Bytes", "KiB", "MiB", "GiB", "TiB"}
-	
-	i := 0
-	for size >= 1024 && i < len(units)-1 {
-		size /= 1024
-		i++
+	fmt.Fprintln(out, "📨 文件数据已发送，等待下载方完成接收...")
+	for {
+		command, err := readCommand()
+		if err != nil {
+			// 连接在收到下载结果之前断开，无法确认下载方已收到完整文件
+			return fmt.Errorf("等待下载结果失败: %w", err)
+		}
+		switch command {
+		case "transfer_complete":
+			fmt.Fprintf(out, "🎉 下载方已完成下载! 总耗时 %.2f 秒\n", time.Since(streamStart).Seconds())
+			return nil
+		case "transfer_aborted", "stop_upload":
+			return ErrDownloaderGone
+		}
 	}
-	unit = units[i]
+}
 
-	var sizeStr string
-	if unit == "Bytes" {
-		sizeStr = fmt.Sprintf("%d %s", f.FileInfo.Size, unit)
-	} else {
-		sizeStr = fmt.Sprintf("%.2f %s", size, unit)
+// UploadHTTP 通过 /upload 以multipart表单上传文件，桥接服务器在下载方完成下载后才返回响应
+// 不支持链路压缩与分块校验；加密 (--encrypt) 照常在提供端完成
+func (f *FlowProvider) UploadHTTP() error {
+	src, err := f.openSource()
+	if err != nil {
+		return err
 	}
+	defer src.Close()
 
-	return fmt.Sprintf(`
+	// 边读文件边写入请求体，不把整个文件读入内存
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", f.FileInfo.Name)
+		if err == nil {
+			err = f.streamFileContent(part, src, f.FileInfo.Size, false, false)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	client, err := f.httpClient(0)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := f.operationContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", f.BridgeURL+"/upload/"+f.AuthToken, pr)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-FileFlow-Provider-Token", f.ProviderToken)
+
+	f.Transport = "http_upload"
+	fmt.Fprintln(out, "🌐 传输通道: HTTP上传", f.BridgeURL+"/upload/")
+	streamStart := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		pr.CloseWithError(err)
+		return fmt.Errorf("HTTP上传失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP上传失败: %s (状态码: %d)", strings.TrimSpace(string(body)), resp.StatusCode)
+	}
+	fmt.Fprintf(out, "🎉 HTTP上传完成! 总耗时 %.2f 秒\n", time.Since(streamStart).Seconds())
+	return nil
+}
+
+// startTLS 在TCP流连接上完成TLS握手，证书与桥接服务器地址不匹配或不受信任时返回明确的错误
+func (f *FlowProvider) startTLS(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         f.TcpHost,
+		RootCAs:            f.TLSRootCAs,
+		InsecureSkipVerify: f.TLSInsecure,
+		MinVersion:         tls.VersionTLS12,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		var hostErr x509.HostnameError
+		var authErr x509.UnknownAuthorityError
+		switch {
+		case errors.As(err, &hostErr):
+			return nil, fmt.Errorf("TLS证书与 %s 不匹配: %v", f.TcpHost, err)
+		case errors.As(err, &authErr):
+			return nil, fmt.Errorf("TLS证书不受信任，自签名证书请使用 --ca-cert 指定根证书: %v", err)
+		}
+		return nil, fmt.Errorf("TLS握手失败: %w", err)
+	}
+	fmt.Fprintln(out, "🔒 TCP流已启用TLS加密")
+	return tlsConn, nil
+}
+
+// waitTransferResult 等待桥接服务器通过控制通道返回的下载结果
+func (f *FlowProvider) waitTransferResult(reader *bufio.Reader, streamStart time.Time) error {
+	result, err := reader.ReadString('\n')
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("等待下载结果超时: %w", err)
+	}
+	if err != nil {
+		// 旧版本桥接服务器不会发送结果通知，连接关闭即视为数据已发送
+		fmt.Fprintln(out, "🎉 文件传输完成! (桥接服务器未返回下载结果)")
+		return nil
+	}
+
+	switch strings.TrimSpace(result) {
+	case "TRANSFER_COMPLETE":
+		fmt.Fprintf(out, "🎉 下载方已完成下载! 总耗时 %.2f 秒\n", time.Since(streamStart).Seconds())
+		return nil
+	case "TRANSFER_CACHED":
+		f.Cached = true
+		fmt.Fprintf(out, "💾 文件已完整缓存到桥接服务器，可以断开连接，下载方可随时下载! 总耗时 %.2f 秒\n", time.Since(streamStart).Seconds())
+		return nil
+	case "TRANSFER_ABORTED":
+		return ErrDownloaderGone
+	default:
+		return fmt.Errorf("未知的服务器通知: %s", strings.TrimSpace(result))
+	}
+}
+
+// abortBackoff 第 n 次连续中止后重新建立流前的等待时间：1秒起逐次翻倍，不超过 MAX_ABORT_BACKOFF
+func abortBackoff(n int) time.Duration {
+	wait := time.Second
+	for i := 1; i < n && wait < MAX_ABORT_BACKOFF; i++ {
+		wait *= 2
+	}
+	return min(wait, MAX_ABORT_BACKOFF)
+}
+
+// Serve 常驻进程，每次下载消耗掉当前流后重新建立流，直到完成MaxDownloads次下载；
+// 单次下载同样在下载中止后重新建立流，直到有一次完整交付。连续中止 MAX_CONSECUTIVE_ABORTS 次后返回错误
+func (f *FlowProvider) Serve() error {
+	total := max(f.MaxDownloads, 1)
+	completed, aborted := 0, 0
+	for completed < total {
+		if total > 1 {
+			fmt.Fprintf(out, "🔗 建立流连接，等待第 %d/%d 次下载...\n", completed+1, total)
+		}
+		err := f.EstablishStreamConnection()
+		if errors.Is(err, ErrDownloaderGone) {
+			// 中止的下载不计入次数，桥接服务器会保留注册等待新的流
+			aborted++
+			if aborted >= MAX_CONSECUTIVE_ABORTS {
+				return fmt.Errorf("连续 %d 次下载中止，不再重新建立流: %w", aborted, err)
+			}
+			wait := abortBackoff(aborted)
+			fmt.Fprintf(out, "⚠️ %v，%v 后重新等待下载方 (连续中止 %d/%d 次)\n", ErrDownloaderGone, wait, aborted, MAX_CONSECUTIVE_ABORTS)
+			ctx, cancel := f.operationContext()
+			select {
+			case <-time.After(wait):
+				cancel()
+			case <-ctx.Done():
+				cancel()
+				return fmt.Errorf("%w: 等待重新建立流时到达截止时间", ErrTimeout)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if f.Cached {
+			// 缓存模式下桥接服务器自行服务剩余下载
+			return nil
+		}
+		completed++
+		aborted = 0
+	}
+	if total > 1 {
+		fmt.Fprintf(out, "🏁 已完成全部 %d 次下载\n", total)
+	}
+	return nil
+}
+
+// VerifyRoundTrip 端到端自检：一边推送文件，一边自己下载自己的链接，比较两端的SHA-256
+func (f *FlowProvider) VerifyRoundTrip() error {
+	src, err := f.openSource()
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, src)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	expected := hasher.Sum(nil)
+
+	// 推送与下载必须同时进行：桥接服务器只在下载方读取时才从流中取数据
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- f.EstablishStreamConnection()
+	}()
+
+	client, err := f.httpClient(0)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "🔍 自检下载:", f.DownloadURL)
+	ctx, cancel := f.operationContext()
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", f.DownloadURL, nil)
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("自检下载失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("自检下载失败: %s (状态码: %d)", strings.TrimSpace(string(body)), resp.StatusCode)
+	}
+
+	hasher = sha256.New()
+	received, err := io.Copy(hasher, resp.Body)
+	if err != nil {
+		return fmt.Errorf("自检下载中断: %w", err)
+	}
+	actual := hasher.Sum(nil)
+
+	if err := <-streamErr; err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "📋 源文件 SHA-256:", hex.EncodeToString(expected))
+	fmt.Fprintln(out, "📋 下载内容 SHA-256:", hex.EncodeToString(actual))
+	if received != f.FileInfo.Size || !bytes.Equal(expected, actual) {
+		return fmt.Errorf("%w (收到 %d / %d 字节)", ErrVerifyFailed, received, f.FileInfo.Size)
+	}
+	return nil
+}
+
+// isDownloaderGone 判断写入错误是否由桥接服务器关闭连接引起（下载方中止后桥接服务器会关闭流）
+func isDownloaderGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+// exitCodeFor 根据错误类型选择退出码
+func exitCodeFor(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDownloaderGone):
+		return EXIT_DOWNLOADER_GONE
+	case errors.Is(err, ErrFileRead):
+		return EXIT_FILE_ERROR
+	case errors.Is(err, ErrVerifyFailed):
+		return EXIT_VERIFY_FAILED
+	case errors.Is(err, ErrTimeout):
+		return EXIT_TIMEOUT
+	case errors.As(err, &netErr):
+		return EXIT_NETWORK_ERROR
+	default:
+		return EXIT_FAILURE
+	}
+}
+
+// FormatSpeed 格式化速度输出
+func FormatSpeed(bytesPerSecond float64) string {
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	unitIndex := 0
+	for bytesPerSecond >= 1024 && unitIndex < len(units)-1 {
+		bytesPerSecond /= 1024
+		unitIndex++
+	}
+	return fmt.Sprintf("%.2f %s", bytesPerSecond, units[unitIndex])
+}
+
+// FormatSize 格式化大小输出
+func FormatSize(bytes int64) string {
+	size := float64(bytes)
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	unitIndex := 0
+	for size >= 1024 && unitIndex < len(units)-1 {
+		size /= 1024
+		unitIndex++
+	}
+	return fmt.Sprintf("%.2f %s", size, units[unitIndex])
+}
+
+// openSource 打开要发送的数据源：文本片段读取内存中的内容，否则打开本地文件
+func (f *FlowProvider) openSource() (io.ReadCloser, error) {
+	if f.FileInfo.Path == "" {
+		return io.NopCloser(strings.NewReader(f.Text)), nil
+	}
+	if f.Follow {
+		// 桥接服务器不支持按需发送：数据在建立流时发送，下载方收到的 Content-Length 为注册大小
+		info, err := f.refreshFollowedFile()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case info.Size() > f.FileInfo.Size:
+			fmt.Fprintf(out, "⚠️ 文件已增大到 %s，注册大小固定为 %s，超出部分不会发送\n", FormatSize(info.Size()), FormatSize(f.FileInfo.Size))
+		case info.Size() < f.FileInfo.Size:
+			fmt.Fprintf(out, "⚠️ 文件已缩小到 %s，不足注册大小 %s，本次下载将不完整\n", FormatSize(info.Size()), FormatSize(f.FileInfo.Size))
+		}
+	}
+	file, err := os.Open(f.FileInfo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	if f.Follow {
+		// 文件变大时只发送前 Size 字节，与 Content-Length 一致
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(file, f.FileInfo.Size), file}, nil
+	}
+	return file, nil
+}
+
+// openFollowedSource --follow 且桥接服务器接受按需发送时，在下载开始时打开文件并发送当时的全部内容。
+// 这类下载不声明长度，桥接服务器读到EOF即结束，文件变大或变小都不会截断；返回的大小用于显示进度
+func (f *FlowProvider) openFollowedSource() (io.ReadCloser, int64, error) {
+	info, err := f.refreshFollowedFile()
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(f.FileInfo.Path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	if info.Size() != f.FileInfo.Size {
+		fmt.Fprintf(out, "📏 文件当前大小为 %s (注册时 %s)，按当前内容发送\n", FormatSize(info.Size()), FormatSize(f.FileInfo.Size))
+	}
+	return file, info.Size(), nil
+}
+
+// refreshFollowedFile --follow 模式下重新读取文件的修改时间与大小
+func (f *FlowProvider) refreshFollowedFile() (os.FileInfo, error) {
+	info, err := os.Stat(f.FileInfo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileRead, err)
+	}
+	if mtime := info.ModTime().Unix(); mtime != f.FileInfo.ModTime {
+		fmt.Fprintf(out, "🔄 文件已更新 (%s)，发送最新内容\n", info.ModTime().Format("2006-01-02 15:04:05"))
+		f.FileInfo.ModTime = mtime
+	}
+	return info, nil
+}
+
+// countingWriter 统计实际写入连接的字节数
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadLimiter 令牌桶限速，限制写到链路上的字节数；批量发送时所有文件共享同一个令牌桶，限制的是总上行速率
+type uploadLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 字节/秒
+	chunk  int     // 每次取令牌的最大字节数，也是令牌桶的容量
+	tokens float64
+	last   time.Time
+}
+
+func newUploadLimiter(rate int64) *uploadLimiter {
+	// 每次最多发送约0.1秒的数据，低速时发送平稳，进度条的速率也随之平稳
+	chunk := 32 * 1024
+	if r := int(rate / 10); r < chunk {
+		chunk = max(r, 1)
+	}
+	return &uploadLimiter{rate: float64(rate), chunk: chunk, tokens: float64(chunk), last: time.Now()}
+}
+
+// wait 取走n字节的令牌，令牌不足时先记账再睡眠补足，并发调用方按取令牌的先后依次发送
+func (l *uploadLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, float64(l.chunk))
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledWriter 按令牌桶把写入切成小块依次发出
+type throttledWriter struct {
+	w       io.Writer
+	limiter *uploadLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, t.limiter.chunk)
+		t.limiter.wait(n)
+		m, err := t.w.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// frameWriter 把数据按块加上长度与CRC32前缀写出；Close 写出剩余数据和长度为0的结束块
+type frameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newFrameWriter(w io.Writer, chunkSize int) *frameWriter {
+	return &frameWriter{w: w, buf: make([]byte, 0, chunkSize)}
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(fw.buf[len(fw.buf):cap(fw.buf)], p)
+		fw.buf = fw.buf[:len(fw.buf)+n]
+		p = p[n:]
+		written += n
+		if len(fw.buf) == cap(fw.buf) {
+			if err := fw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (fw *frameWriter) flush() error {
+	if len(fw.buf) == 0 {
+		return nil
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(fw.buf)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(fw.buf))
+	if _, err := fw.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(fw.buf); err != nil {
+		return err
+	}
+	fw.buf = fw.buf[:0]
+	return nil
+}
+
+func (fw *frameWriter) Close() error {
+	if err := fw.flush(); err != nil {
+		return err
+	}
+	_, err := fw.w.Write(make([]byte, 8))
+	return err
+}
+
+// streamFileContent 从src流式传输size字节的内容到w (TCP流连接或HTTP上传的请求体)，compress为true时以gzip压缩后写入，
+// framed为true时先分块附加校验和（位于压缩之前，桥接服务器报告的偏移即文件内偏移）
+func (f *FlowProvider) streamFileContent(w io.Writer, src io.Reader, size int64, compress, framed bool) (err error) {
+	var transferred int64
+	startTime := time.Now()
+	defer func() {
+		f.BytesTransferred += transferred
+		f.TransferDuration += time.Since(startTime)
+		f.lastTransferred = transferred
+	}()
+	// 传输中断时同样报告已发送的数据量，便于判断是否值得重试；在进度条停止之后输出
+	defer func() {
+		if err == nil {
+			return
+		}
+		var percent float64
+		if size > 0 {
+			percent = float64(transferred) / float64(size) * 100
+		}
+		fmt.Fprintf(out,
+			"📊 传输中断: 已发送 %s / %s (%.1f%%), 耗时 %.2f 秒\n",
+			FormatSize(transferred),
+			FormatSize(size),
+			percent,
+			time.Since(startTime).Seconds(),
+		)
+	}()
+
+	// 进度条实现；批量发送时由 MultiProgress 汇总显示，不再为每个文件单独刷新进度条
+	var progress *ProgressBar
+	if f.Progress == nil {
+		progress = &ProgressBar{
+			Total: size,
+			Desc:  "📤 上传中",
+			Units: []string{"B", "KiB", "MiB", "GiB"},
+		}
+		if f.UploadLimiter != nil {
+			progress.Desc = fmt.Sprintf("📤 上传中 (限速 %s)", FormatSpeed(f.UploadLimiter.rate))
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			progress.Print()
+		}()
+		defer wg.Wait()
+		defer progress.Stop()
+	}
+	setProgress := func(current int64) {
+		if progress != nil {
+			progress.Set(current)
+		} else {
+			f.Progress.Set(f.progressIndex, current)
+		}
+	}
+
+	// TCP流 (含TLS) 在数据全部写出后半关闭写端
+	halfCloser, _ := w.(interface{ CloseWrite() error })
+	// 限速作用于实际发送到链路上的字节 (压缩、分块与加密之后)
+	if f.UploadLimiter != nil {
+		w = &throttledWriter{w: w, limiter: f.UploadLimiter}
+	}
+	// 压缩时数据先写入gzip，wire统计实际发送到链路上的字节
+	wire := &countingWriter{w: w}
+	var dst io.Writer = wire
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(wire)
+		dst = zw
+	}
+	var fw *frameWriter
+	if framed {
+		fw = newFrameWriter(dst, FRAME_CHUNK_SIZE)
+		dst = fw
+	}
+	var ew *encryptWriter
+	if f.Passphrase != "" {
+		var err error
+		if ew, err = newEncryptWriter(dst, f.Passphrase); err != nil {
+			return fmt.Errorf("写入数据失败: %w", err)
+		}
+		dst = ew
+	}
+
+	// 传输文件
+	bufferSize := f.SendBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_SEND_BUFFER_SIZE
+	}
+	buffer := make([]byte, bufferSize)
+
+	for {
+		// 写入超时只在连接阻塞时触发，这里额外检查截止时间，数据源读取缓慢时同样能及时中止
+		if !f.Deadline.IsZero() && time.Now().After(f.Deadline) {
+			return ErrTimeout
+		}
+		n, err := src.Read(buffer)
+		if n > 0 {
+			if _, writeErr := dst.Write(buffer[:n]); writeErr != nil {
+				if isDownloaderGone(writeErr) {
+					return ErrDownloaderGone
+				}
+				return fmt.Errorf("写入数据失败: %w", writeErr)
+			}
+			transferred += int64(n)
+			setProgress(transferred)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrFileRead, err)
+		}
+	}
+	if ew != nil {
+		// 加密最后一块，带有结束标记，下载方据此判断数据没有被截断
+		if err := ew.Close(); err != nil {
+			if isDownloaderGone(err) {
+				return ErrDownloaderGone
+			}
+			return fmt.Errorf("写入数据失败: %w", err)
+		}
+	}
+	if fw != nil {
+		// 写出最后一块与结束块
+		if err := fw.Close(); err != nil {
+			if isDownloaderGone(err) {
+				return ErrDownloaderGone
+			}
+			return fmt.Errorf("写入数据失败: %w", err)
+		}
+	}
+	if zw != nil {
+		// 写出gzip尾部，桥接服务器读到尾部才认为数据结束
+		if err := zw.Close(); err != nil {
+			if isDownloaderGone(err) {
+				return ErrDownloaderGone
+			}
+			return fmt.Errorf("写入数据失败: %w", err)
+		}
+	}
+	if halfCloser != nil {
+		// 半关闭写端：内核发完缓冲区中的数据后发送FIN，桥接服务器读到EOF即知数据已全部到达，
+		// 之后才关闭连接；读方向保持打开，继续等待下载结果通知
+		if err := halfCloser.CloseWrite(); err != nil {
+			if isDownloaderGone(err) {
+				return ErrDownloaderGone
+			}
+			return fmt.Errorf("写入数据失败: %w", err)
+		}
+	}
+
+	// 计算传输统计
+	duration := time.Since(startTime)
+	// 计算每秒字节数
+	var bps float64
+	if duration.Seconds() > 0 {
+		bps = float64(transferred) / duration.Seconds()
+	}
+
+	if progress != nil {
+		progress.Finish()
+	}
+	fmt.Fprintf(out,
+		"📊 传输统计: %s, 耗时 %.2f 秒, 平均速度: %s\n",
+		FormatSize(transferred),
+		duration.Seconds(),
+		FormatSpeed(bps),
+	)
+	if compress && transferred > 0 {
+		fmt.Fprintf(out, "🗜️ 压缩后发送 %s (原始大小的 %.1f%%)\n",
+			FormatSize(wire.n),
+			float64(wire.n)/float64(transferred)*100,
+		)
+	}
+
+	return nil
+}
+
+// Result 汇总本次运行的结果，供 --output-json 输出
+func (f *FlowProvider) Result(status string, err error) TransferResult {
+	result := TransferResult{
+		AuthToken:        f.AuthToken,
+		DownloadURL:      f.DownloadURL,
+		TcpEndpoint:      TcpEndpoint{Host: f.TcpHost, Port: f.TcpPort, TLS: f.TcpTLS},
+		OriginalFilename: f.FileInfo.Name,
+		Size:             f.FileInfo.Size,
+		BytesTransferred: f.BytesTransferred,
+		DurationSeconds:  f.TransferDuration.Seconds(),
+		Status:           status,
+		Transport:        f.Transport,
+		Renewals:         f.Renewals,
+	}
+	if err != nil {
+		result.Error = err.Error()
+		if f.FileInfo.Size > 0 {
+			percent := math.Round(float64(f.lastTransferred)/float64(f.FileInfo.Size)*1000) / 10
+			result.PercentTransferred = &percent
+		}
+	}
+	return result
+}
+
+// CurlCommand 生成接收方可以直接复制运行的curl下载命令
+// -f 使下载失败（如链接已失效）时返回错误而不是把错误页面写入文件
+func (f *FlowProvider) CurlCommand() string {
+	return fmt.Sprintf("curl -fL -o %s %s", shellQuote(f.FileInfo.Name), shellQuote(f.DownloadURL))
+}
+
+// shellQuote 用单引号包裹参数，文件名中的空格、$、引号等不会被shell解释
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// GenerateDownloadInfo 生成下载信息
+func (f *FlowProvider) GenerateDownloadInfo() string {
+	if f.AuthToken == "" || f.DownloadURL == "" {
+		return "文件未注册或下载URL不可用"
+	}
+
+	size := float64(f.FileInfo.Size)
+	unit := "Bytes"
+	units := []string{"Bytes", "KiB", "MiB", "GiB", "TiB"}
+
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	unit = units[i]
+
+	var sizeStr string
+	if unit == "Bytes" {
+		sizeStr = fmt.Sprintf("%d %s", f.FileInfo.Size, unit)
+	} else {
+		sizeStr = fmt.Sprintf("%.2f %s", size, unit)
+	}
+
+	return fmt.Sprintf(`
 📥 下载信息:
 
 • 文件名称: %s
 • 文件大小: %s
 • 下载URL: %s
+• 命令行下载: %s
 • 有效时间: 下载完成后自动失效
 
 💡 提示: 请确保发送端保持运行，直到下载完成。
-`, f.FileInfo.Name, sizeStr, f.DownloadURL)
+`, f.FileInfo.Name, sizeStr, f.DownloadURL, f.CurlCommand())
+}
+
+// ==================== 端到端加密 ====================
+
+// 加密格式：魔数 | 16字节盐 | 12字节基础nonce | 密文块。明文按 ENCRYPT_CHUNK_SIZE 分块，每块单独以
+// AES-256-GCM 加密（nonce 为基础nonce与块序号异或，附加数据标记是否为最后一块），
+// 因此可以边读边解密，截断、重排或篡改任意一块都会导致解密失败
+const (
+	ENCRYPT_MAGIC          = "FFBENC01"
+	ENCRYPT_SALT_SIZE      = 16
+	ENCRYPT_NONCE_SIZE     = 12
+	ENCRYPT_CHUNK_SIZE     = 64 * 1024
+	ENCRYPT_SCRYPT_N       = 1 << 15 // scrypt 代价参数，N=32768、r=8 每次派生约需 32 MiB 内存
+	ENCRYPT_SCRYPT_R       = 8
+	ENCRYPT_SCRYPT_P       = 1
+	ENCRYPT_SUFFIX         = ".enc"
+	ENCRYPT_MIN_PASSPHRASE = 8
+)
+
+const encryptHeaderSize = len(ENCRYPT_MAGIC) + ENCRYPT_SALT_SIZE + ENCRYPT_NONCE_SIZE
+
+// encryptedSize 返回明文大小为size时密文的总长度，每块附加16字节认证标签，空文件也有一个结束块
+func encryptedSize(size int64) int64 {
+	chunks := (size + ENCRYPT_CHUNK_SIZE - 1) / ENCRYPT_CHUNK_SIZE
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptHeaderSize) + size + chunks*16
+}
+
+// newChunkAEAD 由口令和盐以 scrypt 派生AES-256-GCM密钥；内存困难的派生使GPU/ASIC暴力猜测口令的代价更高
+func newChunkAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, ENCRYPT_SCRYPT_N, ENCRYPT_SCRYPT_R, ENCRYPT_SCRYPT_P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("派生密钥失败: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce 第index块的nonce：基础nonce的后8字节与块序号异或
+func chunkNonce(dst, base []byte, index uint64) []byte {
+	dst = append(dst[:0], base...)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i, b := range counter {
+		dst[len(dst)-8+i] ^= b
+	}
+	return dst
+}
+
+// chunkAAD 附加数据标记最后一块，攻击者无法把中间的块伪装成结尾来截断文件
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter 分块加密写出；缓冲区写满且还有后续数据时才封装为普通块，Close 封装最后一块
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	base  []byte
+	nonce []byte
+	index uint64
+	buf   []byte
+	out   []byte
+}
+
+func newEncryptWriter(w io.Writer, passphrase string) (*encryptWriter, error) {
+	header := make([]byte, encryptHeaderSize)
+	copy(header, ENCRYPT_MAGIC)
+	if _, err := rand.Read(header[len(ENCRYPT_MAGIC):]); err != nil {
+		return nil, err
+	}
+	salt := header[len(ENCRYPT_MAGIC) : len(ENCRYPT_MAGIC)+ENCRYPT_SALT_SIZE]
+	aead, err := newChunkAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		base: header[len(ENCRYPT_MAGIC)+ENCRYPT_SALT_SIZE:],
+		buf:  make([]byte, 0, ENCRYPT_CHUNK_SIZE),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) seal(final bool) error {
+	ew.nonce = chunkNonce(ew.nonce, ew.base, ew.index)
+	ew.out = ew.aead.Seal(ew.out[:0], ew.nonce, ew.buf, chunkAAD(final))
+	ew.index++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+// decryptStream 读取 --encrypt 生成的数据，逐块校验并解密后写入w
+func decryptStream(w io.Writer, r io.Reader, passphrase string) error {
+	br := bufio.NewReaderSize(r, ENCRYPT_CHUNK_SIZE)
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("读取加密文件头失败: %v", err)
+	}
+	if string(header[:len(ENCRYPT_MAGIC)]) != ENCRYPT_MAGIC {
+		return errors.New("不是 --encrypt 生成的加密文件")
+	}
+	aead, err := newChunkAEAD(passphrase, header[len(ENCRYPT_MAGIC):len(ENCRYPT_MAGIC)+ENCRYPT_SALT_SIZE])
+	if err != nil {
+		return err
+	}
+	base := header[len(ENCRYPT_MAGIC)+ENCRYPT_SALT_SIZE:]
+
+	chunk := make([]byte, ENCRYPT_CHUNK_SIZE+aead.Overhead())
+	var nonce, plain []byte
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, chunk)
+		if err == io.EOF {
+			return fmt.Errorf("%w: 数据在第 %d 块之前被截断", ErrDecryptFailed, index)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("读取加密数据失败: %v", err)
+		}
+		// 不足一整块的必然是最后一块；恰好一整块时再看后面是否还有数据
+		final := err == io.ErrUnexpectedEOF
+		if !final {
+			if _, peekErr := br.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		nonce = chunkNonce(nonce, base, index)
+		plain, err = aead.Open(plain[:0], nonce, chunk[:n], chunkAAD(final))
+		if err != nil {
+			return fmt.Errorf("%w (第 %d 块)", ErrDecryptFailed, index)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return fmt.Errorf("写入解密数据失败: %v", err)
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// readPassphrase 读取口令：优先使用环境变量 FFB_PASSPHRASE，否则提示并从标准输入读取一行（输入会回显）
+func readPassphrase(prompt string) (string, error) {
+	if passphrase := os.Getenv("FFB_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		if err != nil {
+			return "", fmt.Errorf("读取口令失败: %v", err)
+		}
+		return "", errors.New("口令不能为空")
+	}
+	return passphrase, nil
+}
+
+// runDecrypt 解密下载得到的 .enc 文件；输入为 "-" 时读取标准输入，输出为 "-" 时写到标准输出
+func runDecrypt(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("用法: flow_provider --decrypt <加密文件> [输出文件]")
+	}
+	input := args[0]
+	output := strings.TrimSuffix(input, ENCRYPT_SUFFIX)
+	switch {
+	case len(args) == 2:
+		output = args[1]
+	case input == "-":
+		output = "-"
+	case output == input:
+		output = input + ".dec"
+	}
+	if input == "-" && os.Getenv("FFB_PASSPHRASE") == "" {
+		return errors.New("从标准输入读取加密数据时，请通过环境变量 FFB_PASSPHRASE 提供口令")
+	}
+
+	passphrase, err := readPassphrase("🔑 请输入解密口令: ")
+	if err != nil {
+		return err
+	}
+
+	var src io.Reader = os.Stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrFileRead, err)
+		}
+		defer file.Close()
+		src = file
+	}
+	if output == "-" {
+		return decryptStream(os.Stdout, src, passphrase)
+	}
+
+	// 不覆盖已有文件；解密失败时删除不完整的输出
+	dst, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("创建输出文件失败: %v", err)
+	}
+	if err := decryptStream(dst, src, passphrase); err != nil {
+		dst.Close()
+		os.Remove(output)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("写入解密数据失败: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, "✅ 已解密到", output)
+	return nil
 }
+
 // ==================== 进度条实现 ====================
 
 // ProgressBar 简单的进度条实现
 type ProgressBar struct {
-	Total	 int64
+	Total     int64
 	Current   int64
-	Desc	  string
-	Units	 []string
+	Desc      string
+	Units     []string
 	lastPrint time.Time
-	mu		sync.Mutex
+	stopped   bool
+	mu        sync.Mutex
 }
 
 // Set 更新当前进度
@@ -330,12 +1849,16 @@ func (p *ProgressBar) Set(current int64) {
 
 // Print 打印进度条
 func (p *ProgressBar) Print() {
+	// 空文件无需刷新进度，避免白等一个刷新周期
+	if p.Total <= 0 {
+		return
+	}
 	ticker := time.NewTicker(500 * time.Millisecond) // 每500ms更新一次
 	defer ticker.Stop()
 
 	for range ticker.C {
 		p.mu.Lock()
-		if p.Current >= p.Total {
+		if p.stopped || p.Current >= p.Total {
 			p.mu.Unlock()
 			break
 		}
@@ -346,7 +1869,7 @@ func (p *ProgressBar) Print() {
 		totalSize, totalUnit := p.getHumanSize(p.Total)
 
 		// 打印进度条
-		fmt.Printf("\r%s [%-50s] %.1f%% (%.2f %s / %.2f %s)",
+		fmt.Fprintf(out, "\r%s [%-50s] %.1f%% (%.2f %s / %.2f %s)",
 			p.Desc,
 			strings.Repeat("=", int(percent/2))+">",
 			percent,
@@ -357,6 +1880,16 @@ func (p *ProgressBar) Print() {
 	}
 }
 
+// Stop 停止刷新进度条，传输中途出错时使用，保证错误信息从新的一行开始
+func (p *ProgressBar) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped && p.Current < p.Total {
+		fmt.Fprintln(out)
+	}
+	p.stopped = true
+}
+
 // Finish 完成进度条
 func (p *ProgressBar) Finish() {
 	p.mu.Lock()
@@ -367,15 +1900,16 @@ func (p *ProgressBar) Finish() {
 	totalSize, totalUnit := p.getHumanSize(p.Total)
 
 	// 格式化字符串：5个占位符对应5个参数
-	fmt.Printf("\r%s [%-50s] 100.0%% (%.2f %s / %.2f %s)\n",
-		p.Desc,				  // %s：描述文字（如 "上传中"）
+	fmt.Fprintf(out, "\r%s [%-50s] 100.0%% (%.2f %s / %.2f %s)\n",
+		p.Desc,                  // %s：描述文字（如 "上传中"）
 		strings.Repeat("=", 50), // %-50s：50个等号填满进度条
-		currentSize,			 // %.2f：当前大小数值（完成时=总大小）
-		currentUnit,			 // %s：当前单位（如 MiB/GiB）
-		totalSize,			   // %.2f：总大小数值
-		totalUnit,				// %s：总单位（如 MiB/GiB）
+		currentSize,             // %.2f：当前大小数值（完成时=总大小）
+		currentUnit,             // %s：当前单位（如 MiB/GiB）
+		totalSize,               // %.2f：总大小数值
+		totalUnit,               // %s：总单位（如 MiB/GiB）
 	)
 }
+
 // getHumanSize 转换为人类可读的大小单位
 func (p *ProgressBar) getHumanSize(bytes int64) (float64, string) {
 	size := float64(bytes)
@@ -387,44 +1921,673 @@ func (p *ProgressBar) getHumanSize(bytes int64) (float64, string) {
 	return size, p.Units[unitIndex]
 }
 
+// MultiProgress 批量发送的汇总进度：一行显示已结束的文件数、按总字节数计算的整体进度与速度，
+// 以及最近有数据发送的文件的进度。文件可以陆续加入，总量随之增长
+type MultiProgress struct {
+	mu        sync.Mutex
+	names     []string
+	sizes     []int64
+	current   []int64 // 各文件当前这次推送已发送的字节数
+	best      []int64 // 各文件已达到的最大进度，--serve 重复推送时整体进度不会回退
+	finished  []bool
+	total     int64
+	moved     int64 // 累计发送的字节数（含重复推送），用于计算速度
+	active    int   // 最近有数据发送的文件，-1 表示尚无
+	rate      float64
+	lastMoved int64
+	lastTick  time.Time
+	stopped   bool
+}
+
+// NewMultiProgress 创建汇总进度
+func NewMultiProgress() *MultiProgress {
+	return &MultiProgress{active: -1, lastTick: time.Now()}
+}
+
+// AddFile 加入一个文件，返回其序号
+func (m *MultiProgress) AddFile(name string, size int64) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.names = append(m.names, name)
+	m.sizes = append(m.sizes, size)
+	m.current = append(m.current, 0)
+	m.best = append(m.best, 0)
+	m.finished = append(m.finished, false)
+	m.total += size
+	return len(m.names) - 1
+}
+
+// Set 更新某个文件本次推送已发送的字节数，新的推送从0开始计数
+func (m *MultiProgress) Set(index int, current int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delta := current - m.current[index]
+	if delta < 0 {
+		delta = current
+	}
+	m.moved += delta
+	m.current[index] = current
+	m.best[index] = max(m.best[index], current)
+	m.active = index
+}
+
+// FileDone 标记文件已结束；成功时按完整大小计入整体进度（例如命中缓存去重而未发送数据）
+func (m *MultiProgress) FileDone(index int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished[index] = true
+	if err == nil {
+		m.best[index] = m.sizes[index]
+	}
+}
+
+// line 生成汇总行，调用者需持有锁
+func (m *MultiProgress) line() string {
+	var sent int64
+	done := 0
+	for i := range m.names {
+		sent += min(m.best[i], m.sizes[i])
+		if m.finished[i] {
+			done++
+		}
+	}
+	percent := 0.0
+	if m.total > 0 {
+		percent = float64(sent) / float64(m.total) * 100
+	} else if len(m.names) > 0 && done == len(m.names) {
+		percent = 100
+	}
+
+	s := fmt.Sprintf("[%d/%d 个文件] 总进度 %.1f%%, %s", done, len(m.names), percent, FormatSpeed(m.rate))
+	if i := m.active; i >= 0 && !m.finished[i] && m.sizes[i] > 0 {
+		s += fmt.Sprintf(" | 当前: %s %.1f%%", m.names[i], float64(m.current[i])/float64(m.sizes[i])*100)
+	}
+	return s
+}
+
+// Print 每500ms刷新一次汇总行，直到 Stop
+func (m *MultiProgress) Print() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		m.mu.Lock()
+		if m.stopped {
+			m.mu.Unlock()
+			return
+		}
+		if elapsed := now.Sub(m.lastTick).Seconds(); elapsed > 0 {
+			m.rate = float64(m.moved-m.lastMoved) / elapsed
+		}
+		m.lastMoved, m.lastTick = m.moved, now
+		// 行尾补空格，覆盖上一次较长的输出
+		fmt.Fprintf(out, "\r%-80s", m.line())
+		m.mu.Unlock()
+	}
+}
+
+// Stop 停止刷新并打印最终的汇总行
+func (m *MultiProgress) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	m.rate = 0
+	m.active = -1
+	fmt.Fprintf(out, "\r%-80s\n", m.line())
+}
+
 // ==================== 主函数 ====================
 
+// expandFileArgs 展开文件参数：shell已展开的多个路径原样使用，带引号传入的通配符在进程内展开；目录被跳过
+func expandFileArgs(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		matches := []string{arg}
+		if _, err := os.Stat(arg); err != nil && strings.ContainsAny(arg, "*?[") {
+			globbed, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("无效的通配符 %s: %v", arg, err)
+			}
+			if len(globbed) == 0 {
+				return nil, fmt.Errorf("没有匹配 %s 的文件", arg)
+			}
+			matches = globbed
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("文件 %s 不存在", path)
+			}
+			if info.IsDir() {
+				fmt.Fprintln(out, "⚠️ 跳过目录:", path)
+				continue
+			}
+			if !seen[path] {
+				seen[path] = true
+				files = append(files, path)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("没有可发送的文件")
+	}
+	return files, nil
+}
+
+// sendBatch 以至多 concurrency 个并发请求注册多个文件并列出全部链接，然后并发推送，下载方可以按任意顺序下载。
+// 实时转发模式下每个文件都要保持自己的流连接才能被下载，因此推送不受 concurrency 限制
+func sendBatch(template *FlowProvider, files []string, concurrency int) ([]*FlowProvider, []error) {
+	providers := make([]*FlowProvider, len(files))
+	errs := make([]error, len(files))
+	for i := range files {
+		p := *template
+		// 并发注册时逐个打印的链接详情会相互穿插，统一由下面的链接列表输出
+		p.Quiet = concurrency > 1
+		providers[i] = &p
+	}
+	// 每个文件注册后才知道大小，汇总进度的总量随注册逐步增长
+	progress := NewMultiProgress()
+	jobs := make(chan int)
+	var registrations sync.WaitGroup
+	for w := 0; w < concurrency && w < len(files); w++ {
+		registrations.Add(1)
+		go func() {
+			defer registrations.Done()
+			for i := range jobs {
+				p := providers[i]
+				fmt.Fprintf(out, "📝 注册文件中 (%d/%d): %s\n", i+1, len(files), files[i])
+				if _, err := p.RegisterFile(files[i]); err != nil {
+					errs[i] = p.timeoutError(err)
+					fmt.Fprintf(out, "❌ %s 注册失败: %v\n", files[i], errs[i])
+					continue
+				}
+				p.Progress = progress
+				p.progressIndex = progress.AddFile(p.FileInfo.Name, p.FileInfo.Size)
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	registrations.Wait()
+
+	fmt.Fprintln(out, "\n📋 下载链接列表:")
+	for i, p := range providers {
+		if errs[i] == nil {
+			fmt.Fprintf(out, "  %s\t%s\n", p.FileInfo.Name, p.DownloadURL)
+		}
+	}
+	fmt.Fprintln(out)
+
+	go progress.Print()
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		if errs[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, p *FlowProvider) {
+			defer wg.Done()
+			err := p.Serve()
+			if errs[i] = p.timeoutError(err); errs[i] != nil {
+				fmt.Fprintf(out, "❌ %s 传输失败: %v\n", p.FileInfo.Name, errs[i])
+			}
+			progress.FileDone(p.progressIndex, errs[i])
+		}(i, p)
+	}
+	wg.Wait()
+	progress.Stop()
+	return providers, errs
+}
+
+// sendOptions 发送类子命令 (send、paste 以及不带子命令的旧用法) 共用的选项
+type sendOptions struct {
+	proxy         string
+	name          string
+	serve         int
+	shareRate     int64
+	uploadRate    int64
+	verify        bool
+	timeout       time.Duration
+	tcpTLSCA      string
+	caCert        string
+	insecure      bool
+	nagle         bool
+	sendBuffer    int
+	chunkChecksum bool
+	encrypt       bool
+	compress      bool
+	dedup         bool
+	autoRenew     bool
+	maxRenewals   int
+	follow        bool
+	concurrency   int
+	outputJSON    bool
+}
+
+// register 把发送选项注册到fs
+func (o *sendOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.proxy, "proxy", "", "代理地址 (http://, https://, socks5://)，\"direct\" 表示忽略代理环境变量")
+	fs.StringVar(&o.name, "name", "", "下载时显示的文件名，默认使用本地文件名")
+	fs.IntVar(&o.serve, "serve", 1, "常驻进程，允许同一文件被完整下载的次数 (1-100)")
+	fs.Int64Var(&o.shareRate, "share-rate", 0, "该分享的下载限速 (字节/秒)，0 表示不限速")
+	fs.Int64Var(&o.uploadRate, "max-upload-rate", 0, "本机上传限速 (字节/秒)，批量发送时为所有文件的总速率，0 表示不限速")
+	fs.BoolVar(&o.verify, "verify", false, "端到端自检：推送后自己下载链接并校验SHA-256，适合检查桥接服务器部署")
+	fs.DurationVar(&o.timeout, "timeout", 0, "注册与传输整体的时限 (如 10m)，超时后中止并以退出码 7 退出，0 表示不限制")
+	fs.StringVar(&o.tcpTLSCA, "tcp-tls-ca", "", "同 --ca-cert，保留用于兼容")
+	fs.StringVar(&o.caCert, "ca-cert", "", "信任的根证书文件 (PEM)，用于校验桥接服务器的HTTPS与TCP流TLS证书，适合自签名证书")
+	fs.BoolVar(&o.insecure, "insecure", false, "跳过桥接服务器TLS证书校验 (HTTPS与TCP流)，仅用于测试；生产环境请使用 --ca-cert")
+	fs.BoolVar(&o.nagle, "nagle", false, "在TCP流连接上启用Nagle算法，允许内核合并小包以提高吞吐，代价是小块数据可能被延迟；默认关闭，小块数据立即发出")
+	fs.IntVar(&o.sendBuffer, "send-buffer-size", DEFAULT_SEND_BUFFER_SIZE/1024, "发送缓冲区大小 (KiB)：较小时数据更快到达下载方，较大时吞吐更高")
+	fs.BoolVar(&o.chunkChecksum, "chunk-checksum", false, "按4 MiB分块附带CRC32校验，桥接服务器逐块校验，数据损坏时报告出错的偏移")
+	fs.BoolVar(&o.encrypt, "encrypt", false, "发送前用口令加密 (AES-256-GCM)，桥接服务器只能看到密文；口令取自环境变量 FFB_PASSPHRASE 或交互输入")
+	fs.BoolVar(&o.compress, "compress", false, "在到桥接服务器的TCP链路上用gzip压缩数据，适合上行带宽有限时发送可压缩的文件")
+	fs.BoolVar(&o.dedup, "dedup", false, "注册时附带文件的SHA-256，桥接服务器 (缓存模式) 已有相同内容时跳过上传；需要先完整读取一遍文件")
+	fs.BoolVar(&o.autoRenew, "auto-renew", false, "等待下载期间注册过期时自动以新令牌重新注册并打印新链接，适合无人值守的长期分享")
+	fs.IntVar(&o.maxRenewals, "max-renewals", DEFAULT_MAX_RENEWALS, "--auto-renew 最多重新注册的次数")
+	fs.BoolVar(&o.follow, "follow", false, "每次下载开始时重新读取文件，发送当时的最新内容 (配合 --serve 分享持续更新的文件)；注册大小固定，超出部分不发送")
+	fs.IntVar(&o.concurrency, "concurrency", DEFAULT_BATCH_CONCURRENCY, fmt.Sprintf("批量发送时同时进行的注册请求数 (1-%d)，1 表示逐个注册", MAX_BATCH_CONCURRENCY))
+	fs.BoolVar(&o.outputJSON, "output-json", false, "结束时在标准输出打印JSON结果，其余提示信息改写到标准错误")
+}
+
+// printUsage 打印子命令总览
+func printUsage() {
+	fmt.Fprintln(out, "🌊 FileFlow Bridge - 文件提供客户端")
+	fmt.Fprintln(out, "="+strings.Repeat("=", 49))
+	fmt.Fprintln(out, "用法: flow_provider <子命令> [选项] <参数>...")
+	fmt.Fprintln(out, "子命令:")
+	fmt.Fprintln(out, "  send    [选项] <桥接服务器URL> <文件路径>...  发送一个或多个文件")
+	fmt.Fprintln(out, "  paste   [选项] <桥接服务器URL> [文本]        发送一段文本，省略时读取标准输入")
+	fmt.Fprintln(out, "  decrypt <加密文件> [输出文件]                解密用 --encrypt 发送的文件")
+	fmt.Fprintln(out, "  config                                      显示从环境变量读取的配置")
+	fmt.Fprintln(out, "示例: flow_provider send http://localhost:8000 ./large_file.zip")
+	fmt.Fprintln(out, "      flow_provider send http://localhost:8000 \"*.log\"")
+	fmt.Fprintln(out, "      echo hello | flow_provider paste http://localhost:8000")
+	fmt.Fprintln(out, "兼容旧用法: flow_provider [选项] <桥接服务器URL> <文件路径>... 等同于 send，")
+	fmt.Fprintln(out, "           --text 与 --decrypt 分别等同于 paste 与 decrypt")
+	fmt.Fprintln(out, "使用 flow_provider <子命令> -h 查看各子命令的选项")
+}
+
+// printConfig 显示提供端会读取的环境变量，口令只显示是否设置
+func printConfig() {
+	fmt.Fprintln(out, "🌊 FileFlow Bridge - 文件提供客户端配置")
+	fmt.Fprintln(out, "代理 (未指定 --proxy 时使用):")
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "NO_PROXY"} {
+		value := os.Getenv(name)
+		if value == "" {
+			value = os.Getenv(strings.ToLower(name))
+		}
+		if value == "" {
+			value = "(未设置)"
+		}
+		fmt.Fprintf(out, "  %-12s %s\n", name, value)
+	}
+	passphrase := "(未设置，--encrypt 与 decrypt 会提示输入)"
+	if os.Getenv("FFB_PASSPHRASE") != "" {
+		passphrase = "已设置"
+	}
+	fmt.Fprintln(out, "加密口令:")
+	fmt.Fprintf(out, "  %-12s %s\n", "FFB_PASSPHRASE", passphrase)
+	fmt.Fprintln(out, "默认值:")
+	fmt.Fprintf(out, "  发送缓冲区: %d KiB\n", DEFAULT_SEND_BUFFER_SIZE/1024)
+	fmt.Fprintf(out, "  分块校验块大小: %d MiB\n", FRAME_CHUNK_SIZE/(1024*1024))
+	fmt.Fprintf(out, "  文本片段文件名: %s\n", SNIPPET_FILENAME)
+}
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("🌊 FileFlow Bridge - 文件提供客户端")
-		fmt.Println("=" + strings.Repeat("=", 49))
-		fmt.Println("用法: flow_provider <桥接服务器URL> <文件路径>")
-		fmt.Println("示例: flow_provider http://localhost:8000 ./large_file.zip")
-		os.Exit(1)
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
 	}
 
-	bridgeURL := os.Args[1]
-	filePath := os.Args[2]
+	switch command {
+	case "send", "paste":
+		runSendCommand(command, args[1:])
+	case "decrypt":
+		fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+		fs.Usage = func() {
+			fmt.Fprintln(out, "用法: flow_provider decrypt <加密文件|-> [输出文件|-]")
+			fmt.Fprintln(out, "口令取自环境变量 FFB_PASSPHRASE 或交互输入；输入为 - 时读取标准输入")
+		}
+		fs.Parse(args[1:])
+		if err := runDecrypt(fs.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, "❌ 错误:", err)
+			os.Exit(exitCodeFor(err))
+		}
+	case "config":
+		printConfig()
+	case "help":
+		printUsage()
+	default:
+		// 兼容旧用法：不带子命令时按 send 处理，--text 与 --decrypt 仍然可用
+		runSendCommand("", args)
+	}
+}
 
-	// 检查文件是否存在
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		fmt.Println("❌ 错误: 文件", filePath, "不存在")
-		os.Exit(1)
+// runSendCommand 解析发送类子命令的参数并执行；command 为空表示不带子命令的旧用法
+func runSendCommand(command string, args []string) {
+	var opts sendOptions
+	fs := flag.NewFlagSet("flow_provider "+command, flag.ExitOnError)
+	opts.register(fs)
+	var text string
+	var decrypt bool
+	if command == "" {
+		fs.StringVar(&text, "text", "", "发送一段文本而不是文件，默认下载文件名为 "+SNIPPET_FILENAME+" (等同于 paste 子命令)")
+		fs.BoolVar(&decrypt, "decrypt", false, "解密用 --encrypt 发送的文件 (等同于 decrypt 子命令)")
+	}
+	fs.Usage = func() {
+		switch command {
+		case "send":
+			fmt.Fprintln(out, "用法: flow_provider send [选项] <桥接服务器URL> <文件路径>...")
+		case "paste":
+			fmt.Fprintln(out, "用法: flow_provider paste [选项] <桥接服务器URL> [文本]")
+			fmt.Fprintln(out, "省略文本时读取标准输入，默认下载文件名为 "+SNIPPET_FILENAME)
+		default:
+			printUsage()
+		}
+		fmt.Fprintln(out, "选项:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if opts.outputJSON {
+		out = os.Stderr
+	}
+
+	if decrypt {
+		if err := runDecrypt(fs.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, "❌ 错误:", err)
+			os.Exit(exitCodeFor(err))
+		}
+		return
+	}
+
+	switch {
+	case command == "paste":
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		if fs.NArg() == 2 {
+			text = fs.Arg(1)
+		} else {
+			// 口令同样从标准输入读取，文本来自标准输入时只能通过环境变量提供
+			if opts.encrypt && os.Getenv("FFB_PASSPHRASE") == "" {
+				fmt.Fprintln(out, "❌ 错误: 从标准输入读取文本时，请通过环境变量 FFB_PASSPHRASE 提供加密口令")
+				os.Exit(1)
+			}
+			if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				fmt.Fprintln(out, "📋 请输入要发送的文本，Ctrl-D 结束:")
+			}
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintln(out, "❌ 错误: 读取标准输入失败:", err)
+				os.Exit(EXIT_FILE_ERROR)
+			}
+			text = string(data)
+		}
+		if text == "" {
+			fmt.Fprintln(out, "❌ 错误: 文本内容为空")
+			os.Exit(1)
+		}
+		send(&opts, fs.Arg(0), nil, text)
+	case text != "":
+		if fs.NArg() < 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		send(&opts, fs.Arg(0), nil, text)
+	default:
+		if fs.NArg() < 2 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		// 检查文件是否存在，展开通配符
+		filePaths, err := expandFileArgs(fs.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(out, "❌ 错误:", err)
+			os.Exit(EXIT_FILE_ERROR)
+		}
+		send(&opts, fs.Arg(0), filePaths, "")
 	}
+}
 
+// send 注册并推送文件或文本：filePaths 为空时发送 text
+func send(opts *sendOptions, bridgeURL string, filePaths []string, text string) {
+	textMode := len(filePaths) == 0
 	provider := NewFlowProvider(bridgeURL)
+	provider.ProxyURL = opts.proxy
+	if opts.name != "" {
+		if err := validateFileName(opts.name); err != nil {
+			fmt.Fprintln(out, "❌ 错误:", err)
+			os.Exit(1)
+		}
+		provider.Name = opts.name
+	}
+	if _, err := provider.parseProxyURL(); err != nil {
+		fmt.Fprintln(out, "❌ 错误:", err)
+		os.Exit(1)
+	}
+	if opts.serve < 1 || opts.serve > 100 {
+		fmt.Fprintln(out, "❌ 错误: --serve 必须在 1-100 之间")
+		os.Exit(1)
+	}
+	provider.MaxDownloads = opts.serve
+	if opts.verify && provider.MaxDownloads > 1 {
+		fmt.Fprintln(out, "❌ 错误: --verify 不能与 --serve 同时使用")
+		os.Exit(1)
+	}
+	if opts.shareRate < 0 {
+		fmt.Fprintln(out, "❌ 错误: --share-rate 不能为负数")
+		os.Exit(1)
+	}
+	provider.ShareRate = opts.shareRate
+	if opts.uploadRate < 0 {
+		fmt.Fprintln(out, "❌ 错误: --max-upload-rate 不能为负数")
+		os.Exit(1)
+	}
+	if opts.uploadRate > 0 {
+		provider.UploadLimiter = newUploadLimiter(opts.uploadRate)
+	}
+	provider.Compress = opts.compress
+	provider.ChunkChecksum = opts.chunkChecksum
+	provider.NoDelay = !opts.nagle
+	if size := opts.sendBuffer * 1024; size < MIN_SEND_BUFFER_SIZE || size > MAX_SEND_BUFFER_SIZE {
+		fmt.Fprintf(out, "❌ 错误: --send-buffer-size 必须在 %d-%d KiB 之间\n", MIN_SEND_BUFFER_SIZE/1024, MAX_SEND_BUFFER_SIZE/1024)
+		os.Exit(1)
+	}
+	provider.SendBufferSize = opts.sendBuffer * 1024
+	provider.Dedup = opts.dedup
+	if opts.encrypt {
+		if opts.verify {
+			fmt.Fprintln(out, "❌ 错误: --encrypt 不能与 --verify 同时使用")
+			os.Exit(1)
+		}
+		if opts.dedup {
+			fmt.Fprintln(out, "❌ 错误: --dedup 不能与 --encrypt 同时使用 (密文每次都不同，无法去重)")
+			os.Exit(1)
+		}
+		passphrase, err := readPassphrase("🔑 请输入加密口令 (需告知接收方): ")
+		if err != nil {
+			fmt.Fprintln(out, "❌ 错误:", err)
+			os.Exit(1)
+		}
+		if len(passphrase) < ENCRYPT_MIN_PASSPHRASE {
+			fmt.Fprintf(out, "❌ 错误: 口令至少需要 %d 个字符\n", ENCRYPT_MIN_PASSPHRASE)
+			os.Exit(1)
+		}
+		provider.Passphrase = passphrase
+	}
+	for _, caFile := range []string{opts.caCert, opts.tcpTLSCA} {
+		if caFile == "" {
+			continue
+		}
+		if provider.TLSRootCAs == nil {
+			provider.TLSRootCAs = x509.NewCertPool()
+		}
+		pemData, err := os.ReadFile(caFile)
+		if err != nil || !provider.TLSRootCAs.AppendCertsFromPEM(pemData) {
+			fmt.Fprintln(out, "❌ 错误: 无法读取 --ca-cert 指定的根证书:", caFile)
+			os.Exit(1)
+		}
+	}
+	if opts.insecure {
+		// 无论 --output-json 与否都写到标准错误，避免被忽略
+		fmt.Fprintln(os.Stderr, "⚠️⚠️⚠️ 警告: --insecure 已关闭TLS证书校验，连接可能被中间人窃听或篡改，仅限测试使用！")
+		provider.TLSInsecure = true
+	}
+	if opts.maxRenewals < 0 {
+		fmt.Fprintln(out, "❌ 错误: --max-renewals 不能为负数")
+		os.Exit(1)
+	}
+	if opts.follow {
+		if len(filePaths) != 1 {
+			fmt.Fprintln(out, "❌ 错误: --follow 只能用于单个文件")
+			os.Exit(1)
+		}
+		if opts.verify || opts.dedup {
+			fmt.Fprintln(out, "❌ 错误: --follow 不能与 --verify 或 --dedup 同时使用 (文件内容随时可能变化)")
+			os.Exit(1)
+		}
+		provider.Follow = true
+	}
+	if opts.timeout < 0 {
+		fmt.Fprintln(out, "❌ 错误: --timeout 不能为负数")
+		os.Exit(1)
+	}
+	if opts.timeout > 0 {
+		provider.Deadline = time.Now().Add(opts.timeout)
+	}
+
+	// 输出结果并按错误类型退出；--output-json 模式下结果以JSON写到标准输出
+	finish := func(status string, err error) {
+		if opts.outputJSON {
+			json.NewEncoder(os.Stdout).Encode(provider.Result(status, err))
+		}
+		if err != nil {
+			os.Exit(exitCodeFor(err))
+		}
+	}
+	failStatus := func(err error) string {
+		switch {
+		case errors.Is(err, ErrDownloaderGone):
+			return "downloader_gone"
+		case errors.Is(err, ErrTimeout):
+			return "timeout"
+		}
+		return "failed"
+	}
+
+	// 多个文件：每个文件单独注册、各有链接，结果按文件顺序输出
+	if len(filePaths) > 1 {
+		if provider.Name != "" || opts.verify {
+			fmt.Fprintln(out, "❌ 错误: --name 与 --verify 只能用于单个文件")
+			os.Exit(1)
+		}
+		if opts.concurrency < 1 || opts.concurrency > MAX_BATCH_CONCURRENCY {
+			fmt.Fprintf(out, "❌ 错误: --concurrency 必须在 1-%d 之间\n", MAX_BATCH_CONCURRENCY)
+			os.Exit(1)
+		}
+		providers, errs := sendBatch(provider, filePaths, opts.concurrency)
+		results := make([]TransferResult, len(providers))
+		var firstErr error
+		fmt.Fprintln(out, "\n📊 传输结果:")
+		for i, p := range providers {
+			status := "completed"
+			if p.Cached {
+				status = "cached"
+			}
+			mark := "✅"
+			if errs[i] != nil {
+				status = failStatus(errs[i])
+				mark = "❌"
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+			}
+			results[i] = p.Result(status, errs[i])
+			name := p.FileInfo.Name
+			if name == "" {
+				name = filePaths[i]
+			}
+			fmt.Fprintf(out, "  %s %s\t%s\t%s\n", mark, name, status, p.DownloadURL)
+		}
+		if opts.outputJSON {
+			json.NewEncoder(os.Stdout).Encode(results)
+		}
+		if firstErr != nil {
+			os.Exit(exitCodeFor(firstErr))
+		}
+		fmt.Fprintf(out, "✅ 全部 %d 个文件已传输完成\n", len(providers))
+		return
+	}
 
 	// 执行注册和传输
 	var err error
-	fmt.Println("📝 注册文件中...")
-	if _, err = provider.RegisterFile(filePath); err != nil {
-		fmt.Println("❌ 注册失败:", err)
+	fmt.Fprintln(out, "📝 注册文件中...")
+	if textMode {
+		_, err = provider.RegisterText(text)
+	} else {
+		_, err = provider.RegisterFile(filePaths[0])
+	}
+	if err = provider.timeoutError(err); err != nil {
+		fmt.Fprintln(out, "❌ 注册失败:", err)
+		finish(failStatus(err), err)
 	}
 
-	fmt.Println("🔗 建立流连接...")
-	if err = provider.EstablishStreamConnection(); err != nil {
-		fmt.Println("❌ 传输失败:", err)
+	if opts.verify {
+		if err = provider.timeoutError(provider.VerifyRoundTrip()); err != nil {
+			fmt.Fprintln(out, "❌ 自检失败:", err)
+			finish(failStatus(err), err)
+		}
+		fmt.Fprintln(out, "✅ 自检通过: 下载内容与源文件一致")
+		finish("verified", nil)
+		return
+	}
+
+	if provider.MaxDownloads <= 1 {
+		fmt.Fprintln(out, "🔗 建立流连接...")
+	}
+	for {
+		err = provider.timeoutError(provider.Serve())
+		if err == nil || !opts.autoRenew || errors.Is(err, ErrTimeout) || !provider.registrationExpired() {
+			break
+		}
+		if provider.Renewals >= opts.maxRenewals {
+			fmt.Fprintf(out, "⏰ 注册已过期，已达到 --max-renewals (%d)，不再重新注册\n", opts.maxRenewals)
+			break
+		}
+		provider.Renewals++
+		fmt.Fprintf(out, "⏰ 注册已过期，以新令牌重新注册 (第 %d/%d 次)，旧链接已失效\n", provider.Renewals, opts.maxRenewals)
+		if err = provider.timeoutError(provider.renew()); err != nil {
+			fmt.Fprintln(out, "❌ 重新注册失败:", err)
+			finish(failStatus(err), err)
+		}
+	}
+	if err != nil {
+		if provider.MaxDownloads <= 1 && errors.Is(err, ErrDownloaderGone) {
+			fmt.Fprintln(out, "⚠️", ErrDownloaderGone)
+		} else {
+			fmt.Fprintln(out, "❌ 传输失败:", err)
+		}
+		finish(failStatus(err), err)
+	}
+	if provider.Cached {
+		finish("cached", nil)
+	} else {
+		finish("completed", nil)
 	}
 
 	// 显示下载信息
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println(provider.GenerateDownloadInfo())
-	fmt.Println(strings.Repeat("=", 60))
-	fmt.Println("✅ 操作完成! 文件已准备好下载")
-	fmt.Println("💡 注意: 文件下载完成后，下载链接将自动失效")
-}
\ No newline at end of file
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(out, provider.GenerateDownloadInfo())
+	fmt.Fprintln(out, strings.Repeat("=", 60))
+	fmt.Fprintln(out, "✅ 操作完成! 文件已准备好下载")
+	fmt.Fprintln(out, "💡 注意: 文件下载完成后，下载链接将自动失效")
+}
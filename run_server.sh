@@ -28,6 +28,6 @@ else
 fi
 
 # 启动服务器，使用全部支持的参数
-./fileflowbridge -http-port 8000 -tcp-port 8888 -max-file-size 100 -token-len 8
+./fileflowbridge -http-port 8000 -tcp-port 8888 -max-file-size 100GiB -token-len 8
 
 echo "👋 服务器已停止"
\ No newline at end of file